@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/agent"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/mccmnc"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+// runAgent serves "smsie agent": it runs the modems of this host and
+// connects them to the central server in config.AppConfig.Agent. The local
+// database only holds modems and received SMS not yet taken by the server.
+func runAgent() {
+	cfg := config.AppConfig.Agent
+	if cfg.Server == "" || cfg.APIKey == "" {
+		logger.Log.Fatal("agent.server and agent.api_key are required in agent mode")
+	}
+	logger.Log.Infof("Starting agent %s for %s", cfg.Name, cfg.Server)
+
+	if err := mccmnc.LoadOperators("mcc_mnc.json"); err != nil {
+		logger.Log.Warnf("Failed to load MCC/MNC data: %v", err)
+	}
+
+	db, err := gorm.Open(sqlite.Open(cfg.DSN), &gorm.Config{})
+	if err != nil {
+		logger.Log.Fatalf("Failed to open agent database: %v", err)
+	}
+	// Workers also look up webhooks and caller rules; the agent has none.
+	if err := db.AutoMigrate(&model.Modem{}, &model.SMS{}, &model.Webhook{}, &model.WebhookDelivery{}, &model.CallerRule{}); err != nil {
+		logger.Log.Fatalf("Failed to migrate agent database: %v", err)
+	}
+
+	wm := worker.NewManager(db)
+	wm.Start()
+	defer wm.Stop()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		agent.NewClient(db, wm, cfg).Run(stop)
+		close(done)
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	logger.Log.Info("Stopping agent...")
+	close(stop)
+	<-done
+}
@@ -0,0 +1,229 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	pingInterval   = 30 * time.Second
+	readTimeout    = 90 * time.Second
+	writeTimeout   = 10 * time.Second
+	maxBackoff     = time.Minute
+	maxInflightSMS = 20
+)
+
+// Client keeps the agent connected to the server. Received SMS stay in the
+// local database until the server acknowledges them, so nothing is lost
+// while the connection is down.
+type Client struct {
+	db  *gorm.DB
+	wm  *worker.Manager
+	cfg config.AgentConfig
+}
+
+func NewClient(db *gorm.DB, wm *worker.Manager, cfg config.AgentConfig) *Client {
+	return &Client{db: db, wm: wm, cfg: cfg}
+}
+
+// Run connects and reconnects with backoff until stop is closed.
+func (c *Client) Run(stop <-chan struct{}) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := c.session(stop)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if time.Since(started) > maxBackoff {
+			backoff = time.Second
+		}
+		logger.Log.Warnf("Agent connection to %s lost: %v. Retrying in %s", c.cfg.Server, err, backoff)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+type session struct {
+	c        *Client
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	inflight map[uint]bool // SMS sent and not yet acknowledged
+}
+
+func (c *Client) session(stop <-chan struct{}) error {
+	header := http.Header{"Authorization": {"Bearer " + c.cfg.APIKey}}
+	conn, resp, err := websocket.DefaultDialer.Dial(c.cfg.Server, header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("%v (HTTP %d)", err, resp.StatusCode)
+		}
+		return err
+	}
+	defer conn.Close()
+	s := &session{c: c, conn: conn, inflight: make(map[uint]bool)}
+
+	// Subscribe before the hello so no change falls between the two.
+	_, events, cancel := c.wm.Events().Subscribe(0)
+	defer cancel()
+	if err := s.write(Frame{Type: FrameHello, Name: c.cfg.Name, Modems: c.wm.RemoteModemStates()}); err != nil {
+		return err
+	}
+	logger.Log.Infof("Agent %s connected to %s", c.cfg.Name, c.cfg.Server)
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- s.readLoop()
+	}()
+	if err := s.flushSMS(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeTimeout))
+			return nil
+		case err := <-readErr:
+			return err
+		case <-ticker.C:
+			if err := s.write(Frame{Type: FramePing}); err != nil {
+				return err
+			}
+			if err := s.flushSMS(); err != nil {
+				return err
+			}
+		case e, ok := <-events:
+			if !ok {
+				return errors.New("event stream fell behind")
+			}
+			if err := s.forwardEvent(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *session) forwardEvent(e logic.Event) error {
+	switch {
+	case e.Type == logic.EventSMSReceived:
+		return s.flushSMS()
+	case e.Type == logic.EventModemOffline:
+		return s.write(Frame{Type: FrameOffline, ICCID: e.ICCID})
+	case worker.IsRemoteStateEvent(e.Type):
+		if state, ok := s.c.wm.RemoteModemState(e.ICCID); ok {
+			return s.write(Frame{Type: FrameModem, Modems: []worker.RemoteModemState{state}})
+		}
+	}
+	return nil
+}
+
+func (s *session) readLoop() error {
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		var f Frame
+		if err := s.conn.ReadJSON(&f); err != nil {
+			return err
+		}
+		switch f.Type {
+		case FrameRequest:
+			go s.handleRequest(f)
+		case FrameAck:
+			s.acknowledge(uint(f.ID))
+		}
+	}
+}
+
+func (s *session) handleRequest(f Frame) {
+	reply := Frame{Type: FrameResult, ID: f.ID}
+	result, err := s.c.wm.HandleRemoteCall(f.ICCID, f.Op, f.Data)
+	if err == nil && result != nil {
+		reply.Data, err = json.Marshal(result)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		reply.Code = worker.RemoteErrorCode(err)
+	}
+	if err := s.write(reply); err != nil {
+		logger.Log.Warnf("Agent failed to answer %s on %s: %v", f.Op, f.ICCID, err)
+	}
+}
+
+// flushSMS sends buffered SMS that are not waiting for an ack yet.
+func (s *session) flushSMS() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Only received SMS are forwarded. The server records what it sends,
+	// so anything else the agent stored is dropped instead of piling up.
+	if err := s.c.db.Where("type <> ?", "received").Delete(&model.SMS{}).Error; err != nil {
+		logger.Log.Errorf("Agent failed to drop sent SMS: %v", err)
+	}
+	if len(s.inflight) >= maxInflightSMS {
+		return nil
+	}
+	q := s.c.db.Where("type = ?", "received").Order("id").Limit(maxInflightSMS - len(s.inflight))
+	if len(s.inflight) > 0 {
+		ids := make([]uint, 0, len(s.inflight))
+		for id := range s.inflight {
+			ids = append(ids, id)
+		}
+		q = q.Where("id NOT IN ?", ids)
+	}
+	var pending []model.SMS
+	if err := q.Find(&pending).Error; err != nil {
+		logger.Log.Errorf("Agent failed to load buffered SMS: %v", err)
+		return nil
+	}
+	for i := range pending {
+		if err := s.write(Frame{Type: FrameSMS, ID: uint64(pending[i].ID), SMS: &pending[i]}); err != nil {
+			return err
+		}
+		s.inflight[pending[i].ID] = true
+	}
+	return nil
+}
+
+func (s *session) acknowledge(id uint) {
+	if err := s.c.db.Delete(&model.SMS{}, id).Error; err != nil {
+		logger.Log.Errorf("Agent failed to drop forwarded SMS %d: %v", id, err)
+		return
+	}
+	s.mu.Lock()
+	delete(s.inflight, id)
+	more := len(s.inflight) == 0
+	s.mu.Unlock()
+	if more {
+		_ = s.flushSMS()
+	}
+}
+
+func (s *session) write(f Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return s.conn.WriteJSON(f)
+}
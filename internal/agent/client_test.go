@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+func TestClientForwardsBufferedSMS(t *testing.T) {
+	logger.InitLogger("error")
+	db := newTestDB(t, &model.Modem{}, &model.SMS{})
+	// Received while the server was unreachable.
+	db.Create(&model.SMS{ICCID: "8988", Phone: "+886912345678", Content: "one", Type: "received", Timestamp: time.Now()})
+	db.Create(&model.SMS{ICCID: "8988", Phone: "+886912345678", Content: "two", Type: "received", Timestamp: time.Now()})
+	// Sent through a pool on the agent; the server keeps its own record.
+	db.Create(&model.SMS{ICCID: "8988", Phone: "+886912345678", Content: "sent", Type: "sent", Timestamp: time.Now()})
+
+	frames := make(chan Frame, 10)
+	var auth string
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var f Frame
+			if err := conn.ReadJSON(&f); err != nil {
+				return
+			}
+			frames <- f
+			if f.Type == FrameSMS {
+				conn.WriteJSON(Frame{Type: FrameAck, ID: f.ID})
+			}
+		}
+	}))
+	defer srv.Close()
+
+	cfg := config.AgentConfig{Server: "ws" + strings.TrimPrefix(srv.URL, "http"), APIKey: "smsie_test", Name: "office"}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		NewClient(db, worker.NewManager(db), cfg).Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	hello := <-frames
+	if hello.Type != FrameHello || hello.Name != "office" || auth != "Bearer smsie_test" {
+		t.Fatalf("unexpected hello %+v (auth %q)", hello, auth)
+	}
+	for _, want := range []string{"one", "two"} {
+		f := <-frames
+		if f.Type != FrameSMS || f.SMS == nil || f.SMS.Content != want {
+			t.Fatalf("expected SMS %q, got %+v", want, f)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var count int64
+		db.Model(&model.SMS{}).Count(&count)
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d acknowledged SMS still buffered", count)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
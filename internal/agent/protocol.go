@@ -0,0 +1,38 @@
+// Package agent connects the modems of one host to a central smsie server.
+// The agent dials the server's /agent/ws WebSocket with an admin API key and
+// both sides exchange JSON frames over it.
+package agent
+
+import (
+	"encoding/json"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+)
+
+const (
+	FrameHello   = "hello"   // agent: Name and all Modems, first frame
+	FrameModem   = "modem"   // agent: new state of Modems[0]
+	FrameOffline = "offline" // agent: modem ICCID is gone
+	FrameSMS     = "sms"     // agent: received SMS with its local ID
+	FrameAck     = "ack"     // server: SMS ID is stored and may be dropped
+	FrameRequest = "request" // server: run Op with Data on modem ICCID
+	FrameResult  = "result"  // agent: Data or Error (and Code) for request ID
+	FramePing    = "ping"    // agent: keepalive
+	FramePong    = "pong"    // server: answer to ping
+)
+
+// Frame is one message on the agent connection. Which fields are set
+// depends on Type.
+type Frame struct {
+	Type   string                    `json:"type"`
+	ID     uint64                    `json:"id,omitempty"`
+	Name   string                    `json:"name,omitempty"`
+	ICCID  string                    `json:"iccid,omitempty"`
+	Op     string                    `json:"op,omitempty"`
+	Data   json.RawMessage           `json:"data,omitempty"`
+	Error  string                    `json:"error,omitempty"`
+	Code   string                    `json:"code,omitempty"`
+	Modems []worker.RemoteModemState `json:"modems,omitempty"`
+	SMS    *model.SMS                `json:"sms,omitempty"`
+}
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pccr10001/smsie/internal/agent"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	agentHelloTimeout = 10 * time.Second
+	agentReadTimeout  = 90 * time.Second
+	agentWriteTimeout = 10 * time.Second
+	// Bounded by the agent, which keeps at most 20 SMS unacknowledged.
+	agentFrameQueueSize = 256
+)
+
+var errAgentClosed = errors.New("agent disconnected")
+
+// AgentServer accepts smsie agents on /agent/ws and attaches their modems
+// to the worker manager, so they are used like local ones.
+type AgentServer struct {
+	db       *gorm.DB
+	wm       *worker.Manager
+	mu       sync.Mutex
+	sessions map[string]*agentSession // by agent name
+}
+
+func NewAgentServer(db *gorm.DB, wm *worker.Manager) *AgentServer {
+	return &AgentServer{db: db, wm: wm, sessions: make(map[string]*agentSession)}
+}
+
+// agentSession is the worker.RemoteLink of one connected agent.
+type agentSession struct {
+	name    string
+	keyID   uint
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan agent.Frame
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Handle authenticates the agent with an admin API key as bearer token and
+// serves its connection.
+func (s *AgentServer) Handle(c *gin.Context) {
+	actor, err := authenticateAPIKey(s.db, normalizeAuthBearer(c.GetHeader("Authorization")))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if actor.User.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Admin API key required"})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		logger.Log.Errorf("upgrade agent websocket failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var hello agent.Frame
+	_ = conn.SetReadDeadline(time.Now().Add(agentHelloTimeout))
+	if err := conn.ReadJSON(&hello); err != nil || hello.Type != agent.FrameHello || hello.Name == "" {
+		logger.Log.Warnf("Agent from %s sent no hello", c.ClientIP())
+		return
+	}
+
+	sess := &agentSession{
+		name:    hello.Name,
+		keyID:   actor.APIKey.ID,
+		conn:    conn,
+		pending: make(map[uint64]chan agent.Frame),
+		done:    make(chan struct{}),
+	}
+	s.mu.Lock()
+	old := s.sessions[sess.name]
+	s.sessions[sess.name] = sess
+	s.mu.Unlock()
+	if old != nil {
+		logger.Log.Warnf("Agent %s reconnected, closing its previous connection", sess.name)
+		old.close()
+	}
+	logger.Log.Infof("Agent %s connected from %s with %d modem(s)", sess.name, c.ClientIP(), len(hello.Modems))
+
+	defer func() {
+		sess.close()
+		s.wm.DetachRemote(sess, "")
+		s.mu.Lock()
+		if s.sessions[sess.name] == sess {
+			delete(s.sessions, sess.name)
+		}
+		s.mu.Unlock()
+		logger.Log.Infof("Agent %s disconnected", sess.name)
+	}()
+
+	for _, state := range hello.Modems {
+		s.wm.AttachRemote(sess, state)
+	}
+	if err := s.serve(sess); err != nil && !errors.Is(err, errAgentClosed) {
+		logger.Log.Infof("Agent %s connection ended: %v", sess.name, err)
+	}
+}
+
+// serve reads frames until the connection ends. Results are matched to
+// their requests right away; everything else is handled in order on another
+// goroutine, as SMS rules may send through the same agent and wait for a
+// result.
+func (s *AgentServer) serve(sess *agentSession) error {
+	readErr := make(chan error, 1)
+	frames := make(chan agent.Frame, agentFrameQueueSize)
+	go func() {
+		defer close(frames)
+		for {
+			_ = sess.conn.SetReadDeadline(time.Now().Add(agentReadTimeout))
+			var f agent.Frame
+			if err := sess.conn.ReadJSON(&f); err != nil {
+				readErr <- err
+				return
+			}
+			if f.Type == agent.FrameResult {
+				sess.deliver(f)
+				continue
+			}
+			select {
+			case frames <- f:
+			case <-sess.done:
+				return
+			}
+		}
+	}()
+	handled := make(chan struct{})
+	go func() {
+		defer close(handled)
+		for f := range frames {
+			s.handleFrame(sess, f)
+		}
+	}()
+
+	var err error
+	select {
+	case err = <-readErr:
+	case <-sess.done:
+		err = errAgentClosed
+	}
+	// Closing ends the reader, so no modem is attached after Handle detaches.
+	sess.close()
+	<-handled
+	return err
+}
+
+func (s *AgentServer) handleFrame(sess *agentSession, f agent.Frame) {
+	switch f.Type {
+	case agent.FrameModem:
+		for _, state := range f.Modems {
+			s.wm.AttachRemote(sess, state)
+		}
+	case agent.FrameOffline:
+		s.wm.DetachRemote(sess, f.ICCID)
+	case agent.FrameSMS:
+		if f.SMS == nil {
+			return
+		}
+		if err := s.wm.ReceiveRemoteSMS(sess, *f.SMS); err != nil {
+			logger.Log.Errorf("Failed to store SMS %d from agent %s: %v", f.ID, sess.name, err)
+			return
+		}
+		_ = sess.write(agent.Frame{Type: agent.FrameAck, ID: f.ID})
+	case agent.FramePing:
+		// The agent pings regularly, so this is where a revoked key ends the
+		// session.
+		if err := s.checkKey(sess.keyID); err != nil {
+			logger.Log.Infof("Agent %s disconnected: %v", sess.name, err)
+			sess.close()
+			return
+		}
+		_ = sess.write(agent.Frame{Type: agent.FramePong})
+	}
+}
+
+func (s *AgentServer) checkKey(keyID uint) error {
+	var key model.APIKey
+	if err := s.db.Where("id = ? AND is_active = ?", keyID, true).First(&key).Error; err != nil {
+		return errors.New("API key revoked")
+	}
+	actor, err := loadAPIKeyActor(s.db, &key)
+	if err != nil {
+		return err
+	}
+	if actor.User.Role != "admin" {
+		return errors.New("API key owner is no longer an admin")
+	}
+	return nil
+}
+
+func (a *agentSession) Name() string {
+	return a.name
+}
+
+// Call sends a request to the agent and waits for its result.
+func (a *agentSession) Call(iccid, op string, args, reply interface{}, timeout time.Duration) error {
+	var data json.RawMessage
+	if args != nil {
+		b, err := json.Marshal(args)
+		if err != nil {
+			return err
+		}
+		data = b
+	}
+
+	ch := make(chan agent.Frame, 1)
+	a.mu.Lock()
+	a.nextID++
+	id := a.nextID
+	a.pending[id] = ch
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.pending, id)
+		a.mu.Unlock()
+	}()
+
+	if err := a.write(agent.Frame{Type: agent.FrameRequest, ID: id, ICCID: iccid, Op: op, Data: data}); err != nil {
+		return err
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case f := <-ch:
+		if f.Error != "" {
+			return worker.RemoteError(f.Code, f.Error)
+		}
+		if reply != nil && len(f.Data) > 0 {
+			return json.Unmarshal(f.Data, reply)
+		}
+		return nil
+	case <-timer.C:
+		return errors.New("agent " + a.name + " did not answer in time")
+	case <-a.done:
+		return errAgentClosed
+	}
+}
+
+func (a *agentSession) deliver(f agent.Frame) {
+	a.mu.Lock()
+	ch := a.pending[f.ID]
+	delete(a.pending, f.ID)
+	a.mu.Unlock()
+	if ch != nil {
+		ch <- f
+	}
+}
+
+func (a *agentSession) write(f agent.Frame) error {
+	select {
+	case <-a.done:
+		return errAgentClosed
+	default:
+	}
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	_ = a.conn.SetWriteDeadline(time.Now().Add(agentWriteTimeout))
+	return a.conn.WriteJSON(f)
+}
+
+func (a *agentSession) close() {
+	a.once.Do(func() {
+		close(a.done)
+		_ = a.conn.Close()
+	})
+}
@@ -179,10 +179,14 @@ func (h *APIKeyHandler) DeleteMyAPIKey(c *gin.Context) {
 		return
 	}
 
-	if err := h.db.Where("id = ? AND user_id = ?", id, actor.User.ID).Delete(&model.APIKey{}).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	res := h.db.Where("id = ? AND user_id = ?", id, actor.User.ID).Delete(&model.APIKey{})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
 		return
 	}
+	if res.RowsAffected > 0 {
+		h.db.Where("api_key_id = ?", id).Delete(&model.SMSQuota{})
+	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 }
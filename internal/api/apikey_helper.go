@@ -4,9 +4,13 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"strings"
+	"time"
 
+	"github.com/pccr10001/smsie/internal/model"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 func normalizeAuthBearer(raw string) string {
@@ -55,3 +59,30 @@ func hashPasswordStrict(password string) (string, error) {
 func checkPasswordStrict(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
+
+// authenticateAPIKey resolves a raw API key for protocols that carry it
+// outside the Authorization bearer header, such as SMPP and Twilio basic auth.
+func authenticateAPIKey(db *gorm.DB, raw string) (*authActor, error) {
+	raw = strings.TrimSpace(raw)
+	if !isSMSIEAPIKey(raw) {
+		return nil, errors.New("smsie API key required")
+	}
+	var key model.APIKey
+	if err := db.Where("key_hash = ? AND is_active = ?", hashAPIKey(raw), true).First(&key).Error; err != nil {
+		return nil, errors.New("invalid API key")
+	}
+	return loadAPIKeyActor(db, &key)
+}
+
+func loadAPIKeyActor(db *gorm.DB, key *model.APIKey) (*authActor, error) {
+	now := time.Now()
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return nil, errors.New("API key expired")
+	}
+	var user model.User
+	if err := db.First(&user, key.UserID).Error; err != nil {
+		return nil, errors.New("user not found")
+	}
+	_ = db.Model(&model.APIKey{}).Where("id = ?", key.ID).Update("last_used_at", now).Error
+	return &authActor{User: &user, APIKey: key}, nil
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"gorm.io/gorm"
+)
+
+const (
+	auditMaxBody     = 64 << 10
+	auditMaxResponse = 2 << 10
+)
+
+// auditResponseWriter keeps the start of error responses for the entry.
+type auditResponseWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.Status() >= 400 && w.body.Len() < auditMaxResponse {
+		w.body.Write(b[:min(len(b), auditMaxResponse-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+type AuditHandler struct {
+	db    *gorm.DB
+	repo  *repository.AuditLogRepository
+	audit *logic.AuditLogger
+}
+
+func NewAuditHandler(db *gorm.DB) *AuditHandler {
+	return &AuditHandler{db: db, repo: repository.NewAuditLogRepository(db), audit: logic.NewAuditLogger(db)}
+}
+
+// Record returns middleware that writes each request to the route to the
+// audit log: the actor, its IP, the route parameters and JSON body with
+// secrets redacted, and the response status with the error message of
+// failed requests.
+func (h *AuditHandler) Record(action string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		params := map[string]interface{}{}
+		if c.Request.Body != nil {
+			body, _ := io.ReadAll(io.LimitReader(c.Request.Body, auditMaxBody))
+			c.Request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), c.Request.Body))
+			var decoded interface{}
+			if len(bytes.TrimSpace(body)) > 0 && json.Unmarshal(body, &decoded) == nil {
+				if obj, ok := decoded.(map[string]interface{}); ok {
+					params = obj
+				} else {
+					params["body"] = decoded
+				}
+			}
+		}
+		for _, p := range c.Params {
+			if _, exists := params[p.Key]; !exists {
+				params[p.Key] = p.Value
+			}
+		}
+		for key, values := range c.Request.URL.Query() {
+			// Streaming endpoints carry the session token in the query.
+			if _, exists := params[key]; !exists && key != "token" && len(values) > 0 {
+				params[key] = values[0]
+			}
+		}
+
+		w := &auditResponseWriter{ResponseWriter: c.Writer}
+		c.Writer = w
+		c.Next()
+
+		entry := &model.AuditLog{
+			IP:     c.ClientIP(),
+			Action: action,
+			ICCID:  c.Param("iccid"),
+			Params: logic.AuditParams(params),
+			Status: w.Status(),
+		}
+		if actor, ok := getActor(c); ok {
+			entry.UserID, entry.Username = actor.User.ID, actor.User.Username
+			if actor.APIKey != nil {
+				entry.APIKeyID = actor.APIKey.ID
+			}
+			entry.AuthType = c.GetString("auth_type")
+		} else if username, ok := params["username"].(string); ok {
+			// Logins name the account they try.
+			entry.Username = username
+			var user model.User
+			if h.db.Select("id").Where("username = ?", username).First(&user).Error == nil {
+				entry.UserID = user.ID
+			}
+		}
+		if strings.HasPrefix(action, "user.") {
+			if id, err := strconv.Atoi(c.Param("id")); err == nil && id > 0 {
+				entry.TargetUserID = uint(id)
+			}
+		}
+		if entry.Status >= 400 {
+			var resp struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(w.body.Bytes(), &resp) == nil && resp.Error != "" {
+				entry.Error = resp.Error
+			} else {
+				entry.Error = http.StatusText(entry.Status)
+			}
+		}
+		h.audit.Log(entry)
+	}
+}
+
+// requestClientIP returns the client address like gin's ClientIP with its
+// default of trusting forwarding headers.
+func requestClientIP(r *http.Request) string {
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		first, _, _ := strings.Cut(fwd, ",")
+		if ip := strings.TrimSpace(first); ip != "" {
+			return ip
+		}
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-Ip")); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditFilter parses the query filters shared by listing and export. Times
+// are RFC 3339; since also takes a duration such as 24h.
+func auditFilter(c *gin.Context) (repository.AuditLogFilter, bool) {
+	filter := repository.AuditLogFilter{
+		Action: strings.TrimSpace(c.Query("action")),
+		ICCID:  strings.TrimSpace(c.Query("iccid")),
+		Result: strings.TrimSpace(c.Query("result")),
+		IP:     strings.TrimSpace(c.Query("ip")),
+	}
+	for name, dst := range map[string]*uint{"user_id": &filter.UserID, "api_key_id": &filter.APIKeyID, "target_user_id": &filter.TargetUserID} {
+		if v := c.Query(name); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil || id <= 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid " + name})
+				return filter, false
+			}
+			*dst = uint(id)
+		}
+	}
+	if v := c.Query("since"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			filter.Since = time.Now().Add(-d)
+		} else if t, err := time.Parse(time.RFC3339, v); err == nil {
+			filter.Since = t
+		} else {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since, expected RFC 3339 time or duration"})
+			return filter, false
+		}
+	}
+	if v := c.Query("until"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid until, expected RFC 3339 time"})
+			return filter, false
+		}
+		filter.Until = t
+	}
+	return filter, true
+}
+
+func (h *AuditHandler) ListAuditLogs(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+	filter.Limit = 100
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 {
+		filter.Limit = min(v, 500)
+	}
+	if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+		filter.Offset = v
+	}
+
+	list, total, err := h.repo.List(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": list, "total": total})
+}
+
+// ExportAuditLogs streams every entry matching the filters as CSV, newest
+// first.
+func (h *AuditHandler) ExportAuditLogs(c *gin.Context) {
+	filter, ok := auditFilter(c)
+	if !ok {
+		return
+	}
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="smsie-audit-`+time.Now().Format("20060102")+`.csv"`)
+	c.Status(http.StatusOK)
+
+	out := csv.NewWriter(c.Writer)
+	_ = out.Write([]string{"id", "time", "user_id", "username", "api_key_id", "auth_type", "ip", "action", "iccid", "target_user_id", "params", "result", "status", "error"})
+	uintField := func(v uint) string {
+		if v == 0 {
+			return ""
+		}
+		return strconv.FormatUint(uint64(v), 10)
+	}
+	// Spreadsheets run cells starting with these as formulas.
+	text := func(v string) string {
+		if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+			return "'" + v
+		}
+		return v
+	}
+	err := h.repo.Each(filter, func(e *model.AuditLog) error {
+		return out.Write([]string{
+			strconv.FormatUint(uint64(e.ID), 10),
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			uintField(e.UserID),
+			text(e.Username),
+			uintField(e.APIKeyID),
+			e.AuthType,
+			text(e.IP),
+			e.Action,
+			text(e.ICCID),
+			uintField(e.TargetUserID),
+			e.Params,
+			e.Result,
+			strconv.Itoa(e.Status),
+			text(e.Error),
+		})
+	})
+	out.Flush()
+	if err != nil {
+		// Headers are gone; a truncated file is all that can signal it.
+		_ = c.Error(err)
+	}
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/worker"
+)
+
+// answerWaitingCall holds the established call and accepts the waiting one.
+// Audio is already bridged for the established call, so no session setup is
+// needed and a failure must not close it.
+func (h *ModemHandler) answerWaitingCall(c *gin.Context, w *worker.ModemWorker) {
+	if h.callMgr != nil && h.callMgr.HasActiveSIPCall(c.Param("iccid")) {
+		c.JSON(http.StatusConflict, gin.H{"error": "current call is bridged to sip"})
+		return
+	}
+
+	if err := w.Answer(); err != nil {
+		if worker.IsNoIncomingCallError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "no incoming call"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Answer failed: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
+}
+
+// CallControl performs AT+CHLD multi-call operations: hold_accept, swap,
+// release_accept, release (index), split (index), conference, release_held.
+func (h *ModemHandler) CallControl(c *gin.Context) {
+	iccid := c.Param("iccid")
+	if !enforceICCIDPermission(c, h.db, iccid, PermMakeCall) {
+		return
+	}
+
+	var req struct {
+		Action string `json:"action"`
+		Index  int    `json:"index"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w := h.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
+		return
+	}
+
+	if err := w.CallControl(req.Action, req.Index); err != nil {
+		switch {
+		case worker.IsInvalidCallControlError(err):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case worker.IsCallNotFoundError(err):
+			c.JSON(http.StatusNotFound, gin.H{"error": "call not found"})
+		case worker.IsNoIncomingCallError(err):
+			c.JSON(http.StatusConflict, gin.H{"error": "no waiting call"})
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Call control failed: " + err.Error()})
+		}
+		return
+	}
+
+	state := w.CallState()
+	if h.callMgr != nil && state.State == "idle" && !h.callMgr.HasActiveSIPCall(iccid) {
+		_ = h.callMgr.CloseSession(iccid)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": state})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 	"github.com/pccr10001/smsie/internal/calling"
+	"github.com/pccr10001/smsie/internal/worker"
 	"github.com/pccr10001/smsie/pkg/logger"
 	"github.com/pion/webrtc/v4"
 )
@@ -18,7 +19,7 @@ var wsUpgrader = websocket.Upgrader{
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
-func handleModemWS(c *gin.Context, callMgr *calling.Manager, iccid string, target calling.ModemTarget) {
+func handleModemWS(c *gin.Context, callMgr *calling.Manager, wm *worker.Manager, iccid string, target calling.ModemTarget) {
 	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		logger.Log.Errorf("upgrade websocket failed: %v", err)
@@ -65,6 +66,50 @@ func handleModemWS(c *gin.Context, callMgr *calling.Manager, iccid string, targe
 
 	_ = writeJSON(calling.SignalMessage{Type: "ready", Text: "server ready"})
 
+	// Call state listeners run on the worker goroutine, so hand events off
+	// through a buffered channel instead of writing to the socket inline.
+	callEvents := make(chan worker.CallState, 8)
+	done := make(chan struct{})
+	defer close(done)
+	ringing := false
+	if wm != nil {
+		removeListener := wm.AddCallStateListener(func(w *worker.ModemWorker, state worker.CallState) {
+			rt, ok := w.RuntimeModemState()
+			if !ok || rt.ICCID != iccid {
+				return
+			}
+			select {
+			case callEvents <- state:
+			default:
+			}
+		})
+		defer removeListener()
+
+		if w := wm.GetWorkerByICCID(iccid); w != nil {
+			if state := w.CallState(); state.IncomingRinging || state.Waiting {
+				ringing = true
+				_ = writeJSON(calling.SignalMessage{Type: "incoming", Data: state})
+			}
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case state := <-callEvents:
+				alerting := state.IncomingRinging || state.Waiting
+				switch {
+				case alerting && !ringing:
+					_ = writeJSON(calling.SignalMessage{Type: "incoming", Data: state})
+				case !alerting && ringing:
+					_ = writeJSON(calling.SignalMessage{Type: "call_state", Data: state})
+				}
+				ringing = alerting
+			}
+		}
+	}()
+
 	for {
 		_, raw, err := conn.ReadMessage()
 		if err != nil {
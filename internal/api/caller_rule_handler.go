@@ -0,0 +1,203 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type CallerRuleHandler struct {
+	db *gorm.DB
+}
+
+func NewCallerRuleHandler(db *gorm.DB) *CallerRuleHandler {
+	return &CallerRuleHandler{db: db}
+}
+
+type callerRuleRequest struct {
+	ICCID     *string `json:"iccid"`
+	MatchType *string `json:"match_type"`
+	Pattern   *string `json:"pattern"`
+	Action    *string `json:"action"`
+	AppliesTo *string `json:"applies_to"`
+	Note      *string `json:"note"`
+	Enabled   *bool   `json:"enabled"`
+}
+
+func (req callerRuleRequest) apply(rule *model.CallerRule) {
+	if req.ICCID != nil {
+		rule.ICCID = *req.ICCID
+	}
+	if req.MatchType != nil {
+		rule.MatchType = *req.MatchType
+	}
+	if req.Pattern != nil {
+		rule.Pattern = *req.Pattern
+	}
+	if req.Action != nil {
+		rule.Action = *req.Action
+	}
+	if req.AppliesTo != nil {
+		rule.AppliesTo = *req.AppliesTo
+	}
+	if req.Note != nil {
+		rule.Note = *req.Note
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+}
+
+// ListCallerRules returns global rules plus per-modem rules. With ?iccid= it
+// returns only the rules that apply to that modem (its own and global ones).
+func (h *CallerRuleHandler) ListCallerRules(c *gin.Context) {
+	query := h.db.Model(&model.CallerRule{})
+	if iccid := c.Query("iccid"); iccid != "" {
+		query = query.Where("iccid = ? OR iccid = ''", iccid)
+	}
+
+	var list []model.CallerRule
+	if err := query.Order("id asc").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (h *CallerRuleHandler) CreateCallerRule(c *gin.Context) {
+	var req callerRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := model.CallerRule{Enabled: true}
+	req.apply(&rule)
+	if err := logic.ValidateCallerRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logic.CallerRulesChanged()
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *CallerRuleHandler) UpdateCallerRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+
+	var rule model.CallerRule
+	if err := h.db.First(&rule, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Caller rule not found"})
+		return
+	}
+
+	var req callerRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	oldAction := rule.Action
+	req.apply(&rule)
+	if err := logic.ValidateCallerRule(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Hits are reported per action, so they start over when it changes.
+	if rule.Action != oldAction {
+		rule.CallHits = 0
+		rule.SMSHits = 0
+		rule.LastHitAt = nil
+	}
+
+	if err := h.db.Save(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logic.CallerRulesChanged()
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *CallerRuleHandler) DeleteCallerRule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+
+	if err := h.db.Delete(&model.CallerRule{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	logic.CallerRulesChanged()
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// ResetCallerRuleStats clears the hit counters of a rule.
+func (h *CallerRuleHandler) ResetCallerRuleStats(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return
+	}
+
+	res := h.db.Model(&model.CallerRule{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"call_hits":   0,
+		"sms_hits":    0,
+		"last_hit_at": nil,
+	})
+	if res.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": res.Error.Error()})
+		return
+	}
+	if res.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Caller rule not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset"})
+}
+
+// CallerRuleStats summarises rule hits per modem and action.
+func (h *CallerRuleHandler) CallerRuleStats(c *gin.Context) {
+	type row struct {
+		ICCID    string `json:"iccid"`
+		Action   string `json:"action"`
+		Rules    int64  `json:"rules"`
+		CallHits int64  `json:"call_hits"`
+		SMSHits  int64  `json:"sms_hits"`
+	}
+
+	var rows []row
+	err := h.db.Model(&model.CallerRule{}).
+		Select("iccid, action, COUNT(*) AS rules, COALESCE(SUM(call_hits), 0) AS call_hits, COALESCE(SUM(sms_hits), 0) AS sms_hits").
+		Group("iccid, action").
+		Order("iccid, action").
+		Scan(&rows).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var spamSMS int64
+	if err := h.db.Model(&model.SMS{}).Where("is_spam = ?", true).Count(&spamSMS).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"rules":       rows,
+		"spam_stored": spamSMS,
+	})
+}
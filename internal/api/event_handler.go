@@ -0,0 +1,248 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"gorm.io/gorm"
+)
+
+const (
+	eventHeartbeatInterval = 25 * time.Second
+	// eventRefreshInterval is how often a stream reloads the caller and
+	// forgets cached permission checks, so revocations take effect.
+	eventRefreshInterval = 30 * time.Second
+)
+
+type EventHandler struct {
+	db *gorm.DB
+	wm *worker.Manager
+}
+
+func NewEventHandler(db *gorm.DB, wm *worker.Manager) *EventHandler {
+	return &EventHandler{db: db, wm: wm}
+}
+
+// Stream serves /events as Server-Sent Events, or as a WebSocket of JSON
+// events when the request is an upgrade. Optional filters: types (comma
+// separated types or families such as "sms"), iccid. Resume with the
+// Last-Event-ID header or ?last_event_id=.
+func (h *EventHandler) Stream(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("last_event_id")
+	}
+	var after uint64
+	if lastID != "" {
+		v, err := strconv.ParseUint(strings.TrimSpace(lastID), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		after = v
+	}
+
+	iccid := strings.TrimSpace(c.Query("iccid"))
+	if iccid != "" {
+		if allowed, status, message := actorCanAccessICCIDPermission(h.db, actor, iccid, ""); !allowed {
+			c.JSON(status, gin.H{"error": message})
+			return
+		}
+	}
+
+	filter := &eventFilter{db: h.db, actor: actor, types: c.Query("types"), iccid: iccid, allowed: map[string]bool{}}
+	if websocket.IsWebSocketUpgrade(c.Request) {
+		h.streamWS(c, filter, after)
+		return
+	}
+	h.streamSSE(c, filter, after)
+}
+
+func (h *EventHandler) streamSSE(c *gin.Context, filter *eventFilter, after uint64) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "streaming unsupported"})
+		return
+	}
+
+	backlog, events, cancel := h.wm.Events().Subscribe(after)
+	defer cancel()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprint(c.Writer, "retry: 3000\n\n")
+	flusher.Flush()
+
+	write := func(e logic.Event) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	ping := func() error {
+		if _, err := fmt.Fprint(c.Writer, ": ping\n\n"); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	h.pump(c.Request.Context().Done(), filter, backlog, events, write, ping)
+}
+
+func (h *EventHandler) streamWS(c *gin.Context, filter *eventFilter, after uint64) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	backlog, events, cancel := h.wm.Events().Subscribe(after)
+	defer cancel()
+
+	// The client only sends control frames; reading detects the close.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(e logic.Event) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteJSON(e)
+	}
+	ping := func() error {
+		return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+	}
+
+	h.pump(closed, filter, backlog, events, write, ping)
+}
+
+// pump writes the backlog and then live events until the client goes away,
+// a write fails or the subscriber is dropped for falling behind.
+func (h *EventHandler) pump(done <-chan struct{}, filter *eventFilter, backlog []logic.Event, events <-chan logic.Event, write func(logic.Event) error, ping func() error) {
+	for _, e := range backlog {
+		if filter.allows(e) {
+			if err := write(e); err != nil {
+				return
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeatInterval)
+	defer heartbeat.Stop()
+	refresh := time.NewTicker(eventRefreshInterval)
+	defer refresh.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if filter.allows(e) {
+				if err := write(e); err != nil {
+					return
+				}
+			}
+		case <-heartbeat.C:
+			if err := ping(); err != nil {
+				return
+			}
+		case <-refresh.C:
+			if !filter.refresh() {
+				return
+			}
+		}
+	}
+}
+
+// eventFilter applies the stream filters and the caller's permissions:
+// view_sms for SMS events, make_call for call events and access to the modem
+// for modem events.
+type eventFilter struct {
+	db      *gorm.DB
+	actor   *authActor
+	types   string
+	iccid   string
+	allowed map[string]bool // "<iccid>|<permission>"
+}
+
+func (f *eventFilter) allows(e logic.Event) bool {
+	if !logic.EventTypeMatches(f.types, e.Type) && e.Type != logic.EventStreamReset {
+		return false
+	}
+	if e.ICCID == "" {
+		return true
+	}
+	if f.iccid != "" && e.ICCID != f.iccid {
+		return false
+	}
+
+	perm := ""
+	switch {
+	case strings.HasPrefix(e.Type, "sms."):
+		perm = PermViewSMS
+	case strings.HasPrefix(e.Type, "call."):
+		perm = PermMakeCall
+	}
+	key := e.ICCID + "|" + perm
+	allowed, ok := f.allowed[key]
+	if !ok {
+		allowed, _, _ = actorCanAccessICCIDPermission(f.db, f.actor, e.ICCID, perm)
+		f.allowed[key] = allowed
+	}
+	return allowed
+}
+
+// refresh reloads the user and API key and clears cached checks. It returns
+// false when the caller is no longer authorized.
+func (f *eventFilter) refresh() bool {
+	var user model.User
+	if err := f.db.First(&user, f.actor.User.ID).Error; err != nil {
+		return false
+	}
+	actor := &authActor{User: &user}
+	if f.actor.APIKey != nil {
+		var key model.APIKey
+		if err := f.db.Where("id = ? AND is_active = ?", f.actor.APIKey.ID, true).First(&key).Error; err != nil {
+			return false
+		}
+		if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+			return false
+		}
+		actor.APIKey = &key
+	}
+	f.actor = actor
+	f.allowed = map[string]bool{}
+	return true
+}
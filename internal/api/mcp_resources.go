@@ -0,0 +1,219 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+const (
+	mcpResourceScheme = "smsie://"
+	mcpModemsURI      = "smsie://modems"
+	// mcpResourceSMSLimit is how many recent messages a modem's SMS
+	// resource returns; older ones are available through list_sms.
+	mcpResourceSMSLimit = 50
+)
+
+// mcpResource is a parsed smsie:// URI.
+type mcpResource struct {
+	kind string // modems, modem, modem_sms or sms
+	key  string // ICCID or SMS ID
+}
+
+func parseMCPResourceURI(uri string) (mcpResource, bool) {
+	rest, ok := strings.CutPrefix(uri, mcpResourceScheme)
+	if !ok {
+		return mcpResource{}, false
+	}
+	parts := strings.Split(rest, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "modems":
+		return mcpResource{kind: "modems"}, true
+	case len(parts) == 2 && parts[0] == "modems" && parts[1] != "":
+		return mcpResource{kind: "modem", key: parts[1]}, true
+	case len(parts) == 3 && parts[0] == "modems" && parts[1] != "" && parts[2] == "sms":
+		return mcpResource{kind: "modem_sms", key: parts[1]}, true
+	case len(parts) == 2 && parts[0] == "sms" && parts[1] != "":
+		return mcpResource{kind: "sms", key: parts[1]}, true
+	}
+	return mcpResource{}, false
+}
+
+func (s *MCPHTTPServer) addResources() {
+	s.server.AddResource(&sdkmcp.Resource{
+		URI:         mcpModemsURI,
+		Name:        "modems",
+		Description: "Online modems visible to the API key, with per-modem permissions. Updated when a modem goes online or offline.",
+		MIMEType:    "application/json",
+	}, s.readResource)
+	s.server.AddResourceTemplate(&sdkmcp.ResourceTemplate{
+		URITemplate: "smsie://modems/{iccid}",
+		Name:        "modem",
+		Description: "Runtime state of one modem. Updated on signal, registration and online changes.",
+		MIMEType:    "application/json",
+	}, s.readResource)
+	s.server.AddResourceTemplate(&sdkmcp.ResourceTemplate{
+		URITemplate: "smsie://modems/{iccid}/sms",
+		Name:        "modem_sms",
+		Description: "Latest SMS on one modem, newest first. Requires view_sms. Updated when a message is received or sent.",
+		MIMEType:    "application/json",
+	}, s.readResource)
+	s.server.AddResourceTemplate(&sdkmcp.ResourceTemplate{
+		URITemplate: "smsie://sms/{id}",
+		Name:        "sms",
+		Description: "A single SMS by ID. Requires view_sms on its modem.",
+		MIMEType:    "application/json",
+	}, s.readResource)
+}
+
+func (s *MCPHTTPServer) readResource(ctx context.Context, req *sdkmcp.ReadResourceRequest) (*sdkmcp.ReadResourceResult, error) {
+	uri := req.Params.URI
+	res, ok := parseMCPResourceURI(uri)
+	if !ok {
+		return nil, sdkmcp.ResourceNotFoundError(uri)
+	}
+
+	var body any
+	var err error
+	switch res.kind {
+	case "modems":
+		_, body, err = s.toolListModems(ctx, nil, mcpListModemsInput{})
+	case "modem":
+		_, body, err = s.toolGetModemDetail(ctx, nil, mcpICCIDInput{ICCID: res.key})
+	case "modem_sms":
+		_, body, err = s.toolListSMS(ctx, nil, mcpListSMSInput{ICCID: res.key, PageSize: mcpResourceSMSLimit, MaxRecords: mcpResourceSMSLimit})
+	case "sms":
+		body, err = s.resourceSMS(ctx, res.key)
+	}
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, sdkmcp.ResourceNotFoundError(uri)
+		}
+		return nil, err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &sdkmcp.ReadResourceResult{Contents: []*sdkmcp.ResourceContents{
+		{URI: uri, MIMEType: "application/json", Text: string(data)},
+	}}, nil
+}
+
+func (s *MCPHTTPServer) resourceSMS(ctx context.Context, id string) (*model.SMS, error) {
+	actor, err := getMCPActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !actor.APIKey.CanViewSMS {
+		return nil, errors.New("API key permission denied")
+	}
+	smsID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	// Messages on modems the caller cannot see are reported as missing.
+	query, err := scopedSMSQuery(s.db, actor, "", "")
+	if err != nil {
+		return nil, err
+	}
+	var msg model.SMS
+	if err := query.Where("id = ?", smsID).First(&msg).Error; err != nil {
+		return nil, err
+	}
+	if allowed, _, _ := actorCanAccessICCIDPermission(s.db, actor, msg.ICCID, PermViewSMS); !allowed {
+		return nil, gorm.ErrRecordNotFound
+	}
+	list := []model.SMS{msg}
+	hydrateSMSContent(s.db, list)
+	return &list[0], nil
+}
+
+// subscribeResource only lets a session subscribe to resources it can read.
+func (s *MCPHTTPServer) subscribeResource(ctx context.Context, req *sdkmcp.SubscribeRequest) error {
+	actor, err := getMCPActor(ctx)
+	if err != nil {
+		return err
+	}
+	res, ok := parseMCPResourceURI(req.Params.URI)
+	if !ok {
+		return sdkmcp.ResourceNotFoundError(req.Params.URI)
+	}
+
+	switch res.kind {
+	case "modem":
+		if allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, res.key, ""); !allowed {
+			return errors.New(message)
+		}
+	case "modem_sms":
+		if allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, res.key, PermViewSMS); !allowed {
+			return errors.New(message)
+		}
+	case "sms":
+		if _, err := s.resourceSMS(ctx, res.key); err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return sdkmcp.ResourceNotFoundError(req.Params.URI)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MCPHTTPServer) unsubscribeResource(ctx context.Context, req *sdkmcp.UnsubscribeRequest) error {
+	return nil
+}
+
+// Run turns modem and SMS events into resources/updated notifications for
+// subscribed sessions until stop is closed.
+func (s *MCPHTTPServer) Run(stop <-chan struct{}) {
+	for {
+		_, events, cancel := s.wm.Events().Subscribe(0)
+		dropped := false
+		for !dropped {
+			select {
+			case <-stop:
+				cancel()
+				return
+			case e, ok := <-events:
+				if !ok {
+					dropped = true // fell behind; subscribe again
+					break
+				}
+				s.notifyResourceUpdates(e)
+			}
+		}
+		cancel()
+	}
+}
+
+func (s *MCPHTTPServer) notifyResourceUpdates(e logic.Event) {
+	if e.ICCID == "" {
+		return
+	}
+	ctx := context.Background()
+	modemURI := mcpModemsURI + "/" + e.ICCID
+
+	switch e.Type {
+	case logic.EventSMSReceived, logic.EventSMSSent:
+		meta := sdkmcp.Meta{"event": e.Type}
+		if sms, ok := e.Data.(model.SMS); ok {
+			meta["sms_uri"] = mcpResourceScheme + "sms/" + strconv.FormatUint(uint64(sms.ID), 10)
+		}
+		_ = s.server.ResourceUpdated(ctx, &sdkmcp.ResourceUpdatedNotificationParams{URI: modemURI + "/sms", Meta: meta})
+	case logic.EventModemOnline, logic.EventModemOffline:
+		_ = s.server.ResourceUpdated(ctx, &sdkmcp.ResourceUpdatedNotificationParams{URI: mcpModemsURI})
+		_ = s.server.ResourceUpdated(ctx, &sdkmcp.ResourceUpdatedNotificationParams{URI: modemURI, Meta: sdkmcp.Meta{"event": e.Type}})
+	case logic.EventModemSignal, logic.EventModemRegistration:
+		_ = s.server.ResourceUpdated(ctx, &sdkmcp.ResourceUpdatedNotificationParams{URI: modemURI, Meta: sdkmcp.Meta{"event": e.Type}})
+	}
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -11,6 +12,8 @@ import (
 
 	sdkauth "github.com/modelcontextprotocol/go-sdk/auth"
 	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/pccr10001/smsie/internal/calling"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/internal/worker"
 	"github.com/pccr10001/smsie/pkg/logger"
@@ -32,9 +35,13 @@ const (
 
 type mcpActorContextKey struct{}
 
+type mcpClientIPContextKey struct{}
+
 type MCPHTTPServer struct {
 	db      *gorm.DB
 	wm      *worker.Manager
+	modems  *ModemHandler // shared call and modem state helpers
+	audit   *logic.AuditLogger
 	server  *sdkmcp.Server
 	handler http.Handler
 }
@@ -111,7 +118,8 @@ type mcpWaitSMSOutput struct {
 }
 
 type mcpSendSMSInput struct {
-	ICCID   string `json:"iccid" jsonschema:"ICCID of the modem that should send the SMS"`
+	ICCID   string `json:"iccid,omitempty" jsonschema:"ICCID of the modem that should send the SMS"`
+	Pool    string `json:"pool,omitempty" jsonschema:"modem pool to route the SMS through instead of an ICCID"`
 	Phone   string `json:"phone" jsonschema:"destination phone number"`
 	Message string `json:"message" jsonschema:"SMS body"`
 }
@@ -123,11 +131,14 @@ type mcpSendSMSOutput struct {
 	Message string `json:"message"`
 }
 
-func NewMCPHTTPServer(db *gorm.DB, wm *worker.Manager) *MCPHTTPServer {
-	s := &MCPHTTPServer{db: db, wm: wm}
+func NewMCPHTTPServer(db *gorm.DB, wm *worker.Manager, callMgr *calling.Manager) *MCPHTTPServer {
+	s := &MCPHTTPServer{db: db, wm: wm, modems: NewModemHandler(db, wm, callMgr), audit: logic.NewAuditLogger(db)}
 	s.server = sdkmcp.NewServer(&sdkmcp.Implementation{Name: "smsie", Version: "v2"}, &sdkmcp.ServerOptions{
-		Instructions: "Use the provided SMS and modem tools. All results are automatically constrained by the authenticated API key and modem permissions.",
+		Instructions:       "Use the provided SMS, call and modem tools. Subscribe to smsie://modems/{iccid}/sms to be notified of new messages instead of holding wait_sms open. All results are automatically constrained by the authenticated API key and modem permissions.",
+		SubscribeHandler:   s.subscribeResource,
+		UnsubscribeHandler: s.unsubscribeResource,
 	})
+	s.addResources()
 
 	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
 		Name:        "list_modems",
@@ -141,10 +152,54 @@ func NewMCPHTTPServer(db *gorm.DB, wm *worker.Manager) *MCPHTTPServer {
 		Name:        "wait_sms",
 		Description: "Wait for new SMS messages visible to the authenticated API key. Use after_id to continue from the previous result.",
 	}, s.toolWaitSMS)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "wait_otp",
+		Description: "Wait for a one-time code extracted from an incoming SMS and return the code. Filter by sender or service (e.g. Google); use max_age_sec to accept a code that arrived shortly before the call.",
+	}, s.toolWaitOTP)
 	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
 		Name:        "send_sms",
-		Description: "Send an SMS through a specific modem that the authenticated API key is allowed to use.",
+		Description: "Send an SMS through a specific modem that the authenticated API key is allowed to use, or through a modem pool, which picks one of its modems and fails over to the next.",
 	}, s.toolSendSMS)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "get_modem_detail",
+		Description: "Get the runtime state, SIP line and supplementary services of one modem, with the API key's permissions on it.",
+	}, s.toolGetModemDetail)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "send_at",
+		Description: "Run an AT command on a modem. Requires send_at. Commands that reset, lock or reconfigure the modem are refused unless an admin key sets allow_dangerous.",
+	}, auditedTool(s, "modem.at", s.toolSendAT))
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "send_ussd",
+		Description: "Send a USSD code such as *100# and return the network reply. Requires send_at. Send a menu choice the same way while the state is further_action.",
+	}, s.toolSendUSSD)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "get_call_state",
+		Description: "Get the modem and SIP call state of a modem. Requires make_call.",
+	}, s.toolGetCallState)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "dial",
+		Description: "Place a call from a modem, on the modem leg (default) or through its SIP line. Requires make_call.",
+	}, s.toolDial)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "hangup",
+		Description: "Hang up the current call on a modem. Requires make_call.",
+	}, s.toolHangup)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "send_dtmf",
+		Description: "Send DTMF tones on the current call. Requires make_call.",
+	}, s.toolSendDTMF)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "scan_networks",
+		Description: "Scan for available mobile networks (AT+COPS=?). Admin keys with send_at only; takes up to a few minutes.",
+	}, s.toolScanNetworks)
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "set_operator",
+		Description: "Select the network operator: AUTO or a numeric operator ID. Admin keys with send_at only.",
+	}, auditedTool(s, "modem.set_operator", s.toolSetOperator))
+	sdkmcp.AddTool(s.server, &sdkmcp.Tool{
+		Name:        "reboot_modem",
+		Description: "Reboot a modem (AT+CFUN=1,1). Admin keys with send_at only.",
+	}, auditedTool(s, "modem.reboot", s.toolRebootModem))
 
 	baseHandler := sdkmcp.NewStreamableHTTPHandler(func(r *http.Request) *sdkmcp.Server {
 		return s.server
@@ -164,6 +219,7 @@ func NewMCPHTTPServer(db *gorm.DB, wm *worker.Manager) *MCPHTTPServer {
 			return
 		}
 		ctx := context.WithValue(r.Context(), mcpActorContextKey{}, actor)
+		ctx = context.WithValue(ctx, mcpClientIPContextKey{}, requestClientIP(r))
 		baseHandler.ServeHTTP(w, r.WithContext(ctx))
 	})
 
@@ -213,6 +269,30 @@ func (s *MCPHTTPServer) verifyAPIKeyToken(ctx context.Context, token string, req
 	}, nil
 }
 
+// auditedTool writes each call of a modem-affecting tool to the audit log.
+func auditedTool[In, Out any](s *MCPHTTPServer, action string, h sdkmcp.ToolHandlerFor[In, Out]) sdkmcp.ToolHandlerFor[In, Out] {
+	return func(ctx context.Context, req *sdkmcp.CallToolRequest, input In) (*sdkmcp.CallToolResult, Out, error) {
+		res, out, err := h(ctx, req, input)
+
+		var params map[string]interface{}
+		if raw, merr := json.Marshal(input); merr == nil {
+			_ = json.Unmarshal(raw, &params)
+		}
+		entry := &model.AuditLog{AuthType: "mcp", Action: action, Params: logic.AuditParams(params)}
+		entry.IP, _ = ctx.Value(mcpClientIPContextKey{}).(string)
+		entry.ICCID, _ = params["iccid"].(string)
+		entry.ICCID = strings.TrimSpace(entry.ICCID)
+		if actor, aerr := getMCPActor(ctx); aerr == nil {
+			entry.UserID, entry.Username, entry.APIKeyID = actor.User.ID, actor.User.Username, actor.APIKey.ID
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		s.audit.Log(entry)
+		return res, out, err
+	}
+}
+
 func getMCPActor(ctx context.Context) (*authActor, error) {
 	actor, ok := ctx.Value(mcpActorContextKey{}).(*authActor)
 	if !ok || actor == nil || actor.User == nil || actor.APIKey == nil {
@@ -312,21 +392,23 @@ func hydrateSMSContent(db *gorm.DB, smsList []model.SMS) {
 	}
 }
 
-func (s *MCPHTTPServer) scopedSMSQuery(actor *authActor, iccid, smsType string) (*gorm.DB, error) {
-	query := s.db.Model(&model.SMS{})
+// scopedSMSQuery selects non-spam SMS the actor may view, optionally limited
+// to one modem and type.
+func scopedSMSQuery(db *gorm.DB, actor *authActor, iccid, smsType string) (*gorm.DB, error) {
+	query := db.Model(&model.SMS{}).Where("is_spam = ?", false)
 	if smsType != "" {
 		query = query.Where("type = ?", smsType)
 	}
 
 	if iccid != "" {
-		allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, iccid, PermViewSMS)
+		allowed, _, message := actorCanAccessICCIDPermission(db, actor, iccid, PermViewSMS)
 		if !allowed {
 			return nil, errors.New(message)
 		}
 		return query.Where("iccid = ?", iccid), nil
 	}
 
-	allowedICCIDs, err := allowedICCIDsForPermission(s.db, actor.User, PermViewSMS)
+	allowedICCIDs, err := allowedICCIDsForPermission(db, actor.User, PermViewSMS)
 	if err != nil {
 		return nil, fmt.Errorf("permission check failed: %w", err)
 	}
@@ -434,7 +516,7 @@ func (s *MCPHTTPServer) toolListSMS(ctx context.Context, req *sdkmcp.CallToolReq
 	pageSize := clampInt(input.PageSize, defaultMCPPageSize, 1, maxMCPPageSize)
 	maxRecords := clampInt(input.MaxRecords, defaultMCPMaxRecords, 1, maxMCPMaxRecords)
 
-	query, err := s.scopedSMSQuery(actor, strings.TrimSpace(input.ICCID), smsType)
+	query, err := scopedSMSQuery(s.db, actor, strings.TrimSpace(input.ICCID), smsType)
 	if err != nil {
 		return nil, mcpListSMSOutput{}, err
 	}
@@ -493,7 +575,7 @@ func (s *MCPHTTPServer) toolWaitSMS(ctx context.Context, req *sdkmcp.CallToolReq
 	maxRecords := clampInt(input.MaxRecords, defaultMCPWaitMaxRecords, 1, maxMCPWaitMaxRecords)
 	iccid := strings.TrimSpace(input.ICCID)
 
-	query, err := s.scopedSMSQuery(actor, iccid, smsType)
+	query, err := scopedSMSQuery(s.db, actor, iccid, smsType)
 	if err != nil {
 		return nil, mcpWaitSMSOutput{}, err
 	}
@@ -515,12 +597,20 @@ func (s *MCPHTTPServer) toolWaitSMS(ctx context.Context, req *sdkmcp.CallToolReq
 		}
 	}
 
+	// New SMS wake the wait through the event hub; the slow poll only covers
+	// messages stored without an event.
+	_, events, cancel := s.wm.Events().Subscribe(0)
+	defer cancel()
+	stopProgress := startMCPProgress(ctx, req, time.Duration(timeoutSec)*time.Second, "waiting for SMS")
+	defer stopProgress()
 	deadline := time.Now().Add(time.Duration(timeoutSec) * time.Second)
-	ticker := time.NewTicker(1 * time.Second)
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 
 	for {
-		pollQuery, err := s.scopedSMSQuery(actor, iccid, smsType)
+		pollQuery, err := scopedSMSQuery(s.db, actor, iccid, smsType)
 		if err != nil {
 			return nil, mcpWaitSMSOutput{}, err
 		}
@@ -560,10 +650,24 @@ func (s *MCPHTTPServer) toolWaitSMS(ctx context.Context, req *sdkmcp.CallToolReq
 			}, nil
 		}
 
-		select {
-		case <-ctx.Done():
-			return nil, mcpWaitSMSOutput{}, ctx.Err()
-		case <-ticker.C:
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, mcpWaitSMSOutput{}, ctx.Err()
+			case e, ok := <-events:
+				if !ok {
+					events = nil // dropped for falling behind, keep polling
+					break wait
+				}
+				if e.Type == logic.EventSMSReceived {
+					break wait
+				}
+			case <-timer.C:
+				break wait
+			case <-ticker.C:
+				break wait
+			}
 		}
 	}
 }
@@ -578,12 +682,18 @@ func (s *MCPHTTPServer) toolSendSMS(ctx context.Context, req *sdkmcp.CallToolReq
 	}
 
 	iccid := strings.TrimSpace(input.ICCID)
-	if iccid == "" {
-		return nil, mcpSendSMSOutput{}, errors.New("iccid is required")
+	pool := strings.TrimSpace(input.Pool)
+	if iccid == "" && pool == "" {
+		return nil, mcpSendSMSOutput{}, errors.New("iccid or pool is required")
+	}
+	if iccid != "" && pool != "" {
+		return nil, mcpSendSMSOutput{}, errors.New("give either iccid or pool, not both")
 	}
-	allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, iccid, PermSendSMS)
-	if !allowed {
-		return nil, mcpSendSMSOutput{}, errors.New(message)
+	if pool == "" {
+		allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, iccid, PermSendSMS)
+		if !allowed {
+			return nil, mcpSendSMSOutput{}, errors.New(message)
+		}
 	}
 	if strings.TrimSpace(input.Phone) == "" {
 		return nil, mcpSendSMSOutput{}, errors.New("phone is required")
@@ -592,6 +702,22 @@ func (s *MCPHTTPServer) toolSendSMS(ctx context.Context, req *sdkmcp.CallToolReq
 		return nil, mcpSendSMSOutput{}, errors.New("message is required")
 	}
 
+	if pool != "" {
+		sms, err := sendViaPool(s.db, s.wm, s.modems.quota, actor, pool, strings.TrimSpace(input.Phone), input.Message)
+		if err != nil {
+			if _, ok := logic.AsQuotaExceeded(err); ok {
+				return nil, mcpSendSMSOutput{}, err
+			}
+			return nil, mcpSendSMSOutput{}, fmt.Errorf("send SMS failed: %w", err)
+		}
+		return nil, mcpSendSMSOutput{
+			Status:  "ok",
+			ICCID:   sms.ICCID,
+			Phone:   input.Phone,
+			Message: "SMS sent successfully",
+		}, nil
+	}
+
 	w := s.wm.GetWorkerByICCID(iccid)
 	if w == nil {
 		return nil, mcpSendSMSOutput{}, errors.New("modem not active (worker not found)")
@@ -599,7 +725,12 @@ func (s *MCPHTTPServer) toolSendSMS(ctx context.Context, req *sdkmcp.CallToolReq
 	if w.IsBusy() {
 		return nil, mcpSendSMSOutput{}, errors.New("modem is busy")
 	}
+	subject := actorQuotaSubject(actor)
+	if err := s.modems.quota.Reserve(subject, iccid); err != nil {
+		return nil, mcpSendSMSOutput{}, err
+	}
 	if err := w.SendSMS(input.Phone, input.Message); err != nil {
+		s.modems.quota.Release(subject, iccid)
 		return nil, mcpSendSMSOutput{}, fmt.Errorf("send SMS failed: %w", err)
 	}
 
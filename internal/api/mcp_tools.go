@@ -0,0 +1,605 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+	"github.com/pccr10001/smsie/internal/calling"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+)
+
+const (
+	defaultMCPATTimeoutMs = 10000
+	maxMCPATTimeoutMs     = 60000
+	maxMCPDTMFDigits      = 32
+	mcpProgressInterval   = 2 * time.Second
+)
+
+// dangerousATCommands are refused by send_at unless an admin key sets
+// allow_dangerous. Read forms ending in "?" are always allowed.
+var dangerousATCommands = map[string]string{
+	"+CFUN":     "changes radio power or resets the modem, use reboot_modem",
+	"+CPOF":     "powers the modem off",
+	"+QPOWD":    "powers the modem off",
+	"+IPR":      "changes the serial baud rate",
+	"+ICF":      "changes the serial framing",
+	"+CLCK":     "changes SIM or network locks",
+	"+CPWD":     "changes SIM passwords",
+	"+CPIN":     "a wrong PIN can lock the SIM",
+	"+CRSM":     "can write SIM files",
+	"+CSIM":     "can write SIM files",
+	"+COPS":     "changes operator selection, use set_operator",
+	"+CMGS":     "sends SMS, use send_sms",
+	"+CMSS":     "sends SMS, use send_sms",
+	"+CMGD":     "deletes stored SMS",
+	"+QCFG":     "changes modem configuration",
+	"+QPRTPARA": "writes or restores saved settings",
+	"+EGMR":     "rewrites the IMEI",
+	"+QNVW":     "writes modem NV memory",
+	"+QNVFW":    "writes modem NV memory",
+	"+QFOTADL":  "starts a firmware update",
+	"+CCFC":     "changes call forwarding, which can divert calls and codes",
+}
+
+// dangerousATReads recognise the queries of listed commands that are written
+// like a write, given the arguments after "=".
+var dangerousATReads = map[string]func(args string) bool{
+	// AT+QCFG="name" reads a setting; a value after it writes one.
+	"+QCFG": func(args string) bool { return !strings.Contains(args, ",") },
+	// AT+CCFC=<reason>,2 interrogates forwarding.
+	"+CCFC": func(args string) bool {
+		params := strings.Split(args, ",")
+		return len(params) >= 2 && strings.TrimSpace(params[1]) == "2"
+	},
+}
+
+// dangerousATCommand returns why cmd is refused by send_at, or "".
+func dangerousATCommand(cmd string) string {
+	if strings.ContainsAny(cmd, "\r\n\x1a\x1b") {
+		return "contains line breaks or control characters, send one command line"
+	}
+	body := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(cmd)), "AT")
+	for _, part := range strings.Split(body, ";") {
+		part = strings.TrimSpace(part)
+		basic, ext := part, ""
+		if i := strings.IndexAny(part, "+$^%#"); i >= 0 {
+			basic, ext = part[:i], part[i:]
+		}
+
+		// &D sets DTR handling; any other D in the basic section dials.
+		switch {
+		case strings.Contains(strings.ReplaceAll(basic, "&D", ""), "D"):
+			return "dials a call, use dial"
+		case strings.Contains(basic, "&F"):
+			return "restores factory defaults"
+		case strings.Contains(basic, "&W"):
+			return "overwrites the stored profile"
+		case strings.Contains(basic, "Z"):
+			return "resets the modem, use reboot_modem"
+		}
+
+		if ext == "" || strings.HasSuffix(ext, "?") {
+			continue
+		}
+		name, args := ext, ""
+		if i := strings.IndexAny(name, "=?"); i >= 0 {
+			name, args = name[:i], strings.TrimPrefix(name[i:], "=")
+		}
+		reason, ok := dangerousATCommands[name]
+		if !ok {
+			continue
+		}
+		if isRead, ok := dangerousATReads[name]; ok && isRead(args) {
+			continue
+		}
+		return reason
+	}
+	return ""
+}
+
+type mcpICCIDInput struct {
+	ICCID string `json:"iccid" jsonschema:"ICCID of the modem"`
+}
+
+type mcpStatusOutput struct {
+	Status  string `json:"status"`
+	ICCID   string `json:"iccid"`
+	Message string `json:"message,omitempty"`
+}
+
+type mcpSendATInput struct {
+	ICCID          string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Command        string `json:"command" jsonschema:"AT command, e.g. AT+CSQ"`
+	TimeoutMs      int    `json:"timeout_ms,omitempty" jsonschema:"response timeout in milliseconds, max 60000"`
+	AllowDangerous bool   `json:"allow_dangerous,omitempty" jsonschema:"run commands that can reset, lock or reconfigure the modem; admin keys only"`
+}
+
+type mcpSendATOutput struct {
+	ICCID    string `json:"iccid"`
+	Command  string `json:"command"`
+	Response string `json:"response"`
+}
+
+type mcpSendUSSDInput struct {
+	ICCID string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Code  string `json:"code" jsonschema:"USSD code such as *100#, or a menu choice while the session needs further action"`
+}
+
+type mcpSendUSSDOutput struct {
+	ICCID string `json:"iccid"`
+	worker.USSDResult
+}
+
+type mcpDialInput struct {
+	ICCID  string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Number string `json:"number" jsonschema:"number to dial"`
+	Via    string `json:"via,omitempty" jsonschema:"call leg: modem (default) or sip"`
+	CLIR   string `json:"clir,omitempty" jsonschema:"caller ID for modem calls: default, hide or show"`
+}
+
+type mcpHangupInput struct {
+	ICCID string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Via   string `json:"via,omitempty" jsonschema:"call leg: modem or sip; defaults to sip while a SIP call is active"`
+}
+
+type mcpSendDTMFInput struct {
+	ICCID  string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Digits string `json:"digits" jsonschema:"tones to send in order, from 0-9, * and #"`
+	Via    string `json:"via,omitempty" jsonschema:"call leg: modem or sip; defaults to sip while a SIP call is active"`
+}
+
+type mcpSendDTMFOutput struct {
+	Status   string `json:"status"`
+	ICCID    string `json:"iccid"`
+	Digits   string `json:"digits"`
+	CallMode string `json:"call_mode"`
+}
+
+type mcpScanNetworksOutput struct {
+	ICCID    string   `json:"iccid"`
+	Networks []string `json:"networks"`
+}
+
+type mcpSetOperatorInput struct {
+	ICCID    string `json:"iccid" jsonschema:"ICCID of the modem"`
+	Operator string `json:"operator" jsonschema:"AUTO or a numeric operator ID such as 46692"`
+}
+
+type mcpWaitOTPInput struct {
+	ICCID      string `json:"iccid,omitempty" jsonschema:"optional ICCID filter"`
+	Sender     string `json:"sender,omitempty" jsonschema:"optional sender filter, matches part of the number or sender ID"`
+	Service    string `json:"service,omitempty" jsonschema:"optional service filter such as Google, case-insensitive"`
+	AfterID    *int   `json:"after_id,omitempty" jsonschema:"only return codes from SMS with id greater than this value"`
+	MaxAgeSec  int    `json:"max_age_sec,omitempty" jsonschema:"also accept codes received up to this many seconds before the call, max 3600"`
+	TimeoutSec int    `json:"timeout_sec,omitempty" jsonschema:"wait timeout in seconds, max 120"`
+}
+
+type mcpWaitOTPOutput struct {
+	Timeout bool `json:"timeout"`
+	otpResult
+}
+
+type mcpModemDetailOutput struct {
+	modemWithWorker
+	Permissions mcpModemPermissions `json:"permissions"`
+}
+
+// startMCPProgress sends progress notifications while a long tool call runs,
+// if the client passed a progress token. Progress is the elapsed time in
+// seconds against the expected maximum. Call the returned func when done.
+func startMCPProgress(ctx context.Context, req *sdkmcp.CallToolRequest, total time.Duration, message string) func() {
+	if req == nil || req.Session == nil || req.Params == nil {
+		return func() {}
+	}
+	token := req.Params.GetProgressToken()
+	if token == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		start := time.Now()
+		ticker := time.NewTicker(mcpProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_ = req.Session.NotifyProgress(ctx, &sdkmcp.ProgressNotificationParams{
+					ProgressToken: token,
+					Message:       message,
+					Progress:      time.Since(start).Seconds(),
+					Total:         total.Seconds(),
+				})
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// authorizeModem applies the API key flag and per-modem permission for perm.
+func (s *MCPHTTPServer) authorizeModem(ctx context.Context, iccid, perm string) (*authActor, error) {
+	actor, err := getMCPActor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !permissionFlagFromKey(actor.APIKey, perm) {
+		return nil, errors.New("API key permission denied")
+	}
+	if iccid == "" {
+		return nil, errors.New("iccid is required")
+	}
+	if allowed, _, message := actorCanAccessICCIDPermission(s.db, actor, iccid, perm); !allowed {
+		return nil, errors.New(message)
+	}
+	return actor, nil
+}
+
+// adminModemWorker guards the modem-control tools, which the REST API
+// limits to admins.
+func (s *MCPHTTPServer) adminModemWorker(ctx context.Context, iccid string) (*worker.ModemWorker, error) {
+	actor, err := s.authorizeModem(ctx, iccid, PermSendAT)
+	if err != nil {
+		return nil, err
+	}
+	if actor.User.Role != "admin" {
+		return nil, errors.New("admin access required")
+	}
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, errors.New("modem not active (worker not found)")
+	}
+	return w, nil
+}
+
+func (s *MCPHTTPServer) toolSendAT(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpSendATInput) (*sdkmcp.CallToolResult, mcpSendATOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	actor, err := s.authorizeModem(ctx, iccid, PermSendAT)
+	if err != nil {
+		return nil, mcpSendATOutput{}, err
+	}
+	cmd := strings.TrimSpace(input.Command)
+	if cmd == "" {
+		return nil, mcpSendATOutput{}, errors.New("command is required")
+	}
+	if reason := dangerousATCommand(cmd); reason != "" {
+		if !input.AllowDangerous || actor.User.Role != "admin" {
+			return nil, mcpSendATOutput{}, fmt.Errorf("command refused: %s (admin keys can set allow_dangerous)", reason)
+		}
+	}
+
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, mcpSendATOutput{}, errors.New("modem not active (worker not found)")
+	}
+	if w.IsBusy() {
+		return nil, mcpSendATOutput{}, errors.New("modem is busy")
+	}
+
+	w.SetOccupied(true)
+	defer w.SetOccupied(false)
+
+	timeout := clampInt(input.TimeoutMs, defaultMCPATTimeoutMs, 100, maxMCPATTimeoutMs)
+	resp, err := w.ExecuteAT(cmd, time.Duration(timeout)*time.Millisecond)
+	if err != nil {
+		return nil, mcpSendATOutput{}, err
+	}
+	return nil, mcpSendATOutput{ICCID: iccid, Command: cmd, Response: resp}, nil
+}
+
+func (s *MCPHTTPServer) toolSendUSSD(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpSendUSSDInput) (*sdkmcp.CallToolResult, mcpSendUSSDOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	if _, err := s.authorizeModem(ctx, iccid, PermSendAT); err != nil {
+		return nil, mcpSendUSSDOutput{}, err
+	}
+	if strings.TrimSpace(input.Code) == "" {
+		return nil, mcpSendUSSDOutput{}, errors.New("code is required")
+	}
+
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, mcpSendUSSDOutput{}, errors.New("modem not active (worker not found)")
+	}
+	if w.IsBusy() {
+		return nil, mcpSendUSSDOutput{}, errors.New("modem is busy")
+	}
+	stopProgress := startMCPProgress(ctx, req, 30*time.Second, "waiting for USSD reply")
+	defer stopProgress()
+	res, err := w.SendUSSD(input.Code, 0)
+	if err != nil {
+		return nil, mcpSendUSSDOutput{}, fmt.Errorf("USSD failed: %w", err)
+	}
+	return nil, mcpSendUSSDOutput{ICCID: iccid, USSDResult: *res}, nil
+}
+
+func (s *MCPHTTPServer) toolGetCallState(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpICCIDInput) (*sdkmcp.CallToolResult, map[string]any, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	if _, err := s.authorizeModem(ctx, iccid, PermMakeCall); err != nil {
+		return nil, nil, err
+	}
+	state, ok := s.modems.callStateView(iccid)
+	if !ok {
+		return nil, nil, errors.New("modem not active (worker not found)")
+	}
+	state["iccid"] = iccid
+	return nil, state, nil
+}
+
+func (s *MCPHTTPServer) toolDial(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpDialInput) (*sdkmcp.CallToolResult, map[string]any, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	if _, err := s.authorizeModem(ctx, iccid, PermMakeCall); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(input.Number) == "" {
+		return nil, nil, errors.New("number is required")
+	}
+	via := normalizeCallVia(input.Via)
+	clir, ok := worker.NormalizeCLIR(input.CLIR)
+	if !ok {
+		return nil, nil, errors.New("clir must be default, hide or show")
+	}
+	if clir != "" && via == "sip" {
+		return nil, nil, errors.New("clir is only supported for modem calls")
+	}
+
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, nil, errors.New("modem not active (worker not found)")
+	}
+
+	if via == "sip" {
+		callMgr := s.modems.callMgr
+		if callMgr == nil {
+			return nil, nil, errors.New("calling manager not initialized")
+		}
+		if _, ok := s.modems.sipAvailableForICCID(iccid); !ok {
+			return nil, nil, errors.New("sip client not enabled")
+		}
+		if !w.IsUACReady() {
+			return nil, nil, errors.New("UAC is not enabled on modem (QCFG USBCFG check failed)")
+		}
+		vid, pid := w.UACIdentity()
+		if _, err := callMgr.EnsureSession(iccid, calling.ModemTarget{PortName: w.PortName, VID: vid, PID: pid}); err != nil {
+			return nil, nil, fmt.Errorf("session init failed: %w", err)
+		}
+		if err := callMgr.EnsureAudio(iccid); err != nil {
+			_ = callMgr.CloseSession(iccid)
+			return nil, nil, fmt.Errorf("audio init failed: %w", err)
+		}
+		if err := callMgr.DialSIP(iccid, input.Number); err != nil {
+			switch {
+			case calling.IsSIPInvalidDialNumberError(err):
+				return nil, nil, errors.New("invalid dial number")
+			case calling.IsSIPCallInProgressError(err):
+				return nil, nil, errors.New("call already in progress")
+			}
+			return nil, nil, fmt.Errorf("dial failed: %w", err)
+		}
+		state, reason, updatedAt, _ := callMgr.SIPCallState(iccid)
+		return nil, map[string]any{"status": "ok", "iccid": iccid, "call_mode": "sip", "call_state": map[string]any{
+			"state":      state,
+			"reason":     reason,
+			"updated_at": updatedAt,
+		}}, nil
+	}
+
+	// Without a browser attached the modem leg is placed with no audio
+	// bridge, which is enough for verification calls and IVR navigation.
+	if err := w.Dial(input.Number, clir); err != nil {
+		switch {
+		case worker.IsInvalidDialNumberError(err):
+			return nil, nil, errors.New("invalid dial number")
+		case worker.IsCallInProgressError(err):
+			return nil, nil, errors.New("call already in progress")
+		}
+		return nil, nil, fmt.Errorf("dial failed: %w", err)
+	}
+	return nil, map[string]any{"status": "ok", "iccid": iccid, "call_mode": "modem", "call_state": w.CallState()}, nil
+}
+
+// routeSIP picks the call leg for hangup and DTMF: an explicit via wins,
+// otherwise an active SIP call does.
+func (s *MCPHTTPServer) routeSIP(iccid, via string) bool {
+	if strings.TrimSpace(via) != "" {
+		return normalizeCallVia(via) == "sip"
+	}
+	return s.modems.callMgr != nil && s.modems.callMgr.HasActiveSIPCall(iccid)
+}
+
+func (s *MCPHTTPServer) toolHangup(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpHangupInput) (*sdkmcp.CallToolResult, map[string]any, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	if _, err := s.authorizeModem(ctx, iccid, PermMakeCall); err != nil {
+		return nil, nil, err
+	}
+	callMgr := s.modems.callMgr
+
+	if s.routeSIP(iccid, input.Via) {
+		if _, ok := s.modems.sipAvailableForICCID(iccid); !ok {
+			return nil, nil, errors.New("sip client not enabled")
+		}
+		if err := callMgr.HangupSIP(iccid); err != nil && !calling.IsSIPNoActiveCallError(err) {
+			return nil, nil, fmt.Errorf("hangup failed: %w", err)
+		}
+		state, reason, updatedAt, _ := callMgr.SIPCallState(iccid)
+		if state == "" {
+			state, reason, updatedAt = "idle", "hangup", time.Now()
+		}
+		return nil, map[string]any{"status": "ok", "iccid": iccid, "call_mode": "sip", "call_state": map[string]any{
+			"state":      state,
+			"reason":     reason,
+			"updated_at": updatedAt,
+		}}, nil
+	}
+
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, nil, errors.New("modem not active (worker not found)")
+	}
+	if err := w.Hangup(); err != nil {
+		return nil, nil, fmt.Errorf("hangup failed: %w", err)
+	}
+	if callMgr != nil {
+		_ = callMgr.CloseSession(iccid)
+	}
+	return nil, map[string]any{"status": "ok", "iccid": iccid, "call_mode": "modem", "call_state": w.CallState()}, nil
+}
+
+func (s *MCPHTTPServer) toolSendDTMF(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpSendDTMFInput) (*sdkmcp.CallToolResult, mcpSendDTMFOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	if _, err := s.authorizeModem(ctx, iccid, PermMakeCall); err != nil {
+		return nil, mcpSendDTMFOutput{}, err
+	}
+	digits := strings.TrimSpace(input.Digits)
+	if digits == "" || len(digits) > maxMCPDTMFDigits || strings.Trim(digits, "0123456789*#") != "" {
+		return nil, mcpSendDTMFOutput{}, fmt.Errorf("digits must be 1-%d tones from 0-9,*,#", maxMCPDTMFDigits)
+	}
+
+	out := mcpSendDTMFOutput{Status: "ok", ICCID: iccid, Digits: digits, CallMode: "modem"}
+	if s.routeSIP(iccid, input.Via) {
+		if _, ok := s.modems.sipAvailableForICCID(iccid); !ok {
+			return nil, mcpSendDTMFOutput{}, errors.New("sip client not enabled")
+		}
+		for _, tone := range digits {
+			if err := s.modems.callMgr.SendSIPDTMF(iccid, string(tone)); err != nil {
+				if calling.IsSIPNoActiveCallError(err) {
+					return nil, mcpSendDTMFOutput{}, errors.New("no active call")
+				}
+				return nil, mcpSendDTMFOutput{}, fmt.Errorf("DTMF failed: %w", err)
+			}
+		}
+		out.CallMode = "sip"
+		return nil, out, nil
+	}
+
+	w := s.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, mcpSendDTMFOutput{}, errors.New("modem not active (worker not found)")
+	}
+	for _, tone := range digits {
+		if _, err := w.ExecuteAT(`AT+VTS="`+string(tone)+`"`, 5*time.Second); err != nil {
+			return nil, mcpSendDTMFOutput{}, fmt.Errorf("DTMF failed: %w", err)
+		}
+	}
+	return nil, out, nil
+}
+
+func (s *MCPHTTPServer) toolScanNetworks(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpICCIDInput) (*sdkmcp.CallToolResult, mcpScanNetworksOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	w, err := s.adminModemWorker(ctx, iccid)
+	if err != nil {
+		return nil, mcpScanNetworksOutput{}, err
+	}
+	if w.IsBusy() {
+		return nil, mcpScanNetworksOutput{}, errors.New("modem is busy")
+	}
+	stopProgress := startMCPProgress(ctx, req, 120*time.Second, "scanning networks")
+	defer stopProgress()
+	networks, err := w.ScanNetworks()
+	if err != nil {
+		return nil, mcpScanNetworksOutput{}, fmt.Errorf("scan failed: %w", err)
+	}
+	return nil, mcpScanNetworksOutput{ICCID: iccid, Networks: networks}, nil
+}
+
+func (s *MCPHTTPServer) toolSetOperator(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpSetOperatorInput) (*sdkmcp.CallToolResult, mcpStatusOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	w, err := s.adminModemWorker(ctx, iccid)
+	if err != nil {
+		return nil, mcpStatusOutput{}, err
+	}
+	if strings.TrimSpace(input.Operator) == "" {
+		return nil, mcpStatusOutput{}, errors.New("operator is required")
+	}
+	if w.IsBusy() {
+		return nil, mcpStatusOutput{}, errors.New("modem is busy")
+	}
+	if err := w.SetOperator(strings.TrimSpace(input.Operator)); err != nil {
+		return nil, mcpStatusOutput{}, fmt.Errorf("set operator failed: %w", err)
+	}
+	return nil, mcpStatusOutput{Status: "ok", ICCID: iccid}, nil
+}
+
+func (s *MCPHTTPServer) toolRebootModem(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpICCIDInput) (*sdkmcp.CallToolResult, mcpStatusOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	w, err := s.adminModemWorker(ctx, iccid)
+	if err != nil {
+		return nil, mcpStatusOutput{}, err
+	}
+	if s.modems.callMgr != nil {
+		_ = s.modems.callMgr.CloseSession(iccid)
+	}
+	if err := w.Reboot(); err != nil {
+		return nil, mcpStatusOutput{}, fmt.Errorf("reboot failed: %w", err)
+	}
+	return nil, mcpStatusOutput{Status: "ok", ICCID: iccid, Message: "Reboot command sent (AT+CFUN=1,1)"}, nil
+}
+
+func (s *MCPHTTPServer) toolGetModemDetail(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpICCIDInput) (*sdkmcp.CallToolResult, mcpModemDetailOutput, error) {
+	iccid := strings.TrimSpace(input.ICCID)
+	actor, err := s.authorizeModem(ctx, iccid, "")
+	if err != nil {
+		return nil, mcpModemDetailOutput{}, err
+	}
+
+	var modem model.Modem
+	if err := s.db.First(&modem, "iccid = ?", iccid).Error; err != nil {
+		if s.wm.GetWorkerByICCID(iccid) == nil {
+			return nil, mcpModemDetailOutput{}, errors.New("modem not found")
+		}
+		modem = model.Modem{ICCID: iccid}
+	}
+
+	canViewSMS, _, _ := actorCanAccessICCIDPermission(s.db, actor, iccid, PermViewSMS)
+	canSendSMS, _, _ := actorCanAccessICCIDPermission(s.db, actor, iccid, PermSendSMS)
+	canSendAT, _, _ := actorCanAccessICCIDPermission(s.db, actor, iccid, PermSendAT)
+	canMakeCall, _, _ := actorCanAccessICCIDPermission(s.db, actor, iccid, PermMakeCall)
+	return nil, mcpModemDetailOutput{
+		modemWithWorker: s.modems.modemWithWorkerState(modem),
+		Permissions: mcpModemPermissions{
+			CanViewSMS:  canViewSMS,
+			CanSendSMS:  canSendSMS,
+			CanSendAT:   canSendAT,
+			CanMakeCall: canMakeCall,
+		},
+	}, nil
+}
+
+func (s *MCPHTTPServer) toolWaitOTP(ctx context.Context, req *sdkmcp.CallToolRequest, input mcpWaitOTPInput) (*sdkmcp.CallToolResult, mcpWaitOTPOutput, error) {
+	actor, err := getMCPActor(ctx)
+	if err != nil {
+		return nil, mcpWaitOTPOutput{}, err
+	}
+	if input.AfterID != nil && *input.AfterID < 0 {
+		return nil, mcpWaitOTPOutput{}, errors.New("after_id must be >= 0")
+	}
+	if input.MaxAgeSec < 0 || input.MaxAgeSec > maxOTPWaitMaxAgeSec {
+		return nil, mcpWaitOTPOutput{}, errors.New("max_age_sec must be 0-3600")
+	}
+	timeout := time.Duration(clampInt(input.TimeoutSec, defaultMCPWaitTimeoutSec, 1, maxMCPWaitTimeoutSec)) * time.Second
+
+	stopProgress := startMCPProgress(ctx, req, timeout, "waiting for OTP")
+	defer stopProgress()
+	res, err := waitOTP(ctx, s.db, s.wm, actor, otpWaitFilter{
+		ICCID:   strings.TrimSpace(input.ICCID),
+		Sender:  strings.TrimSpace(input.Sender),
+		Service: strings.TrimSpace(input.Service),
+		AfterID: input.AfterID,
+		MaxAge:  time.Duration(input.MaxAgeSec) * time.Second,
+		Timeout: timeout,
+	})
+	if err != nil {
+		return nil, mcpWaitOTPOutput{}, err
+	}
+	if res == nil {
+		return nil, mcpWaitOTPOutput{Timeout: true}, nil
+	}
+	return nil, mcpWaitOTPOutput{otpResult: *res}, nil
+}
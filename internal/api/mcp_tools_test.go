@@ -0,0 +1,45 @@
+package api
+
+import "testing"
+
+func TestDangerousATCommand(t *testing.T) {
+	for _, tc := range []struct {
+		cmd       string
+		dangerous bool
+	}{
+		{"AT+CSQ", false},
+		{"at+csq;+creg?", false},
+		{"AT+CFUN?", false},
+		{"AT+CFUN=?", false},
+		{"AT+CFUN=1,1", true},
+		{"AT+CSQ;+CFUN=0", true},
+		{"AT+CSQ; +CLCK=\"SC\",1,\"1234\"", true},
+
+		// Basic sections, alone and chained.
+		{"ATI", false},
+		{"ATE0&D2", false},
+		{"AT&F", true},
+		{"ATE0&F", true},
+		{"AT+CSQ;&F", true},
+		{"ATZ", true},
+		{"ATE0V1Z", true},
+		{"AT+CSQ;Z", true},
+		{"AT&W", true},
+		{"ATD+886912345678;", true},
+		{"ATE0D112;", true},
+
+		// Commands whose queries look like writes.
+		{"AT+QCFG=\"band\"", false},
+		{"AT+QCFG=\"band\",0,1,1", true},
+		{"AT+CCFC=0,2", false},
+		{"AT+CCFC=0,3,\"+886912345678\"", true},
+		{"AT+CCFC=0,4", true},
+
+		{"AT+CSQ\r\nAT+CFUN=0", true},
+		{"AT+CMGS=\"+886912345678\"\rhi\x1a", true},
+	} {
+		if got := dangerousATCommand(tc.cmd) != ""; got != tc.dangerous {
+			t.Errorf("%q: expected dangerous=%v, got %q", tc.cmd, tc.dangerous, dangerousATCommand(tc.cmd))
+		}
+	}
+}
@@ -7,15 +7,32 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/pccr10001/smsie/internal/auth"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/pkg/logger"
 	"gorm.io/gorm"
 )
 
+// queryTokenRoutes are the streaming endpoints browsers open with
+// WebSocket or EventSource, which cannot set headers.
+var queryTokenRoutes = map[string]bool{
+	"/api/v1/events":           true,
+	"/api/v1/modems/:iccid/ws": true,
+}
+
 func AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
+	sessions := logic.NewSessionManager(db)
+	settings := logic.NewSettings(db)
 	return func(c *gin.Context) {
-		if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		// Only the short-lived session JWT is accepted in the URL, where it
+		// can end up in logs and browser history; API keys go in the header.
+		streaming := strings.EqualFold(c.GetHeader("Upgrade"), "websocket") || strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+		if c.Request.Method == http.MethodGet && streaming && queryTokenRoutes[c.FullPath()] && c.GetHeader("Authorization") == "" {
 			if token := strings.TrimSpace(c.Query("token")); token != "" {
+				if isSMSIEAPIKey(token) {
+					c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API keys must be sent in the Authorization header"})
+					return
+				}
 				c.Request.Header.Set("Authorization", "Bearer "+token)
 			}
 		}
@@ -72,6 +89,11 @@ func AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
 			return
 		}
 
+		if !sessions.Active(claims.SessionID, claims.UserID) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session expired or revoked"})
+			return
+		}
+
 		// Optionally fetch full user from DB if we need up-to-date fields like AllowedModems
 		var user model.User
 		if err := db.First(&user, claims.UserID).Error; err != nil {
@@ -82,8 +104,14 @@ func AuthMiddleware(db *gorm.DB) gin.HandlerFunc {
 		// Set user in context
 		c.Set("user", &user)
 		c.Set("userID", claims.UserID)
-		c.Set("role", claims.Role)
+		c.Set("role", user.Role)
 		c.Set("auth_type", "jwt")
+		c.Set("session_id", claims.SessionID)
+
+		if twoFactorEnrollmentRequired(settings, &user) && !twoFactorExempt(c) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication required", "code": "totp_enrollment_required"})
+			return
+		}
 
 		c.Next()
 	}
@@ -102,17 +130,25 @@ func AdminOnly() gin.HandlerFunc {
 
 func APIKeyAllowedOnly() gin.HandlerFunc {
 	allowed := map[string]bool{
-		"GET /api/v1/modems":                     true,
-		"GET /api/v1/modems/:iccid":              true,
-		"GET /api/v1/sms":                        true,
-		"POST /api/v1/modems/:iccid/send":        true,
-		"POST /api/v1/modems/:iccid/at":          true,
-		"POST /api/v1/modems/:iccid/input":       true,
-		"GET /api/v1/modems/:iccid/call/state":   true,
-		"POST /api/v1/modems/:iccid/call/dial":   true,
-		"POST /api/v1/modems/:iccid/call/hangup": true,
-		"POST /api/v1/modems/:iccid/call/dtmf":   true,
-		"GET /api/v1/modems/:iccid/ws":           true,
+		"GET /api/v1/modems":                      true,
+		"GET /api/v1/modems/:iccid":               true,
+		"GET /api/v1/sms":                         true,
+		"GET /api/v1/otp/wait":                    true,
+		"POST /api/v1/pools/:name/send":           true,
+		"POST /api/v1/modems/:iccid/send":         true,
+		"POST /api/v1/modems/:iccid/at":           true,
+		"POST /api/v1/modems/:iccid/input":        true,
+		"GET /api/v1/modems/:iccid/call/state":    true,
+		"POST /api/v1/modems/:iccid/call/dial":    true,
+		"POST /api/v1/modems/:iccid/call/hangup":  true,
+		"POST /api/v1/modems/:iccid/call/answer":  true,
+		"POST /api/v1/modems/:iccid/call/reject":  true,
+		"POST /api/v1/modems/:iccid/call/control": true,
+		"POST /api/v1/modems/:iccid/call/dtmf":    true,
+		"GET /api/v1/modems/:iccid/services":      true,
+		"GET /api/v1/modems/:iccid/ws":            true,
+		"GET /api/v1/events":                      true,
+		"GET /api/v1/apikeys/:id/usage":           true,
 	}
 
 	return func(c *gin.Context) {
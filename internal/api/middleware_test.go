@@ -0,0 +1,37 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+func TestAuthMiddlewareQueryToken(t *testing.T) {
+	if logger.Log == nil {
+		logger.InitLogger("error")
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	v1 := r.Group("/api/v1", AuthMiddleware(nil))
+	v1.GET("/events", func(c *gin.Context) { c.Status(http.StatusOK) })
+	v1.GET("/sms", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, tc := range []struct {
+		name, path, wantErr string
+	}{
+		{"api key on events", "/api/v1/events?token=smsie_abc", "API keys must be sent in the Authorization header"},
+		{"token on other route", "/api/v1/sms?token=eyJ", "Authorization header required"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), tc.wantErr) {
+			t.Fatalf("%s: got %d %s", tc.name, w.Code, w.Body.String())
+		}
+	}
+}
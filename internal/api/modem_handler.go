@@ -7,6 +7,7 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/pccr10001/smsie/internal/calling"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/internal/worker"
 	"gorm.io/gorm"
@@ -16,6 +17,7 @@ type ModemHandler struct {
 	db      *gorm.DB
 	wm      *worker.Manager
 	callMgr *calling.Manager
+	quota   *logic.SMSLimiter
 }
 
 type modemWithWorker struct {
@@ -29,10 +31,12 @@ type modemWithWorker struct {
 	SIPRegisterState     string    `json:"sip_register_state,omitempty"`
 	SIPRegisterReason    string    `json:"sip_register_reason,omitempty"`
 	SIPRegisterUpdatedAt time.Time `json:"sip_register_updated_at,omitempty"`
+
+	SupplementaryServices *worker.SupplementaryServices `json:"supplementary_services,omitempty"`
 }
 
 func NewModemHandler(db *gorm.DB, wm *worker.Manager, callMgr *calling.Manager) *ModemHandler {
-	return &ModemHandler{db: db, wm: wm, callMgr: callMgr}
+	return &ModemHandler{db: db, wm: wm, callMgr: callMgr, quota: logic.NewSMSLimiter(db)}
 }
 
 func (h *ModemHandler) sipModeEnabled() bool {
@@ -228,6 +232,10 @@ func (h *ModemHandler) GetModem(c *gin.Context) {
 	rt, hasRuntime := worker.RuntimeModemState{}, false
 	if w != nil {
 		rt, hasRuntime = w.RuntimeModemState()
+		// The detail shows the result once the query is done.
+		if hasRuntime && rt.Status == "online" {
+			w.RefreshSupplementaryServices()
+		}
 	}
 
 	var modem model.Modem
@@ -278,6 +286,13 @@ func (h *ModemHandler) modemWithWorkerState(modem model.Modem) modemWithWorker {
 		}
 	}
 
+	var services *worker.SupplementaryServices
+	if w != nil {
+		if ss, ok := w.SupplementaryServices(); ok {
+			services = &ss
+		}
+	}
+
 	return modemWithWorker{
 		Modem:                modem,
 		WorkerExists:         workerExists,
@@ -289,6 +304,8 @@ func (h *ModemHandler) modemWithWorkerState(modem model.Modem) modemWithWorker {
 		SIPRegisterState:     sipRegisterState,
 		SIPRegisterReason:    sipRegisterReason,
 		SIPRegisterUpdatedAt: sipRegisterUpdatedAt,
+
+		SupplementaryServices: services,
 	}
 }
 
@@ -307,6 +324,7 @@ func (h *ModemHandler) UpdateModem(c *gin.Context) {
 	iccid := c.Param("iccid")
 	var req struct {
 		Name              string `json:"name"`
+		PhoneNumber       string `json:"phone_number"`
 		SIPEnabled        bool   `json:"sip_enabled"`
 		SIPUsername       string `json:"sip_username"`
 		SIPPassword       string `json:"sip_password"`
@@ -346,6 +364,12 @@ func (h *ModemHandler) UpdateModem(c *gin.Context) {
 		return
 	}
 
+	phoneNumber := strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(req.PhoneNumber))
+	if phoneNumber != "" && !twilioNumberPattern.MatchString(phoneNumber) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "phone number must be digits with an optional leading +"})
+		return
+	}
+
 	if req.SIPListenPort > 0 {
 		var conflict int64
 		h.db.Model(&model.Modem{}).Where("iccid <> ? AND sip_listen_port = ?", iccid, req.SIPListenPort).Count(&conflict)
@@ -357,6 +381,7 @@ func (h *ModemHandler) UpdateModem(c *gin.Context) {
 
 	updates := map[string]interface{}{
 		"name":                req.Name,
+		"phone_number":        phoneNumber,
 		"sip_enabled":         req.SIPEnabled,
 		"sip_username":        strings.TrimSpace(req.SIPUsername),
 		"sip_proxy":           strings.TrimSpace(req.SIPProxy),
@@ -420,7 +445,17 @@ func (h *ModemHandler) DeleteModem(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	if err := tx.Where("iccid = ?", iccid).Delete(&model.Webhook{}).Error; err != nil {
+	if err := removeModemFromWebhooks(tx, iccid); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Where("iccid = ?", iccid).Delete(&model.WebhookDelivery{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Where("iccid = ?", iccid).Delete(&model.TelegramMessage{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -430,6 +465,16 @@ func (h *ModemHandler) DeleteModem(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if err := tx.Where("iccid = ?", iccid).Delete(&model.CallerRule{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Where("iccid = ? OR forward_iccid = ?", iccid, iccid).Delete(&model.SMSRule{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	if err := tx.Where("iccid = ?", iccid).Delete(&model.Modem{}).Error; err != nil {
 		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -624,8 +669,18 @@ func (h *ModemHandler) SendSMS(c *gin.Context) {
 		return
 	}
 
+	actor, _ := getActor(c)
+	subject := actorQuotaSubject(actor)
+	if err := h.quota.Reserve(subject, iccid); err != nil {
+		if !writeQuotaError(c, err) {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
 	err := w.SendSMS(req.Phone, req.Message)
 	if err != nil {
+		h.quota.Release(subject, iccid)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Send SMS failed: " + err.Error()})
 		return
 	}
@@ -639,11 +694,21 @@ func (h *ModemHandler) GetCallState(c *gin.Context) {
 		return
 	}
 
-	w := h.wm.GetWorkerByICCID(iccid)
-	if w == nil && !(h.callMgr != nil && h.callMgr.SIPEnabled() && h.callMgr.HasActiveSIPCall(iccid)) {
+	state, ok := h.callStateView(iccid)
+	if !ok {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
 		return
 	}
+	c.JSON(http.StatusOK, state)
+}
+
+// callStateView describes the modem and SIP call state of a modem. It
+// reports false when neither a worker nor an active SIP call exists.
+func (h *ModemHandler) callStateView(iccid string) (gin.H, bool) {
+	w := h.wm.GetWorkerByICCID(iccid)
+	if w == nil && !(h.callMgr != nil && h.callMgr.SIPEnabled() && h.callMgr.HasActiveSIPCall(iccid)) {
+		return nil, false
+	}
 
 	modemState := worker.CallState{}
 	uacReady := false
@@ -701,7 +766,7 @@ func (h *ModemHandler) GetCallState(c *gin.Context) {
 		updatedAt = sipUpdatedAt
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	return gin.H{
 		"state":                  state,
 		"reason":                 reason,
 		"updated_at":             updatedAt,
@@ -712,6 +777,8 @@ func (h *ModemHandler) GetCallState(c *gin.Context) {
 		"incoming":               modemState.Incoming,
 		"voice":                  modemState.Voice,
 		"incoming_ringing":       modemState.IncomingRinging,
+		"waiting":                modemState.Waiting,
+		"calls":                  modemState.Calls,
 		"uac_ready":              uacReady,
 		"uac_vid":                uacVID,
 		"uac_pid":                uacPID,
@@ -729,7 +796,7 @@ func (h *ModemHandler) GetCallState(c *gin.Context) {
 			"register_reason":     sipRegisterReason,
 			"register_updated_at": sipRegisterUpdatedAt,
 		},
-	})
+	}, true
 }
 
 func (h *ModemHandler) Dial(c *gin.Context) {
@@ -741,11 +808,21 @@ func (h *ModemHandler) Dial(c *gin.Context) {
 	var req struct {
 		Number string `json:"number"`
 		Via    string `json:"via"`
+		CLIR   string `json:"clir"` // per-call override: default, hide, show
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	clir, ok := worker.NormalizeCLIR(req.CLIR)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "clir must be default, hide or show"})
+		return
+	}
+	if clir != "" && normalizeCallVia(req.Via) == "sip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "clir is only supported for modem calls"})
+		return
+	}
 
 	w := h.wm.GetWorkerByICCID(iccid)
 	if h.callMgr == nil {
@@ -757,12 +834,25 @@ func (h *ModemHandler) Dial(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
 		return
 	}
+	via := normalizeCallVia(req.Via)
+	if w.IsRemote() {
+		// Audio stays on the agent's host; only call control is forwarded.
+		if via == "sip" {
+			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "sip calls are not available on agent modems"})
+			return
+		}
+		if err := w.Dial(req.Number, clir); err != nil {
+			writeDialError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
+		return
+	}
 	if !w.IsUACReady() {
 		c.JSON(http.StatusConflict, gin.H{"error": "UAC is not enabled on modem (QCFG USBCFG check failed)"})
 		return
 	}
 
-	via := normalizeCallVia(req.Via)
 	if via == "sip" {
 		if _, ok := h.sipAvailableForICCID(iccid); !ok {
 			c.JSON(http.StatusPreconditionFailed, gin.H{"error": "sip client not enabled"})
@@ -815,26 +905,30 @@ func (h *ModemHandler) Dial(c *gin.Context) {
 		return
 	}
 
-	err := w.Dial(req.Number)
+	err := w.Dial(req.Number, clir)
 	if err != nil {
 		if h.callMgr != nil {
 			_ = h.callMgr.CloseSession(iccid)
 		}
-		if worker.IsInvalidDialNumberError(err) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dial number"})
-			return
-		}
-		if worker.IsCallInProgressError(err) {
-			c.JSON(http.StatusConflict, gin.H{"error": "call already in progress"})
-			return
-		}
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Dial failed: " + err.Error()})
+		writeDialError(c, err)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
 }
 
+func writeDialError(c *gin.Context, err error) {
+	if worker.IsInvalidDialNumberError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid dial number"})
+		return
+	}
+	if worker.IsCallInProgressError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "call already in progress"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Dial failed: " + err.Error()})
+}
+
 func (h *ModemHandler) Hangup(c *gin.Context) {
 	iccid := c.Param("iccid")
 	if !enforceICCIDPermission(c, h.db, iccid, PermMakeCall) {
@@ -898,6 +992,135 @@ func (h *ModemHandler) Hangup(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
 }
 
+func (h *ModemHandler) Answer(c *gin.Context) {
+	iccid := c.Param("iccid")
+	if !enforceICCIDPermission(c, h.db, iccid, PermMakeCall) {
+		return
+	}
+
+	if h.callMgr == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "calling manager not initialized"})
+		return
+	}
+
+	w := h.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
+		return
+	}
+	if !w.IsUACReady() && !w.IsRemote() {
+		c.JSON(http.StatusConflict, gin.H{"error": "UAC is not enabled on modem (QCFG USBCFG check failed)"})
+		return
+	}
+	current := w.CallState()
+	if current.Waiting {
+		h.answerWaitingCall(c, w)
+		return
+	}
+	if w.IsRemote() {
+		if err := w.Answer(); err != nil {
+			writeAnswerError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
+		return
+	}
+	if !current.IncomingRinging {
+		c.JSON(http.StatusConflict, gin.H{"error": "no incoming call"})
+		return
+	}
+	if h.callMgr.HasActiveSIPCall(iccid) {
+		c.JSON(http.StatusConflict, gin.H{"error": "incoming call is being forwarded to sip"})
+		return
+	}
+
+	vid, pid := w.UACIdentity()
+	target := calling.ModemTarget{
+		PortName: w.PortName,
+		VID:      vid,
+		PID:      pid,
+	}
+	if !answerWithSession(c, h.callMgr, iccid, target, w.Answer) {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
+}
+
+// answerCallSessions is the part of calling.Manager Answer needs.
+type answerCallSessions interface {
+	EnsureSession(iccid string, target calling.ModemTarget) (*calling.Session, error)
+	EnsureAudio(iccid string) error
+	RequireConnected(iccid string) error
+	CloseSession(iccid string) error
+}
+
+// answerWithSession bridges the browser audio and answers the call. When the
+// session or audio cannot be set up or answering fails, the session is closed
+// again so the UAC device is not left open. The error is written to c.
+func answerWithSession(c *gin.Context, calls answerCallSessions, iccid string, target calling.ModemTarget, answer func() error) bool {
+	fail := func(msg string) bool {
+		_ = calls.CloseSession(iccid)
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": msg})
+		return false
+	}
+	if _, err := calls.EnsureSession(iccid, target); err != nil {
+		return fail("WebRTC session init failed: " + err.Error())
+	}
+	if err := calls.EnsureAudio(iccid); err != nil {
+		return fail("Audio init failed: " + err.Error())
+	}
+	// Like Dial, keep the session while the browser is still signaling so
+	// that it can retry once connected.
+	if err := calls.RequireConnected(iccid); err != nil {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "WebRTC not ready. Please complete signaling first."})
+		return false
+	}
+
+	if err := answer(); err != nil {
+		_ = calls.CloseSession(iccid)
+		writeAnswerError(c, err)
+		return false
+	}
+	return true
+}
+
+func writeAnswerError(c *gin.Context, err error) {
+	if worker.IsNoIncomingCallError(err) {
+		c.JSON(http.StatusConflict, gin.H{"error": "no incoming call"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Answer failed: " + err.Error()})
+}
+
+func (h *ModemHandler) Reject(c *gin.Context) {
+	iccid := c.Param("iccid")
+	if !enforceICCIDPermission(c, h.db, iccid, PermMakeCall) {
+		return
+	}
+
+	w := h.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
+		return
+	}
+
+	if err := w.Reject(); err != nil {
+		if worker.IsNoIncomingCallError(err) {
+			c.JSON(http.StatusConflict, gin.H{"error": "no incoming call"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Reject failed: " + err.Error()})
+		return
+	}
+	// Rejecting a waiting call leaves the established call and its audio up.
+	if h.callMgr != nil && w.CallState().State == "idle" {
+		_ = h.callMgr.CloseSession(iccid)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "call_mode": "modem", "call_state": w.CallState()})
+}
+
 func (h *ModemHandler) Reboot(c *gin.Context) {
 	actor, exists := getActor(c)
 	if !exists {
@@ -958,5 +1181,5 @@ func (h *ModemHandler) WS(c *gin.Context) {
 		PID:      pid,
 	}
 
-	handleModemWS(c, h.callMgr, iccid, target)
+	handleModemWS(c, h.callMgr, h.wm, iccid, target)
 }
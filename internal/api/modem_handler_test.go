@@ -0,0 +1,59 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/calling"
+)
+
+type fakeAnswerSessions struct {
+	sessionErr, audioErr, connectedErr error
+	closed                             int
+}
+
+func (f *fakeAnswerSessions) EnsureSession(string, calling.ModemTarget) (*calling.Session, error) {
+	return nil, f.sessionErr
+}
+func (f *fakeAnswerSessions) EnsureAudio(string) error      { return f.audioErr }
+func (f *fakeAnswerSessions) RequireConnected(string) error { return f.connectedErr }
+func (f *fakeAnswerSessions) CloseSession(string) error {
+	f.closed++
+	return nil
+}
+
+func TestAnswerWithSessionClosesOnFailure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	failed := errors.New("failed")
+	answered := func() error { return nil }
+
+	for name, tc := range map[string]struct {
+		calls  *fakeAnswerSessions
+		answer func() error
+		status int
+		closed int
+	}{
+		"session":   {&fakeAnswerSessions{sessionErr: failed}, answered, http.StatusPreconditionFailed, 1},
+		"audio":     {&fakeAnswerSessions{audioErr: failed}, answered, http.StatusPreconditionFailed, 1},
+		"signaling": {&fakeAnswerSessions{connectedErr: failed}, answered, http.StatusPreconditionFailed, 0},
+		"answer":    {&fakeAnswerSessions{}, func() error { return failed }, http.StatusInternalServerError, 1},
+	} {
+		rec := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(rec)
+		if answerWithSession(c, tc.calls, "8988", calling.ModemTarget{}, tc.answer) {
+			t.Fatalf("%s: expected the answer to fail", name)
+		}
+		if rec.Code != tc.status || tc.calls.closed != tc.closed {
+			t.Fatalf("%s: expected %d and %d closes, got %d and %d closes", name, tc.status, tc.closed, rec.Code, tc.calls.closed)
+		}
+	}
+
+	calls := &fakeAnswerSessions{}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	if !answerWithSession(c, calls, "8988", calling.ModemTarget{}, answered) || calls.closed != 0 {
+		t.Fatalf("expected the session to stay open after answering, got %d closes", calls.closed)
+	}
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/internal/worker"
+	"gorm.io/gorm"
+)
+
+type ModemPoolHandler struct {
+	db      *gorm.DB
+	wm      *worker.Manager
+	repo    *repository.ModemPoolRepository
+	limiter *logic.SMSLimiter
+}
+
+func NewModemPoolHandler(db *gorm.DB, wm *worker.Manager) *ModemPoolHandler {
+	return &ModemPoolHandler{db: db, wm: wm, repo: repository.NewModemPoolRepository(db), limiter: logic.NewSMSLimiter(db)}
+}
+
+type modemPoolRequest struct {
+	Name      *string                  `json:"name"`
+	Strategy  *string                  `json:"strategy"`
+	OnNet     *string                  `json:"on_net"`
+	MinSignal *int                     `json:"min_signal"`
+	Enabled   *bool                    `json:"enabled"`
+	Members   *[]model.ModemPoolMember `json:"members"`
+}
+
+func (req modemPoolRequest) apply(pool *model.ModemPool) {
+	if req.Name != nil {
+		pool.Name = *req.Name
+	}
+	if req.Strategy != nil {
+		pool.Strategy = *req.Strategy
+	}
+	if req.OnNet != nil {
+		pool.OnNet = *req.OnNet
+	}
+	if req.MinSignal != nil {
+		pool.MinSignal = *req.MinSignal
+	}
+	if req.Enabled != nil {
+		pool.Enabled = *req.Enabled
+	}
+	if req.Members != nil {
+		pool.Members = *req.Members
+	}
+}
+
+// actorSendFilter reports whether the actor may send from a modem, for
+// routing through pools.
+func actorSendFilter(db *gorm.DB, actor *authActor) func(iccid string) bool {
+	return func(iccid string) bool {
+		allowed, _, _ := actorCanAccessICCIDPermission(db, actor, iccid, PermSendSMS)
+		return allowed
+	}
+}
+
+// writePoolSendError maps routing and quota errors to status codes.
+func writePoolSendError(c *gin.Context, err error) {
+	if writeQuotaError(c, err) {
+		return
+	}
+	switch {
+	case errors.Is(err, worker.ErrPoolNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, worker.ErrNoPoolModem):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Send SMS failed: " + err.Error()})
+	}
+}
+
+func (h *ModemPoolHandler) ListPools(c *gin.Context) {
+	pools, err := h.repo.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pools)
+}
+
+func (h *ModemPoolHandler) CreatePool(c *gin.Context) {
+	var req modemPoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	pool := model.ModemPool{Enabled: true}
+	req.apply(&pool)
+	h.save(c, &pool)
+}
+
+func (h *ModemPoolHandler) UpdatePool(c *gin.Context) {
+	pool, err := h.repo.FindByName(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem pool not found"})
+		return
+	}
+
+	var req modemPoolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(pool)
+	h.save(c, pool)
+}
+
+func (h *ModemPoolHandler) save(c *gin.Context, pool *model.ModemPool) {
+	if err := logic.ValidateModemPool(pool); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if existing, err := h.repo.FindByName(pool.Name); err == nil && existing.ID != pool.ID {
+		c.JSON(http.StatusConflict, gin.H{"error": "A modem pool with this name already exists"})
+		return
+	}
+	if err := h.repo.Save(pool); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, pool)
+}
+
+func (h *ModemPoolHandler) DeletePool(c *gin.Context) {
+	pool, err := h.repo.FindByName(c.Param("name"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem pool not found"})
+		return
+	}
+	if err := h.repo.Delete(pool.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// SendSMS sends through the pool's modems the caller may send from and
+// reports the one that was used.
+func (h *ModemPoolHandler) SendSMS(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req struct {
+		Phone   string `json:"phone"`
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Phone) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Phone number is required"})
+		return
+	}
+	if req.Message == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message is required"})
+		return
+	}
+
+	sms, err := sendViaPool(h.db, h.wm, h.limiter, actor, c.Param("name"), strings.TrimSpace(req.Phone), req.Message)
+	if err != nil {
+		writePoolSendError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "message": "SMS sent successfully", "iccid": sms.ICCID, "sms": sms})
+}
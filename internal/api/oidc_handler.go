@@ -0,0 +1,318 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/auth"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"golang.org/x/oauth2"
+	"gorm.io/gorm"
+)
+
+const (
+	oidcStateCookie = "smsie_oidc_state"
+	oidcLoginTTL    = 10 * time.Minute
+	oidcCodeTTL     = time.Minute
+
+	// oidcNoPassword is stored as the password hash of single sign-on users;
+	// it never matches, so they cannot log in locally.
+	oidcNoPassword = "!oidc"
+)
+
+var errOIDCUsernameTaken = errors.New("the username belongs to another account")
+
+type oidcPendingLogin struct {
+	nonce    string
+	verifier string
+	expires  time.Time
+}
+
+// oidcIssuedCode carries either the session or, for a linked local user with
+// two-factor authentication on, the token for the second login step.
+type oidcIssuedCode struct {
+	tokens   *logic.SessionTokens
+	mfaToken string
+	user     model.User
+	expires  time.Time
+}
+
+// OIDCHandler signs users in through the configured OpenID Connect provider.
+// The callback hands the new session to the dashboard as a one-time code in
+// the URL, which the dashboard exchanges for its tokens.
+type OIDCHandler struct {
+	db       *gorm.DB
+	cfg      config.OIDCConfig
+	provider *auth.OIDCProvider
+	sessions *logic.SessionManager
+	audit    *logic.AuditLogger
+	users    *UserHandler
+
+	mu      sync.Mutex
+	pending map[string]oidcPendingLogin
+	codes   map[string]oidcIssuedCode
+}
+
+func NewOIDCHandler(db *gorm.DB, cfg config.OIDCConfig, users *UserHandler) *OIDCHandler {
+	return &OIDCHandler{
+		db:       db,
+		cfg:      cfg,
+		provider: auth.NewOIDCProvider(cfg),
+		sessions: logic.NewSessionManager(db),
+		audit:    logic.NewAuditLogger(db),
+		users:    users,
+		pending:  make(map[string]oidcPendingLogin),
+		codes:    make(map[string]oidcIssuedCode),
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Config tells the login page whether to offer single sign-on.
+func (h *OIDCHandler) Config(c *gin.Context) {
+	if h == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": true, "button_text": h.cfg.ButtonText})
+}
+
+// Login sends the browser to the provider.
+func (h *OIDCHandler) Login(c *gin.Context) {
+	state, nonce, verifier := randomHex(16), randomHex(16), oauth2.GenerateVerifier()
+	target, err := h.provider.AuthCodeURL(c.Request.Context(), state, nonce, verifier)
+	if err != nil {
+		logger.Log.Errorf("OIDC login: %v", err)
+		h.fail(c, "", http.StatusBadGateway, "Identity provider unavailable")
+		return
+	}
+
+	now := time.Now()
+	h.mu.Lock()
+	for k, p := range h.pending {
+		if now.After(p.expires) {
+			delete(h.pending, k)
+		}
+	}
+	h.pending[state] = oidcPendingLogin{nonce: nonce, verifier: verifier, expires: now.Add(oidcLoginTTL)}
+	h.mu.Unlock()
+
+	// The cookie ties the callback to this browser.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, int(oidcLoginTTL.Seconds()), "/api/v1/oidc", "", requestIsHTTPS(c.Request), true)
+	c.Redirect(http.StatusFound, target)
+}
+
+func requestIsHTTPS(r *http.Request) bool {
+	return r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// Callback completes the sign-in, provisions the user and redirects to the
+// dashboard with a one-time code.
+func (h *OIDCHandler) Callback(c *gin.Context) {
+	state := c.Query("state")
+	cookie, _ := c.Cookie(oidcStateCookie)
+	c.SetCookie(oidcStateCookie, "", -1, "/api/v1/oidc", "", requestIsHTTPS(c.Request), true)
+
+	h.mu.Lock()
+	pending, ok := h.pending[state]
+	delete(h.pending, state)
+	h.mu.Unlock()
+
+	if errCode := c.Query("error"); errCode != "" {
+		msg := errCode
+		if desc := c.Query("error_description"); desc != "" {
+			msg += ": " + desc
+		}
+		h.fail(c, "", http.StatusUnauthorized, "Identity provider refused the login: "+msg)
+		return
+	}
+	if state == "" || cookie != state || !ok || time.Now().After(pending.expires) {
+		h.fail(c, "", http.StatusBadRequest, "Login expired or was started in another browser, please try again")
+		return
+	}
+
+	identity, err := h.provider.Exchange(c.Request.Context(), c.Query("code"), pending.nonce, pending.verifier)
+	if err != nil {
+		logger.Log.Warnf("OIDC callback: %v", err)
+		h.fail(c, "", http.StatusUnauthorized, "Single sign-on failed")
+		return
+	}
+	if !logic.OIDCGroupAllowed(h.cfg.AllowedGroups, identity.Groups) {
+		h.fail(c, identity.Username, http.StatusForbidden, "Not a member of a group allowed to use smsie")
+		return
+	}
+
+	user, err := h.provision(identity)
+	if errors.Is(err, errOIDCUsernameTaken) {
+		h.fail(c, identity.Username, http.StatusConflict, "Cannot sign in as "+identity.Username+": "+err.Error())
+		return
+	}
+	if err != nil {
+		logger.Log.Errorf("OIDC provisioning of %s: %v", identity.Username, err)
+		h.fail(c, identity.Username, http.StatusInternalServerError, "Failed to set up the user")
+		return
+	}
+	// A linked local user keeps their second factor, which the identity
+	// provider knows nothing about.
+	issued := oidcIssuedCode{user: *user}
+	if user.TOTPEnabled {
+		issued.mfaToken = h.users.startMFAChallenge(user.ID)
+	} else {
+		tokens, err := h.sessions.Create(user, c.ClientIP(), c.Request.UserAgent())
+		if err != nil {
+			h.fail(c, identity.Username, http.StatusInternalServerError, "Failed to generate token")
+			return
+		}
+		issued.tokens = tokens
+	}
+
+	code := randomHex(24)
+	now := time.Now()
+	h.mu.Lock()
+	for k, issued := range h.codes {
+		if now.After(issued.expires) {
+			delete(h.codes, k)
+		}
+	}
+	issued.expires = now.Add(oidcCodeTTL)
+	h.codes[code] = issued
+	h.mu.Unlock()
+
+	h.audit.Log(&model.AuditLog{
+		UserID:   user.ID,
+		Username: user.Username,
+		AuthType: "oidc",
+		IP:       c.ClientIP(),
+		Action:   "auth.oidc_login",
+		Params:   logic.AuditParams(map[string]interface{}{"subject": identity.Subject, "groups": identity.Groups, "mfa_required": user.TOTPEnabled}),
+		Status:   http.StatusOK,
+	})
+	c.Redirect(http.StatusFound, "/?oidc_code="+url.QueryEscape(code))
+}
+
+// fail records the failed login and sends the browser back to the login page
+// with the reason.
+func (h *OIDCHandler) fail(c *gin.Context, username string, status int, msg string) {
+	h.audit.Log(&model.AuditLog{
+		Username: username,
+		AuthType: "oidc",
+		IP:       c.ClientIP(),
+		Action:   "auth.oidc_login",
+		Status:   status,
+		Error:    msg,
+	})
+	c.Redirect(http.StatusFound, "/?oidc_error="+url.QueryEscape(msg))
+}
+
+// Exchange trades the one-time code from the callback for the session's
+// tokens, in the same shape as a local login.
+func (h *OIDCHandler) Exchange(c *gin.Context) {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.mu.Lock()
+	issued, ok := h.codes[req.Code]
+	delete(h.codes, req.Code)
+	h.mu.Unlock()
+	if !ok || time.Now().After(issued.expires) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+	if issued.mfaToken != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    issued.mfaToken,
+			"methods":      []string{"totp", "recovery_code"},
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         issued.tokens.AccessToken,
+		"refresh_token": issued.tokens.RefreshToken,
+		"expires_in":    issued.tokens.ExpiresIn,
+		"token_type":    issued.tokens.TokenType,
+		"user":          issued.user,
+	})
+}
+
+// provision finds or creates the user of an identity and, when group
+// mappings are configured, sets their role and modems from the groups on
+// every login.
+// canLink reports whether a first login may take over the local user of the
+// same name. Only names from the username claim count, never the e-mail or
+// subject fallbacks, and admins only when configured.
+func (h *OIDCHandler) canLink(identity *auth.OIDCIdentity, user *model.User) bool {
+	return h.cfg.LinkLocalUsers && identity.UsernameClaimed && user.OIDCSubject == "" &&
+		(user.Role != "admin" || h.cfg.LinkAdmins)
+}
+
+func (h *OIDCHandler) provision(identity *auth.OIDCIdentity) (*model.User, error) {
+	var user model.User
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_subject = ?", identity.Subject).First(&user).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			err = tx.Where("username = ?", identity.Username).First(&user).Error
+			switch {
+			case err == nil && h.canLink(identity, &user):
+				user.OIDCSubject = identity.Subject
+				err = tx.Save(&user).Error
+			case err == nil:
+				return errOIDCUsernameTaken
+			case errors.Is(err, gorm.ErrRecordNotFound):
+				user = model.User{Username: identity.Username, PasswordHash: oidcNoPassword, Role: "user", OIDCSubject: identity.Subject}
+				err = tx.Create(&user).Error
+				if err == nil {
+					logger.Log.Infof("Created single sign-on user %s", user.Username)
+				}
+			}
+		}
+		if err != nil || len(h.cfg.GroupMappings) == 0 {
+			return err
+		}
+
+		var known []string
+		if err := tx.Model(&model.Modem{}).Order("iccid asc").Pluck("iccid", &known).Error; err != nil {
+			return err
+		}
+		grant := logic.MapOIDCGroups(h.cfg.GroupMappings, identity.Groups, known)
+		user.Role, user.AllowedModems = grant.Role, grant.AllowedModems
+		if err := tx.Save(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&model.UserModemPermission{}).Error; err != nil {
+			return err
+		}
+		for _, rule := range grant.Permissions {
+			rule.UserID = user.ID
+			if err := tx.Create(&rule).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
@@ -0,0 +1,215 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultOTPWaitTimeoutSec = 60
+	maxOTPWaitTimeoutSec     = 300
+	maxOTPWaitMaxAgeSec      = 3600
+)
+
+type OTPHandler struct {
+	db *gorm.DB
+	wm *worker.Manager
+}
+
+func NewOTPHandler(db *gorm.DB, wm *worker.Manager) *OTPHandler {
+	return &OTPHandler{db: db, wm: wm}
+}
+
+// otpWaitFilter selects the code wait_otp returns. Without AfterID only
+// codes received after the call starts, or within MaxAge before it, match.
+type otpWaitFilter struct {
+	ICCID   string
+	Sender  string // substring of the sender number or ID
+	Service string // substring of the guessed service, case-insensitive
+	AfterID *int
+	MaxAge  time.Duration
+	Timeout time.Duration
+}
+
+type otpResult struct {
+	Code       string    `json:"code"`
+	Service    string    `json:"service,omitempty"`
+	Sender     string    `json:"sender"`
+	Confidence float64   `json:"confidence"`
+	SMSID      uint      `json:"sms_id"`
+	ICCID      string    `json:"iccid"`
+	Content    string    `json:"content"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// waitOTP returns the oldest matching code, waiting for new SMS until the
+// timeout. It returns nil without error on timeout.
+func waitOTP(ctx context.Context, db *gorm.DB, wm *worker.Manager, actor *authActor, f otpWaitFilter) (*otpResult, error) {
+	if actor.APIKey != nil && !actor.APIKey.CanViewSMS {
+		return nil, errors.New("API key permission denied")
+	}
+	query := func() (*gorm.DB, error) {
+		q, err := scopedSMSQuery(db, actor, f.ICCID, "received")
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where("otp <> ''")
+		if f.Sender != "" {
+			q = q.Where("phone LIKE ?", "%"+f.Sender+"%")
+		}
+		if f.Service != "" {
+			q = q.Where("LOWER(otp_service) LIKE ?", "%"+strings.ToLower(f.Service)+"%")
+		}
+		return q, nil
+	}
+
+	// Subscribe before taking the starting point so no SMS is missed.
+	_, events, cancel := wm.Events().Subscribe(0)
+	defer cancel()
+
+	afterID := 0
+	var since time.Time
+	switch {
+	case f.AfterID != nil:
+		afterID = *f.AfterID
+	case f.MaxAge > 0:
+		since = time.Now().Add(-f.MaxAge)
+	default:
+		var latest model.SMS
+		if err := db.Model(&model.SMS{}).Order("id desc").Limit(1).Take(&latest).Error; err != nil && err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+		afterID = int(latest.ID)
+	}
+
+	deadline := time.NewTimer(f.Timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		q, err := query()
+		if err != nil {
+			return nil, err
+		}
+		q = q.Where("id > ?", afterID)
+		if !since.IsZero() {
+			q = q.Where("created_at >= ?", since)
+		}
+		var msg model.SMS
+		err = q.Order("id asc").Limit(1).Take(&msg).Error
+		if err == nil {
+			return &otpResult{
+				Code:       msg.OTP,
+				Service:    msg.OTPService,
+				Sender:     msg.Phone,
+				Confidence: msg.OTPConfidence,
+				SMSID:      msg.ID,
+				ICCID:      msg.ICCID,
+				Content:    msg.Content,
+				ReceivedAt: msg.Timestamp,
+			}, nil
+		}
+		if err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-deadline.C:
+				return nil, nil
+			case e, ok := <-events:
+				if !ok {
+					events = nil // dropped for falling behind, keep polling
+					break wait
+				}
+				if e.Type == logic.EventSMSReceived {
+					break wait
+				}
+			case <-ticker.C:
+				break wait
+			}
+		}
+	}
+}
+
+// WaitOTP blocks until a one-time code matching the filters arrives.
+// Query: iccid, sender, service, after_id, max_age (seconds of already
+// received codes to accept), timeout (seconds). format=text returns only the
+// code as plain text.
+func (h *OTPHandler) WaitOTP(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if actor.APIKey != nil && !actor.APIKey.CanViewSMS {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key permission denied"})
+		return
+	}
+
+	f := otpWaitFilter{
+		ICCID:   strings.TrimSpace(c.Query("iccid")),
+		Sender:  strings.TrimSpace(c.Query("sender")),
+		Service: strings.TrimSpace(c.Query("service")),
+		Timeout: defaultOTPWaitTimeoutSec * time.Second,
+	}
+	if f.ICCID != "" && !enforceICCIDPermission(c, h.db, f.ICCID, PermViewSMS) {
+		return
+	}
+	if v := c.Query("after_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "after_id must be a non-negative integer"})
+			return
+		}
+		f.AfterID = &id
+	}
+	if v := c.Query("max_age"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 0 || sec > maxOTPWaitMaxAgeSec {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "max_age must be 0-3600 seconds"})
+			return
+		}
+		f.MaxAge = time.Duration(sec) * time.Second
+	}
+	if v := c.Query("timeout"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec < 1 || sec > maxOTPWaitTimeoutSec {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "timeout must be 1-300 seconds"})
+			return
+		}
+		f.Timeout = time.Duration(sec) * time.Second
+	}
+
+	res, err := waitOTP(c.Request.Context(), h.db, h.wm, actor, f)
+	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if res == nil {
+		c.JSON(http.StatusRequestTimeout, gin.H{"error": "No OTP received before timeout"})
+		return
+	}
+	if c.Query("format") == "text" {
+		c.String(http.StatusOK, res.Code)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
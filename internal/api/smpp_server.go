@@ -0,0 +1,772 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/smpp"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	smppSystemID         = "smsie"
+	smppSubmitQueueSize  = 100
+	smppDeliverQueueSize = 256
+	smppDeliverAttempts  = 3
+	smppRetryDelay       = 10 * time.Second
+	smppConcatTimeout    = 5 * time.Minute
+)
+
+var (
+	smppDestPattern = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+
+	errSMPPClosed  = errors.New("smpp session closed")
+	errSMPPTimeout = errors.New("smpp response timeout")
+)
+
+// SMPPServer lets SMPP 3.4 clients use smsie as an SMSC. Sessions bind with
+// an API key as password and act with that key's modem permissions.
+type SMPPServer struct {
+	db    *gorm.DB
+	wm    *worker.Manager
+	cfg   config.SMPPConfig
+	ln    net.Listener
+	quota *logic.SMSLimiter
+
+	mu       sync.Mutex
+	sessions map[*smppSession]struct{}
+}
+
+func NewSMPPServer(db *gorm.DB, wm *worker.Manager, cfg config.SMPPConfig) *SMPPServer {
+	return &SMPPServer{db: db, wm: wm, cfg: cfg, quota: logic.NewSMSLimiter(db), sessions: map[*smppSession]struct{}{}}
+}
+
+// Listen opens the listening socket, so a port conflict fails at startup.
+func (s *SMPPServer) Listen() error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	logger.Log.Infof("SMPP server listening on %s", ln.Addr())
+	return nil
+}
+
+// Run accepts sessions and delivers received SMS to them until stop is
+// closed.
+func (s *SMPPServer) Run(stop <-chan struct{}) {
+	go s.forwardSMS(stop)
+	go func() {
+		<-stop
+		_ = s.ln.Close()
+		s.mu.Lock()
+		for sess := range s.sessions {
+			go sess.close()
+		}
+		s.mu.Unlock()
+	}()
+
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logger.Log.Warnf("SMPP accept failed: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		sess := newSMPPSession(s, conn)
+		s.mu.Lock()
+		s.sessions[sess] = struct{}{}
+		s.mu.Unlock()
+		go sess.serve()
+	}
+}
+
+func (s *SMPPServer) snapshot() []*smppSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]*smppSession, 0, len(s.sessions))
+	for sess := range s.sessions {
+		out = append(out, sess)
+	}
+	return out
+}
+
+func (s *SMPPServer) removeSession(sess *smppSession) {
+	s.mu.Lock()
+	delete(s.sessions, sess)
+	s.mu.Unlock()
+}
+
+// forwardSMS sends every received SMS as deliver_sm to the receiver sessions
+// allowed to view it. After falling behind it resumes from the hub backlog.
+func (s *SMPPServer) forwardSMS(stop <-chan struct{}) {
+	var lastID uint64
+	for {
+		backlog, events, cancel := s.wm.Events().Subscribe(lastID)
+		for _, e := range backlog {
+			lastID = e.ID
+			s.forwardEvent(e)
+		}
+		for open := true; open; {
+			select {
+			case <-stop:
+				cancel()
+				return
+			case e, ok := <-events:
+				if !ok {
+					open = false
+					break
+				}
+				lastID = e.ID
+				s.forwardEvent(e)
+			}
+		}
+		cancel()
+	}
+}
+
+func (s *SMPPServer) forwardEvent(e logic.Event) {
+	if e.Type != logic.EventSMSReceived {
+		return
+	}
+	sms, ok := e.Data.(model.SMS)
+	if !ok {
+		return
+	}
+	for _, sess := range s.snapshot() {
+		actor, mode, systemID := sess.state()
+		if actor == nil || mode == smpp.BindTransmitter {
+			continue
+		}
+		if mapped := s.systemICCID(systemID); mapped != "" && mapped != sms.ICCID {
+			continue
+		}
+		if allowed, _, _ := actorCanAccessICCIDPermission(s.db, actor, sms.ICCID, PermViewSMS); !allowed {
+			continue
+		}
+		sess.enqueueDeliver(smppDeliverFromSMS(sms))
+	}
+}
+
+// sendReceipt delivers a receipt on the submitting session, or on another
+// receiver session of the same API key when it was bound as transmitter.
+func (s *SMPPServer) sendReceipt(from *smppSession, sm smpp.ShortMessage) {
+	fromActor, fromMode, _ := from.state()
+	if fromMode != smpp.BindTransmitter && !from.isClosed() {
+		from.enqueueDeliver(sm)
+		return
+	}
+	for _, sess := range s.snapshot() {
+		actor, mode, _ := sess.state()
+		if actor == nil || mode == smpp.BindTransmitter || actor.APIKey.ID != fromActor.APIKey.ID {
+			continue
+		}
+		sess.enqueueDeliver(sm)
+		return
+	}
+	logger.Log.Debugf("SMPP receipt for %s dropped: no receiver bound", sm.DestAddr)
+}
+
+func (s *SMPPServer) systemICCID(systemID string) string {
+	return strings.TrimSpace(s.cfg.SystemIDs[strings.ToLower(systemID)])
+}
+
+func (s *SMPPServer) responseTimeout() time.Duration {
+	return time.Duration(s.cfg.ResponseTimeoutSec) * time.Second
+}
+
+func smppDeliverFromSMS(sms model.SMS) smpp.ShortMessage {
+	coding, text := smpp.EncodeText(sms.Content)
+	sm := smpp.ShortMessage{
+		SourceAddr: sms.Phone,
+		DestAddr:   sms.ICCID,
+		DataCoding: coding,
+		Message:    text,
+	}
+	switch {
+	case strings.HasPrefix(sms.Phone, "+"):
+		sm.SourceTON, sm.SourceNPI, sm.SourceAddr = 1, 1, sms.Phone[1:]
+	case strings.IndexFunc(sms.Phone, unicode.IsLetter) >= 0:
+		sm.SourceTON = 5 // alphanumeric
+	}
+	return sm
+}
+
+func newSMPPMessageID() string {
+	buf := make([]byte, 8)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+type smppSubmission struct {
+	ids       []string
+	iccid     string
+	dest      string
+	text      string
+	orig      smpp.ShortMessage
+	submitted time.Time
+}
+
+type smppOutbound struct {
+	sm       smpp.ShortMessage
+	attempts int
+}
+
+type smppConcatKey struct {
+	src, dest string
+	ref       uint16
+	total     byte
+}
+
+type smppConcat struct {
+	sub   *smppSubmission
+	parts [][]byte
+	got   int
+}
+
+type smppSession struct {
+	srv    *SMPPServer
+	conn   net.Conn
+	remote string
+
+	writeMu  sync.Mutex
+	seq      atomic.Uint32
+	lastRead atomic.Int64
+
+	mu       sync.Mutex
+	mode     uint32 // bind command, 0 until bound
+	systemID string
+	actor    *authActor
+	pending  map[uint32]chan *smpp.PDU
+
+	concat  map[smppConcatKey]*smppConcat // only used by the read loop
+	submits chan *smppSubmission          // only sent to by the read loop
+	outbox  chan *smppOutbound
+	window  chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSMPPSession(srv *SMPPServer, conn net.Conn) *smppSession {
+	return &smppSession{
+		srv:     srv,
+		conn:    conn,
+		remote:  conn.RemoteAddr().String(),
+		pending: map[uint32]chan *smpp.PDU{},
+		concat:  map[smppConcatKey]*smppConcat{},
+		submits: make(chan *smppSubmission, smppSubmitQueueSize),
+		outbox:  make(chan *smppOutbound, smppDeliverQueueSize),
+		window:  make(chan struct{}, srv.cfg.WindowSize),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *smppSession) state() (*authActor, uint32, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.actor, s.mode, s.systemID
+}
+
+func (s *smppSession) isClosed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *smppSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		_ = s.conn.Close()
+		s.srv.removeSession(s)
+		if _, _, systemID := s.state(); systemID != "" {
+			logger.Log.Infof("SMPP session %s (%s) closed", systemID, s.remote)
+		}
+	})
+}
+
+func (s *smppSession) serve() {
+	defer s.close()
+	// Accepted messages are still sent after the client unbinds.
+	defer close(s.submits)
+	_ = s.conn.SetReadDeadline(time.Now().Add(s.srv.responseTimeout()))
+
+	for {
+		p, err := smpp.ReadPDU(s.conn)
+		if err != nil {
+			if !s.isClosed() {
+				logger.Log.Debugf("SMPP session %s read failed: %v", s.remote, err)
+			}
+			return
+		}
+		s.lastRead.Store(time.Now().UnixNano())
+		if p.IsResponse() {
+			s.handleResponse(p)
+			continue
+		}
+		if !s.handleRequest(p) {
+			return
+		}
+	}
+}
+
+// handleRequest answers one request; it returns false once the session
+// should end.
+func (s *smppSession) handleRequest(p *smpp.PDU) bool {
+	_, mode, _ := s.state()
+	switch p.CommandID {
+	case smpp.BindTransmitter, smpp.BindReceiver, smpp.BindTransceiver:
+		return s.handleBind(p)
+	case smpp.EnquireLink:
+		s.respond(p, smpp.EnquireLinkResp, smpp.StatusOK, nil)
+	case smpp.Unbind:
+		s.respond(p, smpp.UnbindResp, smpp.StatusOK, nil)
+		return false
+	case smpp.SubmitSM:
+		if mode != smpp.BindTransmitter && mode != smpp.BindTransceiver {
+			s.respond(p, smpp.SubmitSMResp, smpp.StatusInvBndSts, smpp.MessageIDBody(""))
+			return true
+		}
+		s.handleSubmit(p)
+	default:
+		status := smpp.StatusInvCmdID
+		if mode == 0 {
+			status = smpp.StatusInvBndSts
+		}
+		s.respond(p, smpp.GenericNack, status, nil)
+	}
+	return true
+}
+
+func (s *smppSession) handleBind(p *smpp.PDU) bool {
+	respID := p.CommandID | smpp.GenericNack
+	if _, mode, _ := s.state(); mode != 0 {
+		s.respond(p, respID, smpp.StatusAlyBnd, smpp.BindRespBody(smppSystemID))
+		return true
+	}
+	bind, err := smpp.ParseBind(p.Body)
+	if err != nil {
+		s.respond(p, respID, smpp.StatusBindFail, smpp.BindRespBody(smppSystemID))
+		return false
+	}
+	actor, err := authenticateAPIKey(s.srv.db, bind.Password)
+	if err != nil {
+		logger.Log.Warnf("SMPP bind %q from %s rejected: %v", bind.SystemID, s.remote, err)
+		s.respond(p, respID, smpp.StatusInvPaswd, smpp.BindRespBody(smppSystemID))
+		return false
+	}
+	if iccid := s.srv.systemICCID(bind.SystemID); iccid != "" {
+		if allowed, _, message := actorCanAccessICCIDPermission(s.srv.db, actor, iccid, ""); !allowed {
+			logger.Log.Warnf("SMPP bind %q from %s rejected: %s", bind.SystemID, s.remote, message)
+			s.respond(p, respID, smpp.StatusInvSysID, smpp.BindRespBody(smppSystemID))
+			return false
+		}
+	}
+
+	s.mu.Lock()
+	s.mode, s.systemID, s.actor = p.CommandID, bind.SystemID, actor
+	s.mu.Unlock()
+	_ = s.conn.SetReadDeadline(time.Time{})
+	s.respond(p, respID, smpp.StatusOK, smpp.BindRespBody(smppSystemID))
+	logger.Log.Infof("SMPP session %s (%s) bound with API key %d", bind.SystemID, s.remote, actor.APIKey.ID)
+
+	go s.sendLoop()
+	go s.deliverLoop()
+	go s.keepalive()
+	return true
+}
+
+func (s *smppSession) handleSubmit(p *smpp.PDU) {
+	reject := func(status uint32) {
+		s.respond(p, smpp.SubmitSMResp, status, smpp.MessageIDBody(""))
+	}
+	sm, err := smpp.ParseShortMessage(p.Body)
+	if err != nil {
+		reject(smpp.StatusInvCmdLen)
+		return
+	}
+	if sm.ScheduleDeliveryTime != "" {
+		reject(smpp.StatusInvSched)
+		return
+	}
+	dest := strings.TrimSpace(sm.DestAddr)
+	if sm.DestTON == 1 && !strings.HasPrefix(dest, "+") {
+		dest = "+" + dest
+	}
+	if !smppDestPattern.MatchString(dest) {
+		reject(smpp.StatusInvDstAdr)
+		return
+	}
+	seg, payload, isSegment, err := sm.SplitSegment()
+	if err != nil {
+		reject(smpp.StatusSubmitFail)
+		return
+	}
+	// Segments are decoded once complete, a UCS2 character may be split.
+	text := ""
+	if isSegment {
+		_, err = smpp.DecodeText(sm.DataCoding, nil)
+	} else {
+		text, err = smpp.DecodeText(sm.DataCoding, payload)
+	}
+	if err != nil {
+		reject(smpp.StatusSubmitFail)
+		return
+	}
+	iccid, status := s.route(&sm, dest)
+	if status != smpp.StatusOK {
+		reject(status)
+		return
+	}
+	// Only the read loop sends to submits, so a free slot stays free.
+	if len(s.submits) == cap(s.submits) {
+		reject(smpp.StatusThrottled)
+		return
+	}
+	// A concatenated message counts once, on its first segment.
+	if !isSegment || seg.Seq == 1 {
+		actor, _, _ := s.state()
+		if err := s.srv.quota.Reserve(actorQuotaSubject(actor), iccid); err != nil {
+			logger.Log.Infof("SMPP session %s: submit to %s rejected: %v", s.remote, dest, err)
+			if _, ok := logic.AsQuotaExceeded(err); ok {
+				reject(smpp.StatusThrottled)
+			} else {
+				reject(smpp.StatusSysErr)
+			}
+			return
+		}
+	}
+
+	id := newSMPPMessageID()
+	s.respond(p, smpp.SubmitSMResp, smpp.StatusOK, smpp.MessageIDBody(id))
+
+	sub := &smppSubmission{ids: []string{id}, iccid: iccid, dest: dest, text: text, orig: sm, submitted: time.Now()}
+	if isSegment {
+		sub = s.addSegment(smppConcatKey{src: sm.SourceAddr, dest: dest, ref: seg.Ref, total: seg.Total}, seg, payload, sub)
+		if sub == nil {
+			return
+		}
+	}
+	s.submits <- sub
+}
+
+// addSegment collects one part of a concatenated message and returns the
+// whole message once every part arrived. Messages that stay incomplete for
+// smppConcatTimeout fail.
+func (s *smppSession) addSegment(key smppConcatKey, seg smpp.Segment, payload []byte, part *smppSubmission) *smppSubmission {
+	for k, c := range s.concat {
+		if time.Since(c.sub.submitted) > smppConcatTimeout {
+			delete(s.concat, k)
+			s.finish(c.sub, errors.New("incomplete concatenated message"))
+		}
+	}
+
+	c, ok := s.concat[key]
+	if !ok {
+		c = &smppConcat{sub: part, parts: make([][]byte, seg.Total)}
+		s.concat[key] = c
+	} else {
+		c.sub.ids = append(c.sub.ids, part.ids...)
+	}
+	if c.parts[seg.Seq-1] == nil {
+		c.got++
+	}
+	c.parts[seg.Seq-1] = payload
+	if c.got < len(c.parts) {
+		return nil
+	}
+
+	delete(s.concat, key)
+	var all []byte
+	for _, p := range c.parts {
+		all = append(all, p...)
+	}
+	text, err := smpp.DecodeText(c.sub.orig.DataCoding, all)
+	if err != nil {
+		s.finish(c.sub, err)
+		return nil
+	}
+	c.sub.text = text
+	return c.sub
+}
+
+// route picks the modem for a submit_sm: a source_addr naming a modem by
+// ICCID or name, the system_id mapping, the longest matching route prefix,
+// then the first online modem the key may send from.
+func (s *smppSession) route(sm *smpp.ShortMessage, dest string) (string, uint32) {
+	actor, _, systemID := s.state()
+	usable := func(iccid string) bool {
+		if allowed, _, _ := actorCanAccessICCIDPermission(s.srv.db, actor, iccid, PermSendSMS); !allowed {
+			return false
+		}
+		return s.srv.wm.GetWorkerByICCID(iccid) != nil
+	}
+
+	if src := strings.TrimSpace(sm.SourceAddr); src != "" {
+		var modem model.Modem
+		err := s.srv.db.Where("iccid = ? OR (name <> '' AND LOWER(name) = ?)", src, strings.ToLower(src)).First(&modem).Error
+		if err == nil {
+			if !usable(modem.ICCID) {
+				return "", smpp.StatusInvSrcAdr
+			}
+			return modem.ICCID, smpp.StatusOK
+		}
+	}
+
+	if iccid := s.srv.systemICCID(systemID); iccid != "" {
+		if !usable(iccid) {
+			return "", smpp.StatusSubmitFail
+		}
+		return iccid, smpp.StatusOK
+	}
+
+	number := strings.TrimPrefix(dest, "+")
+	var routes []config.SMPPRoute
+	for _, r := range s.srv.cfg.Routes {
+		if prefix := strings.TrimPrefix(strings.TrimSpace(r.Prefix), "+"); strings.HasPrefix(number, prefix) {
+			routes = append(routes, r)
+		}
+	}
+	if len(routes) > 0 {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(strings.TrimPrefix(routes[i].Prefix, "+")) > len(strings.TrimPrefix(routes[j].Prefix, "+"))
+		})
+		for _, r := range routes {
+			if usable(r.ICCID) {
+				return r.ICCID, smpp.StatusOK
+			}
+		}
+		return "", smpp.StatusSubmitFail
+	}
+
+	var iccids []string
+	if err := s.srv.db.Model(&model.Modem{}).Order("iccid asc").Pluck("iccid", &iccids).Error; err != nil {
+		return "", smpp.StatusSysErr
+	}
+	for _, iccid := range iccids {
+		if usable(iccid) {
+			return iccid, smpp.StatusOK
+		}
+	}
+	return "", smpp.StatusSubmitFail
+}
+
+func (s *smppSession) sendLoop() {
+	for sub := range s.submits {
+		err := s.srv.wm.SendSMSFrom(sub.iccid, sub.dest, sub.text)
+		if err != nil {
+			logger.Log.Warnf("SMPP submit %s to %s via %s failed: %v", sub.ids[0], sub.dest, sub.iccid, err)
+			if actor, _, _ := s.state(); actor != nil {
+				s.srv.quota.Release(actorQuotaSubject(actor), sub.iccid)
+			}
+		}
+		s.finish(sub, err)
+	}
+}
+
+// finish sends the delivery receipts registered_delivery asked for. The
+// modem only reports whether the network accepted the message, so success
+// is reported as ACCEPTD rather than DELIVRD.
+func (s *smppSession) finish(sub *smppSubmission, sendErr error) {
+	want := sub.orig.RegisteredDelivery & 0x03
+	if want == 0 || (want == 2 && sendErr == nil) {
+		return
+	}
+	r := smpp.Receipt{Stat: "ACCEPTD", State: smpp.StateAccepted, Submitted: sub.submitted, Done: time.Now(), Text: sub.text}
+	if sendErr != nil {
+		r.Stat, r.State, r.Err = "UNDELIV", smpp.StateUndeliverable, 1
+	}
+	for _, id := range sub.ids {
+		r.MessageID = id
+		s.srv.sendReceipt(s, r.ShortMessage(&sub.orig))
+	}
+}
+
+func (s *smppSession) enqueueDeliver(sm smpp.ShortMessage) {
+	s.enqueue(&smppOutbound{sm: sm})
+}
+
+func (s *smppSession) enqueue(out *smppOutbound) {
+	select {
+	case s.outbox <- out:
+	default:
+		logger.Log.Warnf("SMPP session %s queue full, dropping deliver_sm to %s", s.remote, out.sm.DestAddr)
+	}
+}
+
+// deliverLoop sends queued deliver_sm with at most WindowSize waiting for a
+// response.
+func (s *smppSession) deliverLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case out := <-s.outbox:
+			select {
+			case s.window <- struct{}{}:
+			case <-s.done:
+				return
+			}
+			go s.deliver(out)
+		}
+	}
+}
+
+func (s *smppSession) deliver(out *smppOutbound) {
+	resp, err := s.request(smpp.DeliverSM, out.sm.Body())
+	<-s.window
+	if err == nil && resp.Status == smpp.StatusOK {
+		return
+	}
+	if errors.Is(err, errSMPPClosed) {
+		return
+	}
+	if err == nil {
+		err = fmt.Errorf("status 0x%08X", resp.Status)
+	}
+	out.attempts++
+	if out.attempts >= smppDeliverAttempts {
+		logger.Log.Warnf("SMPP session %s dropped deliver_sm to %s after %d attempts: %v", s.remote, out.sm.DestAddr, out.attempts, err)
+		return
+	}
+	time.AfterFunc(smppRetryDelay, func() {
+		if !s.isClosed() {
+			s.enqueue(out)
+		}
+	})
+}
+
+// keepalive sends enquire_link on idle sessions and ends sessions whose API
+// key was revoked.
+func (s *smppSession) keepalive() {
+	interval := time.Duration(s.srv.cfg.EnquireLinkSec) * time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.refreshActor(); err != nil {
+			logger.Log.Infof("SMPP session %s unbound: %v", s.remote, err)
+			_, _ = s.request(smpp.Unbind, nil)
+			s.close()
+			return
+		}
+		if time.Since(time.Unix(0, s.lastRead.Load())) < interval {
+			continue
+		}
+		resp, err := s.request(smpp.EnquireLink, nil)
+		if err == nil && resp.CommandID != smpp.EnquireLinkResp {
+			err = fmt.Errorf("unexpected response 0x%08X", resp.CommandID)
+		}
+		if err != nil {
+			if !errors.Is(err, errSMPPClosed) {
+				logger.Log.Infof("SMPP session %s enquire_link failed: %v", s.remote, err)
+			}
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *smppSession) refreshActor() error {
+	actor, _, _ := s.state()
+	var key model.APIKey
+	if err := s.srv.db.Where("id = ? AND is_active = ?", actor.APIKey.ID, true).First(&key).Error; err != nil {
+		return errors.New("API key revoked")
+	}
+	fresh, err := loadAPIKeyActor(s.srv.db, &key)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.actor = fresh
+	s.mu.Unlock()
+	return nil
+}
+
+// request sends a server-initiated PDU and waits for the response with the
+// same sequence number.
+func (s *smppSession) request(commandID uint32, body []byte) (*smpp.PDU, error) {
+	seq := s.seq.Add(1) & 0x7FFFFFFF
+	if seq == 0 {
+		seq = s.seq.Add(1) & 0x7FFFFFFF
+	}
+	ch := make(chan *smpp.PDU, 1)
+	s.mu.Lock()
+	s.pending[seq] = ch
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, seq)
+		s.mu.Unlock()
+	}()
+
+	if err := s.write(&smpp.PDU{CommandID: commandID, Sequence: seq, Body: body}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(s.srv.responseTimeout())
+	defer timer.Stop()
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-timer.C:
+		return nil, errSMPPTimeout
+	case <-s.done:
+		return nil, errSMPPClosed
+	}
+}
+
+func (s *smppSession) handleResponse(p *smpp.PDU) {
+	s.mu.Lock()
+	ch, ok := s.pending[p.Sequence]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case ch <- p:
+	default:
+	}
+}
+
+func (s *smppSession) respond(req *smpp.PDU, commandID, status uint32, body []byte) {
+	if err := s.write(&smpp.PDU{CommandID: commandID, Status: status, Sequence: req.Sequence, Body: body}); err != nil {
+		logger.Log.Debugf("SMPP session %s write failed: %v", s.remote, err)
+	}
+}
+
+func (s *smppSession) write(p *smpp.PDU) error {
+	if s.isClosed() {
+		return errSMPPClosed
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.srv.responseTimeout()))
+	_, err := s.conn.Write(p.Bytes())
+	return err
+}
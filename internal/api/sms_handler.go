@@ -86,6 +86,15 @@ func (h *SMSHandler) ListSMS(c *gin.Context) {
 		}
 	}
 
+	// Spam-marked messages are hidden unless asked for: spam=include|only
+	switch c.Query("spam") {
+	case "include":
+	case "only":
+		query = query.Where("is_spam = ?", true)
+	default:
+		query = query.Where("is_spam = ?", false)
+	}
+
 	var total int64
 	query.Count(&total)
 
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/worker"
+	"gorm.io/gorm"
+)
+
+// actorQuotaSubject returns who the actor's SMS count against.
+func actorQuotaSubject(actor *authActor) logic.QuotaSubject {
+	subject := logic.QuotaSubject{UserID: actor.User.ID}
+	if actor.APIKey != nil {
+		subject.APIKeyID = actor.APIKey.ID
+	}
+	return subject
+}
+
+// writeQuotaError answers 429 with Retry-After if err is a quota error.
+func writeQuotaError(c *gin.Context, err error) bool {
+	qe, ok := logic.AsQuotaExceeded(err)
+	if !ok {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(qe.RetryAfterSeconds()))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": qe.Error(), "retry_after": qe.RetryAfterSeconds()})
+	return true
+}
+
+// sendViaPool routes through a pool like SendSMSPool, skipping modems the
+// actor's quotas do not allow. Each modem tried reserves one SMS of the
+// actor's quotas, which is released when that modem fails. It returns the
+// quota error when quotas were all that stopped the send.
+func sendViaPool(db *gorm.DB, wm *worker.Manager, limiter *logic.SMSLimiter, actor *authActor, pool, phone, message string) (*model.SMS, error) {
+	subject := actorQuotaSubject(actor)
+	if err := limiter.Check(subject, ""); err != nil {
+		return nil, err
+	}
+
+	var blocked error
+	tried := false
+	sms, err := wm.SendSMSPoolReserving(pool, phone, message, actorSendFilter(db, actor), func(iccid string) (func(), error) {
+		if err := limiter.Reserve(subject, iccid); err != nil {
+			blocked = err
+			return nil, err
+		}
+		tried = true
+		return func() { limiter.Release(subject, iccid) }, nil
+	})
+	if err != nil && !tried && blocked != nil {
+		return nil, blocked
+	}
+	return sms, err
+}
+
+type SMSQuotaHandler struct {
+	db      *gorm.DB
+	limiter *logic.SMSLimiter
+}
+
+func NewSMSQuotaHandler(db *gorm.DB) *SMSQuotaHandler {
+	return &SMSQuotaHandler{db: db, limiter: logic.NewSMSLimiter(db)}
+}
+
+type smsQuotaRequest struct {
+	UserID    *uint   `json:"user_id"`
+	APIKeyID  *uint   `json:"api_key_id"`
+	ICCID     *string `json:"iccid"`
+	PerMinute *int    `json:"per_minute"`
+	PerHour   *int    `json:"per_hour"`
+	PerDay    *int    `json:"per_day"`
+	PerMonth  *int    `json:"per_month"`
+}
+
+func (req smsQuotaRequest) apply(quota *model.SMSQuota) {
+	if req.UserID != nil {
+		quota.UserID = *req.UserID
+	}
+	if req.APIKeyID != nil {
+		quota.APIKeyID = *req.APIKeyID
+	}
+	if req.ICCID != nil {
+		quota.ICCID = strings.TrimSpace(*req.ICCID)
+	}
+	if req.PerMinute != nil {
+		quota.PerMinute = *req.PerMinute
+	}
+	if req.PerHour != nil {
+		quota.PerHour = *req.PerHour
+	}
+	if req.PerDay != nil {
+		quota.PerDay = *req.PerDay
+	}
+	if req.PerMonth != nil {
+		quota.PerMonth = *req.PerMonth
+	}
+}
+
+func (h *SMSQuotaHandler) ListQuotas(c *gin.Context) {
+	q := h.db.Order("id asc")
+	if userID := c.Query("user_id"); userID != "" {
+		q = q.Where("user_id = ?", userID)
+	}
+	if keyID := c.Query("api_key_id"); keyID != "" {
+		q = q.Where("api_key_id = ?", keyID)
+	}
+
+	var quotas []model.SMSQuota
+	if err := q.Find(&quotas).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, quotas)
+}
+
+func (h *SMSQuotaHandler) CreateQuota(c *gin.Context) {
+	var req smsQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var quota model.SMSQuota
+	req.apply(&quota)
+	h.save(c, &quota)
+}
+
+func (h *SMSQuotaHandler) UpdateQuota(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quota id"})
+		return
+	}
+
+	var quota model.SMSQuota
+	if err := h.db.First(&quota, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SMS quota not found"})
+		return
+	}
+
+	var req smsQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(&quota)
+	h.save(c, &quota)
+}
+
+// save resolves a key quota to the key's owner before validating it.
+func (h *SMSQuotaHandler) save(c *gin.Context, quota *model.SMSQuota) {
+	if quota.APIKeyID != 0 {
+		var key model.APIKey
+		if err := h.db.First(&key, quota.APIKeyID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API key not found"})
+			return
+		}
+		if quota.UserID != 0 && quota.UserID != key.UserID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API key does not belong to this user"})
+			return
+		}
+		quota.UserID = key.UserID
+	} else if quota.UserID != 0 {
+		if err := h.db.First(&model.User{}, quota.UserID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "User not found"})
+			return
+		}
+	}
+	if err := logic.ValidateSMSQuota(quota); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := h.db.Save(quota).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, quota)
+}
+
+func (h *SMSQuotaHandler) DeleteQuota(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid quota id"})
+		return
+	}
+
+	if err := h.db.Delete(&model.SMSQuota{}, id).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+type smsQuotaWindowUsage struct {
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+type smsQuotaUsage struct {
+	model.SMSQuota
+	Windows map[string]smsQuotaWindowUsage `json:"windows"`
+}
+
+// KeyUsage reports how many SMS an API key sent in the current minute, hour,
+// day and month, and what is left of each quota that applies to it. An
+// optional iccid narrows both to one modem. Keys may only see their own
+// usage; admins may see any key's.
+func (h *SMSQuotaHandler) KeyUsage(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid key id"})
+		return
+	}
+	q := h.db.Where("id = ?", id)
+	if actor.User.Role != "admin" {
+		q = q.Where("user_id = ?", actor.User.ID)
+	}
+	var key model.APIKey
+	if err := q.First(&key).Error; err != nil || (actor.APIKey != nil && actor.APIKey.ID != key.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+
+	iccid := strings.TrimSpace(c.Query("iccid"))
+	now := time.Now()
+	usage := make(map[string]int, len(logic.QuotaWindows))
+	for _, window := range logic.QuotaWindows {
+		used, err := h.limiter.Used(key.UserID, key.ID, iccid, logic.QuotaWindowStart(window, now))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		usage[window] = used
+	}
+
+	quotas, err := h.limiter.Quotas(logic.QuotaSubject{UserID: key.UserID, APIKeyID: key.ID}, iccid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	list := make([]smsQuotaUsage, 0, len(quotas))
+	for _, quota := range quotas {
+		item := smsQuotaUsage{SMSQuota: quota, Windows: make(map[string]smsQuotaWindowUsage)}
+		for _, window := range logic.QuotaWindows {
+			limit := logic.QuotaLimit(&quota, window)
+			if limit == 0 {
+				continue
+			}
+			used, err := h.limiter.Used(quota.UserID, quota.APIKeyID, quota.ICCID, logic.QuotaWindowStart(window, now))
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			item.Windows[window] = smsQuotaWindowUsage{
+				Limit:     limit,
+				Used:      used,
+				Remaining: max(limit-used, 0),
+				ResetsAt:  logic.QuotaWindowEnd(window, now),
+			}
+		}
+		list = append(list, item)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_key_id": key.ID, "iccid": iccid, "usage": usage, "quotas": list})
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type SMSRuleHandler struct {
+	db *gorm.DB
+}
+
+func NewSMSRuleHandler(db *gorm.DB) *SMSRuleHandler {
+	return &SMSRuleHandler{db: db}
+}
+
+type smsRuleRequest struct {
+	Name           *string `json:"name"`
+	Priority       *int    `json:"priority"`
+	Enabled        *bool   `json:"enabled"`
+	ICCID          *string `json:"iccid"`
+	SenderPattern  *string `json:"sender_pattern"`
+	ContentRegex   *string `json:"content_regex"`
+	TimeStart      *string `json:"time_start"`
+	TimeEnd        *string `json:"time_end"`
+	Action         *string `json:"action"`
+	ReplyText      *string `json:"reply_text"`
+	ForwardTo      *string `json:"forward_to"`
+	ForwardICCID   *string `json:"forward_iccid"`
+	Tag            *string `json:"tag"`
+	WebhookID      *uint   `json:"webhook_id"`
+	StopProcessing *bool   `json:"stop_processing"`
+	CooldownSec    *int    `json:"cooldown_sec"`
+}
+
+func (req smsRuleRequest) apply(rule *model.SMSRule) {
+	if req.Name != nil {
+		rule.Name = *req.Name
+	}
+	if req.Priority != nil {
+		rule.Priority = *req.Priority
+	}
+	if req.Enabled != nil {
+		rule.Enabled = *req.Enabled
+	}
+	if req.ICCID != nil {
+		rule.ICCID = *req.ICCID
+	}
+	if req.SenderPattern != nil {
+		rule.SenderPattern = *req.SenderPattern
+	}
+	if req.ContentRegex != nil {
+		rule.ContentRegex = *req.ContentRegex
+	}
+	if req.TimeStart != nil {
+		rule.TimeStart = *req.TimeStart
+	}
+	if req.TimeEnd != nil {
+		rule.TimeEnd = *req.TimeEnd
+	}
+	if req.Action != nil {
+		rule.Action = *req.Action
+	}
+	if req.ReplyText != nil {
+		rule.ReplyText = *req.ReplyText
+	}
+	if req.ForwardTo != nil {
+		rule.ForwardTo = *req.ForwardTo
+	}
+	if req.ForwardICCID != nil {
+		rule.ForwardICCID = *req.ForwardICCID
+	}
+	if req.Tag != nil {
+		rule.Tag = *req.Tag
+	}
+	if req.WebhookID != nil {
+		rule.WebhookID = *req.WebhookID
+	}
+	if req.StopProcessing != nil {
+		rule.StopProcessing = *req.StopProcessing
+	}
+	if req.CooldownSec != nil {
+		rule.CooldownSec = *req.CooldownSec
+	}
+}
+
+// ListSMSRules returns the caller's own rules. Admins see every rule and may
+// narrow the list with ?user_id=.
+func (h *SMSRuleHandler) ListSMSRules(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	query := h.db.Model(&model.SMSRule{})
+	if actor.User.Role != "admin" {
+		query = query.Where("user_id = ?", actor.User.ID)
+	} else if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if iccid := c.Query("iccid"); iccid != "" {
+		query = query.Where("iccid = ? OR iccid = ''", iccid)
+	}
+
+	var list []model.SMSRule
+	if err := query.Order("priority asc").Order("id asc").Find(&list).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (h *SMSRuleHandler) CreateSMSRule(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req smsRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	rule := model.SMSRule{UserID: actor.User.ID, Enabled: true}
+	req.apply(&rule)
+	if !h.validateRule(c, actor, &rule) {
+		return
+	}
+
+	if err := h.db.Create(&rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *SMSRuleHandler) UpdateSMSRule(c *gin.Context) {
+	actor, rule, ok := h.loadOwnedRule(c)
+	if !ok {
+		return
+	}
+
+	var req smsRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	req.apply(rule)
+	if !h.validateRule(c, actor, rule) {
+		return
+	}
+
+	if err := h.db.Save(rule).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+func (h *SMSRuleHandler) DeleteSMSRule(c *gin.Context) {
+	_, rule, ok := h.loadOwnedRule(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Delete(&model.SMSRule{}, rule.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// loadOwnedRule loads :id; rules of other users are reported as not found
+// unless the caller is an admin.
+func (h *SMSRuleHandler) loadOwnedRule(c *gin.Context) (*authActor, *model.SMSRule, bool) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, nil, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid rule id"})
+		return nil, nil, false
+	}
+
+	var rule model.SMSRule
+	if err := h.db.First(&rule, id).Error; err != nil ||
+		(actor.User.Role != "admin" && rule.UserID != actor.User.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SMS rule not found"})
+		return nil, nil, false
+	}
+	return actor, &rule, true
+}
+
+// validateRule checks the rule itself and that the caller may use every
+// modem and webhook it references.
+func (h *SMSRuleHandler) validateRule(c *gin.Context, actor *authActor, rule *model.SMSRule) bool {
+	if err := logic.ValidateSMSRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+
+	check := func(iccid, perm string) bool {
+		allowed, status, message := actorCanAccessICCIDPermission(h.db, actor, iccid, perm)
+		if !allowed {
+			c.JSON(status, gin.H{"error": message})
+		}
+		return allowed
+	}
+
+	if rule.ICCID != "" && !check(rule.ICCID, PermViewSMS) {
+		return false
+	}
+
+	switch rule.Action {
+	case logic.SMSRuleAutoReply:
+		if rule.ICCID != "" && !check(rule.ICCID, PermSendSMS) {
+			return false
+		}
+	case logic.SMSRuleForward:
+		sendICCID := rule.ForwardICCID
+		if sendICCID == "" {
+			sendICCID = rule.ICCID
+		}
+		if sendICCID != "" && !check(sendICCID, PermSendSMS) {
+			return false
+		}
+	case logic.SMSRuleWebhook:
+		var wh model.Webhook
+		if err := h.db.First(&wh, rule.WebhookID).Error; err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "webhook not found"})
+			return false
+		}
+		if actor.User.Role != "admin" && (wh.UserID != actor.User.ID || wh.ICCID == logic.WebhookAllModems) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied for this webhook"})
+			return false
+		}
+		for _, iccid := range logic.WebhookScopeICCIDs(&wh) {
+			if !check(iccid, PermViewSMS) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// smsRuleAuthorizer re-checks the owner's permissions each time a rule fires.
+// Deleted users no longer resolve, which disables their rules.
+type smsRuleAuthorizer struct {
+	db *gorm.DB
+}
+
+func NewSMSRuleAuthorizer(db *gorm.DB) logic.SMSRuleAuthorizer {
+	return &smsRuleAuthorizer{db: db}
+}
+
+func (a *smsRuleAuthorizer) CanViewSMS(userID uint, iccid string) bool {
+	return a.allowed(userID, iccid, PermViewSMS)
+}
+
+func (a *smsRuleAuthorizer) CanSendSMS(userID uint, iccid string) bool {
+	return a.allowed(userID, iccid, PermSendSMS)
+}
+
+func (a *smsRuleAuthorizer) allowed(userID uint, iccid, perm string) bool {
+	var user model.User
+	if err := a.db.First(&user, userID).Error; err != nil {
+		return false
+	}
+	allowed, _, _ := actorCanAccessICCIDPermission(a.db, &authActor{User: &user}, iccid, perm)
+	return allowed
+}
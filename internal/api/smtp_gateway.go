@@ -0,0 +1,419 @@
+package api
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/smtpd"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	smtpSendQueueSize  = 100
+	smtpMailQueueSize  = 100
+	smtpMaxRecipients  = 20
+	smtpCommandTimeout = 5 * time.Minute
+	smtpRelayTimeout   = 30 * time.Second
+)
+
+// SMTPGateway sends email addressed to <number>@domain as SMS and mails
+// received SMS to the configured mailboxes. Senders authenticate with an
+// API key as SMTP AUTH password or match the allowlist.
+type SMTPGateway struct {
+	db    *gorm.DB
+	wm    *worker.Manager
+	cfg   config.SMTPConfig
+	srv   *smtpd.Server
+	ln    net.Listener
+	allow []smtpAllowRule
+	quota *logic.SMSLimiter
+
+	relay     *logic.SMTPRelay
+	relayFrom string
+
+	queueMu sync.Mutex
+	sends   chan smtpSendJob
+	mails   chan model.SMS
+}
+
+type smtpAllowRule struct {
+	network *net.IPNet
+	sender  string
+	user    string
+}
+
+type smtpSendJob struct {
+	iccid  string
+	number string
+	text   string
+	sender string // envelope sender, told about failures
+	quota  logic.QuotaSubject
+}
+
+func NewSMTPGateway(db *gorm.DB, wm *worker.Manager, cfg config.SMTPConfig) (*SMTPGateway, error) {
+	g := &SMTPGateway{
+		db:    db,
+		wm:    wm,
+		cfg:   cfg,
+		quota: logic.NewSMSLimiter(db),
+		sends: make(chan smtpSendJob, smtpSendQueueSize),
+		mails: make(chan model.SMS, smtpMailQueueSize),
+	}
+
+	for _, r := range cfg.Allowlist {
+		rule := smtpAllowRule{sender: strings.ToLower(strings.TrimSpace(r.Sender)), user: strings.TrimSpace(r.User)}
+		if network := strings.TrimSpace(r.Network); network != "" {
+			if !strings.Contains(network, "/") {
+				if ip := net.ParseIP(network); ip != nil && ip.To4() != nil {
+					network += "/32"
+				} else {
+					network += "/128"
+				}
+			}
+			_, ipnet, err := net.ParseCIDR(network)
+			if err != nil {
+				return nil, fmt.Errorf("smtp allowlist: invalid network %q", r.Network)
+			}
+			rule.network = ipnet
+		}
+		if rule.network == nil && rule.sender == "" {
+			return nil, errors.New("smtp allowlist: each entry needs a network or a sender")
+		}
+		if rule.user == "" {
+			return nil, errors.New("smtp allowlist: each entry needs a user")
+		}
+		g.allow = append(g.allow, rule)
+	}
+
+	for _, mb := range cfg.Mailboxes {
+		if _, err := mail.ParseAddress(mb.Address); err != nil {
+			return nil, fmt.Errorf("smtp mailbox %q: %v", mb.Address, err)
+		}
+	}
+	if cfg.Relay.Host != "" {
+		relay := logic.SMTPRelay{
+			Host:     cfg.Relay.Host,
+			Port:     cfg.Relay.Port,
+			Security: cfg.Relay.Security,
+			Username: cfg.Relay.Username,
+			Password: cfg.Relay.Password,
+		}
+		if err := relay.Normalize(); err != nil {
+			return nil, fmt.Errorf("smtp relay: %v", err)
+		}
+		from, err := mail.ParseAddress(cfg.Relay.From)
+		if err != nil {
+			return nil, fmt.Errorf("smtp relay: invalid from: %v", err)
+		}
+		g.relay, g.relayFrom = &relay, from.Address
+	} else if len(cfg.Mailboxes) > 0 {
+		return nil, errors.New("smtp mailboxes need a relay")
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("smtp tls: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+
+	g.srv = &smtpd.Server{
+		Hostname:          cfg.Hostname,
+		Backend:           smtpGatewayBackend{g: g},
+		TLSConfig:         tlsConfig,
+		AllowInsecureAuth: cfg.AllowInsecureAuth,
+		MaxMessageBytes:   cfg.MaxMessageBytes,
+		MaxRecipients:     smtpMaxRecipients,
+		Timeout:           smtpCommandTimeout,
+	}
+	return g, nil
+}
+
+// Listen opens the listening socket, so a port conflict fails at startup.
+func (g *SMTPGateway) Listen() error {
+	ln, err := net.Listen("tcp", g.cfg.Listen)
+	if err != nil {
+		return err
+	}
+	g.ln = ln
+	logger.Log.Infof("SMTP gateway listening on %s for @%s", ln.Addr(), g.cfg.Domain)
+	return nil
+}
+
+// Run serves SMTP clients, sends queued SMS and mails received SMS until
+// stop is closed.
+func (g *SMTPGateway) Run(stop <-chan struct{}) {
+	go g.sendLoop(stop)
+	if len(g.cfg.Mailboxes) > 0 {
+		go g.forwardSMS(stop)
+		go g.mailLoop(stop)
+	}
+	go func() {
+		<-stop
+		g.srv.Close()
+	}()
+	if err := g.srv.Serve(g.ln); err != nil && !errors.Is(err, smtpd.ErrServerClosed) {
+		logger.Log.Errorf("SMTP gateway stopped: %v", err)
+	}
+}
+
+func (g *SMTPGateway) sendLoop(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case job := <-g.sends:
+			err := g.wm.SendSMSFrom(job.iccid, job.number, job.text)
+			if err == nil {
+				logger.Log.Infof("SMTP gateway sent SMS to %s via %s", job.number, job.iccid)
+				continue
+			}
+			logger.Log.Warnf("SMTP gateway SMS to %s via %s failed: %v", job.number, job.iccid, err)
+			g.quota.Release(job.quota, job.iccid)
+			if g.relay != nil && job.sender != "" {
+				msg := logic.BuildSMSFailureEmail(g.relayFrom, job.sender, job.number, job.text, err, time.Now(), g.cfg.Domain)
+				if err := g.relay.Send(g.relayFrom, []string{job.sender}, msg, smtpRelayTimeout); err != nil {
+					logger.Log.Warnf("SMTP gateway failure notice to %s: %v", job.sender, err)
+				}
+			}
+		}
+	}
+}
+
+// forwardSMS queues every received SMS for the mailboxes. After falling
+// behind it resumes from the hub backlog.
+func (g *SMTPGateway) forwardSMS(stop <-chan struct{}) {
+	var lastID uint64
+	for {
+		backlog, events, cancel := g.wm.Events().Subscribe(lastID)
+		for _, e := range backlog {
+			lastID = e.ID
+			g.forwardEvent(e)
+		}
+		for open := true; open; {
+			select {
+			case <-stop:
+				cancel()
+				return
+			case e, ok := <-events:
+				if !ok {
+					open = false
+					break
+				}
+				lastID = e.ID
+				g.forwardEvent(e)
+			}
+		}
+		cancel()
+	}
+}
+
+func (g *SMTPGateway) forwardEvent(e logic.Event) {
+	if e.Type != logic.EventSMSReceived {
+		return
+	}
+	sms, ok := e.Data.(model.SMS)
+	if !ok || len(g.mailboxesFor(sms.ICCID)) == 0 {
+		return
+	}
+	select {
+	case g.mails <- sms:
+	default:
+		logger.Log.Warnf("SMTP gateway mail queue full, dropping SMS %d", sms.ID)
+	}
+}
+
+func (g *SMTPGateway) mailboxesFor(iccid string) []string {
+	var out []string
+	for _, mb := range g.cfg.Mailboxes {
+		if mb.ICCID == "*" || mb.ICCID == iccid {
+			addr, _ := mail.ParseAddress(mb.Address)
+			out = append(out, addr.Address)
+		}
+	}
+	return out
+}
+
+func (g *SMTPGateway) mailLoop(stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case sms := <-g.mails:
+			to := g.mailboxesFor(sms.ICCID)
+			msg := logic.BuildSMSEmail(&sms, g.relayFrom, to, g.cfg.Domain)
+			if err := g.relay.Send(g.relayFrom, to, msg, smtpRelayTimeout); err != nil {
+				logger.Log.Warnf("SMTP gateway failed to mail SMS %d: %v", sms.ID, err)
+			}
+		}
+	}
+}
+
+// route picks the modem for one recipient: the modem named in the address,
+// the modem of the SMS being replied to, or the first one the actor may use.
+func (g *SMTPGateway) route(actor *authActor, number, modemRef string, thread *model.SMS) (string, bool) {
+	if modemRef != "" {
+		modem, ok := resolveSendModem(g.db, g.wm, actor, modemRef)
+		if !ok {
+			return "", false
+		}
+		return modem.ICCID, true
+	}
+	if thread != nil && samePhoneNumber(thread.Phone, number) {
+		if allowed, _, _ := actorCanAccessICCIDPermission(g.db, actor, thread.ICCID, PermSendSMS); allowed {
+			return thread.ICCID, true
+		}
+	}
+	modem, ok := resolveSendModem(g.db, g.wm, actor, "")
+	if !ok {
+		return "", false
+	}
+	return modem.ICCID, true
+}
+
+// samePhoneNumber compares numbers written with or without the country code.
+func samePhoneNumber(a, b string) bool {
+	digits := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, s)
+	}
+	da, db := digits(a), digits(b)
+	if da == "" || db == "" {
+		return false
+	}
+	if da == db {
+		return true
+	}
+	const tail = 9
+	return len(da) >= tail && len(db) >= tail && da[len(da)-tail:] == db[len(db)-tail:]
+}
+
+type smtpGatewayBackend struct {
+	g *SMTPGateway
+}
+
+func (b smtpGatewayBackend) Auth(username, password string) (any, error) {
+	return authenticateAPIKey(b.g.db, password)
+}
+
+func (b smtpGatewayBackend) Anonymous(remote net.Addr, from string) (any, error) {
+	var ip net.IP
+	if addr, ok := remote.(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+	from = strings.ToLower(from)
+	for _, r := range b.g.allow {
+		if r.network != nil && (ip == nil || !r.network.Contains(ip)) {
+			continue
+		}
+		if r.sender != "" && from != r.sender && !(strings.HasPrefix(r.sender, "@") && strings.HasSuffix(from, r.sender)) {
+			continue
+		}
+		var user model.User
+		if err := b.g.db.Where("username = ?", r.user).First(&user).Error; err != nil {
+			logger.Log.Warnf("SMTP allowlist user %q not found", r.user)
+			return nil, nil
+		}
+		return &authActor{User: &user}, nil
+	}
+	return nil, nil
+}
+
+func (b smtpGatewayBackend) Rcpt(identity any, to string) error {
+	actor := identity.(*authActor)
+	number, modemRef, err := logic.ParseGatewayAddress(to, b.g.cfg.Domain)
+	if err != nil {
+		return &smtpd.Error{Code: 550, Enhanced: "5.1.1", Message: err.Error()}
+	}
+	if _, ok := b.g.route(actor, number, modemRef, nil); !ok {
+		return &smtpd.Error{Code: 550, Enhanced: "5.7.1", Message: "No modem you may send SMS from"}
+	}
+	return nil
+}
+
+func (b smtpGatewayBackend) Data(identity any, env *smtpd.Envelope) error {
+	actor := identity.(*authActor)
+	msg, err := mail.ReadMessage(bytes.NewReader(env.Data))
+	if err != nil {
+		return &smtpd.Error{Code: 554, Enhanced: "5.6.0", Message: "Malformed message"}
+	}
+	// Vacation replies and bounces must not turn into SMS.
+	if auto := strings.ToLower(strings.TrimSpace(msg.Header.Get("Auto-Submitted"))); auto != "" && auto != "no" {
+		return &smtpd.Error{Code: 550, Enhanced: "5.7.1", Message: "Automatic messages are not sent as SMS"}
+	}
+
+	body, err := logic.EmailText(msg)
+	if err != nil {
+		return &smtpd.Error{Code: 554, Enhanced: "5.6.0", Message: "Malformed message body"}
+	}
+	text := logic.TrimEmailBody(body)
+	if text == "" {
+		text = logic.EmailSubject(msg.Header)
+	}
+	if text == "" {
+		return &smtpd.Error{Code: 554, Enhanced: "5.6.0", Message: "Message has no text"}
+	}
+	text = logic.TruncateSMS(text, b.g.cfg.MaxSMSChars)
+
+	var thread *model.SMS
+	for _, id := range logic.SMSEmailReferences(msg.Header, b.g.cfg.Domain) {
+		var sms model.SMS
+		if err := b.g.db.Where("id = ? AND type = ?", id, "received").First(&sms).Error; err == nil {
+			thread = &sms
+			break
+		}
+	}
+
+	jobs := make([]smtpSendJob, 0, len(env.To))
+	for _, to := range env.To {
+		number, modemRef, err := logic.ParseGatewayAddress(to, b.g.cfg.Domain)
+		if err != nil {
+			return &smtpd.Error{Code: 550, Enhanced: "5.1.1", Message: err.Error()}
+		}
+		iccid, ok := b.g.route(actor, number, modemRef, thread)
+		if !ok {
+			return &smtpd.Error{Code: 550, Enhanced: "5.7.1", Message: "No modem you may send SMS from"}
+		}
+		jobs = append(jobs, smtpSendJob{iccid: iccid, number: number, text: text, sender: env.From})
+	}
+
+	b.g.queueMu.Lock()
+	defer b.g.queueMu.Unlock()
+	if cap(b.g.sends)-len(b.g.sends) < len(jobs) {
+		return &smtpd.Error{Code: 452, Enhanced: "4.3.1", Message: "SMS queue full, try again later"}
+	}
+	iccids := make([]string, len(jobs))
+	for i, job := range jobs {
+		iccids[i] = job.iccid
+	}
+	if err := b.g.quota.ReserveAll(actorQuotaSubject(actor), iccids); err != nil {
+		if _, ok := logic.AsQuotaExceeded(err); ok {
+			return &smtpd.Error{Code: 452, Enhanced: "4.7.0", Message: err.Error()}
+		}
+		return &smtpd.Error{Code: 451, Enhanced: "4.3.0", Message: "Quota check failed"}
+	}
+	for _, job := range jobs {
+		job.quota = actorQuotaSubject(actor)
+		b.g.sends <- job
+	}
+	logger.Log.Infof("SMTP gateway queued %d SMS from %s (%s)", len(jobs), env.From, actor.User.Username)
+	return nil
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+func (h *ModemHandler) supplementaryWorker(c *gin.Context) (*worker.ModemWorker, bool) {
+	iccid := c.Param("iccid")
+	if !enforceICCIDPermission(c, h.db, iccid, PermMakeCall) {
+		return nil, false
+	}
+
+	w := h.wm.GetWorkerByICCID(iccid)
+	if w == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Modem not active (worker not found)"})
+		return nil, false
+	}
+	if w.IsBusy() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Modem is busy"})
+		return nil, false
+	}
+	return w, true
+}
+
+func (h *ModemHandler) respondSupplementaryError(c *gin.Context, err error) {
+	if worker.IsInvalidSupplementaryRequestError(err) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Modem rejected request: " + err.Error()})
+}
+
+// GetSupplementaryServices queries call forwarding, call waiting and CLIR
+// from the network and refreshes the copy shown in the modem detail, which
+// GetModem otherwise fills in the background.
+func (h *ModemHandler) GetSupplementaryServices(c *gin.Context) {
+	w, ok := h.supplementaryWorker(c)
+	if !ok {
+		return
+	}
+
+	ss, err := w.QuerySupplementaryServices()
+	if err != nil {
+		logger.Log.Warnf("[%s] Supplementary service query failed: %v", w.PortName, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if len(ss.Errors) > 0 {
+		logger.Log.Debugf("[%s] Supplementary service query incomplete: %v", w.PortName, ss.Errors)
+	}
+	c.JSON(http.StatusOK, ss)
+}
+
+func (h *ModemHandler) SetCallForwarding(c *gin.Context) {
+	var req struct {
+		Reason      string `json:"reason"` // unconditional, busy, no_reply, not_reachable, all, all_conditional
+		Enabled     bool   `json:"enabled"`
+		Number      string `json:"number"`
+		NoReplyTime int    `json:"no_reply_time"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w, ok := h.supplementaryWorker(c)
+	if !ok {
+		return
+	}
+
+	if err := w.SetCallForwarding(req.Reason, req.Enabled, req.Number, req.NoReplyTime); err != nil {
+		h.respondSupplementaryError(c, err)
+		return
+	}
+
+	ss, _ := w.SupplementaryServices()
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "supplementary_services": ss})
+}
+
+func (h *ModemHandler) SetCallWaiting(c *gin.Context) {
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w, ok := h.supplementaryWorker(c)
+	if !ok {
+		return
+	}
+
+	if err := w.SetCallWaiting(req.Enabled); err != nil {
+		h.respondSupplementaryError(c, err)
+		return
+	}
+
+	ss, _ := w.SupplementaryServices()
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "supplementary_services": ss})
+}
+
+func (h *ModemHandler) SetCLIR(c *gin.Context) {
+	var req struct {
+		Mode string `json:"mode"` // default, hide, show
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	w, ok := h.supplementaryWorker(c)
+	if !ok {
+		return
+	}
+
+	if err := w.SetCLIR(req.Mode); err != nil {
+		h.respondSupplementaryError(c, err)
+		return
+	}
+
+	ss, _ := w.SupplementaryServices()
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "supplementary_services": ss})
+}
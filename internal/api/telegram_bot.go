@@ -0,0 +1,554 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	TelegramModePolling = "polling"
+	TelegramModeWebhook = "webhook"
+
+	telegramSecretHeader = "X-Telegram-Bot-Api-Secret-Token"
+	telegramTextLimit    = 4096
+	telegramRetryDelay   = 5 * time.Second
+)
+
+var telegramPhonePattern = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+
+// TelegramBot is the two-way Telegram bridge. Telegram users are linked to
+// smsie users through User.TelegramID and act with that user's modem
+// permissions.
+type TelegramBot struct {
+	db       *gorm.DB
+	wm       *worker.Manager
+	messages *repository.TelegramMessageRepository
+	cfg      config.TelegramConfig
+	client   *http.Client
+	quota    *logic.SMSLimiter
+}
+
+type tgUpdate struct {
+	UpdateID int64      `json:"update_id"`
+	Message  *tgMessage `json:"message"`
+}
+
+type tgMessage struct {
+	MessageID      int64      `json:"message_id"`
+	From           *tgUser    `json:"from"`
+	Chat           tgChat     `json:"chat"`
+	Text           string     `json:"text"`
+	ReplyToMessage *tgMessage `json:"reply_to_message"`
+}
+
+type tgUser struct {
+	ID    int64 `json:"id"`
+	IsBot bool  `json:"is_bot"`
+}
+
+type tgChat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+func NewTelegramBot(db *gorm.DB, wm *worker.Manager, cfg config.TelegramConfig) (*TelegramBot, error) {
+	if strings.TrimSpace(cfg.BotToken) == "" {
+		return nil, errors.New("telegram.bot_token is required")
+	}
+	switch cfg.Mode {
+	case TelegramModePolling:
+	case TelegramModeWebhook:
+		if cfg.WebhookURL == "" || cfg.WebhookSecret == "" {
+			return nil, errors.New("telegram webhook mode requires webhook_url and webhook_secret")
+		}
+	default:
+		return nil, fmt.Errorf("unknown telegram mode %q", cfg.Mode)
+	}
+
+	return &TelegramBot{
+		db:       db,
+		wm:       wm,
+		messages: repository.NewTelegramMessageRepository(db),
+		cfg:      cfg,
+		quota:    logic.NewSMSLimiter(db),
+		client:   &http.Client{Timeout: time.Duration(cfg.PollTimeoutSec+15) * time.Second},
+	}, nil
+}
+
+func (b *TelegramBot) apiURL(method string) string {
+	return strings.TrimRight(b.cfg.APIBaseURL, "/") + "/bot" + b.cfg.BotToken + "/" + method
+}
+
+// SendMessageURL, OwnsURL and RecordForward implement logic.TelegramBridge.
+func (b *TelegramBot) SendMessageURL() string {
+	return b.apiURL("sendMessage")
+}
+
+func (b *TelegramBot) OwnsURL(url string) bool {
+	return strings.Contains(url, "/bot"+b.cfg.BotToken+"/")
+}
+
+func (b *TelegramBot) RecordForward(chatID, messageID int64, sms *model.SMS) {
+	link := &model.TelegramMessage{ChatID: chatID, MessageID: messageID, SMSID: sms.ID, ICCID: sms.ICCID, Phone: sms.Phone}
+	if err := b.messages.Create(link); err != nil {
+		logger.Log.Warnf("Failed to record Telegram message %d/%d: %v", chatID, messageID, err)
+	}
+}
+
+// call invokes a Bot API method and decodes its result into out.
+func (b *TelegramBot) call(ctx context.Context, method string, params, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.apiURL(method), bytes.NewReader(body))
+	if err != nil {
+		return b.redact(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return b.redact(err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		OK          bool            `json:"ok"`
+		Result      json.RawMessage `json:"result"`
+		Description string          `json:"description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&envelope); err != nil {
+		return fmt.Errorf("telegram %s: %s", method, resp.Status)
+	}
+	if !envelope.OK {
+		return fmt.Errorf("telegram %s: %s", method, envelope.Description)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(envelope.Result, out)
+}
+
+// redact keeps the bot token, which is part of every API URL, out of logs.
+func (b *TelegramBot) redact(err error) error {
+	return errors.New(strings.ReplaceAll(err.Error(), b.cfg.BotToken, "<token>"))
+}
+
+// Run registers the webhook or polls for updates until stop is closed. It
+// also purges expired message links.
+func (b *TelegramBot) Run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	if b.cfg.Mode == TelegramModeWebhook {
+		err := b.call(ctx, "setWebhook", map[string]interface{}{
+			"url":             b.cfg.WebhookURL,
+			"secret_token":    b.cfg.WebhookSecret,
+			"allowed_updates": []string{"message"},
+		}, nil)
+		if err != nil {
+			logger.Log.Errorf("Failed to register Telegram webhook: %v", err)
+		} else {
+			logger.Log.Infof("Telegram webhook registered at %s", b.cfg.WebhookURL)
+		}
+	} else if err := b.call(ctx, "deleteWebhook", map[string]interface{}{}, nil); err != nil {
+		logger.Log.Warnf("Failed to clear Telegram webhook: %v", err)
+	}
+
+	var offset int64
+	lastPurge := time.Time{}
+	for ctx.Err() == nil {
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			if _, err := b.messages.PurgeBefore(lastPurge.AddDate(0, 0, -b.cfg.MessageRetentionDays)); err != nil {
+				logger.Log.Warnf("Failed to purge Telegram messages: %v", err)
+			}
+		}
+
+		if b.cfg.Mode == TelegramModeWebhook {
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Hour):
+			}
+			continue
+		}
+
+		var updates []tgUpdate
+		err := b.call(ctx, "getUpdates", map[string]interface{}{
+			"offset":          offset,
+			"timeout":         b.cfg.PollTimeoutSec,
+			"allowed_updates": []string{"message"},
+		}, &updates)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logger.Log.Warnf("Telegram getUpdates failed: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(telegramRetryDelay):
+			}
+			continue
+		}
+		for _, u := range updates {
+			if u.UpdateID >= offset {
+				offset = u.UpdateID + 1
+			}
+			go b.handleUpdate(u)
+		}
+	}
+}
+
+// HandleWebhook receives updates in webhook mode. Telegram retries slow
+// deliveries, so updates are handled after responding.
+func (b *TelegramBot) HandleWebhook(c *gin.Context) {
+	secret := c.GetHeader(telegramSecretHeader)
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(b.cfg.WebhookSecret)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var u tgUpdate
+	if err := c.ShouldBindJSON(&u); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	go b.handleUpdate(u)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (b *TelegramBot) handleUpdate(u tgUpdate) {
+	msg := u.Message
+	if msg == nil || msg.From == nil || msg.From.IsBot || strings.TrimSpace(msg.Text) == "" {
+		return
+	}
+	isCommand := strings.HasPrefix(msg.Text, "/")
+	isReply := msg.ReplyToMessage != nil && !isCommand
+
+	var user model.User
+	if err := b.db.Where("telegram_id = ?", msg.From.ID).First(&user).Error; err != nil {
+		if isCommand || msg.Chat.Type == "private" || (isReply && msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.IsBot) {
+			b.reply(msg, fmt.Sprintf("Your Telegram user ID %d is not linked to an smsie account. Ask an administrator to link it.", msg.From.ID))
+		}
+		return
+	}
+	actor := &authActor{User: &user}
+
+	if isReply {
+		b.handleReply(actor, msg)
+		return
+	}
+	if !isCommand {
+		if msg.Chat.Type == "private" {
+			b.reply(msg, telegramHelp)
+		}
+		return
+	}
+
+	cmd, args := cutTelegramToken(msg.Text)
+	if at := strings.Index(cmd, "@"); at >= 0 {
+		cmd = cmd[:at]
+	}
+	switch strings.ToLower(cmd) {
+	case "/start", "/help":
+		b.reply(msg, fmt.Sprintf("Linked as %s (Telegram user ID %d).\n\n%s", user.Username, msg.From.ID, telegramHelp))
+	case "/modems":
+		b.cmdModems(actor, msg)
+	case "/send":
+		b.cmdSend(actor, msg, args)
+	case "/ussd":
+		b.cmdUSSD(actor, msg, args)
+	default:
+		b.reply(msg, "Unknown command. "+telegramHelp)
+	}
+}
+
+const telegramHelp = `Commands:
+/modems - list your modems
+/send [modem] <phone> <text> - send an SMS
+/ussd [modem] <code> - run a USSD code, e.g. *100#
+Reply to a forwarded SMS to answer the sender from the same modem.
+[modem] is an ICCID, its last digits or the modem name; it may be omitted if you can use only one modem.`
+
+// handleReply answers the SMS conversation the replied-to message belongs to.
+func (b *TelegramBot) handleReply(actor *authActor, msg *tgMessage) {
+	link, err := b.messages.Find(msg.Chat.ID, msg.ReplyToMessage.MessageID)
+	if err != nil {
+		if msg.ReplyToMessage.From != nil && msg.ReplyToMessage.From.IsBot {
+			b.reply(msg, "This message is not linked to an SMS conversation (or it has expired). Use /send instead.")
+		}
+		return
+	}
+	if allowed, _, message := actorCanAccessICCIDPermission(b.db, actor, link.ICCID, PermSendSMS); !allowed {
+		b.reply(msg, message)
+		return
+	}
+	b.sendSMS(msg, actor, link.ICCID, link.Phone, msg.Text)
+}
+
+func (b *TelegramBot) cmdModems(actor *authActor, msg *tgMessage) {
+	modems, err := b.visibleModems(actor, "")
+	if err != nil {
+		b.reply(msg, "Failed to list modems: "+err.Error())
+		return
+	}
+	if len(modems) == 0 {
+		b.reply(msg, "No modems available.")
+		return
+	}
+
+	var sb strings.Builder
+	for _, m := range modems {
+		perms := []string{}
+		for _, p := range []struct{ perm, label string }{{PermViewSMS, "view"}, {PermSendSMS, "send"}, {PermSendAT, "ussd"}} {
+			if ok, _, _ := actorCanAccessICCIDPermission(b.db, actor, m.ICCID, p.perm); ok {
+				perms = append(perms, p.label)
+			}
+		}
+		fmt.Fprintf(&sb, "%s (%s)\n  %s", modemLabel(&m), m.ICCID, m.Status)
+		if m.Status == "online" {
+			fmt.Fprintf(&sb, ", %s, %d%%", m.Operator, m.SignalStrength)
+		}
+		fmt.Fprintf(&sb, " [%s]\n", strings.Join(perms, ", "))
+	}
+	b.reply(msg, sb.String())
+}
+
+func (b *TelegramBot) cmdSend(actor *authActor, msg *tgMessage, args string) {
+	first, rest := cutTelegramToken(args)
+	iccid := ""
+	if next, _ := cutTelegramToken(rest); telegramPhonePattern.MatchString(next) {
+		if m, ok := b.matchModem(actor, first, PermSendSMS); ok {
+			iccid = m.ICCID
+			args = rest
+		}
+	}
+
+	phone, text := cutTelegramToken(args)
+	text = strings.TrimSpace(text)
+	if !telegramPhonePattern.MatchString(phone) || text == "" {
+		b.reply(msg, "Usage: /send [modem] <phone> <text>")
+		return
+	}
+	if iccid == "" {
+		m, err := b.defaultModem(actor, PermSendSMS)
+		if err != nil {
+			b.reply(msg, err.Error())
+			return
+		}
+		iccid = m.ICCID
+	}
+	if allowed, _, message := actorCanAccessICCIDPermission(b.db, actor, iccid, PermSendSMS); !allowed {
+		b.reply(msg, message)
+		return
+	}
+	b.sendSMS(msg, actor, iccid, phone, text)
+}
+
+func (b *TelegramBot) cmdUSSD(actor *authActor, msg *tgMessage, args string) {
+	first, rest := cutTelegramToken(args)
+	iccid := ""
+	code := first
+	if m, ok := b.matchModem(actor, first, PermSendAT); ok && strings.TrimSpace(rest) != "" {
+		iccid = m.ICCID
+		code, _ = cutTelegramToken(rest)
+	}
+	if code == "" {
+		b.reply(msg, "Usage: /ussd [modem] <code>")
+		return
+	}
+	if iccid == "" {
+		m, err := b.defaultModem(actor, PermSendAT)
+		if err != nil {
+			b.reply(msg, err.Error())
+			return
+		}
+		iccid = m.ICCID
+	}
+	if allowed, _, message := actorCanAccessICCIDPermission(b.db, actor, iccid, PermSendAT); !allowed {
+		b.reply(msg, message)
+		return
+	}
+
+	res, err := b.wm.SendUSSDFrom(iccid, code)
+	if err != nil {
+		b.reply(msg, "USSD failed: "+err.Error())
+		return
+	}
+	text := res.Text
+	if text == "" {
+		text = "(no text)"
+	}
+	text += "\n[" + res.State + "]"
+	if res.State == worker.USSDFurtherAction {
+		text += fmt.Sprintf("\nReply with /ussd %s <choice> to continue.", iccid)
+	}
+	b.reply(msg, text)
+}
+
+// sendSMS sends and confirms in the chat. Replying to the confirmation
+// continues the same conversation.
+func (b *TelegramBot) sendSMS(msg *tgMessage, actor *authActor, iccid, phone, text string) {
+	subject := actorQuotaSubject(actor)
+	if err := b.quota.Reserve(subject, iccid); err != nil {
+		b.reply(msg, "Send SMS failed: "+err.Error())
+		return
+	}
+	if err := b.wm.SendSMSFrom(iccid, phone, text); err != nil {
+		b.quota.Release(subject, iccid)
+		b.reply(msg, "Send SMS failed: "+err.Error())
+		return
+	}
+	label := iccid
+	var modem model.Modem
+	if err := b.db.Where("iccid = ?", iccid).First(&modem).Error; err == nil {
+		label = modemLabel(&modem)
+	}
+	if id, err := b.reply(msg, fmt.Sprintf("Sent to %s via %s", phone, label)); err == nil {
+		b.RecordForward(msg.Chat.ID, id, &model.SMS{ICCID: iccid, Phone: phone})
+	}
+}
+
+func (b *TelegramBot) reply(msg *tgMessage, text string) (int64, error) {
+	if r := []rune(text); len(r) > telegramTextLimit {
+		text = string(r[:telegramTextLimit-1]) + "…"
+	}
+	var sent tgMessage
+	err := b.call(context.Background(), "sendMessage", map[string]interface{}{
+		"chat_id": msg.Chat.ID,
+		"text":    text,
+		"reply_parameters": map[string]interface{}{
+			"message_id":                  msg.MessageID,
+			"allow_sending_without_reply": true,
+		},
+	}, &sent)
+	if err != nil {
+		logger.Log.Warnf("Telegram sendMessage to %d failed: %v", msg.Chat.ID, err)
+		return 0, err
+	}
+	return sent.MessageID, nil
+}
+
+// visibleModems returns the modems the user may use for perm ("" = any), with
+// runtime state applied.
+func (b *TelegramBot) visibleModems(actor *authActor, perm string) ([]model.Modem, error) {
+	allowed, err := allowedICCIDsForPermission(b.db, actor.User, perm)
+	if err != nil {
+		return nil, err
+	}
+	query := b.db.Model(&model.Modem{})
+	if actor.User.Role != "admin" {
+		if len(allowed) == 0 {
+			return nil, nil
+		}
+		if !hasWildcardICCID(allowed) {
+			query = query.Where("iccid IN ?", allowed)
+		}
+	}
+
+	var modems []model.Modem
+	if err := query.Order("iccid asc").Find(&modems).Error; err != nil {
+		return nil, err
+	}
+	for i := range modems {
+		var rt worker.RuntimeModemState
+		hasRuntime := false
+		if w := b.wm.GetWorkerByICCID(modems[i].ICCID); w != nil {
+			rt, hasRuntime = w.RuntimeModemState()
+		}
+		modems[i] = modemWithRuntimeState(modems[i], rt, hasRuntime)
+	}
+	return modems, nil
+}
+
+// matchModem resolves an ICCID, a unique ICCID suffix of at least four digits
+// or a modem name among the modems usable for perm.
+func (b *TelegramBot) matchModem(actor *authActor, ref, perm string) (*model.Modem, bool) {
+	ref = strings.TrimSpace(ref)
+	if ref == "" {
+		return nil, false
+	}
+	modems, err := b.visibleModems(actor, perm)
+	if err != nil {
+		return nil, false
+	}
+
+	var found *model.Modem
+	for i := range modems {
+		m := &modems[i]
+		if m.ICCID == ref || (m.Name != "" && strings.EqualFold(m.Name, ref)) {
+			return m, true
+		}
+		if len(ref) >= 4 && strings.HasSuffix(m.ICCID, ref) {
+			if found != nil {
+				return nil, false
+			}
+			found = m
+		}
+	}
+	return found, found != nil
+}
+
+// defaultModem is the only modem usable for perm, preferring online ones.
+func (b *TelegramBot) defaultModem(actor *authActor, perm string) (*model.Modem, error) {
+	modems, err := b.visibleModems(actor, perm)
+	if err != nil {
+		return nil, err
+	}
+	online := []model.Modem{}
+	for _, m := range modems {
+		if m.Status == "online" {
+			online = append(online, m)
+		}
+	}
+	switch {
+	case len(online) == 1:
+		return &online[0], nil
+	case len(online) == 0:
+		return nil, errors.New("no online modem available")
+	default:
+		return nil, errors.New("several modems available, name one (see /modems)")
+	}
+}
+
+func modemLabel(m *model.Modem) string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.ICCID
+}
+
+// cutTelegramToken splits off the first whitespace separated token; the rest
+// keeps its line breaks.
+func cutTelegramToken(s string) (string, string) {
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	end := strings.IndexFunc(s, unicode.IsSpace)
+	if end < 0 {
+		return s, ""
+	}
+	return s[:end], strings.TrimLeftFunc(s[end:], unicode.IsSpace)
+}
@@ -0,0 +1,641 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/internal/worker"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"github.com/warthog618/sms"
+	"gorm.io/gorm"
+)
+
+const (
+	twilioMaxBodyLen       = 1600
+	twilioDefaultPageSize  = 50
+	twilioMaxPageSize      = 1000
+	twilioCallbackTimeout  = 10 * time.Second
+	twilioErrUnknown       = 30008
+	twilioDateSentLayout   = "2006-01-02"
+	twilioMoreInfoTemplate = "https://www.twilio.com/docs/errors/%d"
+)
+
+var twilioNumberPattern = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+
+// TwilioHandler serves a subset of Twilio's Messages API so that Twilio
+// clients can send and read SMS through smsie modems.
+type TwilioHandler struct {
+	db     *gorm.DB
+	wm     *worker.Manager
+	client *http.Client
+	// publicClient posts the status callbacks of non-admins, which must not
+	// reach the internal network.
+	publicClient *http.Client
+	quota        *logic.SMSLimiter
+}
+
+func NewTwilioHandler(db *gorm.DB, wm *worker.Manager) *TwilioHandler {
+	return &TwilioHandler{
+		db:           db,
+		wm:           wm,
+		client:       &http.Client{Timeout: twilioCallbackTimeout},
+		publicClient: logic.PublicOnlyHTTPClient(twilioCallbackTimeout),
+		quota:        logic.NewSMSLimiter(db),
+	}
+}
+
+// TwilioAuth accepts an smsie API key as the basic auth password, which is
+// where Twilio clients put the auth token. The username is ignored.
+func TwilioAuth(db *gorm.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		_, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="Twilio API"`)
+			twilioError(c, http.StatusUnauthorized, 20003, "Authenticate")
+			c.Abort()
+			return
+		}
+		actor, err := authenticateAPIKey(db, password)
+		if err != nil {
+			c.Header("WWW-Authenticate", `Basic realm="Twilio API"`)
+			twilioError(c, http.StatusUnauthorized, 20003, "Authenticate: "+err.Error())
+			c.Abort()
+			return
+		}
+		c.Set("user", actor.User)
+		c.Set("userID", actor.User.ID)
+		c.Set("role", actor.User.Role)
+		c.Set("auth_type", "api_key")
+		c.Set("api_key", actor.APIKey)
+		c.Next()
+	}
+}
+
+func twilioError(c *gin.Context, status, code int, message string) {
+	c.JSON(status, gin.H{
+		"code":      code,
+		"message":   message,
+		"more_info": fmt.Sprintf(twilioMoreInfoTemplate, code),
+		"status":    status,
+	})
+}
+
+type twilioMessageJSON struct {
+	AccountSID          string            `json:"account_sid"`
+	APIVersion          string            `json:"api_version"`
+	Body                string            `json:"body"`
+	DateCreated         string            `json:"date_created"`
+	DateSent            *string           `json:"date_sent"`
+	DateUpdated         string            `json:"date_updated"`
+	Direction           string            `json:"direction"`
+	ErrorCode           *int              `json:"error_code"`
+	ErrorMessage        *string           `json:"error_message"`
+	From                string            `json:"from"`
+	MessagingServiceSID *string           `json:"messaging_service_sid"`
+	NumMedia            string            `json:"num_media"`
+	NumSegments         string            `json:"num_segments"`
+	Price               *string           `json:"price"`
+	PriceUnit           string            `json:"price_unit"`
+	SID                 string            `json:"sid"`
+	Status              string            `json:"status"`
+	SubresourceURIs     map[string]string `json:"subresource_uris"`
+	To                  string            `json:"to"`
+	URI                 string            `json:"uri"`
+
+	sortTime time.Time
+}
+
+func twilioDate(t time.Time) string {
+	return t.UTC().Format(time.RFC1123Z)
+}
+
+func twilioAccountPath(accountSID string) string {
+	return "/" + logic.TwilioAPIVersion + "/Accounts/" + accountSID
+}
+
+func newTwilioMessageJSON(accountSID, sid string) twilioMessageJSON {
+	base := twilioAccountPath(accountSID) + "/Messages/" + sid
+	return twilioMessageJSON{
+		AccountSID:      accountSID,
+		APIVersion:      logic.TwilioAPIVersion,
+		NumMedia:        "0",
+		PriceUnit:       "USD",
+		SID:             sid,
+		SubresourceURIs: map[string]string{"media": base + "/Media.json"},
+		URI:             base + ".json",
+	}
+}
+
+func twilioOutboundJSON(accountSID string, m *model.TwilioMessage) twilioMessageJSON {
+	out := newTwilioMessageJSON(accountSID, m.SID)
+	out.Body = m.Body
+	out.DateCreated = twilioDate(m.CreatedAt)
+	out.DateUpdated = twilioDate(m.UpdatedAt)
+	out.Direction = "outbound-api"
+	out.From = m.From
+	out.To = m.To
+	out.NumSegments = strconv.Itoa(m.NumSegments)
+	out.Status = m.Status
+	out.sortTime = m.CreatedAt
+	if m.SentAt != nil {
+		sent := twilioDate(*m.SentAt)
+		out.DateSent = &sent
+		out.sortTime = *m.SentAt
+	}
+	if m.ErrorCode != 0 {
+		code, msg := m.ErrorCode, m.ErrorMessage
+		out.ErrorCode, out.ErrorMessage = &code, &msg
+	}
+	return out
+}
+
+func twilioInboundJSON(accountSID string, s *model.SMS) twilioMessageJSON {
+	out := newTwilioMessageJSON(accountSID, logic.TwilioSMSSID(s.ID))
+	sent := twilioDate(s.Timestamp)
+	out.Body = s.Content
+	out.DateCreated = twilioDate(s.CreatedAt)
+	out.DateUpdated = twilioDate(s.CreatedAt)
+	out.DateSent = &sent
+	out.Direction = "inbound"
+	out.From = s.Phone
+	out.To = logic.ModemAddress(s.ICCID)
+	out.NumSegments = "1"
+	out.Status = "received"
+	out.sortTime = s.Timestamp
+	return out
+}
+
+func normalizeTwilioNumber(raw string) string {
+	return strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(strings.TrimSpace(raw))
+}
+
+func twilioSegments(body string) int {
+	pdus, err := sms.Encode([]byte(body), sms.AsSubmit)
+	if err != nil || len(pdus) == 0 {
+		return 1
+	}
+	return len(pdus)
+}
+
+func newTwilioMessageSID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "SM" + hex.EncodeToString(buf), nil
+}
+
+// resolveSendModem maps a modem reference (phone number, ICCID or name) to a
+// modem the actor may send from. Without a reference, the first online modem
+// the actor may send from is used, or the first offline one.
+func resolveSendModem(db *gorm.DB, wm *worker.Manager, actor *authActor, ref string) (*model.Modem, bool) {
+	canSend := func(iccid string) bool {
+		allowed, _, _ := actorCanAccessICCIDPermission(db, actor, iccid, PermSendSMS)
+		return allowed
+	}
+
+	if ref != "" {
+		var modem model.Modem
+		err := db.Where("(phone_number <> '' AND phone_number = ?) OR iccid = ? OR (name <> '' AND LOWER(name) = ?)",
+			normalizeTwilioNumber(ref), ref, strings.ToLower(ref)).First(&modem).Error
+		if err != nil || !canSend(modem.ICCID) {
+			return nil, false
+		}
+		return &modem, true
+	}
+
+	var modems []model.Modem
+	if err := db.Order("iccid asc").Find(&modems).Error; err != nil {
+		return nil, false
+	}
+	var fallback *model.Modem
+	for i := range modems {
+		if !canSend(modems[i].ICCID) {
+			continue
+		}
+		if wm.GetWorkerByICCID(modems[i].ICCID) != nil {
+			return &modems[i], true
+		}
+		if fallback == nil {
+			fallback = &modems[i]
+		}
+	}
+	return fallback, fallback != nil
+}
+
+func (h *TwilioHandler) CreateMessage(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		twilioError(c, http.StatusUnauthorized, 20003, "Authenticate")
+		return
+	}
+	accountSID := c.Param("sid")
+
+	to := normalizeTwilioNumber(c.PostForm("To"))
+	from := strings.TrimSpace(c.PostForm("From"))
+	body := c.PostForm("Body")
+	callback := strings.TrimSpace(c.PostForm("StatusCallback"))
+	serviceSID := strings.TrimSpace(c.PostForm("MessagingServiceSid"))
+
+	if to == "" {
+		twilioError(c, http.StatusBadRequest, 21604, "A 'To' phone number is required.")
+		return
+	}
+	if !twilioNumberPattern.MatchString(to) {
+		twilioError(c, http.StatusBadRequest, 21211, fmt.Sprintf("The 'To' number %s is not a valid phone number.", to))
+		return
+	}
+	if body == "" {
+		twilioError(c, http.StatusBadRequest, 21602, "Message body is required.")
+		return
+	}
+	if len([]rune(body)) > twilioMaxBodyLen {
+		twilioError(c, http.StatusBadRequest, 21617, "The concatenated message body exceeds the 1600 character limit.")
+		return
+	}
+	if from == "" && serviceSID == "" {
+		twilioError(c, http.StatusBadRequest, 21603, "A 'From' phone number is required.")
+		return
+	}
+	if callback != "" {
+		if u, err := url.Parse(callback); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			twilioError(c, http.StatusBadRequest, 21609, "Invalid StatusCallback URL.")
+			return
+		}
+		if actor.User.Role != "admin" {
+			if err := logic.CheckWebhookTarget(c.Request.Context(), callback); err != nil {
+				twilioError(c, http.StatusBadRequest, 21609, "Invalid StatusCallback URL: "+err.Error())
+				return
+			}
+		}
+	}
+
+	// A messaging service named like a modem pool routes through the pool,
+	// and From is filled in once a modem has sent the message.
+	var modem model.Modem
+	var pool *model.ModemPool
+	if from == "" {
+		pool, _ = repository.NewModemPoolRepository(h.db).FindByName(serviceSID)
+	}
+	poolName := ""
+	if pool != nil && pool.Enabled {
+		poolName = pool.Name
+	} else if resolved, ok := resolveSendModem(h.db, h.wm, actor, from); ok {
+		modem = *resolved
+	} else {
+		if from == "" {
+			twilioError(c, http.StatusBadRequest, 21606, "No SMS-capable modem is available for this account.")
+		} else {
+			twilioError(c, http.StatusBadRequest, 21606, fmt.Sprintf("The From phone number %s is not a valid, SMS-capable inbound phone number or short code for your account.", from))
+		}
+		return
+	}
+
+	// Pool sends are counted once a modem has sent them.
+	var err error
+	if poolName != "" {
+		err = h.quota.Check(actorQuotaSubject(actor), "")
+	} else {
+		err = h.quota.Reserve(actorQuotaSubject(actor), modem.ICCID)
+	}
+	if qe, ok := logic.AsQuotaExceeded(err); ok {
+		c.Header("Retry-After", strconv.Itoa(qe.RetryAfterSeconds()))
+		twilioError(c, http.StatusTooManyRequests, 20429, qe.Error())
+		return
+	} else if err != nil {
+		twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+		return
+	}
+
+	sid, err := newTwilioMessageSID()
+	if err != nil {
+		twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+		return
+	}
+	fromAddr := modem.PhoneNumber
+	if fromAddr == "" {
+		fromAddr = modem.ICCID
+	}
+	msg := &model.TwilioMessage{
+		SID:            sid,
+		UserID:         actor.User.ID,
+		ICCID:          modem.ICCID,
+		From:           fromAddr,
+		To:             to,
+		Body:           body,
+		NumSegments:    twilioSegments(body),
+		Status:         "queued",
+		StatusCallback: callback,
+	}
+	if actor.APIKey != nil {
+		msg.APIKeyID = actor.APIKey.ID
+	}
+	if err := h.db.Create(msg).Error; err != nil {
+		twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+		return
+	}
+
+	// Status callbacks are signed with the key the client authenticated with,
+	// like Twilio signs them with the account's auth token.
+	_, authToken, _ := c.Request.BasicAuth()
+	resp := twilioOutboundJSON(accountSID, msg)
+	go h.deliver(accountSID, authToken, msg, poolName, actor)
+
+	c.JSON(http.StatusCreated, resp)
+}
+
+// deliver sends the message from its modem, or through the pool when one is
+// given, in which case the modem that sent it becomes the message's From.
+func (h *TwilioHandler) deliver(accountSID, authToken string, msg *model.TwilioMessage, pool string, actor *authActor) {
+	h.db.Model(msg).Update("status", "sending")
+
+	updates := map[string]interface{}{}
+	var err error
+	if pool != "" {
+		var sms *model.SMS
+		if sms, err = sendViaPool(h.db, h.wm, h.quota, actor, pool, msg.To, msg.Body); err == nil {
+			msg.ICCID, msg.From = sms.ICCID, sms.ICCID
+			var modem model.Modem
+			if h.db.First(&modem, "iccid = ?", sms.ICCID).Error == nil && modem.PhoneNumber != "" {
+				msg.From = modem.PhoneNumber
+			}
+			updates["iccid"], updates["from_number"] = msg.ICCID, msg.From
+		}
+	} else if err = h.wm.SendSMSFrom(msg.ICCID, msg.To, msg.Body); err != nil {
+		h.quota.Release(actorQuotaSubject(actor), msg.ICCID)
+	}
+	if err != nil {
+		logger.Log.Warnf("Twilio message %s to %s via %s failed: %v", msg.SID, msg.To, msg.ICCID, err)
+		msg.Status, msg.ErrorCode, msg.ErrorMessage = "failed", twilioErrUnknown, err.Error()
+		updates["error_code"] = msg.ErrorCode
+		updates["error_message"] = msg.ErrorMessage
+	} else {
+		now := time.Now()
+		msg.Status, msg.SentAt = "sent", &now
+		updates["sent_at"] = now
+	}
+	updates["status"] = msg.Status
+	if err := h.db.Model(msg).Updates(updates).Error; err != nil {
+		logger.Log.Errorf("Failed to update Twilio message %s: %v", msg.SID, err)
+	}
+
+	if msg.StatusCallback != "" {
+		h.postStatusCallback(accountSID, authToken, msg, actor.User.Role != "admin")
+	}
+}
+
+// postStatusCallback reports the final status of msg. With publicOnly the
+// connection is refused unless it goes to a public address.
+func (h *TwilioHandler) postStatusCallback(accountSID, authToken string, msg *model.TwilioMessage, publicOnly bool) {
+	form := url.Values{
+		"MessageSid":    {msg.SID},
+		"SmsSid":        {msg.SID},
+		"MessageStatus": {msg.Status},
+		"SmsStatus":     {msg.Status},
+		"AccountSid":    {accountSID},
+		"From":          {msg.From},
+		"To":            {msg.To},
+		"ApiVersion":    {logic.TwilioAPIVersion},
+	}
+	if msg.ErrorCode != 0 {
+		form.Set("ErrorCode", strconv.Itoa(msg.ErrorCode))
+	}
+	req, err := http.NewRequest(http.MethodPost, msg.StatusCallback, strings.NewReader(form.Encode()))
+	if err != nil {
+		logger.Log.Warnf("Twilio status callback for %s: %v", msg.SID, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(logic.TwilioSignatureHeader, logic.TwilioSignature(authToken, msg.StatusCallback, form))
+	client := h.client
+	if publicOnly {
+		client = h.publicClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Log.Warnf("Twilio status callback for %s: %v", msg.SID, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		logger.Log.Warnf("Twilio status callback for %s returned %s", msg.SID, resp.Status)
+	}
+}
+
+// twilioDateRange converts DateSent, DateSent< and DateSent> (whole UTC days,
+// inclusive) to a half-open time range. Zero times are unbounded.
+func twilioDateRange(c *gin.Context) (time.Time, time.Time, bool) {
+	var from, until time.Time
+	parse := func(key string) (time.Time, bool) {
+		raw := strings.TrimSpace(c.Query(key))
+		if raw == "" {
+			return time.Time{}, true
+		}
+		if t, err := time.Parse(twilioDateSentLayout, raw); err == nil {
+			return t, true
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		return t, err == nil
+	}
+	day, ok1 := parse("DateSent")
+	before, ok2 := parse("DateSent<")
+	after, ok3 := parse("DateSent>")
+	if !ok1 || !ok2 || !ok3 {
+		return from, until, false
+	}
+	if !day.IsZero() {
+		from, until = day, day.AddDate(0, 0, 1)
+	}
+	if !before.IsZero() {
+		until = before.AddDate(0, 0, 1)
+	}
+	if !after.IsZero() {
+		from = after
+	}
+	return from, until, true
+}
+
+func (h *TwilioHandler) ListMessages(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		twilioError(c, http.StatusUnauthorized, 20003, "Authenticate")
+		return
+	}
+	accountSID := c.Param("sid")
+
+	pageSize, err := strconv.Atoi(c.DefaultQuery("PageSize", strconv.Itoa(twilioDefaultPageSize)))
+	if err != nil || pageSize <= 0 {
+		pageSize = twilioDefaultPageSize
+	}
+	if pageSize > twilioMaxPageSize {
+		pageSize = twilioMaxPageSize
+	}
+	page, err := strconv.Atoi(c.DefaultQuery("Page", "0"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+	dateFrom, dateUntil, ok := twilioDateRange(c)
+	if !ok {
+		twilioError(c, http.StatusBadRequest, 20001, "DateSent must be YYYY-MM-DD.")
+		return
+	}
+	to := normalizeTwilioNumber(c.Query("To"))
+	from := normalizeTwilioNumber(c.Query("From"))
+
+	// Fetch enough of both directions to fill the requested page after
+	// merging, plus one to know whether a next page exists.
+	limit := (page+1)*pageSize + 1
+	var messages []twilioMessageJSON
+
+	outbound := h.db.Model(&model.TwilioMessage{}).Where("user_id = ?", actor.User.ID)
+	if to != "" {
+		outbound = outbound.Where("to_number = ?", to)
+	}
+	if from != "" {
+		outbound = outbound.Where("from_number = ?", from)
+	}
+	if !dateFrom.IsZero() {
+		outbound = outbound.Where("COALESCE(sent_at, created_at) >= ?", dateFrom)
+	}
+	if !dateUntil.IsZero() {
+		outbound = outbound.Where("COALESCE(sent_at, created_at) < ?", dateUntil)
+	}
+	var sent []model.TwilioMessage
+	if err := outbound.Order("created_at desc").Limit(limit).Find(&sent).Error; err != nil {
+		twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+		return
+	}
+	for i := range sent {
+		messages = append(messages, twilioOutboundJSON(accountSID, &sent[i]))
+	}
+
+	if actor.APIKey == nil || actor.APIKey.CanViewSMS {
+		inbound, err := scopedSMSQuery(h.db, actor, "", "received")
+		if err != nil {
+			twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+			return
+		}
+		if to != "" {
+			inbound = inbound.Where("iccid IN (?)", h.db.Model(&model.Modem{}).Select("iccid").
+				Where("(phone_number <> '' AND phone_number = ?) OR iccid = ?", to, to))
+		}
+		if from != "" {
+			inbound = inbound.Where("phone = ?", from)
+		}
+		if !dateFrom.IsZero() {
+			inbound = inbound.Where("timestamp >= ?", dateFrom)
+		}
+		if !dateUntil.IsZero() {
+			inbound = inbound.Where("timestamp < ?", dateUntil)
+		}
+		var received []model.SMS
+		if err := inbound.Order("timestamp desc").Limit(limit).Find(&received).Error; err != nil {
+			twilioError(c, http.StatusInternalServerError, 20500, "Internal Server Error")
+			return
+		}
+		for i := range received {
+			messages = append(messages, twilioInboundJSON(accountSID, &received[i]))
+		}
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].sortTime.After(messages[j].sortTime)
+	})
+
+	start := page * pageSize
+	hasNext := len(messages) > start+pageSize
+	if start > len(messages) {
+		start = len(messages)
+	}
+	end := start + pageSize
+	if end > len(messages) {
+		end = len(messages)
+	}
+	pageMessages := messages[start:end]
+	if pageMessages == nil {
+		pageMessages = []twilioMessageJSON{}
+	}
+
+	pageURI := func(p int) string {
+		q := c.Request.URL.Query()
+		q.Set("PageSize", strconv.Itoa(pageSize))
+		q.Set("Page", strconv.Itoa(p))
+		return twilioAccountPath(accountSID) + "/Messages.json?" + q.Encode()
+	}
+	var nextURI, prevURI *string
+	if hasNext {
+		u := pageURI(page + 1)
+		nextURI = &u
+	}
+	if page > 0 {
+		u := pageURI(page - 1)
+		prevURI = &u
+	}
+	endIndex := start
+	if len(pageMessages) > 0 {
+		endIndex = start + len(pageMessages) - 1
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"messages":          pageMessages,
+		"page":              page,
+		"page_size":         pageSize,
+		"start":             start,
+		"end":               endIndex,
+		"uri":               pageURI(page),
+		"first_page_uri":    pageURI(0),
+		"next_page_uri":     nextURI,
+		"previous_page_uri": prevURI,
+	})
+}
+
+func (h *TwilioHandler) GetMessage(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		twilioError(c, http.StatusUnauthorized, 20003, "Authenticate")
+		return
+	}
+	accountSID := c.Param("sid")
+	sid := strings.TrimSuffix(c.Param("message"), ".json")
+	notFound := func() {
+		twilioError(c, http.StatusNotFound, 20404, fmt.Sprintf("The requested resource %s was not found", c.Request.URL.Path))
+	}
+
+	var msg model.TwilioMessage
+	if err := h.db.Where("sid = ? AND user_id = ?", sid, actor.User.ID).First(&msg).Error; err == nil {
+		c.JSON(http.StatusOK, twilioOutboundJSON(accountSID, &msg))
+		return
+	}
+
+	if len(sid) != 34 || !strings.HasPrefix(sid, "SM") {
+		notFound()
+		return
+	}
+	id, err := strconv.ParseUint(sid[2:], 16, 64)
+	if err != nil || (actor.APIKey != nil && !actor.APIKey.CanViewSMS) {
+		notFound()
+		return
+	}
+	var s model.SMS
+	if err := h.db.Where("id = ? AND type = ? AND is_spam = ?", id, "received", false).First(&s).Error; err != nil {
+		notFound()
+		return
+	}
+	if allowed, _, _ := actorCanAccessICCIDPermission(h.db, actor, s.ICCID, PermViewSMS); !allowed {
+		notFound()
+		return
+	}
+	c.JSON(http.StatusOK, twilioInboundJSON(accountSID, &s))
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+const (
+	mfaChallengeTTL      = 5 * time.Minute
+	mfaChallengeAttempts = 5
+)
+
+// mfaChallenge is a login that passed the password check and waits for the
+// second factor.
+type mfaChallenge struct {
+	userID   uint
+	expires  time.Time
+	attempts int
+}
+
+// twoFactorEnrollmentRequired reports whether an admin must set up two-factor
+// authentication before using the dashboard. Single sign-on users are left to
+// their identity provider.
+func twoFactorEnrollmentRequired(settings *logic.Settings, user *model.User) bool {
+	return user.Role == "admin" && !user.TOTPEnabled && user.PasswordHash != oidcNoPassword &&
+		settings.Bool(logic.SettingRequireAdmin2FA)
+}
+
+// twoFactorExempt are the routes an admin who has to enroll can still use.
+func twoFactorExempt(c *gin.Context) bool {
+	path := c.FullPath()
+	return path == "/api/v1/2fa" || strings.HasPrefix(path, "/api/v1/2fa/") || path == "/api/v1/logout"
+}
+
+// startMFAChallenge returns the token the second login step presents.
+func (h *UserHandler) startMFAChallenge(userID uint) string {
+	token := randomHex(24)
+	now := time.Now()
+	h.mu.Lock()
+	for k, ch := range h.challenges {
+		if now.After(ch.expires) {
+			delete(h.challenges, k)
+		}
+	}
+	h.challenges[token] = &mfaChallenge{userID: userID, expires: now.Add(mfaChallengeTTL)}
+	h.mu.Unlock()
+	return token
+}
+
+// writeTwoFactorLocked answers 429 with Retry-After if the user's second
+// factor is locked after too many wrong codes. The lock belongs to the user,
+// so starting a new login does not reset it.
+func writeTwoFactorLocked(c *gin.Context, twoFactor *logic.TwoFactor, user *model.User) bool {
+	left, locked := twoFactor.LockedFor(user)
+	if !locked {
+		return false
+	}
+	retry := int(math.Ceil(left.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retry))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": logic.Err2FALocked.Error(), "retry_after": retry})
+	return true
+}
+
+// LoginTwoFactor is the second login step. It trades the token from Login and
+// a TOTP or recovery code for the session tokens.
+func (h *UserHandler) LoginTwoFactor(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.mu.Lock()
+	ch, ok := h.challenges[req.MFAToken]
+	if ok && time.Now().After(ch.expires) {
+		delete(h.challenges, req.MFAToken)
+		ok = false
+	}
+	h.mu.Unlock()
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+		return
+	}
+
+	var user model.User
+	if err := h.db.First(&user, ch.userID).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired, please sign in again"})
+		return
+	}
+	// Failed and successful attempts are audited under the user.
+	c.Set("user", &user)
+	if writeTwoFactorLocked(c, h.twoFactor, &user) {
+		h.mu.Lock()
+		delete(h.challenges, req.MFAToken)
+		h.mu.Unlock()
+		return
+	}
+
+	usedRecovery, err := h.twoFactor.Verify(&user, req.Code)
+	if err != nil {
+		h.mu.Lock()
+		ch.attempts++
+		if ch.attempts >= mfaChallengeAttempts {
+			delete(h.challenges, req.MFAToken)
+		}
+		h.mu.Unlock()
+		// The code that used up the attempts locks the second factor.
+		if writeTwoFactorLocked(c, h.twoFactor, &user) {
+			return
+		}
+		if errors.Is(err, logic.Err2FALocked) {
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, logic.ErrInvalid2FACode) || errors.Is(err, logic.Err2FANotEnrolled) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid two-factor code"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	h.mu.Lock()
+	delete(h.challenges, req.MFAToken)
+	h.mu.Unlock()
+
+	tokens, err := h.sessions.Create(&user, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	resp := gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"token_type":    tokens.TokenType,
+		"user":          user,
+	}
+	if usedRecovery {
+		left, _ := h.twoFactor.RecoveryCodesLeft(user.ID)
+		resp["recovery_codes_left"] = left
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// TwoFactorStatus shows whether the caller has two-factor authentication on.
+func (h *UserHandler) TwoFactorStatus(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	left, err := h.twoFactor.RecoveryCodesLeft(actor.User.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":             actor.User.TOTPEnabled,
+		"recovery_codes_left": left,
+		"required":            actor.User.Role == "admin" && actor.User.PasswordHash != oidcNoPassword && h.settings.Bool(logic.SettingRequireAdmin2FA),
+		"available":           actor.User.PasswordHash != oidcNoPassword,
+	})
+}
+
+// SetupTwoFactor creates a new secret for the caller's authenticator app.
+// It is not used for logins until confirmed with EnableTwoFactor.
+func (h *UserHandler) SetupTwoFactor(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if actor.User.PasswordHash == oidcNoPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is managed by the identity provider"})
+		return
+	}
+	secret, uri, err := h.twoFactor.Setup(actor.User)
+	if errors.Is(err, logic.Err2FAAlreadyActive) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "uri": uri})
+}
+
+// EnableTwoFactor confirms the secret from SetupTwoFactor with a code from the
+// app and returns the recovery codes, which are only shown once.
+func (h *UserHandler) EnableTwoFactor(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	codes, err := h.twoFactor.Enable(actor.User, req.Code)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Two-factor authentication enabled", "recovery_codes": codes})
+}
+
+// DisableTwoFactor turns two-factor authentication off for the caller, who
+// confirms with their password and a current code.
+func (h *UserHandler) DisableTwoFactor(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req struct {
+		Password string `json:"password" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if actor.User.Role == "admin" && h.settings.Bool(logic.SettingRequireAdmin2FA) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for admins"})
+		return
+	}
+	if !checkPasswordHash(req.Password, actor.User.PasswordHash) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Incorrect password"})
+		return
+	}
+	if _, err := h.twoFactor.Verify(actor.User, req.Code); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	if err := h.twoFactor.Disable(actor.User.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Two-factor authentication disabled"})
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes after checking
+// a current code.
+func (h *UserHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := h.twoFactor.Verify(actor.User, req.Code); err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	codes, err := h.twoFactor.RegenerateRecoveryCodes(actor.User)
+	if err != nil {
+		twoFactorError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+func twoFactorError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, logic.ErrInvalid2FACode):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid two-factor code"})
+	case errors.Is(err, logic.Err2FANotEnrolled), errors.Is(err, logic.Err2FAAlreadyActive):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, logic.Err2FALocked):
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// ResetUserTwoFactor turns two-factor authentication off for a user who lost
+// their authenticator, so they can log in with the password and enroll again.
+func (h *UserHandler) ResetUserTwoFactor(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	var user model.User
+	if err := h.db.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err := h.twoFactor.Disable(user.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "Two-factor authentication reset"})
+}
+
+// GetSecuritySettings returns the dashboard-wide security settings.
+func (h *UserHandler) GetSecuritySettings(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"require_admin_2fa": h.settings.Bool(logic.SettingRequireAdmin2FA)})
+}
+
+// UpdateSecuritySettings changes the dashboard-wide security settings.
+func (h *UserHandler) UpdateSecuritySettings(c *gin.Context) {
+	var req struct {
+		RequireAdmin2FA *bool `json:"require_admin_2fa"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RequireAdmin2FA != nil {
+		if err := h.settings.Set(logic.SettingRequireAdmin2FA, strconv.FormatBool(*req.RequireAdmin2FA)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	h.GetSecuritySettings(c)
+}
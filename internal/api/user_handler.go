@@ -1,22 +1,36 @@
 package api
 
 import (
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/gin-gonic/gin"
-	"github.com/pccr10001/smsie/internal/auth"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
 	"gorm.io/gorm"
 )
 
 type UserHandler struct {
-	db *gorm.DB
+	db        *gorm.DB
+	sessions  *logic.SessionManager
+	twoFactor *logic.TwoFactor
+	settings  *logic.Settings
+
+	mu         sync.Mutex
+	challenges map[string]*mfaChallenge
 }
 
 func NewUserHandler(db *gorm.DB) *UserHandler {
-	return &UserHandler{db: db}
+	return &UserHandler{
+		db:         db,
+		sessions:   logic.NewSessionManager(db),
+		twoFactor:  logic.NewTwoFactor(db),
+		settings:   logic.NewSettings(db),
+		challenges: make(map[string]*mfaChallenge),
+	}
 }
 
 type permissionInput struct {
@@ -69,18 +83,108 @@ func (h *UserHandler) Login(c *gin.Context) {
 		return
 	}
 
-	token, err := auth.GenerateToken(&user)
+	// The session is only issued once the second factor is checked by
+	// LoginTwoFactor.
+	if user.TOTPEnabled {
+		if writeTwoFactorLocked(c, h.twoFactor, &user) {
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    h.startMFAChallenge(user.ID),
+			"methods":      []string{"totp", "recovery_code"},
+		})
+		return
+	}
+
+	tokens, err := h.sessions.Create(&user, c.ClientIP(), c.Request.UserAgent())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"user":  user,
+		"token":                    tokens.AccessToken,
+		"refresh_token":            tokens.RefreshToken,
+		"expires_in":               tokens.ExpiresIn,
+		"token_type":               tokens.TokenType,
+		"user":                     user,
+		"totp_enrollment_required": twoFactorEnrollmentRequired(h.settings, &user),
+	})
+}
+
+// RefreshToken trades a refresh token for a new access token and refresh
+// token. The old refresh token stops working.
+func (h *UserHandler) RefreshToken(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokens, user, err := h.sessions.Refresh(req.RefreshToken, c.ClientIP(), c.Request.UserAgent())
+	if errors.Is(err, logic.ErrSessionInvalid) || errors.Is(err, logic.ErrRefreshReused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+	// Refreshes are audited under the session's user.
+	c.Set("user", user)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":         tokens.AccessToken,
+		"refresh_token": tokens.RefreshToken,
+		"expires_in":    tokens.ExpiresIn,
+		"token_type":    tokens.TokenType,
+		"user":          user,
 	})
 }
 
+// Logout revokes the caller's session, or with {"all": true} every session
+// of the user.
+func (h *UserHandler) Logout(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	sessionID := c.GetString("session_id")
+	if sessionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only dashboard sessions can log out; deactivate API keys instead"})
+		return
+	}
+
+	var req struct {
+		All bool `json:"all"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	if req.All {
+		n, err := h.sessions.RevokeUser(actor.User.ID, "")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "logged out", "revoked": n})
+		return
+	}
+	if err := h.sessions.Revoke(sessionID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "logged out", "revoked": 1})
+}
+
 func (h *UserHandler) ListUsers(c *gin.Context) {
 	var users []model.User
 	if err := h.db.Find(&users).Error; err != nil {
@@ -236,6 +340,48 @@ func (h *UserHandler) replaceUserPermissions(userID uint, allowedModems string,
 	return nil
 }
 
+// UpdateUserTelegram links a Telegram user ID to the user for the Telegram
+// bot; 0 unlinks it.
+func (h *UserHandler) UpdateUserTelegram(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+
+	var req struct {
+		TelegramID int64 `json:"telegram_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.TelegramID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid telegram_id"})
+		return
+	}
+
+	var user model.User
+	if err := h.db.First(&user, id).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if req.TelegramID != 0 {
+		var count int64
+		h.db.Model(&model.User{}).Where("telegram_id = ? AND id <> ?", req.TelegramID, user.ID).Count(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "telegram_id is linked to another user"})
+			return
+		}
+	}
+
+	if err := h.db.Model(&user).Update("telegram_id", req.TelegramID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
 func (h *UserHandler) DeleteUser(c *gin.Context) {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
@@ -243,6 +389,10 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if _, err := h.sessions.RevokeUser(uint(id), ""); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 }
 
@@ -264,6 +414,11 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
+	if user.PasswordHash == oidcNoPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is managed by the identity provider"})
+		return
+	}
+
 	// Verify old password
 	if !checkPasswordHash(req.OldPassword, user.PasswordHash) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Incorrect old password"})
@@ -283,5 +438,12 @@ func (h *UserHandler) ChangePassword(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"status": "Password updated"})
+	// Log out everywhere else; the session that changed it stays signed in.
+	revoked, err := h.sessions.RevokeUser(user.ID, c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password updated, but failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "Password updated", "revoked_sessions": revoked})
 }
@@ -1,52 +1,534 @@
 package api
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
 	"gorm.io/gorm"
 )
 
 type WebhookHandler struct {
-	db *gorm.DB
+	db         *gorm.DB
+	deliveries *repository.WebhookDeliveryRepository
+	service    *logic.WebhookService
 }
 
 func NewWebhookHandler(db *gorm.DB) *WebhookHandler {
-	return &WebhookHandler{db: db}
+	deliveries := repository.NewWebhookDeliveryRepository(db)
+	service := logic.NewWebhookService(repository.NewWebhookRepository(db), deliveries, repository.NewSMSRepository(db))
+	service.SetAuthorizer(NewSMSRuleAuthorizer(db))
+	return &WebhookHandler{
+		db:         db,
+		deliveries: deliveries,
+		service:    service,
+	}
+}
+
+type webhookRequest struct {
+	ICCID          *string            `json:"iccid"`
+	ICCIDs         *string            `json:"iccids"`
+	URL            *string            `json:"url"`
+	Platform       *string            `json:"platform"`
+	ChannelID      *string            `json:"channel_id"`
+	Template       *string            `json:"template"`
+	Title          *string            `json:"title"`
+	Priority       *string            `json:"priority"`
+	Markdown       *bool              `json:"markdown"`
+	Token          *string            `json:"token"`
+	SMTPHost       *string            `json:"smtp_host"`
+	SMTPPort       *int               `json:"smtp_port"`
+	SMTPUsername   *string            `json:"smtp_username"`
+	SMTPPassword   *string            `json:"smtp_password"`
+	SMTPSecurity   *string            `json:"smtp_security"`
+	EmailFrom      *string            `json:"email_from"`
+	EmailTo        *string            `json:"email_to"`
+	Enabled        *bool              `json:"enabled"`
+	SenderPattern  *string            `json:"sender_pattern"`
+	ContentRegex   *string            `json:"content_regex"`
+	Keywords       *string            `json:"keywords"`
+	MessageTypes   *string            `json:"message_types"`
+	Method         *string            `json:"method"`
+	ContentType    *string            `json:"content_type"`
+	Headers        *map[string]string `json:"headers"`
+	Secret         *string            `json:"secret"`
+	GenerateSecret bool               `json:"generate_secret"`
+}
+
+// apply copies the request onto the webhook. It returns a newly generated
+// secret, which is shown to the caller once.
+func (req webhookRequest) apply(wh *model.Webhook) (string, error) {
+	if req.ICCID != nil {
+		wh.ICCID = *req.ICCID
+	}
+	if req.ICCIDs != nil {
+		wh.ICCIDs = *req.ICCIDs
+	}
+	if req.URL != nil {
+		wh.URL = *req.URL
+	}
+	if req.Platform != nil {
+		wh.Platform = *req.Platform
+	}
+	if req.ChannelID != nil {
+		wh.ChannelID = *req.ChannelID
+	}
+	if req.Template != nil {
+		wh.Template = *req.Template
+	}
+	if req.Title != nil {
+		wh.Title = *req.Title
+	}
+	if req.Priority != nil {
+		wh.Priority = *req.Priority
+	}
+	if req.Markdown != nil {
+		wh.Markdown = *req.Markdown
+	}
+	if req.Token != nil && *req.Token != logic.WebhookHeaderMask {
+		wh.Token = strings.TrimSpace(*req.Token)
+	}
+	if req.SMTPHost != nil {
+		wh.SMTPHost = *req.SMTPHost
+	}
+	if req.SMTPPort != nil {
+		wh.SMTPPort = *req.SMTPPort
+	}
+	if req.SMTPUsername != nil {
+		wh.SMTPUsername = *req.SMTPUsername
+	}
+	if req.SMTPPassword != nil && *req.SMTPPassword != logic.WebhookHeaderMask {
+		wh.SMTPPassword = *req.SMTPPassword
+	}
+	if req.SMTPSecurity != nil {
+		wh.SMTPSecurity = *req.SMTPSecurity
+	}
+	if req.EmailFrom != nil {
+		wh.EmailFrom = *req.EmailFrom
+	}
+	if req.EmailTo != nil {
+		wh.EmailTo = *req.EmailTo
+	}
+	if req.Enabled != nil {
+		wh.Enabled = *req.Enabled
+	}
+	if req.SenderPattern != nil {
+		wh.SenderPattern = *req.SenderPattern
+	}
+	if req.ContentRegex != nil {
+		wh.ContentRegex = *req.ContentRegex
+	}
+	if req.Keywords != nil {
+		wh.Keywords = *req.Keywords
+	}
+	if req.MessageTypes != nil {
+		wh.MessageTypes = *req.MessageTypes
+	}
+	if req.Method != nil {
+		wh.Method = *req.Method
+	}
+	if req.ContentType != nil {
+		wh.ContentType = *req.ContentType
+	}
+	if req.Headers != nil {
+		if err := logic.SetWebhookHeaders(wh, *req.Headers); err != nil {
+			return "", err
+		}
+	}
+	if req.Secret != nil {
+		wh.Secret = strings.TrimSpace(*req.Secret)
+	}
+	if err := logic.ValidateWebhookFilters(wh); err != nil {
+		return "", err
+	}
+	if err := logic.ValidateWebhookRequestOptions(wh); err != nil {
+		return "", err
+	}
+	if err := logic.ValidateWebhookPlatform(wh); err != nil {
+		return "", err
+	}
+
+	if !req.GenerateSecret {
+		return "", nil
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	wh.Secret = "whsec_" + hex.EncodeToString(buf)
+	return wh.Secret, nil
 }
 
+// webhookWithSecret is returned once when the server generated the secret.
+type webhookWithSecret struct {
+	model.Webhook
+	Secret string `json:"secret"`
+}
+
+// presentWebhook fills the runtime fields; the secret itself is never returned.
+func presentWebhook(wh *model.Webhook) {
+	wh.HeaderMap = logic.MaskWebhookHeaders(logic.WebhookHeaders(wh))
+	wh.HasSecret = wh.Secret != ""
+	wh.HasToken = wh.Token != ""
+	wh.HasSMTPPass = wh.SMTPPassword != ""
+}
+
+// ListWebhooks returns the caller's own webhooks; admins see every webhook
+// and may narrow the list with ?user_id=. With ?iccid= only webhooks covering
+// the modem (its own, multi-modem and wildcard webhooks) are returned.
 func (h *WebhookHandler) ListWebhooks(c *gin.Context) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
 	iccid := c.Query("iccid")
-	var list []model.Webhook
-	if err := h.db.Where("iccid = ?", iccid).Find(&list).Error; err != nil {
+	query := h.db.Model(&model.Webhook{})
+	if actor.User.Role != "admin" {
+		query = query.Where("user_id = ?", actor.User.ID)
+	} else if userID := c.Query("user_id"); userID != "" {
+		query = query.Where("user_id = ?", userID)
+	}
+	if iccid != "" {
+		query = query.Where("iccid = ? OR iccid = '*' OR iccids LIKE ?", iccid, "%"+iccid+"%")
+	}
+
+	var found []model.Webhook
+	if err := query.Order("id asc").Find(&found).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+
+	list := make([]model.Webhook, 0, len(found))
+	for i := range found {
+		if iccid != "" && !logic.WebhookCoversICCID(&found[i], iccid) {
+			continue
+		}
+		presentWebhook(&found[i])
+		list = append(list, found[i])
+	}
 	c.JSON(http.StatusOK, list)
 }
 
 func (h *WebhookHandler) CreateWebhook(c *gin.Context) {
-	var wh model.Webhook
-	if err := c.ShouldBindJSON(&wh); err != nil {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
+	wh := model.Webhook{UserID: actor.User.ID, Enabled: true}
+	secret, err := req.apply(&wh)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeScope(c, actor, &wh) {
+		return
+	}
+
 	if err := h.db.Create(&wh).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	h.respondWebhook(c, &wh, secret)
+}
+
+// UpdateWebhook changes the fields present in the body. Masked header, token
+// and password values keep what is stored; "enabled" pauses the webhook.
+func (h *WebhookHandler) UpdateWebhook(c *gin.Context) {
+	actor, wh, ok := h.loadOwnedWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	secret, err := req.apply(wh)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.authorizeScope(c, actor, wh) {
+		return
+	}
+
+	if err := h.db.Save(wh).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	h.respondWebhook(c, wh, secret)
+}
+
+func (h *WebhookHandler) respondWebhook(c *gin.Context, wh *model.Webhook, secret string) {
+	presentWebhook(wh)
+	if secret != "" {
+		c.JSON(http.StatusOK, webhookWithSecret{Webhook: *wh, Secret: secret})
+		return
+	}
 	c.JSON(http.StatusOK, wh)
 }
 
 func (h *WebhookHandler) DeleteWebhook(c *gin.Context) {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
-	if err := h.db.Delete(&model.Webhook{}, id).Error; err != nil {
+	_, wh, ok := h.loadOwnedWebhook(c)
+	if !ok {
+		return
+	}
+
+	if err := h.db.Delete(&model.Webhook{}, wh.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.db.Where("webhook_id = ?", wh.ID).Delete(&model.WebhookDelivery{}).Error; err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
 }
+
+// TestWebhook sends a sample SMS right away, even to a disabled webhook, and
+// returns the receiver's response; non-admins only get its status code. The
+// body may override iccid, phone and content of the sample. Nothing is
+// recorded in the delivery log.
+func (h *WebhookHandler) TestWebhook(c *gin.Context) {
+	actor, wh, ok := h.loadOwnedWebhook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		ICCID   string `json:"iccid"`
+		Phone   string `json:"phone"`
+		Content string `json:"content"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	sms := &model.SMS{
+		ICCID:     req.ICCID,
+		Phone:     req.Phone,
+		Content:   req.Content,
+		Type:      "received",
+		Timestamp: time.Now(),
+	}
+	if sms.ICCID == "" {
+		if scope := logic.WebhookScopeICCIDs(wh); len(scope) > 0 {
+			sms.ICCID = scope[0]
+		}
+	} else if !logic.WebhookCoversICCID(wh, sms.ICCID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "iccid is not covered by this webhook"})
+		return
+	}
+	if sms.Phone == "" {
+		sms.Phone = "+10000000000"
+	}
+	if sms.Content == "" {
+		sms.Content = "Test message from smsie"
+	}
+	logic.ApplyOTP(sms)
+
+	res := h.service.Test(*wh, sms)
+	if actor.User.Role != "admin" {
+		res.Body = ""
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// loadOwnedWebhook loads :id; webhooks of other users are reported as not
+// found unless the caller is an admin.
+func (h *WebhookHandler) loadOwnedWebhook(c *gin.Context) (*authActor, *model.Webhook, bool) {
+	actor, ok := getActor(c)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, nil, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook id"})
+		return nil, nil, false
+	}
+
+	var wh model.Webhook
+	if err := h.db.First(&wh, id).Error; err != nil ||
+		(actor.User.Role != "admin" && wh.UserID != actor.User.ID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, nil, false
+	}
+	return actor, &wh, true
+}
+
+// authorizeScope requires view_sms on every modem the webhook covers; only
+// admins may use the "*" scope.
+func (h *WebhookHandler) authorizeScope(c *gin.Context, actor *authActor, wh *model.Webhook) bool {
+	if wh.ICCID == logic.WebhookAllModems && actor.User.Role != "admin" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create webhooks for all modems"})
+		return false
+	}
+	for _, iccid := range logic.WebhookScopeICCIDs(wh) {
+		allowed, status, message := actorCanAccessICCIDPermission(h.db, actor, iccid, PermViewSMS)
+		if !allowed {
+			c.JSON(status, gin.H{"error": message})
+			return false
+		}
+	}
+	// The shared bot would post anywhere, so others may only reach their own
+	// linked Telegram account through it.
+	if wh.Platform == "telegram" && wh.URL == "" && actor.User.Role != "admin" &&
+		(actor.User.TelegramID == 0 || wh.ChannelID != strconv.FormatInt(actor.User.TelegramID, 10)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Without a url, channel_id must be your linked Telegram account"})
+		return false
+	}
+	// Only admins may point webhooks at the internal network; delivery
+	// checks the address again when connecting.
+	if wh.URL != "" && actor.User.Role != "admin" {
+		if err := logic.CheckWebhookTarget(c.Request.Context(), wh.URL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "url: " + err.Error()})
+			return false
+		}
+	}
+	if wh.Platform == "email" && actor.User.Role != "admin" {
+		if err := logic.CheckWebhookTarget(c.Request.Context(), "smtp://"+wh.SMTPHost); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "smtp_host: " + err.Error()})
+			return false
+		}
+	}
+	return true
+}
+
+// ListDeliveries returns the delivery log, newest first. Filters: webhook_id,
+// iccid, status (sending, retrying, success, dead), limit (max 500), offset.
+func (h *WebhookHandler) ListDeliveries(c *gin.Context) {
+	h.listDeliveries(c, c.Query("status"))
+}
+
+// ListDeadLetters returns deliveries that exhausted their retries or failed
+// permanently and can be redelivered manually.
+func (h *WebhookHandler) ListDeadLetters(c *gin.Context) {
+	h.listDeliveries(c, repository.DeliveryDead)
+}
+
+func (h *WebhookHandler) listDeliveries(c *gin.Context, status string) {
+	filter := repository.WebhookDeliveryFilter{
+		ICCID:  c.Query("iccid"),
+		Status: status,
+		Limit:  100,
+	}
+	if v := c.Query("webhook_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid webhook_id"})
+			return
+		}
+		filter.WebhookID = uint(id)
+	}
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 {
+		filter.Limit = v
+		if filter.Limit > 500 {
+			filter.Limit = 500
+		}
+	}
+	if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+		filter.Offset = v
+	}
+
+	list, total, err := h.deliveries.List(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": list, "total": total})
+}
+
+// RedeliverDelivery sends a delivery again synchronously and returns the
+// updated record, including the receiver's response.
+func (h *WebhookHandler) RedeliverDelivery(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid delivery id"})
+		return
+	}
+
+	d, err := h.service.Redeliver(uint(id))
+	if err != nil {
+		if errors.Is(err, logic.ErrDeliveryInFlight) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// WebhookStats returns per-webhook delivery counters and success rate.
+// Optional filters: iccid, since (Go duration such as 24h).
+func (h *WebhookHandler) WebhookStats(c *gin.Context) {
+	var since time.Time
+	if v := c.Query("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since duration"})
+			return
+		}
+		since = time.Now().Add(-d)
+	}
+
+	stats, err := h.deliveries.Stats(c.Query("iccid"), since)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// removeModemFromWebhooks drops a deleted modem from webhook scopes and
+// deletes webhooks that no longer cover any modem.
+func removeModemFromWebhooks(tx *gorm.DB, iccid string) error {
+	var scoped []model.Webhook
+	if err := tx.Where("iccid = ? OR iccids LIKE ?", iccid, "%"+iccid+"%").Find(&scoped).Error; err != nil {
+		return err
+	}
+	for i := range scoped {
+		wh := &scoped[i]
+		if !logic.WebhookCoversICCID(wh, iccid) {
+			continue
+		}
+		if logic.RemoveWebhookICCID(wh, iccid) {
+			if err := tx.Model(wh).Updates(map[string]interface{}{"iccid": wh.ICCID, "iccids": wh.ICCIDs}).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tx.Delete(&model.Webhook{}, wh.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("webhook_id = ?", wh.ID).Delete(&model.WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,45 +1,217 @@
 package auth
 
 import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/pccr10001/smsie/internal/config"
 	"github.com/pccr10001/smsie/internal/model"
 )
 
-var secretKey = []byte("YOUR_SECRET_KEY_CHANGE_IN_PROD") // Should come from config
+const minSecretLen = 16
+
+var (
+	mu         sync.RWMutex
+	keys       = map[string][]byte{}
+	signingKID string
+	accessTTL  = 15 * time.Minute
+	refreshTTL = 720 * time.Hour
+)
 
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Role   string `json:"role"`
+	UserID    uint   `json:"user_id"`
+	Role      string `json:"role"`
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func GenerateToken(user *model.User) (string, error) {
-	expirationTime := time.Now().Add(24 * time.Hour)
+// Init loads the signing keys and token lifetimes. A configured secret wins;
+// otherwise keys come from the key file, which gets a random key if it does
+// not exist yet.
+func Init(cfg config.AuthConfig) error {
+	access, err := parseTTL("access_token_ttl", cfg.AccessTokenTTL, 15*time.Minute)
+	if err != nil {
+		return err
+	}
+	refresh, err := parseTTL("refresh_token_ttl", cfg.RefreshTokenTTL, 720*time.Hour)
+	if err != nil {
+		return err
+	}
+
+	ring := map[string][]byte{}
+	var kid string
+	if cfg.JWTSecret != "" {
+		for _, secret := range append(cfg.JWTPreviousSecrets, cfg.JWTSecret) {
+			if len(secret) < minSecretLen {
+				return fmt.Errorf("JWT secrets must be at least %d bytes", minSecretLen)
+			}
+			kid = secretKID([]byte(secret))
+			ring[kid] = []byte(secret)
+		}
+	} else {
+		if _, err := os.Stat(cfg.JWTKeyFile); errors.Is(err, os.ErrNotExist) {
+			if _, err := RotateKeyFile(cfg.JWTKeyFile); err != nil {
+				return err
+			}
+		}
+		if ring, kid, err = readKeyFile(cfg.JWTKeyFile); err != nil {
+			return err
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	keys, signingKID = ring, kid
+	accessTTL, refreshTTL = access, refresh
+	return nil
+}
+
+func parseTTL(name, value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, value)
+	}
+	return d, nil
+}
+
+// secretKID names a configured secret without revealing it.
+func secretKID(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:4])
+}
+
+// readKeyFile reads "kid secret" lines, secrets in base64url. The last key
+// signs new tokens; all of them verify.
+func readKeyFile(path string) (map[string][]byte, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+
+	ring := map[string][]byte{}
+	var kid string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, "", fmt.Errorf("%s:%d: expected \"kid secret\"", path, line)
+		}
+		secret, err := base64.RawURLEncoding.DecodeString(fields[1])
+		if err != nil || len(secret) < minSecretLen {
+			return nil, "", fmt.Errorf("%s:%d: invalid secret", path, line)
+		}
+		kid = fields[0]
+		ring[kid] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if kid == "" {
+		return nil, "", fmt.Errorf("%s: no keys", path)
+	}
+	return ring, kid, nil
+}
+
+// RotateKeyFile appends a random key to the key file, creating it if needed,
+// and returns the new key's ID. Running servers pick it up on restart; the
+// older keys keep verifying until they are removed from the file.
+func RotateKeyFile(path string) (string, error) {
+	secret := make([]byte, 32)
+	id := make([]byte, 4)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	kid := time.Now().UTC().Format("20060102") + "-" + hex.EncodeToString(id)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", kid, base64.RawURLEncoding.EncodeToString(secret)); err != nil {
+		f.Close()
+		return "", err
+	}
+	return kid, f.Close()
+}
+
+// AccessTTL is how long access tokens are valid.
+func AccessTTL() time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	return accessTTL
+}
+
+// RefreshTTL is how long a session lasts without being refreshed.
+func RefreshTTL() time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	return refreshTTL
+}
+
+// GenerateToken signs a short-lived access token for a session.
+func GenerateToken(user *model.User, sessionID string) (string, error) {
+	mu.RLock()
+	kid, secret, ttl := signingKID, keys[signingKID], accessTTL
+	mu.RUnlock()
+	if secret == nil {
+		return "", errors.New("JWT signing key not loaded")
+	}
+
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := &Claims{
-		UserID: user.ID,
-		Role:   user.Role,
+		UserID:    user.ID,
+		Role:      user.Role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        hex.EncodeToString(jti),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(secretKey)
+	token.Header["kid"] = kid
+	return token.SignedString(secret)
 }
 
 func ValidateToken(tokenString string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
+		kid, _ := token.Header["kid"].(string)
+		mu.RLock()
+		secret := keys[kid]
+		mu.RUnlock()
+		if secret == nil {
+			return nil, errors.New("unknown signing key")
 		}
-		return secretKey, nil
-	})
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
 		return nil, err
@@ -48,6 +220,9 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	if !token.Valid {
 		return nil, errors.New("invalid token")
 	}
+	if claims.SessionID == "" {
+		return nil, errors.New("token has no session")
+	}
 
 	return claims, nil
 }
@@ -97,6 +97,8 @@ type ModemIncomingState struct {
 	Incoming        bool
 	Voice           bool
 	IncomingRinging bool
+	Waiting         bool // a second call is waiting behind an established one
+	Calls           int  // number of modem call legs (+CLCC entries)
 	UpdatedAt       time.Time
 }
 
@@ -155,6 +157,7 @@ type SignalMessage struct {
 	Offer     *webrtc.SessionDescription `json:"offer,omitempty"`
 	Answer    *webrtc.SessionDescription `json:"answer,omitempty"`
 	Candidate *webrtc.ICECandidateInit   `json:"candidate,omitempty"`
+	Data      any                        `json:"data,omitempty"`
 }
 
 func ParseSignalMessage(raw []byte) (SignalMessage, error) {
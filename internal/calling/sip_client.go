@@ -120,6 +120,8 @@ type ModemIncomingState struct {
 	Incoming        bool
 	Voice           bool
 	IncomingRinging bool
+	Waiting         bool // a second call is waiting behind an established one
+	Calls           int  // number of modem call legs (+CLCC entries)
 	UpdatedAt       time.Time
 }
 
@@ -1049,6 +1051,11 @@ func (g *sipInboundGateway) syncModemState(target ModemTarget, state ModemIncomi
 	if !state.IncomingRinging || strings.TrimSpace(state.Number) == "" {
 		return nil
 	}
+	// Only a lone ringing call is offered to SIP; a waiting call belongs to
+	// whoever holds the established call on the modem.
+	if state.Waiting || state.Calls > 1 {
+		return nil
+	}
 	if state.Direction != 1 || state.Mode != 0 {
 		return nil
 	}
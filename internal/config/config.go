@@ -2,6 +2,7 @@ package config
 
 import (
 	"log"
+	"os"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -13,7 +14,16 @@ type Config struct {
 	Serial   SerialConfig   `mapstructure:"serial"`
 	Calling  CallingConfig  `mapstructure:"calling"`
 	Webhook  WebhookConfig  `mapstructure:"webhook"`
+	Telegram TelegramConfig `mapstructure:"telegram"`
+	SMPP     SMPPConfig     `mapstructure:"smpp"`
+	Twilio   TwilioConfig   `mapstructure:"twilio"`
+	SMTP     SMTPConfig     `mapstructure:"smtp_gateway"`
+	Agents   AgentsConfig   `mapstructure:"agents"`
+	Agent    AgentConfig    `mapstructure:"agent"`
 	Users    UsersConfig    `mapstructure:"users"`
+	Auth     AuthConfig     `mapstructure:"auth"`
+	OIDC     OIDCConfig     `mapstructure:"oidc"`
+	Audit    AuditConfig    `mapstructure:"audit"`
 	Log      LogConfig      `mapstructure:"log"`
 }
 
@@ -68,9 +78,147 @@ type SIPConfig struct {
 }
 
 type WebhookConfig struct {
-	TelegramToken  string `mapstructure:"telegram_token"`
-	TelegramChatID string `mapstructure:"telegram_chat_id"`
-	SlackURL       string `mapstructure:"slack_url"`
+	TelegramToken         string `mapstructure:"telegram_token"`
+	TelegramChatID        string `mapstructure:"telegram_chat_id"`
+	SlackURL              string `mapstructure:"slack_url"`
+	TimeoutSec            int    `mapstructure:"timeout_sec"`
+	MaxAttempts           int    `mapstructure:"max_attempts"`
+	RetryBaseSec          int    `mapstructure:"retry_base_sec"`
+	RetryMaxSec           int    `mapstructure:"retry_max_sec"`
+	DeliveryRetentionDays int    `mapstructure:"delivery_retention_days"`
+}
+
+// AuthConfig configures how dashboard sessions are signed and how long they
+// last. With no jwt_secret, signing keys are kept in jwt_key_file, which is
+// created on first start; "smsie rotate-jwt-key" adds a new key to it.
+type AuthConfig struct {
+	JWTSecret          string   `mapstructure:"jwt_secret"`           // also SMSIE_JWT_SECRET; overrides jwt_key_file
+	JWTPreviousSecrets []string `mapstructure:"jwt_previous_secrets"` // still accepted after changing jwt_secret
+	JWTKeyFile         string   `mapstructure:"jwt_key_file"`         // default smsie_jwt.keys
+	AccessTokenTTL     string   `mapstructure:"access_token_ttl"`     // default 15m
+	RefreshTokenTTL    string   `mapstructure:"refresh_token_ttl"`    // default 720h, extended by each refresh
+}
+
+// OIDCConfig enables single sign-on with an OpenID Connect provider next to
+// local logins.
+type OIDCConfig struct {
+	Enabled        bool               `mapstructure:"enabled"`
+	DiscoveryURL   string             `mapstructure:"discovery_url"` // issuer URL or its /.well-known/openid-configuration
+	ClientID       string             `mapstructure:"client_id"`
+	ClientSecret   string             `mapstructure:"client_secret"` // also SMSIE_OIDC_CLIENT_SECRET
+	RedirectURL    string             `mapstructure:"redirect_url"`  // e.g. https://smsie.example.com/api/v1/oidc/callback
+	Scopes         []string           `mapstructure:"scopes"`        // default openid, profile, email
+	ButtonText     string             `mapstructure:"button_text"`   // default "Sign in with SSO"
+	UsernameClaim  string             `mapstructure:"username_claim"`
+	GroupsClaim    string             `mapstructure:"groups_claim"`
+	AllowedGroups  []string           `mapstructure:"allowed_groups"`   // empty = any user of the provider
+	LinkLocalUsers bool               `mapstructure:"link_local_users"` // let a first login take over a local user of the same name
+	LinkAdmins     bool               `mapstructure:"link_admins"`      // with link_local_users, local admins too
+	GroupMappings  []OIDCGroupMapping `mapstructure:"group_mappings"`
+}
+
+// OIDCGroupMapping grants the members of a provider group a role or modems.
+type OIDCGroupMapping struct {
+	Group       string   `mapstructure:"group"`
+	Role        string   `mapstructure:"role"`        // admin, or user (default)
+	Modems      []string `mapstructure:"modems"`      // ICCIDs, or "*" for all
+	Permissions []string `mapstructure:"permissions"` // make_call, view_sms, send_sms, send_at; default all
+}
+
+// AuditConfig configures the audit log of security-relevant actions.
+type AuditConfig struct {
+	RetentionDays int `mapstructure:"retention_days"` // default 365
+}
+
+// TelegramConfig configures the two-way Telegram bot.
+type TelegramConfig struct {
+	Enabled              bool   `mapstructure:"enabled"`
+	BotToken             string `mapstructure:"bot_token"`
+	APIBaseURL           string `mapstructure:"api_base_url"`   // Bot API server, default https://api.telegram.org
+	Mode                 string `mapstructure:"mode"`           // polling (default) or webhook
+	WebhookURL           string `mapstructure:"webhook_url"`    // Public URL of /telegram/webhook for webhook mode
+	WebhookSecret        string `mapstructure:"webhook_secret"` // Checked against X-Telegram-Bot-Api-Secret-Token
+	PollTimeoutSec       int    `mapstructure:"poll_timeout_sec"`
+	MessageRetentionDays int    `mapstructure:"message_retention_days"` // How long chat replies can be answered
+}
+
+// SMPPConfig configures the SMPP 3.4 server. ESMEs bind with any system_id
+// and an smsie API key as the password.
+type SMPPConfig struct {
+	Enabled            bool              `mapstructure:"enabled"`
+	Listen             string            `mapstructure:"listen"`      // default :2775
+	WindowSize         int               `mapstructure:"window_size"` // Unanswered deliver_sm per session
+	EnquireLinkSec     int               `mapstructure:"enquire_link_sec"`
+	ResponseTimeoutSec int               `mapstructure:"response_timeout_sec"`
+	SystemIDs          map[string]string `mapstructure:"system_ids"` // system_id (lower case) -> ICCID
+	Routes             []SMPPRoute       `mapstructure:"routes"`
+}
+
+// SMPPRoute sends submit_sm whose destination starts with Prefix through
+// ICCID. The longest matching prefix wins.
+type SMPPRoute struct {
+	Prefix string `mapstructure:"prefix"`
+	ICCID  string `mapstructure:"iccid"`
+}
+
+// TwilioConfig enables the Twilio-compatible Messages API under /2010-04-01.
+type TwilioConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// SMTPConfig configures the email-to-SMS gateway. Mail to <number>@Domain is
+// sent as SMS; received SMS are mailed to Mailboxes through Relay.
+type SMTPConfig struct {
+	Enabled           bool            `mapstructure:"enabled"`
+	Listen            string          `mapstructure:"listen"`   // default :2525
+	Domain            string          `mapstructure:"domain"`   // default sms.local
+	Hostname          string          `mapstructure:"hostname"` // Greeting name, default Domain
+	TLSCertFile       string          `mapstructure:"tls_cert_file"`
+	TLSKeyFile        string          `mapstructure:"tls_key_file"`
+	AllowInsecureAuth bool            `mapstructure:"allow_insecure_auth"` // AUTH without STARTTLS from non-loopback clients
+	MaxSMSChars       int             `mapstructure:"max_sms_chars"`
+	MaxMessageBytes   int             `mapstructure:"max_message_bytes"`
+	Allowlist         []SMTPAllowRule `mapstructure:"allowlist"`
+	Mailboxes         []SMTPMailbox   `mapstructure:"mailboxes"`
+	Relay             SMTPRelayConfig `mapstructure:"relay"`
+}
+
+// SMTPAllowRule lets unauthenticated mail from Network and/or Sender send as
+// User. Sender is an address or "@domain".
+type SMTPAllowRule struct {
+	Network string `mapstructure:"network"`
+	Sender  string `mapstructure:"sender"`
+	User    string `mapstructure:"user"`
+}
+
+// SMTPMailbox receives SMS of ICCID ("*" for all modems) at Address.
+type SMTPMailbox struct {
+	ICCID   string `mapstructure:"iccid"`
+	Address string `mapstructure:"address"`
+}
+
+type SMTPRelayConfig struct {
+	Host     string `mapstructure:"host"`
+	Port     int    `mapstructure:"port"`
+	Security string `mapstructure:"security"` // starttls (default), tls, none
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	From     string `mapstructure:"from"`
+}
+
+// AgentsConfig lets smsie agents on other hosts attach their modems over
+// /agent/ws.
+type AgentsConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+}
+
+// AgentConfig is used by "smsie agent", which runs the modems of this host
+// for a central server.
+type AgentConfig struct {
+	Server string `mapstructure:"server"`  // e.g. wss://smsie.example.com/agent/ws
+	APIKey string `mapstructure:"api_key"` // API key of an admin user on the server
+	Name   string `mapstructure:"name"`    // default hostname
+	DSN    string `mapstructure:"dsn"`     // SQLite file buffering SMS, default smsie_agent.db
 }
 
 type UsersConfig struct {
@@ -137,6 +285,99 @@ func LoadConfig() {
 	if AppConfig.Calling.SIP.DTMFDurationMillis <= 0 {
 		AppConfig.Calling.SIP.DTMFDurationMillis = 160
 	}
+	if AppConfig.Webhook.TimeoutSec <= 0 {
+		AppConfig.Webhook.TimeoutSec = 10
+	}
+	if AppConfig.Webhook.MaxAttempts <= 0 {
+		AppConfig.Webhook.MaxAttempts = 8
+	}
+	if AppConfig.Webhook.RetryBaseSec <= 0 {
+		AppConfig.Webhook.RetryBaseSec = 30
+	}
+	if AppConfig.Webhook.RetryMaxSec < AppConfig.Webhook.RetryBaseSec {
+		AppConfig.Webhook.RetryMaxSec = 3600
+	}
+	if AppConfig.Webhook.DeliveryRetentionDays <= 0 {
+		AppConfig.Webhook.DeliveryRetentionDays = 30
+	}
+	if secret := os.Getenv("SMSIE_JWT_SECRET"); secret != "" {
+		AppConfig.Auth.JWTSecret = secret
+	}
+	if AppConfig.Auth.JWTKeyFile == "" {
+		AppConfig.Auth.JWTKeyFile = "smsie_jwt.keys"
+	}
+	if AppConfig.Auth.AccessTokenTTL == "" {
+		AppConfig.Auth.AccessTokenTTL = "15m"
+	}
+	if AppConfig.Auth.RefreshTokenTTL == "" {
+		AppConfig.Auth.RefreshTokenTTL = "720h"
+	}
+	if secret := os.Getenv("SMSIE_OIDC_CLIENT_SECRET"); secret != "" {
+		AppConfig.OIDC.ClientSecret = secret
+	}
+	if len(AppConfig.OIDC.Scopes) == 0 {
+		AppConfig.OIDC.Scopes = []string{"openid", "profile", "email"}
+	}
+	if AppConfig.OIDC.ButtonText == "" {
+		AppConfig.OIDC.ButtonText = "Sign in with SSO"
+	}
+	if AppConfig.OIDC.UsernameClaim == "" {
+		AppConfig.OIDC.UsernameClaim = "preferred_username"
+	}
+	if AppConfig.OIDC.GroupsClaim == "" {
+		AppConfig.OIDC.GroupsClaim = "groups"
+	}
+	if AppConfig.Audit.RetentionDays <= 0 {
+		AppConfig.Audit.RetentionDays = 365
+	}
+	if AppConfig.Telegram.APIBaseURL == "" {
+		AppConfig.Telegram.APIBaseURL = "https://api.telegram.org"
+	}
+	if AppConfig.Telegram.Mode == "" {
+		AppConfig.Telegram.Mode = "polling"
+	}
+	if AppConfig.Telegram.PollTimeoutSec <= 0 {
+		AppConfig.Telegram.PollTimeoutSec = 30
+	}
+	if AppConfig.Telegram.MessageRetentionDays <= 0 {
+		AppConfig.Telegram.MessageRetentionDays = 30
+	}
+
+	if AppConfig.SMPP.Listen == "" {
+		AppConfig.SMPP.Listen = ":2775"
+	}
+	if AppConfig.SMPP.WindowSize <= 0 {
+		AppConfig.SMPP.WindowSize = 10
+	}
+	if AppConfig.SMPP.EnquireLinkSec <= 0 {
+		AppConfig.SMPP.EnquireLinkSec = 30
+	}
+	if AppConfig.SMPP.ResponseTimeoutSec <= 0 {
+		AppConfig.SMPP.ResponseTimeoutSec = 30
+	}
+
+	if AppConfig.SMTP.Listen == "" {
+		AppConfig.SMTP.Listen = ":2525"
+	}
+	if AppConfig.SMTP.Domain == "" {
+		AppConfig.SMTP.Domain = "sms.local"
+	}
+	if AppConfig.SMTP.Hostname == "" {
+		AppConfig.SMTP.Hostname = AppConfig.SMTP.Domain
+	}
+	if AppConfig.SMTP.MaxSMSChars <= 0 {
+		AppConfig.SMTP.MaxSMSChars = 480
+	}
+	if AppConfig.SMTP.MaxMessageBytes <= 0 {
+		AppConfig.SMTP.MaxMessageBytes = 2 << 20
+	}
+
+	if AppConfig.Agent.Name == "" {
+		AppConfig.Agent.Name, _ = os.Hostname()
+	}
+	if AppConfig.Agent.DSN == "" {
+		AppConfig.Agent.DSN = "smsie_agent.db"
+	}
 
 	log.Println("Configuration loaded successfully")
 }
@@ -0,0 +1,190 @@
+package logic
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+
+	AuditRedacted = "[redacted]"
+
+	auditMaxParams = 4096
+	auditMaxError  = 512
+)
+
+// auditSecretKeys are parameter names, or name suffixes after an underscore,
+// whose values are never stored.
+var auditSecretKeys = []string{"password", "secret", "token", "api_key", "key_hash", "pin", "puk", "headers", "authorization", "code"}
+
+// auditSecretAT matches AT commands that carry a SIM PIN or a lock password.
+var auditSecretAT = regexp.MustCompile(`(?i)^\s*(AT)?\s*\+(CPIN|CLCK|CPWD)\s*=`)
+
+// AuditSecretKey reports whether a parameter name holds a secret.
+func AuditSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range auditSecretKeys {
+		if key == s || strings.HasSuffix(key, "_"+s) {
+			return true
+		}
+	}
+	return strings.Contains(key, "password") || strings.Contains(key, "secret")
+}
+
+// RedactAuditParams replaces secret values in decoded JSON parameters, in
+// place, and returns them.
+func RedactAuditParams(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, item := range val {
+			if AuditSecretKey(k) {
+				if item != nil && item != "" {
+					val[k] = AuditRedacted
+				}
+				continue
+			}
+			if s, ok := item.(string); ok {
+				switch lower := strings.ToLower(k); {
+				case lower == "command":
+					val[k] = RedactATCommand(s)
+					continue
+				case lower == "url" || strings.HasSuffix(lower, "_url"):
+					val[k] = redactURL(s)
+					continue
+				}
+			}
+			val[k] = RedactAuditParams(item)
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = RedactAuditParams(val[i])
+		}
+	}
+	return v
+}
+
+// RedactATCommand hides the arguments of AT commands that carry a PIN or a
+// password.
+func RedactATCommand(cmd string) string {
+	if loc := auditSecretAT.FindStringIndex(cmd); loc != nil {
+		return cmd[:loc[1]] + AuditRedacted
+	}
+	return cmd
+}
+
+// redactURL keeps the scheme and host of a URL; paths and queries of
+// webhook URLs often embed tokens.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		if raw == "" {
+			return raw
+		}
+		return AuditRedacted
+	}
+	if u.Path == "" && u.RawQuery == "" && u.User == nil {
+		return raw
+	}
+	return u.Scheme + "://" + u.Host + "/" + AuditRedacted
+}
+
+// RedactQueryToken hides the token query parameter of a request path, which
+// the browser streaming endpoints carry.
+func RedactQueryToken(path string) string {
+	i := strings.IndexByte(path, '?')
+	if i < 0 {
+		return path
+	}
+	query, err := url.ParseQuery(path[i+1:])
+	if err != nil || !query.Has("token") {
+		return path
+	}
+	query.Set("token", AuditRedacted)
+	return path[:i+1] + query.Encode()
+}
+
+// AuditParams encodes parameters for an audit entry with secrets redacted.
+func AuditParams(params map[string]interface{}) string {
+	if len(params) == 0 {
+		return ""
+	}
+	// Round-trip through JSON so structs and maps are redacted alike.
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return ""
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return ""
+	}
+	raw, _ = json.Marshal(RedactAuditParams(decoded))
+	if len(raw) > auditMaxParams {
+		return string(raw[:auditMaxParams])
+	}
+	return string(raw)
+}
+
+// AuditLogger appends entries to the audit log.
+type AuditLogger struct {
+	repo *repository.AuditLogRepository
+}
+
+func NewAuditLogger(db *gorm.DB) *AuditLogger {
+	return &AuditLogger{repo: repository.NewAuditLogRepository(db)}
+}
+
+// Log stores an entry. The result follows the status when it is not set.
+// Failures to store are logged, never returned, so auditing cannot break the
+// action itself.
+func (a *AuditLogger) Log(entry *model.AuditLog) {
+	if a == nil {
+		return
+	}
+	if entry.Result == "" {
+		entry.Result = AuditSuccess
+		if entry.Status >= 400 || entry.Error != "" {
+			entry.Result = AuditFailure
+		}
+	}
+	if len(entry.Error) > auditMaxError {
+		entry.Error = entry.Error[:auditMaxError]
+	}
+	if err := a.repo.Create(entry); err != nil {
+		logger.Log.Errorf("Failed to write audit log entry %s: %v", entry.Action, err)
+	}
+}
+
+// RunRetention purges entries older than the configured retention once a
+// day until stop is closed.
+func (a *AuditLogger) RunRetention(stop <-chan struct{}) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		days := config.AppConfig.Audit.RetentionDays
+		if days <= 0 {
+			days = 365
+		}
+		if n, err := a.repo.PurgeBefore(time.Now().AddDate(0, 0, -days)); err != nil {
+			logger.Log.Warnf("Failed to purge audit log: %v", err)
+		} else if n > 0 {
+			logger.Log.Infof("Purged %d audit log entries older than %d days", n, days)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestAuditParamsRedactsSecrets(t *testing.T) {
+	got := AuditParams(map[string]interface{}{
+		"username":     "alice",
+		"password":     "hunter2",
+		"sip_password": "s3cret",
+		"api_key_id":   7,
+		"command":      `AT+CPIN="1234"`,
+		"url":          "https://hooks.slack.com/services/T000/B000/XXXX",
+		"headers":      map[string]string{"Authorization": "Bearer abc"},
+		"code":         "287082",
+		"members":      []map[string]interface{}{{"iccid": "8988", "token": "t"}},
+	})
+
+	var params map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &params); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]interface{}{
+		"username":     "alice",
+		"password":     AuditRedacted,
+		"sip_password": AuditRedacted,
+		"api_key_id":   float64(7),
+		"command":      "AT+CPIN=" + AuditRedacted,
+		"url":          "https://hooks.slack.com/" + AuditRedacted,
+		"headers":      AuditRedacted,
+		"code":         AuditRedacted,
+	} {
+		if params[key] != want {
+			t.Fatalf("%s: expected %v, got %v", key, want, params[key])
+		}
+	}
+	member := params["members"].([]interface{})[0].(map[string]interface{})
+	if member["iccid"] != "8988" || member["token"] != AuditRedacted {
+		t.Fatalf("unexpected nested params %v", member)
+	}
+}
+
+func TestRedactATCommand(t *testing.T) {
+	if got := RedactATCommand("AT+CSQ"); got != "AT+CSQ" {
+		t.Fatalf("unexpected %q", got)
+	}
+	if got := RedactATCommand(`at+clck="SC",0,"0000"`); got != "at+clck="+AuditRedacted {
+		t.Fatalf("unexpected %q", got)
+	}
+}
+
+func TestRedactQueryToken(t *testing.T) {
+	for path, want := range map[string]string{
+		"/api/v1/sms":                            "/api/v1/sms",
+		"/api/v1/sms?page=2":                     "/api/v1/sms?page=2",
+		"/api/v1/events?token=eyJ.abc&types=sms": "/api/v1/events?token=%5Bredacted%5D&types=sms",
+	} {
+		if got := RedactQueryToken(path); got != want {
+			t.Fatalf("%s: expected %s, got %s", path, want, got)
+		}
+	}
+}
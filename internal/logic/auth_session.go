@@ -0,0 +1,210 @@
+package logic
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/auth"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	refreshTokenPrefix = "rt_"
+
+	// refreshReuseGrace tolerates two tabs refreshing the same token at once.
+	refreshReuseGrace    = 10 * time.Second
+	authSessionPruneTick = time.Hour
+)
+
+var (
+	ErrSessionInvalid = errors.New("invalid or expired refresh token")
+	ErrRefreshReused  = errors.New("refresh token was already used, session revoked")
+
+	authSessionPruneMu   sync.Mutex
+	authSessionLastPrune time.Time
+)
+
+// SessionTokens is what a login or a refresh hands to the client.
+type SessionTokens struct {
+	AccessToken  string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"` // seconds until the access token expires
+	TokenType    string `json:"token_type"`
+}
+
+// SessionManager issues, refreshes and revokes dashboard sessions.
+type SessionManager struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+func NewSessionManager(db *gorm.DB) *SessionManager {
+	return &SessionManager{db: db, now: time.Now}
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return refreshTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Create starts a session for a user who just logged in.
+func (m *SessionManager) Create(user *model.User, ip, userAgent string) (*SessionTokens, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+	now := m.now()
+	session := model.AuthSession{
+		ID:          hex.EncodeToString(id),
+		UserID:      user.ID,
+		RefreshHash: hashRefreshToken(refresh),
+		RotatedAt:   now,
+		ExpiresAt:   now.Add(auth.RefreshTTL()),
+		IP:          ip,
+		UserAgent:   truncateRunes(userAgent, 255),
+		LastUsedAt:  now,
+	}
+	if err := m.db.Create(&session).Error; err != nil {
+		return nil, err
+	}
+	m.prune(now)
+	return m.tokens(user, session.ID, refresh)
+}
+
+// Refresh trades a refresh token for a new access token and a new refresh
+// token. Presenting a token that was already replaced revokes the session,
+// since one of the two holders must have stolen it.
+func (m *SessionManager) Refresh(refreshToken, ip, userAgent string) (*SessionTokens, *model.User, error) {
+	now := m.now()
+	hash := hashRefreshToken(refreshToken)
+
+	var session model.AuthSession
+	if err := m.db.Where("refresh_hash = ?", hash).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, m.checkReuse(hash, now)
+		}
+		return nil, nil, err
+	}
+	if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return nil, nil, ErrSessionInvalid
+	}
+	var user model.User
+	if err := m.db.First(&user, session.UserID).Error; err != nil {
+		return nil, nil, ErrSessionInvalid
+	}
+
+	refresh, err := newRefreshToken()
+	if err != nil {
+		return nil, nil, err
+	}
+	res := m.db.Model(&model.AuthSession{}).
+		Where("id = ? AND refresh_hash = ? AND revoked_at IS NULL", session.ID, hash).
+		Updates(map[string]interface{}{
+			"refresh_hash":      hashRefreshToken(refresh),
+			"prev_refresh_hash": hash,
+			"rotated_at":        now,
+			"expires_at":        now.Add(auth.RefreshTTL()),
+			"ip":                ip,
+			"user_agent":        truncateRunes(userAgent, 255),
+			"last_used_at":      now,
+		})
+	if res.Error != nil {
+		return nil, nil, res.Error
+	}
+	if res.RowsAffected == 0 {
+		// Another request refreshed it first.
+		return nil, nil, ErrSessionInvalid
+	}
+	tokens, err := m.tokens(&user, session.ID, refresh)
+	return tokens, &user, err
+}
+
+func (m *SessionManager) checkReuse(hash string, now time.Time) error {
+	var session model.AuthSession
+	if err := m.db.Where("prev_refresh_hash = ?", hash).First(&session).Error; err != nil {
+		return ErrSessionInvalid
+	}
+	if session.RevokedAt != nil || now.Sub(session.RotatedAt) < refreshReuseGrace {
+		return ErrSessionInvalid
+	}
+	if err := m.Revoke(session.ID); err != nil {
+		return err
+	}
+	logger.Log.Warnf("Refresh token of session %s for user %d was reused, session revoked", session.ID, session.UserID)
+	return ErrRefreshReused
+}
+
+func (m *SessionManager) tokens(user *model.User, sessionID, refresh string) (*SessionTokens, error) {
+	access, err := auth.GenerateToken(user, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionTokens{
+		AccessToken:  access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(auth.AccessTTL().Seconds()),
+		TokenType:    "Bearer",
+	}, nil
+}
+
+// Active reports whether access tokens of the session are still accepted.
+func (m *SessionManager) Active(sessionID string, userID uint) bool {
+	var n int64
+	m.db.Model(&model.AuthSession{}).
+		Where("id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", sessionID, userID, m.now()).
+		Count(&n)
+	return n > 0
+}
+
+// Revoke ends one session.
+func (m *SessionManager) Revoke(sessionID string) error {
+	return m.db.Model(&model.AuthSession{}).
+		Where("id = ? AND revoked_at IS NULL", sessionID).
+		Update("revoked_at", m.now()).Error
+}
+
+// RevokeUser ends all sessions of a user except, if set, the given one, and
+// returns how many it ended.
+func (m *SessionManager) RevokeUser(userID uint, exceptSessionID string) (int64, error) {
+	q := m.db.Model(&model.AuthSession{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+	if exceptSessionID != "" {
+		q = q.Where("id <> ?", exceptSessionID)
+	}
+	res := q.Update("revoked_at", m.now())
+	return res.RowsAffected, res.Error
+}
+
+// prune drops expired sessions; revoked ones are kept until then so reuse of
+// their refresh tokens is still recognised.
+func (m *SessionManager) prune(now time.Time) {
+	authSessionPruneMu.Lock()
+	if now.Sub(authSessionLastPrune) < authSessionPruneTick {
+		authSessionPruneMu.Unlock()
+		return
+	}
+	authSessionLastPrune = now
+	authSessionPruneMu.Unlock()
+
+	if err := m.db.Where("expires_at < ?", now).Delete(&model.AuthSession{}).Error; err != nil {
+		logger.Log.Warnf("Failed to prune expired sessions: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package logic
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/auth"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+func newSessionTestManager(t *testing.T) (*SessionManager, *model.User) {
+	t.Helper()
+	logger.InitLogger("error")
+	if err := auth.Init(config.AuthConfig{JWTKeyFile: filepath.Join(t.TempDir(), "jwt.keys")}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.User{}, &model.AuthSession{}); err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Username: "alice", PasswordHash: "x", Role: "user"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return NewSessionManager(db), user
+}
+
+func TestSessionRefreshRotates(t *testing.T) {
+	m, user := newSessionTestManager(t)
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	first, err := m.Create(user, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := auth.ValidateToken(first.AccessToken)
+	if err != nil || claims.UserID != user.ID || !m.Active(claims.SessionID, user.ID) {
+		t.Fatalf("expected an active session, got %+v, %v", claims, err)
+	}
+
+	now = now.Add(time.Minute)
+	second, _, err := m.Refresh(first.RefreshToken, "127.0.0.1", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("expected a new refresh token")
+	}
+
+	// Another tab refreshing with the same token right away is turned down
+	// without harm.
+	if _, _, err := m.Refresh(first.RefreshToken, "127.0.0.1", "test"); !errors.Is(err, ErrSessionInvalid) {
+		t.Fatalf("expected a concurrent refresh to fail, got %v", err)
+	}
+	if !m.Active(claims.SessionID, user.ID) {
+		t.Fatal("expected the session to survive a concurrent refresh")
+	}
+
+	// Replaying it later marks it stolen and ends the session.
+	now = now.Add(time.Minute)
+	if _, _, err := m.Refresh(first.RefreshToken, "10.0.0.1", "thief"); !errors.Is(err, ErrRefreshReused) {
+		t.Fatalf("expected reuse to be detected, got %v", err)
+	}
+	if m.Active(claims.SessionID, user.ID) {
+		t.Fatal("expected the session to be revoked")
+	}
+	if _, _, err := m.Refresh(second.RefreshToken, "127.0.0.1", "test"); !errors.Is(err, ErrSessionInvalid) {
+		t.Fatalf("expected the newer token to die with the session, got %v", err)
+	}
+}
+
+func TestSessionRevokeUser(t *testing.T) {
+	m, user := newSessionTestManager(t)
+	keep, err := m.Create(user, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := m.Create(user, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepClaims, _ := auth.ValidateToken(keep.AccessToken)
+	otherClaims, _ := auth.ValidateToken(other.AccessToken)
+
+	n, err := m.RevokeUser(user.ID, keepClaims.SessionID)
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 session revoked, got %d, %v", n, err)
+	}
+	if !m.Active(keepClaims.SessionID, user.ID) || m.Active(otherClaims.SessionID, user.ID) {
+		t.Fatal("expected only the other session to be revoked")
+	}
+	if _, _, err := m.Refresh(other.RefreshToken, "", ""); !errors.Is(err, ErrSessionInvalid) {
+		t.Fatalf("expected a revoked session not to refresh, got %v", err)
+	}
+}
+
+func TestTokenKeyRotation(t *testing.T) {
+	logger.InitLogger("error")
+	path := filepath.Join(t.TempDir(), "jwt.keys")
+	cfg := config.AuthConfig{JWTKeyFile: path}
+	if err := auth.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{ID: 1, Role: "admin"}
+	old, err := auth.GenerateToken(user, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := auth.RotateKeyFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.Init(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ValidateToken(old); err != nil {
+		t.Fatalf("expected tokens of the previous key to verify, got %v", err)
+	}
+
+	// A different secret does not accept tokens of the key file.
+	if err := auth.Init(config.AuthConfig{JWTSecret: "0123456789abcdef0123"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := auth.ValidateToken(old); err == nil {
+		t.Fatal("expected a token of an unknown key to be rejected")
+	}
+	if err := auth.Init(config.AuthConfig{JWTSecret: "short"}); err == nil {
+		t.Fatal("expected a short secret to be rejected")
+	}
+}
@@ -0,0 +1,244 @@
+package logic
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+const (
+	CallerChannelCall = "call"
+	CallerChannelSMS  = "sms"
+
+	CallerActionAllow = "allow"
+	CallerActionBlock = "block"
+	CallerActionSpam  = "spam"
+
+	CallerMatchExact   = "exact"
+	CallerMatchPrefix  = "prefix"
+	CallerMatchRegex   = "regex"
+	CallerMatchUnknown = "unknown"
+	CallerMatchAny     = "any"
+)
+
+type CallerDecision struct {
+	Action string
+	RuleID uint
+}
+
+// Screened reports whether the caller should be kept away from the user:
+// calls are rejected, SMS is either dropped (block) or stored as spam.
+func (d CallerDecision) Screened() bool {
+	return d.Action == CallerActionBlock || d.Action == CallerActionSpam
+}
+
+// Rules are cached per modem and channel because calls are screened on the
+// URC read loop. Rule edits through the API call CallerRulesChanged; the TTL
+// only covers edits made directly in the database.
+const callerRuleCacheTTL = time.Minute
+
+var callerRuleGeneration atomic.Uint64
+
+// CallerRulesChanged drops the rules cached by every CallerFilter.
+func CallerRulesChanged() {
+	callerRuleGeneration.Add(1)
+}
+
+type cachedCallerRules struct {
+	rules      []model.CallerRule
+	compiled   map[uint]*regexp.Regexp
+	generation uint64
+	loadedAt   time.Time
+}
+
+type CallerFilter struct {
+	repo *repository.CallerRuleRepository
+
+	mu    sync.Mutex
+	cache map[string]*cachedCallerRules
+}
+
+func NewCallerFilter(repo *repository.CallerRuleRepository) *CallerFilter {
+	return &CallerFilter{repo: repo, cache: make(map[string]*cachedCallerRules)}
+}
+
+func (f *CallerFilter) activeRules(iccid, channel string) (*cachedCallerRules, error) {
+	key := iccid + "|" + channel
+	generation := callerRuleGeneration.Load()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if cached, ok := f.cache[key]; ok && cached.generation == generation && time.Since(cached.loadedAt) < callerRuleCacheTTL {
+		return cached, nil
+	}
+
+	rules, err := f.repo.FindActive(iccid, channel)
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedCallerRules{
+		rules:      rules,
+		compiled:   compileCallerRules(rules),
+		generation: generation,
+		loadedAt:   time.Now(),
+	}
+	f.cache[key] = cached
+	return cached, nil
+}
+
+func compileCallerRules(rules []model.CallerRule) map[uint]*regexp.Regexp {
+	compiled := make(map[uint]*regexp.Regexp)
+	for _, rule := range rules {
+		if rule.MatchType != CallerMatchRegex {
+			continue
+		}
+		if re, err := regexp.Compile(strings.TrimSpace(rule.Pattern)); err == nil {
+			compiled[rule.ID] = re
+		}
+	}
+	return compiled
+}
+
+func (f *CallerFilter) Evaluate(iccid, number, channel string) CallerDecision {
+	allow := CallerDecision{Action: CallerActionAllow}
+	if f == nil || f.repo == nil {
+		return allow
+	}
+
+	cached, err := f.activeRules(iccid, channel)
+	if err != nil {
+		logger.Log.Errorf("Failed to load caller rules for ICCID %s: %v", iccid, err)
+		return allow
+	}
+
+	decision := matchCallerRules(cached.rules, cached.compiled, number)
+	if decision.RuleID != 0 {
+		// The hit is counted for the action that decided, so counters of a
+		// rule whose action was changed meanwhile are left alone.
+		go func() {
+			if err := f.repo.RecordHit(decision.RuleID, channel, decision.Action); err != nil {
+				logger.Log.Warnf("Failed to record caller rule hit %d: %v", decision.RuleID, err)
+			}
+		}()
+	}
+	return decision
+}
+
+// MatchCallerRules evaluates rules in order. Any matching allow rule wins,
+// otherwise the first matching block/spam rule decides.
+func MatchCallerRules(rules []model.CallerRule, number string) CallerDecision {
+	return matchCallerRules(rules, compileCallerRules(rules), number)
+}
+
+func matchCallerRules(rules []model.CallerRule, compiled map[uint]*regexp.Regexp, number string) CallerDecision {
+	normalized := NormalizeCallerNumber(number)
+
+	var screened *model.CallerRule
+	for i := range rules {
+		rule := &rules[i]
+		if !callerRuleMatches(rule, compiled[rule.ID], normalized) {
+			continue
+		}
+		if rule.Action == CallerActionAllow {
+			return CallerDecision{Action: CallerActionAllow, RuleID: rule.ID}
+		}
+		if screened == nil {
+			screened = rule
+		}
+	}
+
+	if screened == nil {
+		return CallerDecision{Action: CallerActionAllow}
+	}
+	return CallerDecision{Action: screened.Action, RuleID: screened.ID}
+}
+
+func NormalizeCallerNumber(number string) string {
+	number = strings.TrimSpace(number)
+	switch strings.ToLower(number) {
+	case "unknown", "private", "anonymous", "restricted", "withheld":
+		return ""
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, number)
+}
+
+func callerRuleMatches(rule *model.CallerRule, re *regexp.Regexp, normalized string) bool {
+	switch rule.MatchType {
+	case CallerMatchAny:
+		return true
+	case CallerMatchUnknown:
+		return normalized == ""
+	}
+
+	if normalized == "" {
+		return false
+	}
+	pattern := strings.TrimSpace(rule.Pattern)
+
+	switch rule.MatchType {
+	case CallerMatchExact:
+		return strings.EqualFold(normalized, NormalizeCallerNumber(pattern))
+	case CallerMatchPrefix:
+		prefix := NormalizeCallerNumber(pattern)
+		return prefix != "" && strings.HasPrefix(strings.ToLower(normalized), strings.ToLower(prefix))
+	case CallerMatchRegex:
+		return re != nil && re.MatchString(normalized)
+	default:
+		return false
+	}
+}
+
+// ValidateCallerRule normalizes enum fields in place and rejects invalid rules.
+func ValidateCallerRule(rule *model.CallerRule) error {
+	rule.ICCID = strings.TrimSpace(rule.ICCID)
+	rule.MatchType = strings.ToLower(strings.TrimSpace(rule.MatchType))
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.AppliesTo = strings.ToLower(strings.TrimSpace(rule.AppliesTo))
+	rule.Pattern = strings.TrimSpace(rule.Pattern)
+
+	switch rule.MatchType {
+	case CallerMatchExact, CallerMatchPrefix:
+		if NormalizeCallerNumber(rule.Pattern) == "" {
+			return errors.New("pattern is required for exact and prefix rules")
+		}
+	case CallerMatchRegex:
+		if rule.Pattern == "" {
+			return errors.New("pattern is required for regex rules")
+		}
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return errors.New("invalid regex pattern: " + err.Error())
+		}
+	case CallerMatchUnknown, CallerMatchAny:
+		rule.Pattern = ""
+	default:
+		return errors.New("match_type must be exact, prefix, regex, unknown or any")
+	}
+
+	switch rule.Action {
+	case CallerActionAllow, CallerActionBlock, CallerActionSpam:
+	default:
+		return errors.New("action must be allow, block or spam")
+	}
+
+	switch rule.AppliesTo {
+	case "":
+		rule.AppliesTo = "all"
+	case "all", CallerChannelCall, CallerChannelSMS:
+	default:
+		return errors.New("applies_to must be call, sms or all")
+	}
+	return nil
+}
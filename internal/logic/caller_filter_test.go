@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+func TestCallerFilterCachesRules(t *testing.T) {
+	logger.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.CallerRule{}); err != nil {
+		t.Fatal(err)
+	}
+	rule := model.CallerRule{MatchType: CallerMatchRegex, Pattern: `^\+8869`, Action: CallerActionBlock, AppliesTo: "all", Enabled: true}
+	db.Create(&rule)
+
+	f := NewCallerFilter(repository.NewCallerRuleRepository(db))
+	if d := f.Evaluate("8988", "+886 912", CallerChannelCall); d.Action != CallerActionBlock || d.RuleID != rule.ID {
+		t.Fatalf("expected the regex rule to block, got %+v", d)
+	}
+
+	// Edits outside the API are only seen once the cache is dropped.
+	db.Model(&rule).Update("action", CallerActionAllow)
+	if d := f.Evaluate("8988", "+886912", CallerChannelCall); d.Action != CallerActionBlock {
+		t.Fatalf("expected the cached rule to be used, got %+v", d)
+	}
+	CallerRulesChanged()
+	if d := f.Evaluate("8988", "+886912", CallerChannelCall); d.Action != CallerActionAllow {
+		t.Fatalf("expected the changed rule to be loaded, got %+v", d)
+	}
+
+	// Only the block hit counted before the action changed.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var stored model.CallerRule
+		db.First(&stored, rule.ID)
+		if stored.CallHits == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 1 call hit, got %d", stored.CallHits)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
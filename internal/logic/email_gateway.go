@@ -0,0 +1,313 @@
+package logic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+var (
+	gatewayNumberPattern = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+	emailQuoteHeader     = regexp.MustCompile(`(?i)^(on .+ wrote:|-+ ?original message ?-+|-+ ?forwarded message ?-+|_{5,}|from: .+|.+ 寫道[:：]?|.+ 写道[:：]?)$`)
+	emailHTMLBreak       = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</tr>|</li>`)
+	emailHTMLTag         = regexp.MustCompile(`(?s)<[^>]*>`)
+	emailHTMLDrop        = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+	emailReplyPrefix     = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|sv|回覆|回复)\s*[:：]\s*)+`)
+	emailSMSReference    = regexp.MustCompile(`<sms-([0-9]+)@([^>]+)>`)
+)
+
+// ParseGatewayAddress splits an email-to-SMS address "<number>@domain" or
+// "<number>+<modem>@domain", where the optional modem is a name, ICCID or
+// phone number.
+func ParseGatewayAddress(addr, domain string) (number, modem string, err error) {
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 || !strings.EqualFold(addr[at+1:], domain) {
+		return "", "", fmt.Errorf("recipient domain must be %s", domain)
+	}
+	local := addr[:at]
+	plus := strings.HasPrefix(local, "+")
+	number, modem, _ = strings.Cut(strings.TrimPrefix(local, "+"), "+")
+	number = strings.NewReplacer("-", "", ".", "").Replace(number)
+	if plus {
+		number = "+" + number
+	}
+	if !gatewayNumberPattern.MatchString(number) {
+		return "", "", fmt.Errorf("%q is not a phone number", local)
+	}
+	return number, modem, nil
+}
+
+// GatewayAddress is the reply address for SMS from phone on the modem, or ""
+// when the sender is not a phone number.
+func GatewayAddress(phone, iccid, domain string) string {
+	if !gatewayNumberPattern.MatchString(phone) {
+		return ""
+	}
+	return phone + "+" + iccid + "@" + domain
+}
+
+// SMSEmailMessageID is the Message-ID of the email for a received SMS.
+func SMSEmailMessageID(smsID uint, domain string) string {
+	return fmt.Sprintf("<sms-%d@%s>", smsID, domain)
+}
+
+// SMSEmailReferences returns the SMS IDs referenced by In-Reply-To and
+// References headers, most recent first.
+func SMSEmailReferences(header mail.Header, domain string) []uint {
+	var ids []uint
+	seen := map[uint]bool{}
+	for _, h := range []string{header.Get("In-Reply-To"), header.Get("References")} {
+		matches := emailSMSReference.FindAllStringSubmatch(h, -1)
+		for i := len(matches) - 1; i >= 0; i-- {
+			m := matches[i]
+			if !strings.EqualFold(m[2], domain) {
+				continue
+			}
+			id, err := strconv.ParseUint(m[1], 10, 32)
+			if err != nil || seen[uint(id)] {
+				continue
+			}
+			seen[uint(id)] = true
+			ids = append(ids, uint(id))
+		}
+	}
+	return ids
+}
+
+// EmailText returns the readable text of a message: the first text/plain
+// part, or the first text/html part with markup removed.
+func EmailText(msg *mail.Message) (string, error) {
+	plain, htmlText, err := emailParts(msg.Header, msg.Body, 0)
+	if err != nil {
+		return "", err
+	}
+	if plain != "" {
+		return plain, nil
+	}
+	return htmlToText(htmlText), nil
+}
+
+type partHeader interface {
+	Get(key string) string
+}
+
+func emailParts(h partHeader, body io.Reader, depth int) (plain, htmlText string, err error) {
+	if depth > 5 {
+		return "", "", errors.New("MIME nesting too deep")
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return plain, htmlText, nil
+			}
+			if err != nil {
+				return plain, htmlText, err
+			}
+			if strings.HasPrefix(strings.ToLower(p.Header.Get("Content-Disposition")), "attachment") {
+				continue
+			}
+			// multipart.Reader already decodes quoted-printable parts.
+			pp, ph, err := emailParts(p.Header, p, depth+1)
+			if err != nil {
+				return plain, htmlText, err
+			}
+			if plain == "" {
+				plain = pp
+			}
+			if htmlText == "" {
+				htmlText = ph
+			}
+			if plain != "" {
+				return plain, htmlText, nil
+			}
+		}
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return "", "", nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, &newlineStripper{r: body})
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	raw, err := io.ReadAll(io.LimitReader(body, 1<<20))
+	if err != nil {
+		return "", "", err
+	}
+	text := decodeCharset(raw, params["charset"])
+	if mediaType == "text/html" {
+		return "", text, nil
+	}
+	return text, "", nil
+}
+
+// newlineStripper drops line breaks so base64 bodies can be decoded.
+type newlineStripper struct {
+	r io.Reader
+}
+
+func (n *newlineStripper) Read(p []byte) (int, error) {
+	for {
+		c, err := n.r.Read(p)
+		out := p[:0]
+		for _, b := range p[:c] {
+			if b != '\r' && b != '\n' {
+				out = append(out, b)
+			}
+		}
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// decodeCharset converts Latin-1 bodies to UTF-8; other charsets are assumed
+// to be UTF-8 compatible.
+func decodeCharset(b []byte, charset string) string {
+	switch strings.ToLower(charset) {
+	case "iso-8859-1", "latin1", "windows-1252":
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes)
+	}
+	if !utf8.Valid(b) {
+		return strings.ToValidUTF8(string(b), "?")
+	}
+	return string(b)
+}
+
+func htmlToText(s string) string {
+	s = emailHTMLDrop.ReplaceAllString(s, "")
+	s = emailHTMLBreak.ReplaceAllString(s, "\n")
+	s = emailHTMLTag.ReplaceAllString(s, "")
+	return html.UnescapeString(s)
+}
+
+// TrimEmailBody keeps what the sender wrote: quoted replies, the "On ...
+// wrote:" line after them and signatures are removed and blank lines
+// collapsed.
+func TrimEmailBody(body string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+	var out []string
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "--" || emailQuoteHeader.MatchString(trimmed) {
+			break
+		}
+		// "On <date> <name> <address> wrote:" wrapped over two lines
+		if strings.HasSuffix(strings.ToLower(trimmed), "wrote:") && len(out) > 0 && strings.HasPrefix(strings.ToLower(out[len(out)-1]), "on ") {
+			out = out[:len(out)-1]
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		if trimmed == "" && (len(out) == 0 || out[len(out)-1] == "") {
+			continue
+		}
+		out = append(out, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+// EmailSubject decodes the Subject header without reply prefixes.
+func EmailSubject(header mail.Header) string {
+	dec := mime.WordDecoder{}
+	subject, err := dec.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+	return strings.TrimSpace(emailReplyPrefix.ReplaceAllString(subject, ""))
+}
+
+// TruncateSMS shortens s to at most max characters, ending with "..." when
+// anything was cut.
+func TruncateSMS(s string, max int) string {
+	runes := []rune(s)
+	if max <= 0 || len(runes) <= max {
+		return s
+	}
+	if max <= 3 {
+		return string(runes[:max])
+	}
+	return strings.TrimRight(string(runes[:max-3]), " \n") + "..."
+}
+
+// BuildSMSEmail renders a received SMS as a plain text email. Replies go to
+// the gateway address of the sender on the same modem, and all SMS of one
+// conversation share a References root so mail clients thread them.
+func BuildSMSEmail(sms *model.SMS, from string, to []string, domain string) []byte {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", (&mail.Address{Name: sms.Phone, Address: from}).String())
+	header("To", strings.Join(to, ", "))
+	if reply := GatewayAddress(sms.Phone, sms.ICCID, domain); reply != "" {
+		header("Reply-To", "<"+reply+">")
+	}
+	header("Subject", mime.QEncoding.Encode("utf-8", "SMS from "+sms.Phone))
+	header("Date", sms.Timestamp.Format(time.RFC1123Z))
+	header("Message-ID", SMSEmailMessageID(sms.ID, domain))
+	root := fmt.Sprintf("<conv-%s-%x@%s>", sms.ICCID, sms.Phone, domain)
+	header("In-Reply-To", root)
+	header("References", root)
+	header("Auto-Submitted", "auto-generated")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(sms.Content, "\r\n", "\n"), "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+// BuildSMSFailureEmail tells the sender of an email that its SMS could not be
+// sent.
+func BuildSMSFailureEmail(from, to, number, text string, sendErr error, now time.Time, domain string) []byte {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", from)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", "SMS to "+number+" failed"))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<fail-%d@%s>", now.UnixNano(), domain))
+	header("Auto-Submitted", "auto-replied")
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	fmt.Fprintf(qp, "Your message to %s could not be sent: %v\r\n\r\n%s\r\n", number, sendErr, strings.ReplaceAll(text, "\n", "\r\n"))
+	qp.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,82 @@
+package logic
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+func TestParseGatewayAddress(t *testing.T) {
+	number, modem, err := ParseGatewayAddress("+886912345678+office@SMS.local", "sms.local")
+	if err != nil || number != "+886912345678" || modem != "office" {
+		t.Fatalf("got %q %q %v", number, modem, err)
+	}
+	number, modem, err = ParseGatewayAddress("0912-345-678@sms.local", "sms.local")
+	if err != nil || number != "0912345678" || modem != "" {
+		t.Fatalf("got %q %q %v", number, modem, err)
+	}
+	if _, _, err := ParseGatewayAddress("+886912345678@example.com", "sms.local"); err == nil {
+		t.Fatal("foreign domain accepted")
+	}
+	if _, _, err := ParseGatewayAddress("alice@sms.local", "sms.local"); err == nil {
+		t.Fatal("non-numeric local part accepted")
+	}
+}
+
+func TestEmailTextAndTrim(t *testing.T) {
+	raw := "Subject: Re: SMS from +886912345678\r\n" +
+		"In-Reply-To: <sms-42@sms.local>\r\n" +
+		"References: <conv-1@sms.local> <sms-41@sms.local> <sms-42@sms.local>\r\n" +
+		"Content-Type: multipart/alternative; boundary=b1\r\n\r\n" +
+		"--b1\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n" +
+		"On my way =E2=9C=93\r\n\r\n\r\nSee you\r\n\r\nOn Mon, 1 May 2024 at 10:00, +886912345678 <\r\n+886912345678+8988@sms.local> wrote:\r\n> where are you?\r\n" +
+		"--b1\r\nContent-Type: text/html\r\n\r\n<p>ignored</p>\r\n--b1--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text, err := EmailText(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := TrimEmailBody(text); got != "On my way ✓\n\nSee you" {
+		t.Fatalf("trimmed body = %q", got)
+	}
+	if got := EmailSubject(msg.Header); got != "SMS from +886912345678" {
+		t.Fatalf("subject = %q", got)
+	}
+	if ids := SMSEmailReferences(msg.Header, "sms.local"); len(ids) != 2 || ids[0] != 42 || ids[1] != 41 {
+		t.Fatalf("references = %v", ids)
+	}
+
+	htmlOnly, _ := mail.ReadMessage(strings.NewReader("Content-Type: text/html\r\n\r\n<div>Hi&amp;bye<br>second</div><style>p{}</style>"))
+	if text, _ := EmailText(htmlOnly); strings.TrimSpace(text) != "Hi&bye\nsecond" {
+		t.Fatalf("html text = %q", text)
+	}
+}
+
+func TestTruncateSMS(t *testing.T) {
+	if got := TruncateSMS("short", 10); got != "short" {
+		t.Fatalf("got %q", got)
+	}
+	if got := TruncateSMS("驗證碼一二三四五六", 6); got != "驗證碼..." {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestBuildSMSEmail(t *testing.T) {
+	sms := &model.SMS{ID: 7, ICCID: "8988", Phone: "+886912345678", Content: "hello", Timestamp: time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)}
+	msg, err := mail.ReadMessage(strings.NewReader(string(BuildSMSEmail(sms, "smsie@example.com", []string{"me@example.com"}, "sms.local"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Header.Get("Reply-To") != "<+886912345678+8988@sms.local>" || msg.Header.Get("Message-ID") != "<sms-7@sms.local>" {
+		t.Fatalf("unexpected headers %v", msg.Header)
+	}
+	if ids := SMSEmailReferences(mail.Header{"In-Reply-To": {msg.Header.Get("Message-ID")}}, "sms.local"); len(ids) != 1 || ids[0] != 7 {
+		t.Fatalf("own Message-ID not recognized: %v", ids)
+	}
+}
@@ -0,0 +1,144 @@
+package logic
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EventSMSReceived       = "sms.received"
+	EventSMSSent           = "sms.sent"
+	EventSMSFailed         = "sms.failed"
+	EventModemOnline       = "modem.online"
+	EventModemOffline      = "modem.offline"
+	EventModemSignal       = "modem.signal"
+	EventModemRegistration = "modem.registration"
+	EventCallState         = "call.state"
+	// EventStreamReset tells a resuming client that events were missed and
+	// it should reload state through the REST API.
+	EventStreamReset = "stream.reset"
+
+	eventBacklogSize    = 1024
+	eventSubscriberSize = 256
+)
+
+// Event is one change pushed to /api/v1/events. IDs grow across restarts,
+// so a Last-Event-ID from a previous process is detected as a gap.
+type Event struct {
+	ID    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	ICCID string      `json:"iccid,omitempty"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// EventHub fans events out to subscribers and keeps a backlog for resuming.
+type EventHub struct {
+	mu      sync.Mutex
+	nextID  uint64
+	backlog []Event // ring buffer, oldest at start
+	start   int
+	subs    map[int]chan Event
+	nextSub int
+}
+
+func NewEventHub() *EventHub {
+	return &EventHub{
+		nextID:  uint64(time.Now().UnixMicro()),
+		backlog: make([]Event, 0, eventBacklogSize),
+		subs:    make(map[int]chan Event),
+	}
+}
+
+// Publish assigns the event an ID and delivers it. Subscribers that cannot
+// keep up are dropped; they reconnect and resume from the backlog.
+func (h *EventHub) Publish(eventType, iccid string, data interface{}) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.nextID++
+	e := Event{ID: h.nextID, Type: eventType, ICCID: iccid, Time: time.Now(), Data: data}
+	if len(h.backlog) < eventBacklogSize {
+		h.backlog = append(h.backlog, e)
+	} else {
+		h.backlog[h.start] = e
+		h.start = (h.start + 1) % eventBacklogSize
+	}
+
+	for id, ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			close(ch)
+			delete(h.subs, id)
+		}
+	}
+}
+
+// Subscribe returns the backlog after lastID and a channel for new events.
+// A lastID of 0 starts with new events only. If events after lastID are no
+// longer available, the backlog starts with an EventStreamReset followed by
+// every retained event. The channel is closed when the subscriber falls
+// behind; cancel must be called when done.
+func (h *EventHub) Subscribe(lastID uint64) (backlog []Event, events <-chan Event, cancel func()) {
+	if h == nil {
+		return nil, nil, func() {}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lastID != 0 {
+		oldest := h.nextID + 1
+		if len(h.backlog) > 0 {
+			oldest = h.backlog[h.start].ID
+		}
+		if lastID+1 < oldest || lastID > h.nextID {
+			backlog = append(backlog, Event{ID: oldest - 1, Type: EventStreamReset, Time: time.Now()})
+			lastID = 0
+		}
+		for i := 0; i < len(h.backlog); i++ {
+			e := h.backlog[(h.start+i)%len(h.backlog)]
+			if e.ID > lastID {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	ch := make(chan Event, eventSubscriberSize)
+	id := h.nextSub
+	h.nextSub++
+	h.subs[id] = ch
+
+	return backlog, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[id]; ok {
+			close(ch)
+			delete(h.subs, id)
+		}
+	}
+}
+
+// EventTypeMatches reports whether t is selected by a comma separated filter
+// of types or families such as "sms", "sms." or "sms.*". An empty filter
+// selects all.
+func EventTypeMatches(filter, t string) bool {
+	if strings.TrimSpace(filter) == "" {
+		return true
+	}
+	for _, item := range strings.Split(filter, ",") {
+		item = strings.TrimSuffix(strings.TrimSpace(item), "*")
+		if item == "" {
+			continue
+		}
+		if item == t || strings.HasPrefix(t, strings.TrimSuffix(item, ".")+".") {
+			return true
+		}
+	}
+	return false
+}
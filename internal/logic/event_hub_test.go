@@ -0,0 +1,82 @@
+package logic
+
+import "testing"
+
+func TestEventHubResumeFromBacklog(t *testing.T) {
+	h := NewEventHub()
+	h.Publish(EventSMSReceived, "1", nil)
+	h.Publish(EventModemSignal, "1", nil)
+	h.Publish(EventSMSSent, "2", nil)
+
+	all, _, cancel := h.Subscribe(1)
+	cancel()
+	if len(all) != 4 || all[0].Type != EventStreamReset || all[1].Type != EventSMSReceived {
+		t.Fatalf("expected reset and all events for an unknown id, got %+v", all)
+	}
+
+	first := h.backlog[0].ID
+	backlog, events, cancel := h.Subscribe(first)
+	defer cancel()
+	if len(backlog) != 2 || backlog[0].Type != EventModemSignal || backlog[1].Type != EventSMSSent {
+		t.Fatalf("unexpected backlog: %+v", backlog)
+	}
+
+	h.Publish(EventCallState, "1", nil)
+	if e := <-events; e.Type != EventCallState || e.ID != backlog[1].ID+1 {
+		t.Fatalf("unexpected live event: %+v", e)
+	}
+}
+
+func TestEventHubGapAfterOverflow(t *testing.T) {
+	h := NewEventHub()
+	h.Publish(EventSMSReceived, "1", nil)
+	first := h.backlog[0].ID
+	for i := 0; i < eventBacklogSize+1; i++ {
+		h.Publish(EventModemSignal, "1", nil)
+	}
+
+	backlog, _, cancel := h.Subscribe(first)
+	defer cancel()
+	if len(backlog) != eventBacklogSize+1 || backlog[0].Type != EventStreamReset {
+		t.Fatalf("expected reset and full backlog, got %d events starting with %+v", len(backlog), backlog[0])
+	}
+	if backlog[0].ID != backlog[1].ID-1 {
+		t.Fatalf("reset id %d should precede oldest retained %d", backlog[0].ID, backlog[1].ID)
+	}
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	h := NewEventHub()
+	_, events, cancel := h.Subscribe(0)
+	defer cancel()
+	for i := 0; i < eventSubscriberSize+1; i++ {
+		h.Publish(EventModemSignal, "1", nil)
+	}
+
+	n := 0
+	for range events {
+		n++
+	}
+	if n != eventSubscriberSize {
+		t.Fatalf("expected %d buffered events before close, got %d", eventSubscriberSize, n)
+	}
+}
+
+func TestEventTypeMatches(t *testing.T) {
+	cases := []struct {
+		filter, typ string
+		want        bool
+	}{
+		{"", EventSMSReceived, true},
+		{"sms", EventSMSReceived, true},
+		{"sms.*", EventSMSSent, true},
+		{"modem.signal, call.state", EventCallState, true},
+		{"modem.signal", EventModemOnline, false},
+		{"sm", EventSMSReceived, false},
+	}
+	for _, tc := range cases {
+		if got := EventTypeMatches(tc.filter, tc.typ); got != tc.want {
+			t.Fatalf("EventTypeMatches(%q, %q) = %v, want %v", tc.filter, tc.typ, got, tc.want)
+		}
+	}
+}
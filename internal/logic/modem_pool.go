@@ -0,0 +1,139 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pccr10001/smsie/internal/mccmnc"
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+const (
+	PoolStrategyRoundRobin  = "round_robin"
+	PoolStrategyLeastRecent = "least_recent"
+	PoolStrategyPriority    = "priority"
+)
+
+var (
+	poolNamePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	poolCountryPattern = regexp.MustCompile(`^[A-Za-z]{2}$`)
+	poolPrefixPattern  = regexp.MustCompile(`^\+?[0-9]+$`)
+)
+
+// ValidateModemPool normalizes a pool and its members.
+func ValidateModemPool(pool *model.ModemPool) error {
+	pool.Name = strings.TrimSpace(pool.Name)
+	pool.Strategy = strings.ToLower(strings.TrimSpace(pool.Strategy))
+	if !poolNamePattern.MatchString(pool.Name) {
+		return errors.New("name must be 1-64 letters, digits, '_', '.' or '-'")
+	}
+
+	switch pool.Strategy {
+	case "":
+		pool.Strategy = PoolStrategyRoundRobin
+	case PoolStrategyRoundRobin, PoolStrategyLeastRecent, PoolStrategyPriority:
+	default:
+		return errors.New("strategy must be round_robin, least_recent or priority")
+	}
+	if pool.MinSignal < 0 || pool.MinSignal > 100 {
+		return errors.New("min_signal must be between 0 and 100")
+	}
+
+	var onNet []string
+	for _, pair := range splitWebhookList(pool.OnNet) {
+		prefix, operator, ok := strings.Cut(pair, "=")
+		prefix, operator = NormalizeCallerNumber(prefix), strings.TrimSpace(operator)
+		if !ok || !poolPrefixPattern.MatchString(prefix) || operator == "" {
+			return fmt.Errorf("invalid on_net entry %q, expected prefix=operator", pair)
+		}
+		onNet = append(onNet, prefix+"="+operator)
+	}
+	pool.OnNet = strings.Join(onNet, ",")
+
+	seen := make(map[string]bool)
+	for i := range pool.Members {
+		member := &pool.Members[i]
+		member.ICCID = strings.TrimSpace(member.ICCID)
+		if member.ICCID == "" {
+			return errors.New("member iccid is required")
+		}
+		if seen[member.ICCID] {
+			return fmt.Errorf("modem %s is listed twice", member.ICCID)
+		}
+		seen[member.ICCID] = true
+		if member.DailyLimit < 0 {
+			return errors.New("daily_limit must not be negative")
+		}
+
+		var destinations []string
+		for _, dest := range splitWebhookList(member.Destinations) {
+			if poolCountryPattern.MatchString(dest) {
+				destinations = append(destinations, strings.ToUpper(dest))
+				continue
+			}
+			if prefix := NormalizeCallerNumber(dest); poolPrefixPattern.MatchString(prefix) {
+				destinations = append(destinations, prefix)
+				continue
+			}
+			return fmt.Errorf("invalid destination %q", dest)
+		}
+		member.Destinations = strings.Join(destinations, ",")
+	}
+	return nil
+}
+
+// PoolDestinationMatch reports how specifically a member's destinations
+// cover the phone number: the length of the longest matching prefix, 0 for a
+// member without destinations, or -1 if none matches. Countries match by
+// their calling code.
+func PoolDestinationMatch(destinations, phone string) int {
+	list := splitWebhookList(destinations)
+	if len(list) == 0 {
+		return 0
+	}
+	phone = poolInternational(NormalizeCallerNumber(phone))
+	best := -1
+	for _, dest := range list {
+		prefix := dest
+		if poolCountryPattern.MatchString(dest) {
+			code := mccmnc.CallingCode(dest)
+			if code == "" {
+				continue
+			}
+			prefix = "+" + code
+		}
+		prefix = poolInternational(prefix)
+		if strings.HasPrefix(phone, prefix) && len(prefix) > best {
+			best = len(prefix)
+		}
+	}
+	return best
+}
+
+// PoolOnNetOperator returns the operator serving the phone number according
+// to the pool's on-net table, by longest prefix.
+func PoolOnNetOperator(onNet, phone string) string {
+	phone = poolInternational(NormalizeCallerNumber(phone))
+	operator, best := "", 0
+	for _, pair := range splitWebhookList(onNet) {
+		prefix, op, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		prefix = poolInternational(prefix)
+		if strings.HasPrefix(phone, prefix) && len(prefix) > best {
+			operator, best = strings.TrimSpace(op), len(prefix)
+		}
+	}
+	return operator
+}
+
+// poolInternational writes a 00 international prefix as +.
+func poolInternational(number string) string {
+	if strings.HasPrefix(number, "00") {
+		return "+" + number[2:]
+	}
+	return number
+}
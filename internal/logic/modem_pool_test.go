@@ -0,0 +1,59 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+func TestValidateModemPool(t *testing.T) {
+	pool := &model.ModemPool{
+		Name:  "main",
+		OnNet: " +886 93 = Taiwan Mobile ,+88691=Chunghwa",
+		Members: []model.ModemPoolMember{
+			{ICCID: " 8988 ", Destinations: "tw, +1 (415)"},
+		},
+	}
+	if err := ValidateModemPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	if pool.Strategy != PoolStrategyRoundRobin || pool.OnNet != "+88693=Taiwan Mobile,+88691=Chunghwa" {
+		t.Fatalf("unexpected pool %+v", pool)
+	}
+	if m := pool.Members[0]; m.ICCID != "8988" || m.Destinations != "TW,+1415" {
+		t.Fatalf("unexpected member %+v", m)
+	}
+
+	for _, bad := range []*model.ModemPool{
+		{Name: "bad name"},
+		{Name: "a", Strategy: "random"},
+		{Name: "a", OnNet: "+886"},
+		{Name: "a", Members: []model.ModemPoolMember{{ICCID: "1"}, {ICCID: "1"}}},
+		{Name: "a", Members: []model.ModemPoolMember{{ICCID: "1", Destinations: "abc"}}},
+	} {
+		if ValidateModemPool(bad) == nil {
+			t.Fatalf("expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestPoolDestinationMatch(t *testing.T) {
+	cases := []struct {
+		destinations, phone string
+		want                int
+	}{
+		{"", "+886912345678", 0},
+		{"+886", "+886 912-345-678", 4},
+		{"+886,+88691", "00886912345678", 6},
+		{"+1", "+886912345678", -1},
+		{"ZZ", "+886912345678", -1},
+	}
+	for _, tc := range cases {
+		if got := PoolDestinationMatch(tc.destinations, tc.phone); got != tc.want {
+			t.Fatalf("PoolDestinationMatch(%q, %q) = %d, want %d", tc.destinations, tc.phone, got, tc.want)
+		}
+	}
+	if op := PoolOnNetOperator("+886=Any,+88693=Taiwan Mobile", "+886933123456"); op != "Taiwan Mobile" {
+		t.Fatalf("unexpected on-net operator %q", op)
+	}
+}
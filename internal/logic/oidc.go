@@ -0,0 +1,153 @@
+package logic
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+// oidcPermissions are the permission names group mappings may grant.
+var oidcPermissions = []string{"make_call", "view_sms", "send_sms", "send_at"}
+
+// OIDCGrant is what a user's provider groups give them.
+type OIDCGrant struct {
+	Role          string
+	AllowedModems string
+	// Permissions are the per-modem rows to store; none means every
+	// permission on AllowedModems.
+	Permissions []model.UserModemPermission
+}
+
+// ValidateOIDCMappings checks roles and permission names of group mappings.
+func ValidateOIDCMappings(mappings []config.OIDCGroupMapping) error {
+	for i, m := range mappings {
+		if strings.TrimSpace(m.Group) == "" {
+			return fmt.Errorf("oidc.group_mappings[%d]: group is required", i)
+		}
+		if m.Role != "" && m.Role != "admin" && m.Role != "user" {
+			return fmt.Errorf("oidc.group_mappings[%d]: role must be admin or user", i)
+		}
+		for _, perm := range m.Permissions {
+			if !containsString(oidcPermissions, perm) {
+				return fmt.Errorf("oidc.group_mappings[%d]: unknown permission %q", i, perm)
+			}
+		}
+	}
+	return nil
+}
+
+// OIDCGroupAllowed reports whether a user in the groups may sign in.
+func OIDCGroupAllowed(allowed, groups []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if containsString(allowed, g) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// MapOIDCGroups combines the mappings of the groups a user is in. Permission
+// rows match modems exactly, so a "*" mapping that grants only some
+// permissions is expanded to the modems known now.
+func MapOIDCGroups(mappings []config.OIDCGroupMapping, groups, knownICCIDs []string) OIDCGrant {
+	grant := OIDCGrant{Role: "user"}
+	var wildcard model.UserModemPermission
+	hasWildcard, restricted := false, false
+	perICCID := map[string]model.UserModemPermission{}
+
+	for _, m := range mappings {
+		if !containsString(groups, m.Group) {
+			continue
+		}
+		if m.Role == "admin" {
+			grant.Role = "admin"
+		}
+		flags := oidcMappingFlags(m)
+		if !allOIDCFlags(flags) {
+			restricted = true
+		}
+		for _, iccid := range m.Modems {
+			iccid = strings.TrimSpace(iccid)
+			switch iccid {
+			case "":
+			case "*":
+				hasWildcard = true
+				wildcard = mergeOIDCFlags(wildcard, flags)
+			default:
+				perICCID[iccid] = mergeOIDCFlags(perICCID[iccid], flags)
+			}
+		}
+	}
+
+	if grant.Role == "admin" || (hasWildcard && allOIDCFlags(wildcard)) {
+		grant.AllowedModems = "*"
+		return grant
+	}
+	if hasWildcard {
+		grant.AllowedModems = "*"
+		if !restricted {
+			return grant
+		}
+		for _, iccid := range knownICCIDs {
+			perICCID[iccid] = mergeOIDCFlags(perICCID[iccid], wildcard)
+		}
+	}
+
+	iccids := make([]string, 0, len(perICCID))
+	for iccid := range perICCID {
+		iccids = append(iccids, iccid)
+	}
+	sort.Strings(iccids)
+	if !hasWildcard {
+		grant.AllowedModems = strings.Join(iccids, ",")
+	}
+	if !restricted {
+		return grant
+	}
+	for _, iccid := range iccids {
+		rule := perICCID[iccid]
+		rule.ICCID = iccid
+		grant.Permissions = append(grant.Permissions, rule)
+	}
+	return grant
+}
+
+func oidcMappingFlags(m config.OIDCGroupMapping) model.UserModemPermission {
+	perms := m.Permissions
+	if len(perms) == 0 {
+		perms = oidcPermissions
+	}
+	return model.UserModemPermission{
+		CanMakeCall: containsString(perms, "make_call"),
+		CanViewSMS:  containsString(perms, "view_sms"),
+		CanSendSMS:  containsString(perms, "send_sms"),
+		CanSendAT:   containsString(perms, "send_at"),
+	}
+}
+
+func mergeOIDCFlags(a, b model.UserModemPermission) model.UserModemPermission {
+	a.CanMakeCall = a.CanMakeCall || b.CanMakeCall
+	a.CanViewSMS = a.CanViewSMS || b.CanViewSMS
+	a.CanSendSMS = a.CanSendSMS || b.CanSendSMS
+	a.CanSendAT = a.CanSendAT || b.CanSendAT
+	return a
+}
+
+func allOIDCFlags(p model.UserModemPermission) bool {
+	return p.CanMakeCall && p.CanViewSMS && p.CanSendSMS && p.CanSendAT
+}
@@ -0,0 +1,64 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/pccr10001/smsie/internal/config"
+)
+
+var testOIDCMappings = []config.OIDCGroupMapping{
+	{Group: "smsie-admins", Role: "admin"},
+	{Group: "ops", Modems: []string{"*"}},
+	{Group: "support", Modems: []string{"8988"}, Permissions: []string{"view_sms"}},
+	{Group: "sales", Modems: []string{"8988", "8989"}, Permissions: []string{"send_sms"}},
+	{Group: "readers", Modems: []string{"*"}, Permissions: []string{"view_sms"}},
+}
+
+func TestMapOIDCGroups(t *testing.T) {
+	known := []string{"8988", "8989", "8990"}
+
+	if g := MapOIDCGroups(testOIDCMappings, []string{"smsie-admins", "support"}, known); g.Role != "admin" || g.AllowedModems != "*" || len(g.Permissions) != 0 {
+		t.Fatalf("expected admin, got %+v", g)
+	}
+	if g := MapOIDCGroups(testOIDCMappings, []string{"ops", "support"}, known); g.Role != "user" || g.AllowedModems != "*" || len(g.Permissions) != 0 {
+		t.Fatalf("expected every permission on all modems, got %+v", g)
+	}
+	if g := MapOIDCGroups(testOIDCMappings, []string{"unknown"}, known); g.Role != "user" || g.AllowedModems != "" {
+		t.Fatalf("expected no modems, got %+v", g)
+	}
+
+	g := MapOIDCGroups(testOIDCMappings, []string{"support", "sales"}, known)
+	if g.AllowedModems != "8988,8989" || len(g.Permissions) != 2 {
+		t.Fatalf("unexpected grant %+v", g)
+	}
+	if p := g.Permissions[0]; p.ICCID != "8988" || !p.CanViewSMS || !p.CanSendSMS || p.CanSendAT || p.CanMakeCall {
+		t.Fatalf("expected merged view and send on 8988, got %+v", p)
+	}
+	if p := g.Permissions[1]; p.ICCID != "8989" || p.CanViewSMS || !p.CanSendSMS {
+		t.Fatalf("expected send only on 8989, got %+v", p)
+	}
+
+	// A partial wildcard is expanded to the known modems.
+	g = MapOIDCGroups(testOIDCMappings, []string{"readers", "sales"}, known)
+	if g.AllowedModems != "*" || len(g.Permissions) != 3 {
+		t.Fatalf("unexpected grant %+v", g)
+	}
+	if p := g.Permissions[2]; p.ICCID != "8990" || !p.CanViewSMS || p.CanSendSMS {
+		t.Fatalf("expected view only on 8990, got %+v", p)
+	}
+}
+
+func TestValidateOIDCMappings(t *testing.T) {
+	if err := ValidateOIDCMappings(testOIDCMappings); err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateOIDCMappings([]config.OIDCGroupMapping{{Group: "x", Permissions: []string{"reboot"}}}); err == nil {
+		t.Fatal("expected an unknown permission to be rejected")
+	}
+	if err := ValidateOIDCMappings([]config.OIDCGroupMapping{{Group: "x", Role: "root"}}); err == nil {
+		t.Fatal("expected an unknown role to be rejected")
+	}
+	if !OIDCGroupAllowed(nil, nil) || OIDCGroupAllowed([]string{"staff"}, []string{"guests"}) || !OIDCGroupAllowed([]string{"staff"}, []string{"guests", "staff"}) {
+		t.Fatal("unexpected allowed group check")
+	}
+}
@@ -0,0 +1,218 @@
+package logic
+
+import (
+	"math"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+// OTPMinConfidence is the score an extracted code needs to be stored.
+const OTPMinConfidence = 0.5
+
+// OTPMatch is a one-time code found in an SMS.
+type OTPMatch struct {
+	Code       string
+	Confidence float64 // 0-1
+	Service    string  // Guessed from the sender or content, may be empty
+}
+
+var (
+	// ASCII keywords are matched as words so "pin" does not hit "spinning".
+	otpWordKeywords = regexp.MustCompile(`(?i)\b(otp|code|codes|passcode|password|pin|verification|verify|one[- ]time|2fa|auth|authentication|login|sign[- ]in|tan|token|codigo|kode)\b`)
+	// Other scripts have no word boundaries and are matched anywhere.
+	otpTextKeywords = regexp.MustCompile(`(?i)验证码|驗證碼|校验码|校驗碼|动态码|動態碼|认证码|認證碼|确认码|確認碼|安全码|安全碼|密码|密碼|授权码|授權碼|` +
+		`認証コード|確認コード|認証番号|確認番号|ワンタイム|パスワード|` +
+		`인증\s?번호|인증\s?코드|확인\s?코드|` +
+		`código|code de vérification|bestätigungscode|mã xác nhận|mã otp|код|пароль|รหัส`)
+
+	otpNumeric      = regexp.MustCompile(`\b\d{4,8}\b`)
+	otpSplitNumeric = regexp.MustCompile(`\b(\d{3})[ -](\d{3})\b`)
+	otpAlphanumeric = regexp.MustCompile(`\b[A-Z0-9]{4,10}\b`)
+
+	otpBracketService = regexp.MustCompile(`^\s*(?:<#>\s*)?[\[【［(]([^\]】］)]{1,30})[\]】］)]`)
+	otpPhraseService  = regexp.MustCompile(`\b(?i:your|for|from)\s+([A-Z][\w&.\-]*(?:\s[A-Z][\w&.\-]*)?)\s+(?i:verification|security|login|sign[- ]in|confirmation|one[- ]time|otp|authentication|account|code)\b`)
+)
+
+type otpCandidate struct {
+	code       string
+	start, end int
+	numeric    bool
+}
+
+// ExtractOTP looks for a one-time code in an SMS. It scores each candidate
+// by how close it is to a keyword such as "code" or "验证码" and returns the
+// best one if it reaches OTPMinConfidence.
+func ExtractOTP(sender, content string) (OTPMatch, bool) {
+	candidates := otpCandidates(content)
+	if len(candidates) == 0 {
+		return OTPMatch{}, false
+	}
+	keywords := otpKeywordSpans(content)
+
+	best, bestScore := otpCandidate{}, 0.0
+	for _, c := range candidates {
+		score := 0.2
+		if len(keywords) > 0 {
+			score = 0.5
+			switch d := otpKeywordDistance(c, keywords); {
+			case d <= 30:
+				score += 0.3
+			case d <= 80:
+				score += 0.15
+			}
+		}
+		switch {
+		case c.numeric && len(c.code) == 6:
+			score += 0.1
+		case c.numeric:
+			score += 0.05
+		}
+		if len(candidates) == 1 {
+			score += 0.1
+		}
+		if score > bestScore {
+			best, bestScore = c, score
+		}
+	}
+
+	bestScore = math.Round(math.Min(bestScore, 1)*100) / 100
+	if bestScore < OTPMinConfidence {
+		return OTPMatch{}, false
+	}
+	return OTPMatch{Code: best.code, Confidence: bestScore, Service: guessOTPService(sender, content)}, true
+}
+
+// ApplyOTP stores the code found in a received SMS on it.
+func ApplyOTP(sms *model.SMS) {
+	if m, ok := ExtractOTP(sms.Phone, sms.Content); ok {
+		sms.OTP, sms.OTPConfidence, sms.OTPService = m.Code, m.Confidence, m.Service
+	}
+}
+
+func otpCandidates(content string) []otpCandidate {
+	var out []otpCandidate
+	taken := func(start, end int) bool {
+		for _, c := range out {
+			if start < c.end && end > c.start {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, m := range otpSplitNumeric.FindAllStringSubmatchIndex(content, -1) {
+		if otpExcluded(content, m[0], m[1]) {
+			continue
+		}
+		out = append(out, otpCandidate{code: content[m[2]:m[3]] + content[m[4]:m[5]], start: m[0], end: m[1], numeric: true})
+	}
+	for _, m := range otpNumeric.FindAllStringIndex(content, -1) {
+		if taken(m[0], m[1]) || otpExcluded(content, m[0], m[1]) {
+			continue
+		}
+		out = append(out, otpCandidate{code: content[m[0]:m[1]], start: m[0], end: m[1], numeric: true})
+	}
+	for _, m := range otpAlphanumeric.FindAllStringIndex(content, -1) {
+		code := content[m[0]:m[1]]
+		if taken(m[0], m[1]) || !strings.ContainsAny(code, "0123456789") || !strings.ContainsAny(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			continue
+		}
+		if otpExcluded(content, m[0], m[1]) {
+			continue
+		}
+		out = append(out, otpCandidate{code: code, start: m[0], end: m[1]})
+	}
+	return out
+}
+
+// otpExcluded rejects numbers that are amounts, phone numbers, times, dates
+// or part of a longer number.
+func otpExcluded(content string, start, end int) bool {
+	before := strings.TrimRight(content[:start], " ")
+	after := strings.TrimLeft(content[end:], " ")
+
+	if strings.HasSuffix(before, "+") || strings.ContainsAny(lastRune(before), "$¥€£￥") {
+		return true
+	}
+	upper := strings.ToUpper(before)
+	for _, p := range []string{"USD", "TWD", "RMB", "CNY", "HKD", "EUR"} {
+		if strings.HasSuffix(upper, p) && !strings.ContainsFunc(lastRune(upper[:len(upper)-len(p)]), unicode.IsLetter) {
+			return true
+		}
+	}
+	for _, s := range []string{"元", "%", "円", "원"} {
+		if strings.HasPrefix(after, s) {
+			return true
+		}
+	}
+	// 12:30, 2024/01/02, 1,000.50 and similar
+	if start > 0 && strings.ContainsRune(":/.,", rune(content[start-1])) && start > 1 && isASCIIDigit(content[start-2]) {
+		return true
+	}
+	if end < len(content)-1 && strings.ContainsRune(":/.,", rune(content[end])) && isASCIIDigit(content[end+1]) {
+		return true
+	}
+	return false
+}
+
+func lastRune(s string) string {
+	r, size := utf8.DecodeLastRuneInString(s)
+	if size == 0 {
+		return ""
+	}
+	return string(r)
+}
+
+func isASCIIDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+func otpKeywordSpans(content string) [][2]int {
+	var spans [][2]int
+	for _, m := range otpWordKeywords.FindAllStringIndex(content, -1) {
+		spans = append(spans, [2]int{m[0], m[1]})
+	}
+	for _, m := range otpTextKeywords.FindAllStringIndex(content, -1) {
+		spans = append(spans, [2]int{m[0], m[1]})
+	}
+	return spans
+}
+
+// otpKeywordDistance is the gap in bytes between a candidate and the nearest
+// keyword on either side.
+func otpKeywordDistance(c otpCandidate, keywords [][2]int) int {
+	best := math.MaxInt
+	for _, k := range keywords {
+		d := 0
+		switch {
+		case k[1] <= c.start:
+			d = c.start - k[1]
+		case k[0] >= c.end:
+			d = k[0] - c.end
+		}
+		if d < best {
+			best = d
+		}
+	}
+	return best
+}
+
+// guessOTPService prefers an alphanumeric sender ID such as "Google", then a
+// leading [Name] or 【Name】 tag, then phrases like "your Name code".
+func guessOTPService(sender, content string) string {
+	sender = strings.TrimSpace(sender)
+	if strings.IndexFunc(sender, unicode.IsLetter) >= 0 {
+		return sender
+	}
+	if m := otpBracketService.FindStringSubmatch(content); m != nil {
+		return strings.TrimSpace(m[1])
+	}
+	if m := otpPhraseService.FindStringSubmatch(content); m != nil && !otpWordKeywords.MatchString(m[1]) {
+		return strings.TrimSpace(m[1])
+	}
+	return ""
+}
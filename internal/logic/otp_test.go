@@ -0,0 +1,46 @@
+package logic
+
+import "testing"
+
+func TestExtractOTP(t *testing.T) {
+	cases := []struct {
+		sender, content string
+		code, service   string
+	}{
+		{"Google", "G-482913 is your Google verification code.", "482913", "Google"},
+		{"+886912345678", "Your verification code is 5521. It expires in 10 minutes.", "5521", ""},
+		{"+12025550100", "Use 739 104 to sign in to your Acme account", "739104", "Acme"},
+		{"+12025550100", "Your Microsoft account security code is 3307", "3307", "Microsoft"},
+		{"10690000", "【淘宝】您的验证码是834512，5分钟内有效，请勿泄露。", "834512", "淘宝"},
+		{"0912345678", "[LINE] 您的LINE驗證碼為 902144", "902144", "LINE"},
+		{"Steam", "Your Steam Guard code: R7K2P", "R7K2P", "Steam"},
+		{"+8210", "[카카오] 인증번호 [482210]를 입력해주세요.", "482210", "카카오"},
+		{"+81", "認証コード：112233", "112233", ""},
+		{"+1555", "Payment of $1250 received on 2024/05/01 at 12:30, ref code 664201", "664201", ""},
+	}
+	for _, tc := range cases {
+		m, ok := ExtractOTP(tc.sender, tc.content)
+		if !ok {
+			t.Fatalf("no OTP found in %q", tc.content)
+		}
+		if m.Code != tc.code || m.Service != tc.service {
+			t.Fatalf("ExtractOTP(%q) = %+v, want code %q service %q", tc.content, m, tc.code, tc.service)
+		}
+		if m.Confidence < OTPMinConfidence || m.Confidence > 1 {
+			t.Fatalf("confidence out of range: %+v", m)
+		}
+	}
+}
+
+func TestExtractOTPIgnoresPlainMessages(t *testing.T) {
+	for _, content := range []string{
+		"Meet me at 1830 near gate 12",
+		"Your bill of $1250 is due on 2024/05/01",
+		"您的密码已修改成功",
+		"Call me back at +886912345678",
+	} {
+		if m, ok := ExtractOTP("+886912345678", content); ok {
+			t.Fatalf("unexpected OTP in %q: %+v", content, m)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package logic
+
+import (
+	"sync"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+var (
+	settingsMu    sync.RWMutex
+	settingsCache = map[string]string{}
+)
+
+// Settings reads and writes AppSetting rows. Values are cached for the
+// process, which is the only writer.
+type Settings struct {
+	db *gorm.DB
+}
+
+func NewSettings(db *gorm.DB) *Settings {
+	return &Settings{db: db}
+}
+
+func (s *Settings) Get(key string) string {
+	settingsMu.RLock()
+	v, ok := settingsCache[key]
+	settingsMu.RUnlock()
+	if ok {
+		return v
+	}
+	var row model.AppSetting
+	if err := s.db.Where(map[string]interface{}{"key": key}).Limit(1).Find(&row).Error; err != nil {
+		return ""
+	}
+	settingsMu.Lock()
+	settingsCache[key] = row.Value
+	settingsMu.Unlock()
+	return row.Value
+}
+
+func (s *Settings) Bool(key string) bool {
+	return s.Get(key) == "true"
+}
+
+func (s *Settings) Set(key, value string) error {
+	if err := s.db.Save(&model.AppSetting{Key: key, Value: value}).Error; err != nil {
+		return err
+	}
+	settingsMu.Lock()
+	settingsCache[key] = value
+	settingsMu.Unlock()
+	return nil
+}
@@ -0,0 +1,298 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	QuotaMinute = "minute"
+	QuotaHour   = "hour"
+	QuotaDay    = "day"
+	QuotaMonth  = "month"
+
+	smsUsagePruneInterval = time.Hour
+)
+
+var QuotaWindows = []string{QuotaMinute, QuotaHour, QuotaDay, QuotaMonth}
+
+var (
+	// smsQuotaMu makes checking and recording one step for all senders.
+	smsQuotaMu        sync.Mutex
+	smsUsageLastPrune time.Time
+)
+
+// QuotaSubject is who an SMS counts against: a user, and the API key it was
+// sent with (0 for sessions and rules).
+type QuotaSubject struct {
+	UserID   uint
+	APIKeyID uint
+}
+
+// QuotaExceededError reports the quota that blocks a send and how long until
+// its window resets.
+type QuotaExceededError struct {
+	Quota      model.SMSQuota
+	Window     string
+	Limit      int
+	RetryAfter time.Duration
+}
+
+func (e *QuotaExceededError) Error() string {
+	scope := "user"
+	if e.Quota.APIKeyID != 0 {
+		scope = "API key"
+	}
+	if e.Quota.ICCID != "" {
+		scope += " quota for modem " + e.Quota.ICCID
+	} else {
+		scope += " quota"
+	}
+	return fmt.Sprintf("SMS %s exceeded (%d per %s), retry in %ds", scope, e.Limit, e.Window, e.RetryAfterSeconds())
+}
+
+// RetryAfterSeconds rounds RetryAfter up for a Retry-After header.
+func (e *QuotaExceededError) RetryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// AsQuotaExceeded unwraps a QuotaExceededError.
+func AsQuotaExceeded(err error) (*QuotaExceededError, bool) {
+	var qe *QuotaExceededError
+	ok := errors.As(err, &qe)
+	return qe, ok
+}
+
+// QuotaLimit returns the limit a quota sets for a window, 0 for none.
+func QuotaLimit(q *model.SMSQuota, window string) int {
+	switch window {
+	case QuotaMinute:
+		return q.PerMinute
+	case QuotaHour:
+		return q.PerHour
+	case QuotaDay:
+		return q.PerDay
+	case QuotaMonth:
+		return q.PerMonth
+	}
+	return 0
+}
+
+// QuotaWindowStart returns the start of the calendar window containing t, in
+// t's location.
+func QuotaWindowStart(window string, t time.Time) time.Time {
+	switch window {
+	case QuotaMinute:
+		return t.Truncate(time.Minute)
+	case QuotaHour:
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	case QuotaDay:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+}
+
+// QuotaWindowEnd returns when the calendar window containing t ends.
+func QuotaWindowEnd(window string, t time.Time) time.Time {
+	start := QuotaWindowStart(window, t)
+	switch window {
+	case QuotaMinute:
+		return start.Add(time.Minute)
+	case QuotaHour:
+		return start.Add(time.Hour)
+	case QuotaDay:
+		return start.AddDate(0, 0, 1)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// ValidateSMSQuota checks that a quota sets at least one sane limit.
+func ValidateSMSQuota(q *model.SMSQuota) error {
+	if q.UserID == 0 {
+		return errors.New("user_id or api_key_id is required")
+	}
+	for _, window := range QuotaWindows {
+		if QuotaLimit(q, window) < 0 {
+			return fmt.Errorf("per_%s must not be negative", window)
+		}
+	}
+	if q.PerMinute == 0 && q.PerHour == 0 && q.PerDay == 0 && q.PerMonth == 0 {
+		return errors.New("at least one of per_minute, per_hour, per_day and per_month is required")
+	}
+	return nil
+}
+
+// SMSLimiter enforces SMS quotas with per-minute usage counters stored in
+// the database, so they survive restarts.
+type SMSLimiter struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+func NewSMSLimiter(db *gorm.DB) *SMSLimiter {
+	return &SMSLimiter{db: db, now: time.Now}
+}
+
+// Reserve checks the subject's quotas for the modem and counts one SMS.
+func (l *SMSLimiter) Reserve(subject QuotaSubject, iccid string) error {
+	return l.ReserveAll(subject, []string{iccid})
+}
+
+// ReserveAll reserves one SMS per listed modem, all of them or none.
+func (l *SMSLimiter) ReserveAll(subject QuotaSubject, iccids []string) error {
+	smsQuotaMu.Lock()
+	defer smsQuotaMu.Unlock()
+	var reserved []model.SMSUsage
+	for _, iccid := range iccids {
+		err := l.check(subject, iccid)
+		var usage model.SMSUsage
+		if err == nil {
+			usage, err = l.record(subject, iccid)
+		}
+		if err != nil {
+			for _, u := range reserved {
+				l.release(u)
+			}
+			return err
+		}
+		reserved = append(reserved, usage)
+	}
+	return nil
+}
+
+// Release gives back an SMS reserved for the modem when sending it failed.
+// It takes back the subject's latest count on the modem, which is the
+// reservation unless another SMS was counted in a later minute.
+func (l *SMSLimiter) Release(subject QuotaSubject, iccid string) {
+	smsQuotaMu.Lock()
+	defer smsQuotaMu.Unlock()
+	var usage model.SMSUsage
+	err := l.db.Where("user_id = ? AND api_key_id = ? AND iccid = ? AND count > 0", subject.UserID, subject.APIKeyID, iccid).
+		Order("minute desc").First(&usage).Error
+	if err == nil {
+		err = l.release(usage)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		logger.Log.Warnf("Failed to release SMS quota of user %d on %s: %v", subject.UserID, iccid, err)
+	}
+}
+
+// Check reports a QuotaExceededError if the subject may not send one more
+// SMS through the modem. With an empty ICCID only quotas covering all modems
+// are checked.
+func (l *SMSLimiter) Check(subject QuotaSubject, iccid string) error {
+	smsQuotaMu.Lock()
+	defer smsQuotaMu.Unlock()
+	return l.check(subject, iccid)
+}
+
+// Quotas returns the quotas that apply to the subject on the modem: the
+// user's and, for an API key, the key's own.
+func (l *SMSLimiter) Quotas(subject QuotaSubject, iccid string) ([]model.SMSQuota, error) {
+	q := l.db.Where("user_id = ?", subject.UserID)
+	if subject.APIKeyID != 0 {
+		q = q.Where("api_key_id IN ?", []uint{0, subject.APIKeyID})
+	} else {
+		q = q.Where("api_key_id = ?", 0)
+	}
+	if iccid != "" {
+		q = q.Where("iccid IN ?", []string{"", iccid})
+	} else {
+		q = q.Where("iccid = ?", "")
+	}
+	var list []model.SMSQuota
+	err := q.Order("id asc").Find(&list).Error
+	return list, err
+}
+
+func (l *SMSLimiter) check(subject QuotaSubject, iccid string) error {
+	quotas, err := l.Quotas(subject, iccid)
+	if err != nil {
+		return err
+	}
+	now := l.now()
+	var blocked *QuotaExceededError
+	for _, quota := range quotas {
+		for _, window := range QuotaWindows {
+			limit := QuotaLimit(&quota, window)
+			if limit == 0 {
+				continue
+			}
+			used, err := l.Used(quota.UserID, quota.APIKeyID, quota.ICCID, QuotaWindowStart(window, now))
+			if err != nil {
+				return err
+			}
+			if used < limit {
+				continue
+			}
+			// Report the window that stays closed the longest.
+			retry := QuotaWindowEnd(window, now).Sub(now)
+			if blocked == nil || retry > blocked.RetryAfter {
+				blocked = &QuotaExceededError{Quota: quota, Window: window, Limit: limit, RetryAfter: retry}
+			}
+		}
+	}
+	if blocked != nil {
+		return blocked
+	}
+	return nil
+}
+
+// Used counts SMS since the given time by the user, or by one API key when
+// apiKeyID is set, on one modem or on all of them.
+func (l *SMSLimiter) Used(userID, apiKeyID uint, iccid string, since time.Time) (int, error) {
+	q := l.db.Model(&model.SMSUsage{}).Where("user_id = ? AND minute >= ?", userID, since.UTC())
+	if apiKeyID != 0 {
+		q = q.Where("api_key_id = ?", apiKeyID)
+	}
+	if iccid != "" {
+		q = q.Where("iccid = ?", iccid)
+	}
+	var used int64
+	err := q.Select("COALESCE(SUM(count), 0)").Scan(&used).Error
+	return int(used), err
+}
+
+func (l *SMSLimiter) release(u model.SMSUsage) error {
+	return l.db.Model(&model.SMSUsage{}).
+		Where("user_id = ? AND api_key_id = ? AND iccid = ? AND minute = ?", u.UserID, u.APIKeyID, u.ICCID, u.Minute).
+		Update("count", gorm.Expr("count - 1")).Error
+}
+
+func (l *SMSLimiter) record(subject QuotaSubject, iccid string) (model.SMSUsage, error) {
+	now := l.now()
+	usage := model.SMSUsage{
+		UserID:   subject.UserID,
+		APIKeyID: subject.APIKeyID,
+		ICCID:    iccid,
+		Minute:   now.UTC().Truncate(time.Minute),
+		Count:    1,
+	}
+	err := l.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "api_key_id"}, {Name: "iccid"}, {Name: "minute"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{"count": gorm.Expr("count + 1")}),
+	}).Create(&usage).Error
+	if err != nil {
+		return usage, err
+	}
+
+	// Counters older than the previous month are not needed by any window.
+	if now.Sub(smsUsageLastPrune) > smsUsagePruneInterval {
+		smsUsageLastPrune = now
+		cutoff := QuotaWindowStart(QuotaMonth, now).AddDate(0, -1, 0).UTC()
+		if err := l.db.Where("minute < ?", cutoff).Delete(&model.SMSUsage{}).Error; err != nil {
+			logger.Log.Warnf("Failed to prune SMS usage counters: %v", err)
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,134 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+func newQuotaTestLimiter(t *testing.T) (*SMSLimiter, *gorm.DB) {
+	t.Helper()
+	logger.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.SMSQuota{}, &model.SMSUsage{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewSMSLimiter(db), db
+}
+
+func TestSMSLimiterWindows(t *testing.T) {
+	l, db := newQuotaTestLimiter(t)
+	now := time.Date(2024, 3, 10, 12, 0, 30, 0, time.UTC)
+	l.now = func() time.Time { return now }
+	db.Create(&model.SMSQuota{UserID: 1, PerMinute: 2, PerHour: 3})
+
+	user := QuotaSubject{UserID: 1}
+	for i := 0; i < 2; i++ {
+		if err := l.Reserve(user, "8988"); err != nil {
+			t.Fatalf("send %d: %v", i+1, err)
+		}
+	}
+	err := l.Reserve(user, "8988")
+	qe, ok := AsQuotaExceeded(err)
+	if !ok || qe.Window != QuotaMinute || qe.RetryAfterSeconds() != 30 {
+		t.Fatalf("expected minute quota with 30s retry, got %v", err)
+	}
+
+	// A new minute frees the minute window, the hour caps the third send.
+	now = now.Add(time.Minute)
+	if err := l.Reserve(user, "8989"); err != nil {
+		t.Fatalf("expected send in the next minute, got %v", err)
+	}
+	qe, ok = AsQuotaExceeded(l.Reserve(user, "8989"))
+	if !ok || qe.Window != QuotaHour {
+		t.Fatalf("expected hour quota, got %v", qe)
+	}
+	if got := qe.RetryAfter; got != 58*time.Minute+30*time.Second {
+		t.Fatalf("unexpected retry after %v", got)
+	}
+
+	now = now.Add(time.Hour)
+	if err := l.Reserve(user, "8988"); err != nil {
+		t.Fatalf("expected send in the next hour, got %v", err)
+	}
+}
+
+func TestSMSLimiterKeyAndModemQuotas(t *testing.T) {
+	l, db := newQuotaTestLimiter(t)
+	db.Create(&model.SMSQuota{UserID: 1, PerDay: 3})
+	db.Create(&model.SMSQuota{UserID: 1, APIKeyID: 7, PerDay: 1})
+	db.Create(&model.SMSQuota{UserID: 1, ICCID: "8988", PerDay: 2})
+
+	key := QuotaSubject{UserID: 1, APIKeyID: 7}
+	if err := l.Reserve(key, "8989"); err != nil {
+		t.Fatal(err)
+	}
+	qe, ok := AsQuotaExceeded(l.Reserve(key, "8989"))
+	if !ok || qe.Quota.APIKeyID != 7 {
+		t.Fatalf("expected the key's quota, got %v", qe)
+	}
+
+	// The key's usage counts towards its owner.
+	user := QuotaSubject{UserID: 1}
+	if err := l.Reserve(user, "8988"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reserve(user, "8988"); err != nil {
+		t.Fatal(err)
+	}
+	qe, ok = AsQuotaExceeded(l.Check(user, "8988"))
+	if !ok || qe.Quota.APIKeyID != 0 {
+		t.Fatalf("expected the user's quota, got %v", qe)
+	}
+
+	// Another user is unaffected.
+	if err := l.Reserve(QuotaSubject{UserID: 2}, "8988"); err != nil {
+		t.Fatal(err)
+	}
+	var rows int64
+	db.Model(&model.SMSUsage{}).Where("user_id = ?", 1).Count(&rows)
+	if rows != 2 {
+		t.Fatalf("expected usage grouped into 2 rows, got %d", rows)
+	}
+}
+
+func TestSMSLimiterRelease(t *testing.T) {
+	l, db := newQuotaTestLimiter(t)
+	db.Create(&model.SMSQuota{UserID: 1, PerDay: 1})
+
+	user := QuotaSubject{UserID: 1}
+	if err := l.Reserve(user, "8988"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := AsQuotaExceeded(l.Check(user, "8988")); !ok {
+		t.Fatal("expected the reservation to use up the quota")
+	}
+	l.Release(user, "8988")
+	if err := l.Reserve(user, "8988"); err != nil {
+		t.Fatalf("expected a released SMS to be available again, got %v", err)
+	}
+	// Nothing to release on another modem.
+	l.Release(user, "8989")
+	if used, _ := l.Used(1, 0, "", time.Time{}); used != 1 {
+		t.Fatalf("expected 1 SMS counted, got %d", used)
+	}
+}
+
+func TestValidateSMSQuota(t *testing.T) {
+	if err := ValidateSMSQuota(&model.SMSQuota{UserID: 1}); err == nil {
+		t.Fatal("expected a quota without limits to be rejected")
+	}
+	if err := ValidateSMSQuota(&model.SMSQuota{UserID: 1, PerDay: -1}); err == nil {
+		t.Fatal("expected a negative limit to be rejected")
+	}
+	if err := ValidateSMSQuota(&model.SMSQuota{UserID: 1, PerMonth: 100}); err != nil {
+		t.Fatal(err)
+	}
+}
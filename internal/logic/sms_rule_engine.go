@@ -0,0 +1,389 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+const (
+	SMSRuleAutoReply = "auto_reply"
+	SMSRuleForward   = "forward"
+	SMSRuleTag       = "tag"
+	SMSRuleMarkRead  = "mark_read"
+	SMSRuleWebhook   = "webhook"
+
+	smsRuleDefaultCooldown = 5 * time.Minute
+	smsRuleSendWindow      = time.Hour
+	smsRuleMaxSendsPerPeer = 5
+	smsRuleForwardTemplate = "From {{.Phone}}: {{.Content}}"
+)
+
+var smsRuleDialable = regexp.MustCompile(`^\+?[0-9]{3,20}$`)
+
+// SMSRuleSender sends an SMS through the modem with the given ICCID.
+type SMSRuleSender func(iccid, phone, message string) error
+
+// SMSRuleAuthorizer re-checks the rule owner's modem permissions when a rule
+// fires, so revoking access also disables the owner's existing rules.
+type SMSRuleAuthorizer interface {
+	CanViewSMS(userID uint, iccid string) bool
+	CanSendSMS(userID uint, iccid string) bool
+}
+
+type SMSRuleEngine struct {
+	repo     *repository.SMSRuleRepository
+	smsRepo  *repository.SMSRepository
+	webhooks *WebhookService
+	send     SMSRuleSender
+	auth     SMSRuleAuthorizer
+	quota    *SMSLimiter
+	now      func() time.Time
+
+	mu       sync.Mutex
+	cooldown map[string]time.Time   // "<rule id>|<sender>" -> last rule-generated send
+	sends    map[string][]time.Time // destination -> rule-generated sends within smsRuleSendWindow
+}
+
+func NewSMSRuleEngine(db *gorm.DB, send SMSRuleSender, auth SMSRuleAuthorizer) *SMSRuleEngine {
+	// Webhooks fired by rules are checked against their own owner, like
+	// those dispatched for every SMS.
+	webhooks := NewWebhookService(repository.NewWebhookRepository(db), repository.NewWebhookDeliveryRepository(db), repository.NewSMSRepository(db))
+	webhooks.SetAuthorizer(auth)
+	return &SMSRuleEngine{
+		repo:     repository.NewSMSRuleRepository(db),
+		smsRepo:  repository.NewSMSRepository(db),
+		webhooks: webhooks,
+		send:     send,
+		auth:     auth,
+		quota:    NewSMSLimiter(db),
+		now:      time.Now,
+		cooldown: make(map[string]time.Time),
+		sends:    make(map[string][]time.Time),
+	}
+}
+
+// Apply evaluates the rules for a stored, received SMS. Tag and mark_read
+// update the SMS in place (and in the database) so webhooks dispatched
+// afterwards see them; outgoing messages are sent in the background.
+func (e *SMSRuleEngine) Apply(sms *model.SMS) {
+	if e == nil || e.repo == nil || sms == nil || sms.ID == 0 {
+		return
+	}
+
+	rules, err := e.repo.FindActive(sms.ICCID)
+	if err != nil {
+		logger.Log.Errorf("Failed to load SMS rules for ICCID %s: %v", sms.ICCID, err)
+		return
+	}
+
+	now := e.now()
+	changed := false
+	for i := range rules {
+		rule := &rules[i]
+		if !SMSRuleMatches(rule, sms, now) {
+			continue
+		}
+		if e.auth != nil && !e.auth.CanViewSMS(rule.UserID, sms.ICCID) {
+			continue
+		}
+		if err := e.repo.RecordHit(rule.ID); err != nil {
+			logger.Log.Warnf("Failed to record SMS rule hit %d: %v", rule.ID, err)
+		}
+
+		switch rule.Action {
+		case SMSRuleTag:
+			if tags := addSMSTag(sms.Tags, rule.Tag); tags != sms.Tags {
+				sms.Tags = tags
+				changed = true
+			}
+		case SMSRuleMarkRead:
+			if !sms.IsRead {
+				sms.IsRead = true
+				changed = true
+			}
+		case SMSRuleWebhook:
+			if e.webhooks != nil {
+				if err := e.webhooks.DispatchTo(rule.WebhookID, sms); err != nil {
+					logger.Log.Warnf("SMS rule %d: webhook %d not dispatched: %v", rule.ID, rule.WebhookID, err)
+				}
+			}
+		case SMSRuleAutoReply:
+			e.sendFromRule(rule, sms, sms.ICCID, sms.Phone)
+		case SMSRuleForward:
+			iccid := rule.ForwardICCID
+			if iccid == "" {
+				iccid = sms.ICCID
+			}
+			e.sendFromRule(rule, sms, iccid, rule.ForwardTo)
+		}
+
+		if rule.StopProcessing {
+			break
+		}
+	}
+
+	if changed && e.smsRepo != nil {
+		if err := e.smsRepo.UpdateFlags(sms.ID, sms.Tags, sms.IsRead); err != nil {
+			logger.Log.Errorf("Failed to update SMS %d from rules: %v", sms.ID, err)
+		}
+	}
+}
+
+func (e *SMSRuleEngine) sendFromRule(rule *model.SMSRule, sms *model.SMS, iccid, to string) {
+	if e.send == nil {
+		return
+	}
+
+	sender := NormalizeCallerNumber(sms.Phone)
+	to = NormalizeCallerNumber(to)
+	if !smsRuleDialable.MatchString(to) {
+		logger.Log.Infof("SMS rule %d: skipped, %q is not a dialable number", rule.ID, to)
+		return
+	}
+	if rule.Action == SMSRuleForward && to == sender {
+		logger.Log.Infof("SMS rule %d: skipped forwarding back to the sender %s", rule.ID, to)
+		return
+	}
+	if e.auth != nil && !e.auth.CanSendSMS(rule.UserID, iccid) {
+		logger.Log.Infof("SMS rule %d: owner %d may not send from %s", rule.ID, rule.UserID, iccid)
+		return
+	}
+
+	text, err := RenderSMSRuleText(rule, sms)
+	if err != nil || strings.TrimSpace(text) == "" {
+		logger.Log.Warnf("SMS rule %d: empty or invalid message text: %v", rule.ID, err)
+		return
+	}
+
+	if !e.allowSend(rule, sender, to) {
+		logger.Log.Infof("SMS rule %d: loop protection suppressed send to %s", rule.ID, to)
+		return
+	}
+	subject := QuotaSubject{UserID: rule.UserID}
+	if err := e.quota.Reserve(subject, iccid); err != nil {
+		logger.Log.Infof("SMS rule %d: not sending to %s: %v", rule.ID, to, err)
+		return
+	}
+
+	go func() {
+		if err := e.send(iccid, to, text); err != nil {
+			e.quota.Release(subject, iccid)
+			logger.Log.Errorf("SMS rule %d: failed to send to %s via %s: %v", rule.ID, to, iccid, err)
+			return
+		}
+		logger.Log.Infof("SMS rule %d: sent %s to %s via %s", rule.ID, rule.Action, to, iccid)
+	}()
+}
+
+// allowSend is the loop protection: a rule answers each sender at most once
+// per cooldown, and no destination gets more than smsRuleMaxSendsPerPeer
+// rule-generated messages per smsRuleSendWindow, whichever rules produced them.
+func (e *SMSRuleEngine) allowSend(rule *model.SMSRule, sender, to string) bool {
+	cooldown := smsRuleDefaultCooldown
+	if rule.CooldownSec > 0 {
+		cooldown = time.Duration(rule.CooldownSec) * time.Second
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := e.now()
+	key := fmt.Sprintf("%d|%s", rule.ID, sender)
+	if last, ok := e.cooldown[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+
+	recent := e.sends[to][:0]
+	for _, at := range e.sends[to] {
+		if now.Sub(at) < smsRuleSendWindow {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= smsRuleMaxSendsPerPeer {
+		e.sends[to] = recent
+		return false
+	}
+
+	e.cooldown[key] = now
+	e.sends[to] = append(recent, now)
+
+	if len(e.cooldown) > 1024 {
+		for k, at := range e.cooldown {
+			if now.Sub(at) > 24*time.Hour {
+				delete(e.cooldown, k)
+			}
+		}
+	}
+	return true
+}
+
+func SMSRuleMatches(rule *model.SMSRule, sms *model.SMS, now time.Time) bool {
+	if rule == nil || sms == nil || !rule.Enabled {
+		return false
+	}
+	if rule.ICCID != "" && rule.ICCID != sms.ICCID {
+		return false
+	}
+	if !smsRuleInWindow(rule.TimeStart, rule.TimeEnd, now) {
+		return false
+	}
+	if rule.SenderPattern != "" {
+		re, err := regexp.Compile(rule.SenderPattern)
+		if err != nil || !re.MatchString(NormalizeCallerNumber(sms.Phone)) {
+			return false
+		}
+	}
+	if rule.ContentRegex != "" {
+		re, err := regexp.Compile(rule.ContentRegex)
+		if err != nil || !re.MatchString(sms.Content) {
+			return false
+		}
+	}
+	return true
+}
+
+// smsRuleInWindow checks the local time of day against [start, end). A window
+// with start after end wraps around midnight; empty bounds are open.
+func smsRuleInWindow(start, end string, now time.Time) bool {
+	if start == "" && end == "" {
+		return true
+	}
+	from, err := parseClockMinutes(start, 0)
+	if err != nil {
+		return false
+	}
+	to, err := parseClockMinutes(end, 24*60)
+	if err != nil {
+		return false
+	}
+
+	cur := now.Hour()*60 + now.Minute()
+	switch {
+	case from == to:
+		return true
+	case from < to:
+		return cur >= from && cur < to
+	default:
+		return cur >= from || cur < to
+	}
+}
+
+func parseClockMinutes(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// RenderSMSRuleText renders ReplyText as a text/template over the received SMS.
+// Forward rules without a text use smsRuleForwardTemplate.
+func RenderSMSRuleText(rule *model.SMSRule, sms *model.SMS) (string, error) {
+	text := rule.ReplyText
+	if text == "" && rule.Action == SMSRuleForward {
+		text = smsRuleForwardTemplate
+	}
+	tmpl, err := template.New("sms_rule").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, sms); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func addSMSTag(tags, tag string) string {
+	if tag == "" {
+		return tags
+	}
+	list := []string{}
+	for _, item := range strings.Split(tags, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item == tag {
+			return tags
+		}
+		list = append(list, item)
+	}
+	return strings.Join(append(list, tag), ",")
+}
+
+// ValidateSMSRule normalizes the rule in place and rejects invalid rules.
+func ValidateSMSRule(rule *model.SMSRule) error {
+	rule.Name = strings.TrimSpace(rule.Name)
+	rule.ICCID = strings.TrimSpace(rule.ICCID)
+	rule.SenderPattern = strings.TrimSpace(rule.SenderPattern)
+	rule.TimeStart = strings.TrimSpace(rule.TimeStart)
+	rule.TimeEnd = strings.TrimSpace(rule.TimeEnd)
+	rule.Action = strings.ToLower(strings.TrimSpace(rule.Action))
+	rule.ForwardTo = NormalizeCallerNumber(rule.ForwardTo)
+	rule.ForwardICCID = strings.TrimSpace(rule.ForwardICCID)
+	rule.Tag = strings.TrimSpace(rule.Tag)
+
+	if rule.SenderPattern != "" {
+		if _, err := regexp.Compile(rule.SenderPattern); err != nil {
+			return fmt.Errorf("invalid sender_pattern: %v", err)
+		}
+	}
+	if rule.ContentRegex != "" {
+		if _, err := regexp.Compile(rule.ContentRegex); err != nil {
+			return fmt.Errorf("invalid content_regex: %v", err)
+		}
+	}
+	if _, err := parseClockMinutes(rule.TimeStart, 0); err != nil {
+		return fmt.Errorf("time_start: %v", err)
+	}
+	if _, err := parseClockMinutes(rule.TimeEnd, 0); err != nil {
+		return fmt.Errorf("time_end: %v", err)
+	}
+	if rule.CooldownSec < 0 {
+		return errors.New("cooldown_sec must not be negative")
+	}
+
+	switch rule.Action {
+	case SMSRuleAutoReply:
+		if strings.TrimSpace(rule.ReplyText) == "" {
+			return errors.New("reply_text is required for auto_reply")
+		}
+	case SMSRuleForward:
+		if !smsRuleDialable.MatchString(rule.ForwardTo) {
+			return errors.New("forward_to must be a phone number")
+		}
+	case SMSRuleTag:
+		if rule.Tag == "" || strings.Contains(rule.Tag, ",") {
+			return errors.New("tag is required and must not contain commas")
+		}
+	case SMSRuleMarkRead:
+	case SMSRuleWebhook:
+		if rule.WebhookID == 0 {
+			return errors.New("webhook_id is required for webhook")
+		}
+	default:
+		return errors.New("action must be one of auto_reply, forward, tag, mark_read, webhook")
+	}
+
+	if rule.Action == SMSRuleAutoReply || rule.Action == SMSRuleForward {
+		if _, err := template.New("sms_rule").Parse(rule.ReplyText); err != nil {
+			return fmt.Errorf("invalid reply_text template: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package logic
+
+import (
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+func TestSMSRuleInWindowWrapsMidnight(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2024, 1, 1, h, m, 0, 0, time.Local) }
+
+	if !smsRuleInWindow("22:00", "08:00", at(23, 30)) {
+		t.Fatal("expected 23:30 inside 22:00-08:00")
+	}
+	if !smsRuleInWindow("22:00", "08:00", at(7, 59)) {
+		t.Fatal("expected 07:59 inside 22:00-08:00")
+	}
+	if smsRuleInWindow("22:00", "08:00", at(8, 0)) {
+		t.Fatal("expected 08:00 outside 22:00-08:00")
+	}
+	if smsRuleInWindow("09:00", "", at(8, 59)) {
+		t.Fatal("expected 08:59 outside open-ended 09:00 window")
+	}
+}
+
+func TestSMSRuleLoopProtection(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	e := &SMSRuleEngine{
+		now:      func() time.Time { return now },
+		cooldown: make(map[string]time.Time),
+		sends:    make(map[string][]time.Time),
+	}
+	rule := &model.SMSRule{ID: 1, CooldownSec: 60}
+
+	if !e.allowSend(rule, "+886900000001", "+886900000001") {
+		t.Fatal("expected first reply to be allowed")
+	}
+	if e.allowSend(rule, "+886900000001", "+886900000001") {
+		t.Fatal("expected second reply within cooldown to be suppressed")
+	}
+
+	// Past the cooldown the hourly per-destination cap still applies.
+	for i := 1; i < smsRuleMaxSendsPerPeer; i++ {
+		now = now.Add(2 * time.Minute)
+		if !e.allowSend(rule, "+886900000001", "+886900000001") {
+			t.Fatalf("expected reply %d to be allowed", i+1)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if e.allowSend(rule, "+886900000001", "+886900000001") {
+		t.Fatal("expected hourly cap to suppress the reply")
+	}
+
+	now = now.Add(time.Hour)
+	if !e.allowSend(rule, "+886900000001", "+886900000001") {
+		t.Fatal("expected reply after the window to be allowed")
+	}
+}
+
+type denySMSRuleAuthorizer struct{}
+
+func (denySMSRuleAuthorizer) CanViewSMS(uint, string) bool { return false }
+func (denySMSRuleAuthorizer) CanSendSMS(uint, string) bool { return false }
+
+func TestSMSRuleWebhookChecksOwner(t *testing.T) {
+	logger.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.Webhook{}, &model.WebhookDelivery{}, &model.SMS{}); err != nil {
+		t.Fatal(err)
+	}
+	wh := model.Webhook{UserID: 5, URL: "https://example.com/hook", Platform: "generic", Enabled: true}
+	db.Create(&wh)
+
+	e := NewSMSRuleEngine(db, nil, denySMSRuleAuthorizer{})
+	if err := e.webhooks.DispatchTo(wh.ID, &model.SMS{ID: 1, ICCID: "8988"}); err == nil {
+		t.Fatal("expected the webhook of an owner without view_sms to be skipped")
+	}
+	var n int64
+	db.Model(&model.WebhookDelivery{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("expected no delivery, got %d", n)
+	}
+}
@@ -0,0 +1,121 @@
+package logic
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SMTPRelay is an outbound SMTP server used by the email webhook platform
+// and the SMTP gateway.
+type SMTPRelay struct {
+	Host     string
+	Port     int
+	Security string // starttls (default), tls or none
+	Username string
+	Password string
+	// PublicOnly refuses to connect to private, loopback and link-local
+	// addresses, for relays configured by non-admins.
+	PublicOnly bool
+}
+
+// Normalize validates the relay and fills in the default security and port.
+func (r *SMTPRelay) Normalize() error {
+	r.Host = strings.TrimSpace(r.Host)
+	if r.Host == "" || strings.ContainsAny(r.Host, " /:") {
+		return errors.New("smtp_host is required for email")
+	}
+
+	r.Security = strings.ToLower(strings.TrimSpace(r.Security))
+	switch r.Security {
+	case "":
+		r.Security = SMTPSecurityStartTLS
+	case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+	default:
+		return errors.New("smtp_security must be starttls, tls or none")
+	}
+	if r.Port == 0 {
+		switch r.Security {
+		case SMTPSecurityTLS:
+			r.Port = 465
+		case SMTPSecurityNone:
+			r.Port = 25
+		default:
+			r.Port = 587
+		}
+	}
+	if r.Port < 1 || r.Port > 65535 {
+		return errors.New("smtp_port must be between 1 and 65535")
+	}
+	if r.Username != "" && r.Security == SMTPSecurityNone {
+		return errors.New("smtp authentication requires starttls or tls")
+	}
+	return nil
+}
+
+// Send delivers msg, a complete RFC 5322 message, to the given recipients.
+func (r SMTPRelay) Send(from string, to []string, msg []byte, timeout time.Duration) error {
+	addr := net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+	dialer := &net.Dialer{Timeout: timeout}
+	if r.PublicOnly {
+		dialer.Control = publicDialControl
+	}
+	tlsConfig := &tls.Config{ServerName: r.Host}
+
+	var conn net.Conn
+	var err error
+	if r.Security == SMTPSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, r.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if r.Security == SMTPSecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if r.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", r.Username, r.Password, r.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,53 @@
+package logic
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+// TelegramBridge is implemented by the two-way Telegram bot. While one is
+// installed, telegram webhooks without a URL send through the bot, and SMS
+// forwarded by the bot are recorded so that chat replies go back by SMS.
+type TelegramBridge interface {
+	// SendMessageURL is the bot's sendMessage endpoint.
+	SendMessageURL() string
+	// OwnsURL reports whether a webhook URL belongs to the bridge bot.
+	OwnsURL(url string) bool
+	RecordForward(chatID, messageID int64, sms *model.SMS)
+}
+
+var (
+	telegramBridgeMu sync.RWMutex
+	telegramBridge   TelegramBridge
+)
+
+func SetTelegramBridge(b TelegramBridge) {
+	telegramBridgeMu.Lock()
+	defer telegramBridgeMu.Unlock()
+	telegramBridge = b
+}
+
+func currentTelegramBridge() TelegramBridge {
+	telegramBridgeMu.RLock()
+	defer telegramBridgeMu.RUnlock()
+	return telegramBridge
+}
+
+// recordTelegramForward reads the sent message from a sendMessage response.
+func recordTelegramForward(bridge TelegramBridge, sms *model.SMS, body []byte) {
+	var resp struct {
+		OK     bool `json:"ok"`
+		Result struct {
+			MessageID int64 `json:"message_id"`
+			Chat      struct {
+				ID int64 `json:"id"`
+			} `json:"chat"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil || !resp.OK || resp.Result.MessageID == 0 {
+		return
+	}
+	bridge.RecordForward(resp.Result.Chat.ID, resp.Result.MessageID, sms)
+}
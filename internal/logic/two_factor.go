@@ -0,0 +1,351 @@
+package logic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+const (
+	TOTPIssuer = "smsie"
+
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // steps accepted either side of now, for clock drift
+	recoveryCodeCount = 10
+
+	// After totpMaxFailures wrong codes in a row, no code of the user is
+	// accepted for totpLockout, across login attempts.
+	totpMaxFailures = 5
+	totpLockout     = 15 * time.Minute
+
+	// SettingRequireAdmin2FA makes admins with a local password enroll
+	// before they can use the dashboard.
+	SettingRequireAdmin2FA = "require_admin_2fa"
+)
+
+var (
+	ErrInvalid2FACode   = errors.New("invalid two-factor code")
+	Err2FANotEnrolled   = errors.New("two-factor authentication is not set up")
+	Err2FAAlreadyActive = errors.New("two-factor authentication is already enabled")
+	Err2FALocked        = errors.New("too many invalid two-factor codes, try again later")
+
+	totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// NewTOTPSecret returns a random 160-bit secret in base32.
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpBase32.EncodeToString(b), nil
+}
+
+// TOTPURI is the otpauth:// URI authenticator apps read from a QR code.
+func TOTPURI(account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", TOTPIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(TOTPIssuer+":"+account) + "?" + v.Encode()
+}
+
+// TOTPCode computes the RFC 6238 code of a time step.
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpBase32.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// TOTPStep is the time step t falls in.
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// VerifyTOTP returns the step a code matches around t. Steps up to lastStep
+// were used already and never match again.
+func VerifyTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := TOTPStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := TOTPCode(secret, step)
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode ignores case, spaces and dashes.
+func normalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(strings.TrimSpace(code)))
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCode returns a code like "k3m9q-x2f7a".
+func newRecoveryCode() (string, error) {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:5]) + "-" + string(b[5:]), nil
+}
+
+// TwoFactor manages TOTP enrollment, recovery codes and verification.
+type TwoFactor struct {
+	db  *gorm.DB
+	now func() time.Time
+}
+
+func NewTwoFactor(db *gorm.DB) *TwoFactor {
+	return &TwoFactor{db: db, now: time.Now}
+}
+
+// Setup starts enrollment with a new secret. It only becomes active once a
+// code from it is confirmed with Enable.
+func (f *TwoFactor) Setup(user *model.User) (secret, uri string, err error) {
+	if user.TOTPEnabled {
+		return "", "", Err2FAAlreadyActive
+	}
+	if secret, err = NewTOTPSecret(); err != nil {
+		return "", "", err
+	}
+	if err := f.db.Model(&model.User{}).Where("id = ?", user.ID).Update("totp_pending", secret).Error; err != nil {
+		return "", "", err
+	}
+	user.TOTPPending = secret
+	return secret, TOTPURI(user.Username, secret), nil
+}
+
+// Enable activates the pending secret if the code matches it and returns
+// fresh recovery codes.
+func (f *TwoFactor) Enable(user *model.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, Err2FAAlreadyActive
+	}
+	if user.TOTPPending == "" {
+		return nil, Err2FANotEnrolled
+	}
+	step, ok := VerifyTOTP(user.TOTPPending, code, f.now(), 0)
+	if !ok {
+		return nil, ErrInvalid2FACode
+	}
+
+	var codes []string
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"totp_enabled":   true,
+			"totp_secret":    user.TOTPPending,
+			"totp_pending":   "",
+			"totp_last_step": step,
+		}).Error
+		if err != nil {
+			return err
+		}
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled, user.TOTPSecret, user.TOTPPending, user.TOTPLastStep = true, user.TOTPPending, "", step
+	return codes, nil
+}
+
+// LockedFor reports how long the user's second factor stays locked after
+// too many wrong codes.
+func (f *TwoFactor) LockedFor(user *model.User) (time.Duration, bool) {
+	if user.TOTPLockedUntil == nil {
+		return 0, false
+	}
+	left := user.TOTPLockedUntil.Sub(f.now())
+	return left, left > 0
+}
+
+// Verify accepts a current TOTP code or an unused recovery code, each only
+// once, and reports whether a recovery code was used. Wrong codes count
+// towards a lockout, during which Verify returns Err2FALocked.
+func (f *TwoFactor) Verify(user *model.User, code string) (usedRecovery bool, err error) {
+	if !user.TOTPEnabled {
+		return false, Err2FANotEnrolled
+	}
+	if _, locked := f.LockedFor(user); locked {
+		return false, Err2FALocked
+	}
+	usedRecovery, err = f.verify(user, code)
+	if errors.Is(err, ErrInvalid2FACode) {
+		if ferr := f.recordFailure(user); ferr != nil {
+			return false, ferr
+		}
+	} else if err == nil && user.TOTPFailures > 0 {
+		if err := f.db.Model(&model.User{}).Where("id = ?", user.ID).Update("totp_failures", 0).Error; err != nil {
+			return usedRecovery, err
+		}
+		user.TOTPFailures = 0
+	}
+	return usedRecovery, err
+}
+
+// recordFailure counts a wrong code and locks the second factor once there
+// were totpMaxFailures of them.
+func (f *TwoFactor) recordFailure(user *model.User) error {
+	err := f.db.Model(&model.User{}).Where("id = ?", user.ID).
+		Update("totp_failures", gorm.Expr("totp_failures + 1")).Error
+	if err != nil {
+		return err
+	}
+	var stored model.User
+	if err := f.db.Select("totp_failures").First(&stored, user.ID).Error; err != nil {
+		return err
+	}
+	user.TOTPFailures = stored.TOTPFailures
+	if user.TOTPFailures < totpMaxFailures {
+		return nil
+	}
+	until := f.now().Add(totpLockout)
+	err = f.db.Model(&model.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"totp_failures":     0,
+		"totp_locked_until": until,
+	}).Error
+	if err != nil {
+		return err
+	}
+	user.TOTPFailures, user.TOTPLockedUntil = 0, &until
+	return nil
+}
+
+func (f *TwoFactor) verify(user *model.User, code string) (bool, error) {
+	if step, ok := VerifyTOTP(user.TOTPSecret, code, f.now(), user.TOTPLastStep); ok {
+		res := f.db.Model(&model.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if res.Error != nil {
+			return false, res.Error
+		}
+		if res.RowsAffected == 0 {
+			// The same code was just used by another request.
+			return false, ErrInvalid2FACode
+		}
+		user.TOTPLastStep = step
+		return false, nil
+	}
+
+	var rc model.RecoveryCode
+	if err := f.db.Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).First(&rc).Error; err != nil {
+		return false, ErrInvalid2FACode
+	}
+	res := f.db.Model(&model.RecoveryCode{}).Where("id = ? AND used_at IS NULL", rc.ID).Update("used_at", f.now())
+	if res.Error != nil {
+		return false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return false, ErrInvalid2FACode
+	}
+	return true, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of the user.
+func (f *TwoFactor) RegenerateRecoveryCodes(user *model.User) ([]string, error) {
+	if !user.TOTPEnabled {
+		return nil, Err2FANotEnrolled
+	}
+	var codes []string
+	err := f.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		codes, err = replaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	return codes, err
+}
+
+// RecoveryCodesLeft counts unused recovery codes.
+func (f *TwoFactor) RecoveryCodesLeft(userID uint) (int, error) {
+	var n int64
+	err := f.db.Model(&model.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&n).Error
+	return int(n), err
+}
+
+// Disable turns two-factor authentication off and drops the secret and
+// recovery codes; admins use it to reset a user who lost their device.
+func (f *TwoFactor) Disable(userID uint) error {
+	return f.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&model.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+			"totp_enabled":      false,
+			"totp_secret":       "",
+			"totp_pending":      "",
+			"totp_last_step":    0,
+			"totp_failures":     0,
+			"totp_locked_until": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error
+	})
+}
+
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := tx.Create(&model.RecoveryCode{UserID: userID, CodeHash: hashRecoveryCode(code)}).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
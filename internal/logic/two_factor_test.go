@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+// RFC 6238 test secret "12345678901234567890" in base32.
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	for unix, want := range map[int64]string{59: "287082", 1111111109: "081804", 2000000000: "279037"} {
+		got, err := TOTPCode(rfcTOTPSecret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil || got != want {
+			t.Fatalf("code at %d: got %q, %v, want %q", unix, got, err, want)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	prev, _ := TOTPCode(rfcTOTPSecret, TOTPStep(now)-1)
+	step, ok := VerifyTOTP(rfcTOTPSecret, prev, now, 0)
+	if !ok || step != TOTPStep(now)-1 {
+		t.Fatal("expected the previous step to be accepted for clock drift")
+	}
+	if _, ok := VerifyTOTP(rfcTOTPSecret, prev, now, step); ok {
+		t.Fatal("expected a used step to be rejected")
+	}
+	old, _ := TOTPCode(rfcTOTPSecret, TOTPStep(now)-3)
+	if _, ok := VerifyTOTP(rfcTOTPSecret, old, now, 0); ok {
+		t.Fatal("expected an old code to be rejected")
+	}
+}
+
+func TestTwoFactorEnrollment(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.User{}, &model.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Username: "alice", PasswordHash: "x"}
+	db.Create(user)
+
+	f := NewTwoFactor(db)
+	now := time.Unix(1700000000, 0)
+	f.now = func() time.Time { return now }
+
+	secret, uri, err := f.Setup(user)
+	if err != nil || uri == "" {
+		t.Fatal(err)
+	}
+	if _, err := f.Enable(user, "000000"); !errors.Is(err, ErrInvalid2FACode) {
+		t.Fatalf("expected a wrong code to be rejected, got %v", err)
+	}
+	code, _ := TOTPCode(secret, TOTPStep(now))
+	recovery, err := f.Enable(user, code)
+	if err != nil || len(recovery) != recoveryCodeCount {
+		t.Fatalf("expected %d recovery codes, got %d, %v", recoveryCodeCount, len(recovery), err)
+	}
+
+	// The code that enabled it cannot log in again.
+	if _, err := f.Verify(user, code); !errors.Is(err, ErrInvalid2FACode) {
+		t.Fatalf("expected replay to be rejected, got %v", err)
+	}
+	now = now.Add(30 * time.Second)
+	code, _ = TOTPCode(secret, TOTPStep(now))
+	if used, err := f.Verify(user, code); err != nil || used {
+		t.Fatalf("expected the next code to work, got %v", err)
+	}
+
+	if used, err := f.Verify(user, " "+recovery[0]+" "); err != nil || !used {
+		t.Fatalf("expected the recovery code to work, got %v", err)
+	}
+	if _, err := f.Verify(user, recovery[0]); !errors.Is(err, ErrInvalid2FACode) {
+		t.Fatalf("expected a recovery code to work once, got %v", err)
+	}
+	if left, _ := f.RecoveryCodesLeft(user.ID); left != recoveryCodeCount-1 {
+		t.Fatalf("expected %d codes left, got %d", recoveryCodeCount-1, left)
+	}
+
+	if err := f.Disable(user.ID); err != nil {
+		t.Fatal(err)
+	}
+	var stored model.User
+	db.First(&stored, user.ID)
+	if stored.TOTPEnabled || stored.TOTPSecret != "" {
+		t.Fatal("expected 2FA to be reset")
+	}
+	if left, _ := f.RecoveryCodesLeft(user.ID); left != 0 {
+		t.Fatalf("expected recovery codes to be dropped, got %d", left)
+	}
+}
+
+func TestTwoFactorLockout(t *testing.T) {
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.User{}, &model.RecoveryCode{}); err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := NewTOTPSecret()
+	user := &model.User{Username: "alice", PasswordHash: "x", TOTPEnabled: true, TOTPSecret: secret}
+	db.Create(user)
+
+	f := NewTwoFactor(db)
+	now := time.Unix(1700000000, 0)
+	f.now = func() time.Time { return now }
+	code, _ := TOTPCode(secret, TOTPStep(now))
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+
+	// Failures count per user, whichever login they came from.
+	for i := 0; i < totpMaxFailures; i++ {
+		var stored model.User
+		db.First(&stored, user.ID)
+		if _, err := f.Verify(&stored, wrong); !errors.Is(err, ErrInvalid2FACode) {
+			t.Fatalf("attempt %d: expected an invalid code, got %v", i+1, err)
+		}
+	}
+	var stored model.User
+	db.First(&stored, user.ID)
+	if left, locked := f.LockedFor(&stored); !locked || left != totpLockout {
+		t.Fatalf("expected a %v lockout, got %v %v", totpLockout, left, locked)
+	}
+	if _, err := f.Verify(&stored, code); !errors.Is(err, Err2FALocked) {
+		t.Fatalf("expected the right code to be refused while locked, got %v", err)
+	}
+
+	now = now.Add(totpLockout)
+	code, _ = TOTPCode(secret, TOTPStep(now))
+	if _, err := f.Verify(&stored, code); err != nil {
+		t.Fatalf("expected the code to work after the lockout, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+)
+
+// emailWebhookPlatform sends notifications over SMTP. The webhook URL is not
+// used; smtp_host, email_from and email_to are required.
+type emailWebhookPlatform struct{}
+
+func (emailWebhookPlatform) Validate(wh *model.Webhook) error {
+	relay := SMTPRelay{Host: wh.SMTPHost, Port: wh.SMTPPort, Security: wh.SMTPSecurity, Username: wh.SMTPUsername}
+	if err := relay.Normalize(); err != nil {
+		return err
+	}
+	wh.SMTPHost, wh.SMTPPort, wh.SMTPSecurity = relay.Host, relay.Port, relay.Security
+
+	from, err := mail.ParseAddress(strings.TrimSpace(wh.EmailFrom))
+	if err != nil {
+		return fmt.Errorf("invalid email_from: %v", err)
+	}
+	wh.EmailFrom = from.String()
+
+	to, err := mail.ParseAddressList(strings.TrimSpace(wh.EmailTo))
+	if err != nil || len(to) == 0 {
+		return errors.New("email_to must be a comma separated list of addresses")
+	}
+	list := make([]string, 0, len(to))
+	for _, addr := range to {
+		list = append(list, addr.String())
+	}
+	wh.EmailTo = strings.Join(list, ", ")
+	return nil
+}
+
+func (emailWebhookPlatform) Deliver(wh *model.Webhook, msg *WebhookMessage) webhookResult {
+	start := time.Now()
+	err := sendWebhookEmail(wh, msg, start)
+	if err != nil {
+		logger.Log.Errorf("Failed to send email via %s: %v", wh.SMTPHost, err)
+		return webhookResult{Err: err, Latency: time.Since(start)}
+	}
+	logger.Log.Infof("Email sent to %s", wh.EmailTo)
+	return webhookResult{Code: 250, Body: "queued", Latency: time.Since(start)}
+}
+
+func sendWebhookEmail(wh *model.Webhook, msg *WebhookMessage, now time.Time) error {
+	from, err := mail.ParseAddress(wh.EmailFrom)
+	if err != nil {
+		return err
+	}
+	to, err := mail.ParseAddressList(wh.EmailTo)
+	if err != nil {
+		return err
+	}
+	rcpts := make([]string, 0, len(to))
+	for _, addr := range to {
+		rcpts = append(rcpts, addr.Address)
+	}
+	relay := SMTPRelay{Host: wh.SMTPHost, Port: wh.SMTPPort, Security: wh.SMTPSecurity, Username: wh.SMTPUsername, Password: wh.SMTPPassword, PublicOnly: msg.PublicOnly}
+	return relay.Send(from.Address, rcpts, buildWebhookEmail(wh, msg, now), webhookTimeout())
+}
+
+// buildWebhookEmail renders a plain text message with a quoted-printable body.
+func buildWebhookEmail(wh *model.Webhook, msg *WebhookMessage, now time.Time) []byte {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", wh.EmailFrom)
+	header("To", wh.EmailTo)
+	header("Subject", mime.QEncoding.Encode("utf-8", msg.DefaultTitle()))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<smsie-%d-%d-%d@%s>", wh.ID, msg.SMS.ID, now.UnixNano(), wh.SMTPHost))
+	header("X-Priority", strconv.Itoa(emailPriority(msg.Priority)))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	qp.Write([]byte(strings.ReplaceAll(strings.ReplaceAll(msg.Text, "\r\n", "\n"), "\n", "\r\n")))
+	qp.Close()
+	return buf.Bytes()
+}
+
+func emailPriority(p string) int {
+	switch p {
+	case WebhookPriorityLow:
+		return 5
+	case WebhookPriorityHigh:
+		return 2
+	case WebhookPriorityUrgent:
+		return 1
+	}
+	return 3
+}
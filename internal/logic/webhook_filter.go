@@ -0,0 +1,171 @@
+package logic
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+// WebhookAllModems as ICCID makes a webhook cover every modem.
+const WebhookAllModems = "*"
+
+// WebhookCoversICCID reports whether the webhook is scoped to the modem.
+func WebhookCoversICCID(wh *model.Webhook, iccid string) bool {
+	if wh.ICCID == WebhookAllModems || (wh.ICCID != "" && wh.ICCID == iccid) {
+		return true
+	}
+	for _, item := range splitWebhookList(wh.ICCIDs) {
+		if item == iccid {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookMatches evaluates scope and filters of an enabled webhook for an SMS.
+func WebhookMatches(wh *model.Webhook, sms *model.SMS) bool {
+	if !wh.Enabled || !WebhookCoversICCID(wh, sms.ICCID) {
+		return false
+	}
+
+	// Sent SMS only reach webhooks that ask for them.
+	types := splitWebhookList(wh.MessageTypes)
+	if len(types) == 0 {
+		types = []string{"received"}
+	}
+	found := false
+	for _, t := range types {
+		if strings.EqualFold(t, sms.Type) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	if wh.SenderPattern != "" {
+		re, err := regexp.Compile(wh.SenderPattern)
+		if err != nil || !re.MatchString(NormalizeCallerNumber(sms.Phone)) {
+			return false
+		}
+	}
+	if wh.ContentRegex != "" {
+		re, err := regexp.Compile(wh.ContentRegex)
+		if err != nil || !re.MatchString(sms.Content) {
+			return false
+		}
+	}
+
+	if keywords := splitWebhookList(wh.Keywords); len(keywords) > 0 {
+		content := strings.ToLower(sms.Content)
+		for _, kw := range keywords {
+			if strings.Contains(content, strings.ToLower(kw)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// MatchWebhooks keeps the webhooks that should receive the SMS.
+func MatchWebhooks(list []model.Webhook, sms *model.SMS) []model.Webhook {
+	out := make([]model.Webhook, 0, len(list))
+	for i := range list {
+		if WebhookMatches(&list[i], sms) {
+			out = append(out, list[i])
+		}
+	}
+	return out
+}
+
+// ValidateWebhookFilters normalizes scope and filter fields in place.
+func ValidateWebhookFilters(wh *model.Webhook) error {
+	wh.ICCID = strings.TrimSpace(wh.ICCID)
+	wh.ICCIDs = strings.Join(dedupeWebhookList(splitWebhookList(wh.ICCIDs)), ",")
+	if wh.ICCID == "" && wh.ICCIDs == "" {
+		return errors.New("iccid or iccids is required")
+	}
+	if wh.ICCID == WebhookAllModems && wh.ICCIDs != "" {
+		return errors.New("iccids cannot be combined with iccid \"*\"")
+	}
+
+	wh.SenderPattern = strings.TrimSpace(wh.SenderPattern)
+	if wh.SenderPattern != "" {
+		if _, err := regexp.Compile(wh.SenderPattern); err != nil {
+			return fmt.Errorf("invalid sender_pattern: %v", err)
+		}
+	}
+	if wh.ContentRegex != "" {
+		if _, err := regexp.Compile(wh.ContentRegex); err != nil {
+			return fmt.Errorf("invalid content_regex: %v", err)
+		}
+	}
+
+	wh.Keywords = strings.Join(dedupeWebhookList(splitWebhookList(wh.Keywords)), ",")
+
+	types := dedupeWebhookList(splitWebhookList(strings.ToLower(wh.MessageTypes)))
+	for _, t := range types {
+		if t != "received" && t != "sent" {
+			return fmt.Errorf("invalid message type %q, expected received or sent", t)
+		}
+	}
+	wh.MessageTypes = strings.Join(types, ",")
+	return nil
+}
+
+// WebhookScopeICCIDs lists the specific modems a webhook covers, without "*".
+func WebhookScopeICCIDs(wh *model.Webhook) []string {
+	list := splitWebhookList(wh.ICCIDs)
+	if wh.ICCID != "" && wh.ICCID != WebhookAllModems {
+		list = append([]string{wh.ICCID}, list...)
+	}
+	return dedupeWebhookList(list)
+}
+
+func splitWebhookList(s string) []string {
+	out := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func dedupeWebhookList(list []string) []string {
+	seen := map[string]struct{}{}
+	out := make([]string, 0, len(list))
+	for _, item := range list {
+		if _, ok := seen[item]; ok {
+			continue
+		}
+		seen[item] = struct{}{}
+		out = append(out, item)
+	}
+	return out
+}
+
+// RemoveWebhookICCID drops a modem from the webhook scope. It returns false
+// when no modem is left and the webhook should be deleted.
+func RemoveWebhookICCID(wh *model.Webhook, iccid string) bool {
+	if wh.ICCID == WebhookAllModems {
+		return true
+	}
+	remaining := []string{}
+	for _, item := range WebhookScopeICCIDs(wh) {
+		if item != iccid {
+			remaining = append(remaining, item)
+		}
+	}
+	if len(remaining) == 0 {
+		return false
+	}
+	wh.ICCID = remaining[0]
+	wh.ICCIDs = strings.Join(remaining[1:], ",")
+	return true
+}
@@ -0,0 +1,52 @@
+package logic
+
+import (
+	"testing"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+func TestWebhookMatchesScopeAndFilters(t *testing.T) {
+	sms := &model.SMS{ICCID: "8988", Phone: "+886 912-345-678", Content: "Your OTP is 1234", Type: "received"}
+
+	group := &model.Webhook{ICCID: "1111", ICCIDs: "2222, 8988", Enabled: true}
+	if !WebhookMatches(group, sms) {
+		t.Fatal("expected multi-ICCID webhook to match")
+	}
+	if WebhookMatches(&model.Webhook{ICCID: "1111", ICCIDs: "89888", Enabled: true}, sms) {
+		t.Fatal("expected ICCID list to require an exact entry")
+	}
+
+	wildcard := &model.Webhook{ICCID: "*", Enabled: true, SenderPattern: `^\+886912`, Keywords: "code,otp"}
+	if !WebhookMatches(wildcard, sms) {
+		t.Fatal("expected wildcard webhook with matching sender and keyword to match")
+	}
+
+	wildcard.Keywords = "invoice"
+	if WebhookMatches(wildcard, sms) {
+		t.Fatal("expected keyword filter to reject")
+	}
+
+	typed := &model.Webhook{ICCID: "8988", Enabled: true, MessageTypes: "sent"}
+	if WebhookMatches(typed, sms) {
+		t.Fatal("expected message type filter to reject")
+	}
+	sent := &model.SMS{ICCID: "8988", Phone: "+886912345678", Type: "sent"}
+	if !WebhookMatches(typed, sent) {
+		t.Fatal("expected a sent webhook to match a sent SMS")
+	}
+	if WebhookMatches(group, sent) {
+		t.Fatal("expected webhooks without message_types to skip sent SMS")
+	}
+}
+
+func TestRemoveWebhookICCID(t *testing.T) {
+	wh := &model.Webhook{ICCID: "1111", ICCIDs: "2222,3333"}
+	if !RemoveWebhookICCID(wh, "1111") || wh.ICCID != "2222" || wh.ICCIDs != "3333" {
+		t.Fatalf("unexpected scope after removal: %q %q", wh.ICCID, wh.ICCIDs)
+	}
+	single := &model.Webhook{ICCID: "1111"}
+	if RemoveWebhookICCID(single, "1111") {
+		t.Fatal("expected webhook without modems to be deleted")
+	}
+}
@@ -0,0 +1,259 @@
+package logic
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+const (
+	WebhookPriorityLow    = "low"
+	WebhookPriorityNormal = "normal"
+	WebhookPriorityHigh   = "high"
+	WebhookPriorityUrgent = "urgent"
+
+	defaultWebhookTitle = "SMS from {{.Phone}}"
+
+	webhookCallbackBodySize = 64 << 10
+)
+
+// WebhookMessage is the rendered notification handed to a platform.
+type WebhookMessage struct {
+	Title    string // Empty unless the webhook has a title template
+	Text     string
+	Priority string
+	Markdown bool
+	SMS      *model.SMS
+
+	// PublicOnly refuses connections to private, loopback and link-local
+	// addresses; set for webhooks of non-admins.
+	PublicOnly bool
+	// OwnerTelegramChat is the linked Telegram user of a non-admin owner,
+	// the only chat their webhooks may reach through the shared bot.
+	OwnerTelegramChat string
+}
+
+// DefaultTitle returns the title, or the default "SMS from <phone>" for
+// platforms that always need one.
+func (m *WebhookMessage) DefaultTitle() string {
+	if m.Title != "" {
+		return m.Title
+	}
+	return renderWebhookTemplate(defaultWebhookTitle, m.SMS, "SMS")
+}
+
+// WebhookPlatform formats and delivers notifications for one platform value.
+// Validate normalizes the platform specific fields in place.
+type WebhookPlatform interface {
+	Validate(wh *model.Webhook) error
+	Deliver(wh *model.Webhook, msg *WebhookMessage) webhookResult
+}
+
+var (
+	webhookPlatformsMu sync.RWMutex
+	webhookPlatforms   = map[string]WebhookPlatform{}
+)
+
+// RegisterWebhookPlatform makes a platform available under the given name.
+func RegisterWebhookPlatform(name string, p WebhookPlatform) {
+	webhookPlatformsMu.Lock()
+	defer webhookPlatformsMu.Unlock()
+	webhookPlatforms[name] = p
+}
+
+// WebhookPlatformNames lists the registered platforms.
+func WebhookPlatformNames() []string {
+	webhookPlatformsMu.RLock()
+	defer webhookPlatformsMu.RUnlock()
+	names := make([]string, 0, len(webhookPlatforms))
+	for name := range webhookPlatforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupWebhookPlatform(name string) WebhookPlatform {
+	if name == "" {
+		name = "generic"
+	}
+	webhookPlatformsMu.RLock()
+	defer webhookPlatformsMu.RUnlock()
+	return webhookPlatforms[name]
+}
+
+// ValidateWebhookPlatform checks the platform, templates and priority, then
+// the platform's own configuration.
+func ValidateWebhookPlatform(wh *model.Webhook) error {
+	wh.Platform = strings.ToLower(strings.TrimSpace(wh.Platform))
+	if wh.Platform == "" {
+		wh.Platform = "generic"
+	}
+	p := lookupWebhookPlatform(wh.Platform)
+	if p == nil {
+		return fmt.Errorf("unknown platform %q, expected one of %s", wh.Platform, strings.Join(WebhookPlatformNames(), ", "))
+	}
+
+	if _, err := template.New("msg").Parse(wh.Template); err != nil {
+		return fmt.Errorf("invalid template: %v", err)
+	}
+	if _, err := template.New("title").Parse(wh.Title); err != nil {
+		return fmt.Errorf("invalid title: %v", err)
+	}
+
+	wh.Priority = strings.ToLower(strings.TrimSpace(wh.Priority))
+	switch wh.Priority {
+	case "":
+		wh.Priority = WebhookPriorityNormal
+	case WebhookPriorityLow, WebhookPriorityNormal, WebhookPriorityHigh, WebhookPriorityUrgent:
+	default:
+		return errors.New("priority must be low, normal, high or urgent")
+	}
+
+	return p.Validate(wh)
+}
+
+func renderWebhookTemplate(text string, sms *model.SMS, fallback string) string {
+	if text == "" {
+		return fallback
+	}
+	tmpl, err := template.New("msg").Parse(text)
+	if err != nil {
+		return fallback
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, sms); err != nil {
+		return fallback
+	}
+	return buf.String()
+}
+
+func renderWebhookMessage(wh *model.Webhook, sms *model.SMS) *WebhookMessage {
+	priority := wh.Priority
+	if priority == "" {
+		priority = WebhookPriorityNormal
+	}
+	return &WebhookMessage{
+		Title:    renderWebhookTemplate(wh.Title, sms, ""),
+		Text:     renderWebhookTemplate(wh.Template, sms, sms.Content),
+		Priority: priority,
+		Markdown: wh.Markdown,
+		SMS:      sms,
+	}
+}
+
+// validateWebhookURL requires an absolute http(s) URL.
+func validateWebhookURL(raw, field string) error {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", field)
+	}
+	return nil
+}
+
+func webhookTimeout() time.Duration {
+	timeout := time.Duration(config.AppConfig.Webhook.TimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return timeout
+}
+
+// webhookHTTPRequest is what an HTTP based platform wants sent. Header values
+// are set after the webhook's static headers and signature.
+type webhookHTTPRequest struct {
+	Method      string
+	URL         string
+	ContentType string
+	Body        []byte
+	Header      http.Header
+	// OnSuccess, if set, receives the full response body of a 2xx reply.
+	OnSuccess func(body []byte)
+}
+
+// httpWebhookPlatform adapts a validate and build pair to WebhookPlatform.
+type httpWebhookPlatform struct {
+	validate func(wh *model.Webhook) error
+	build    func(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error)
+}
+
+func (p httpWebhookPlatform) Validate(wh *model.Webhook) error {
+	if p.validate == nil {
+		return validateWebhookURL(wh.URL, "url")
+	}
+	return p.validate(wh)
+}
+
+func (p httpWebhookPlatform) Deliver(wh *model.Webhook, msg *WebhookMessage) webhookResult {
+	r, err := p.build(wh, msg)
+	if err != nil {
+		logger.Log.Errorf("Failed to build webhook %d request: %v", wh.ID, err)
+		return webhookResult{Err: err}
+	}
+	return doWebhookHTTP(wh, r, msg.PublicOnly)
+}
+
+func doWebhookHTTP(wh *model.Webhook, r *webhookHTTPRequest, publicOnly bool) webhookResult {
+	method := r.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	target := r.URL
+	if target == "" {
+		target = wh.URL
+	}
+	req, err := http.NewRequest(method, target, bytes.NewReader(r.Body))
+	if err != nil {
+		logger.Log.Errorf("Failed to create request: %v", err)
+		return webhookResult{Err: err}
+	}
+	applyWebhookHeaders(req, wh, r.ContentType, r.Body, time.Now())
+	for name, values := range r.Header {
+		req.Header[name] = values
+	}
+
+	client := &http.Client{Timeout: webhookTimeout()}
+	if publicOnly {
+		client.Transport = webhookPublicTransport
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Log.Errorf("Failed to send webhook to %s: %v", wh.URL, err)
+		return webhookResult{Err: err, Latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	limit := int64(webhookResponseBodySize)
+	if r.OnSuccess != nil {
+		limit = webhookCallbackBodySize
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, limit))
+	snippet := body
+	if len(snippet) > webhookResponseBodySize {
+		snippet = snippet[:webhookResponseBodySize]
+	}
+	res := webhookResult{Code: resp.StatusCode, Body: string(snippet), Latency: time.Since(start)}
+	if r.OnSuccess != nil && res.ok() {
+		r.OnSuccess(body)
+	}
+
+	if resp.StatusCode >= 400 {
+		logger.Log.Errorf("Webhook %s returned status: %d", wh.URL, resp.StatusCode)
+	} else {
+		logger.Log.Infof("Webhook sent to %s", wh.URL)
+	}
+	return res
+}
@@ -0,0 +1,147 @@
+package logic
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+func TestValidateWebhookPlatform(t *testing.T) {
+	matrix := &model.Webhook{Platform: "Matrix", URL: "https://matrix.example.org/", ChannelID: "!room:example.org"}
+	if err := ValidateWebhookPlatform(matrix); err == nil {
+		t.Fatal("expected matrix without token to be rejected")
+	}
+	matrix.Token = "syt_abc"
+	if err := ValidateWebhookPlatform(matrix); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if matrix.Platform != "matrix" || matrix.URL != "https://matrix.example.org" || matrix.Priority != WebhookPriorityNormal {
+		t.Fatalf("expected normalized webhook, got %q %q %q", matrix.Platform, matrix.URL, matrix.Priority)
+	}
+
+	if err := ValidateWebhookPlatform(&model.Webhook{Platform: "ntfy", URL: "https://ntfy.sh/"}); err == nil {
+		t.Fatal("expected ntfy URL without topic to be rejected")
+	}
+	if err := ValidateWebhookPlatform(&model.Webhook{Platform: "telegram", URL: "https://hooks.slack.com/services/T0/B0/X"}); err == nil {
+		t.Fatal("expected a Slack URL on a Telegram webhook to be rejected")
+	}
+	if err := ValidateWebhookPlatform(&model.Webhook{Platform: "pager", URL: "https://example.com"}); err == nil {
+		t.Fatal("expected unknown platform to be rejected")
+	}
+	if err := ValidateWebhookPlatform(&model.Webhook{URL: "https://example.com", Title: "{{.Phone"}); err == nil {
+		t.Fatal("expected invalid title template to be rejected")
+	}
+
+	email := &model.Webhook{Platform: "email", SMTPHost: "smtp.example.com", SMTPSecurity: "tls",
+		EmailFrom: "smsie@example.com", EmailTo: "a@example.com, b@example.com"}
+	if err := ValidateWebhookPlatform(email); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if email.SMTPPort != 465 {
+		t.Fatalf("expected implicit TLS default port 465, got %d", email.SMTPPort)
+	}
+}
+
+func TestBuildTelegramWebhookBotChat(t *testing.T) {
+	wh := &model.Webhook{Platform: "telegram", ChannelID: "-100200"}
+	msg := &WebhookMessage{Text: "hi", SMS: &model.SMS{}, PublicOnly: true, OwnerTelegramChat: "42"}
+	if _, err := buildTelegramWebhook(wh, msg); !errors.Is(err, ErrTelegramChatNotLinked) {
+		t.Fatalf("expected another chat to be refused, got %v", err)
+	}
+	wh.ChannelID = "42"
+	if _, err := buildTelegramWebhook(wh, msg); err != nil {
+		t.Fatalf("expected the linked chat to work, got %v", err)
+	}
+	msg.OwnerTelegramChat = ""
+	if _, err := buildTelegramWebhook(wh, msg); !errors.Is(err, ErrTelegramChatNotLinked) {
+		t.Fatalf("expected an unlinked owner to be refused, got %v", err)
+	}
+	wh.ChannelID = "-100200"
+	msg.PublicOnly = false
+	if _, err := buildTelegramWebhook(wh, msg); err != nil {
+		t.Fatalf("expected admin webhooks to reach any chat, got %v", err)
+	}
+}
+
+func TestBuildMatrixWebhookIsIdempotent(t *testing.T) {
+	wh := &model.Webhook{ID: 3, URL: "https://matrix.example.org", ChannelID: "!room:example.org", Token: "tok"}
+	msg := &WebhookMessage{Text: "hi", Priority: WebhookPriorityNormal, SMS: &model.SMS{ID: 42}}
+
+	r, err := buildMatrixWebhook(wh, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := "https://matrix.example.org/_matrix/client/v3/rooms/%21room:example.org/send/m.room.message/smsie-3-42"
+	if r.Method != http.MethodPut || r.URL != want {
+		t.Fatalf("unexpected request %s %s", r.Method, r.URL)
+	}
+	if r.Header.Get("Authorization") != "Bearer tok" {
+		t.Fatal("expected bearer token")
+	}
+}
+
+func TestBuildWebhookEmail(t *testing.T) {
+	wh := &model.Webhook{ID: 1, SMTPHost: "smtp.example.com", EmailFrom: "smsie@example.com", EmailTo: "a@example.com"}
+	msg := &WebhookMessage{Text: "Código 1234", Priority: WebhookPriorityUrgent, SMS: &model.SMS{Phone: "+886912345678"}}
+
+	raw := string(buildWebhookEmail(wh, msg, msg.SMS.Timestamp))
+	for _, want := range []string{"Subject: SMS from +886912345678\r\n", "X-Priority: 1\r\n", "C=C3=B3digo 1234"} {
+		if !strings.Contains(raw, want) {
+			t.Fatalf("expected %q in message:\n%s", want, raw)
+		}
+	}
+}
+
+func TestTwilioSignature(t *testing.T) {
+	// Example from Twilio's webhook security documentation.
+	params := url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+14158675310"},
+		"Digits":  {"1234"},
+		"From":    {"+14158675310"},
+		"To":      {"+18005551212"},
+	}
+	if got := TwilioSignature("12345", "https://mycompany.com/myapp.php?foo=1&bar=2", params); got != "GvWf1cFY/Q7PnoempGyD5oXAezc=" {
+		t.Fatalf("signature = %q", got)
+	}
+}
+
+func TestBuildTwilioWebhook(t *testing.T) {
+	SetModemNumberLookup(func(iccid string) string {
+		if iccid == "8988600000000000001" {
+			return "+886912000111"
+		}
+		return ""
+	})
+	defer SetModemNumberLookup(nil)
+
+	wh := &model.Webhook{URL: "https://app.example.com/sms", Token: "secret"}
+	msg := &WebhookMessage{SMS: &model.SMS{ID: 26, ICCID: "8988600000000000001", Phone: "+886987654321", Content: "hi"}}
+	r, err := buildTwilioWebhook(wh, msg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	form, err := url.ParseQuery(string(r.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Get("MessageSid") != "SM0000000000000000000000000000001a" || form.Get("To") != "+886912000111" || form.Get("From") != "+886987654321" {
+		t.Fatalf("unexpected form %v", form)
+	}
+	if r.Header.Get(TwilioSignatureHeader) != TwilioSignature("secret", wh.URL, form) {
+		t.Fatal("signature does not cover the posted form")
+	}
+}
+
+func TestSMTPRelayPublicOnlyRefusesLoopback(t *testing.T) {
+	relay := SMTPRelay{Host: "127.0.0.1", Port: 25, Security: SMTPSecurityNone, PublicOnly: true}
+	err := relay.Send("a@example.com", []string{"b@example.com"}, []byte("hi"), time.Second)
+	if !errors.Is(err, ErrWebhookPrivateTarget) {
+		t.Fatalf("expected a loopback relay to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,349 @@
+package logic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+const (
+	discordContentLimit = 2000
+	discordEmbedLimit   = 4096
+)
+
+var ErrTelegramChatNotLinked = errors.New("the Telegram bot only sends to the owner's linked Telegram account")
+
+func init() {
+	RegisterWebhookPlatform("generic", httpWebhookPlatform{build: buildGenericWebhook})
+	RegisterWebhookPlatform("telegram", httpWebhookPlatform{validate: validateTelegramWebhook, build: buildTelegramWebhook})
+	RegisterWebhookPlatform("slack", httpWebhookPlatform{build: buildSlackWebhook})
+	RegisterWebhookPlatform("discord", httpWebhookPlatform{build: buildDiscordWebhook})
+	RegisterWebhookPlatform("teams", httpWebhookPlatform{build: buildTeamsWebhook})
+	RegisterWebhookPlatform("matrix", httpWebhookPlatform{validate: validateMatrixWebhook, build: buildMatrixWebhook})
+	RegisterWebhookPlatform("ntfy", httpWebhookPlatform{validate: validateNtfyWebhook, build: buildNtfyWebhook})
+	RegisterWebhookPlatform("gotify", httpWebhookPlatform{validate: validateGotifyWebhook, build: buildGotifyWebhook})
+	RegisterWebhookPlatform("twilio", httpWebhookPlatform{build: buildTwilioWebhook})
+	RegisterWebhookPlatform("email", emailWebhookPlatform{})
+}
+
+// Generic: JSON {"text", "sms"} unless another content type is configured.
+func buildGenericWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	contentType := wh.ContentType
+	if contentType == "" {
+		contentType = WebhookContentJSON
+	}
+	body, err := encodeGenericBody(contentType, msg.Text, msg.SMS)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookHTTPRequest{Method: wh.Method, ContentType: contentType, Body: body}, nil
+}
+
+// Telegram: url may be left empty to send through the two-way bot, which
+// then needs channel_id.
+func validateTelegramWebhook(wh *model.Webhook) error {
+	if strings.TrimSpace(wh.URL) == "" && currentTelegramBridge() != nil {
+		if strings.TrimSpace(wh.ChannelID) == "" {
+			return errors.New("channel_id is required when sending through the Telegram bot")
+		}
+		return nil
+	}
+	if isSlackURL(wh.URL) {
+		return errors.New("url is a Slack webhook, use the slack platform")
+	}
+	return validateWebhookURL(wh.URL, "url")
+}
+
+func isSlackURL(raw string) bool {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == "slack.com" || strings.HasSuffix(host, ".slack.com")
+}
+
+// Telegram always uses Markdown: assumes the URL is
+// `https://api.telegram.org/bot<token>/sendMessage` with the chat in channel_id.
+func buildTelegramWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	if wh.URL == "" && msg.PublicOnly && (msg.OwnerTelegramChat == "" || wh.ChannelID != msg.OwnerTelegramChat) {
+		return nil, ErrTelegramChatNotLinked
+	}
+	text := msg.Text
+	if msg.Title != "" {
+		text = "*" + msg.Title + "*\n" + text
+	}
+	body := map[string]interface{}{
+		"text":       text,
+		"parse_mode": "Markdown",
+	}
+	if wh.ChannelID != "" {
+		body["chat_id"] = wh.ChannelID
+	}
+	r, err := jsonWebhookRequest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	bridge := currentTelegramBridge()
+	if bridge == nil {
+		return r, nil
+	}
+	if wh.URL == "" {
+		r.URL = bridge.SendMessageURL()
+	}
+	if msg.SMS.ID != 0 && (wh.URL == "" || bridge.OwnsURL(wh.URL)) {
+		sms := msg.SMS
+		r.OnSuccess = func(body []byte) { recordTelegramForward(bridge, sms, body) }
+	}
+	return r, nil
+}
+
+func buildSlackWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	text := msg.Text
+	if !msg.Markdown {
+		text = escapeSlackText(text)
+	}
+	if msg.Title != "" {
+		text = "*" + escapeSlackText(msg.Title) + "*\n" + text
+	}
+	return jsonWebhookRequest(map[string]interface{}{"text": text, "mrkdwn": msg.Markdown || msg.Title != ""})
+}
+
+// Discord: plain content, or an embed colored by priority when a title is set.
+func buildDiscordWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	text := msg.Text
+	if !msg.Markdown {
+		text = escapeMarkdown(text)
+	}
+	if msg.Title == "" {
+		return jsonWebhookRequest(map[string]interface{}{
+			"content":          truncateRunes(text, discordContentLimit),
+			"allowed_mentions": map[string]interface{}{"parse": []string{}},
+		})
+	}
+	return jsonWebhookRequest(map[string]interface{}{
+		"embeds": []map[string]interface{}{{
+			"title":       truncateRunes(msg.Title, 256),
+			"description": truncateRunes(text, discordEmbedLimit),
+			"color":       discordPriorityColor(msg.Priority),
+			"timestamp":   msg.SMS.Timestamp.Format(time.RFC3339),
+		}},
+		"allowed_mentions": map[string]interface{}{"parse": []string{}},
+	})
+}
+
+// Teams: an Adaptive Card as accepted by Power Automate "Workflows" webhooks.
+func buildTeamsWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	text := msg.Text
+	if !msg.Markdown {
+		text = escapeMarkdown(text)
+	}
+	titleColor := "Default"
+	switch msg.Priority {
+	case WebhookPriorityHigh:
+		titleColor = "Warning"
+	case WebhookPriorityUrgent:
+		titleColor = "Attention"
+	}
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []map[string]interface{}{
+			{"type": "TextBlock", "text": msg.DefaultTitle(), "weight": "Bolder", "size": "Medium", "color": titleColor, "wrap": true},
+			{"type": "TextBlock", "text": text, "wrap": true},
+		},
+	}
+	return jsonWebhookRequest(map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content":     card,
+		}},
+	})
+}
+
+// Matrix: url is the homeserver base URL, channel_id the room ID and token an
+// access token of the sending account.
+func validateMatrixWebhook(wh *model.Webhook) error {
+	if err := validateWebhookURL(wh.URL, "url"); err != nil {
+		return err
+	}
+	wh.URL = strings.TrimRight(strings.TrimSpace(wh.URL), "/")
+	wh.ChannelID = strings.TrimSpace(wh.ChannelID)
+	if !strings.HasPrefix(wh.ChannelID, "!") || !strings.Contains(wh.ChannelID, ":") {
+		return errors.New("channel_id must be a Matrix room ID like !abc:example.org")
+	}
+	if wh.Token == "" {
+		return errors.New("token (access token) is required for matrix")
+	}
+	return nil
+}
+
+func buildMatrixWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	content := map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    msg.Text,
+	}
+	if msg.Title != "" {
+		content["body"] = msg.Title + "\n" + msg.Text
+		content["format"] = "org.matrix.custom.html"
+		content["formatted_body"] = "<b>" + html.EscapeString(msg.Title) + "</b><br>" +
+			strings.ReplaceAll(html.EscapeString(msg.Text), "\n", "<br>")
+	}
+	if msg.Priority == WebhookPriorityUrgent {
+		content["msgtype"] = "m.notice"
+	}
+
+	r, err := jsonWebhookRequest(content)
+	if err != nil {
+		return nil, err
+	}
+	// The transaction ID makes retries of the same delivery idempotent.
+	txn := fmt.Sprintf("smsie-%d-%d", wh.ID, msg.SMS.ID)
+	if msg.SMS.ID == 0 {
+		txn += "-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	}
+	r.Method = http.MethodPut
+	r.URL = wh.URL + "/_matrix/client/v3/rooms/" + url.PathEscape(wh.ChannelID) +
+		"/send/m.room.message/" + url.PathEscape(txn)
+	r.Header.Set("Authorization", "Bearer "+wh.Token)
+	return r, nil
+}
+
+// ntfy: url is the topic URL, e.g. https://ntfy.sh/my-topic.
+func validateNtfyWebhook(wh *model.Webhook) error {
+	if err := validateWebhookURL(wh.URL, "url"); err != nil {
+		return err
+	}
+	u, _ := url.Parse(strings.TrimSpace(wh.URL))
+	if strings.Trim(u.Path, "/") == "" {
+		return errors.New("url must include the ntfy topic, e.g. https://ntfy.sh/my-topic")
+	}
+	return nil
+}
+
+func buildNtfyWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	r := &webhookHTTPRequest{ContentType: WebhookContentPlain + "; charset=utf-8", Body: []byte(msg.Text), Header: http.Header{}}
+	r.Header.Set("X-Title", msg.DefaultTitle())
+	r.Header.Set("X-Priority", strconv.Itoa(ntfyPriority(msg.Priority)))
+	r.Header.Set("X-Tags", "envelope")
+	if msg.Markdown {
+		r.Header.Set("X-Markdown", "yes")
+	}
+	if wh.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+wh.Token)
+	}
+	return r, nil
+}
+
+// Gotify: url is the server base URL and token an application token.
+func validateGotifyWebhook(wh *model.Webhook) error {
+	if err := validateWebhookURL(wh.URL, "url"); err != nil {
+		return err
+	}
+	wh.URL = strings.TrimRight(strings.TrimSpace(wh.URL), "/")
+	if wh.Token == "" {
+		return errors.New("token (application token) is required for gotify")
+	}
+	return nil
+}
+
+func buildGotifyWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	body := map[string]interface{}{
+		"title":    msg.DefaultTitle(),
+		"message":  msg.Text,
+		"priority": gotifyPriority(msg.Priority),
+	}
+	if msg.Markdown {
+		body["extras"] = map[string]interface{}{
+			"client::display": map[string]string{"contentType": "text/markdown"},
+		}
+	}
+	r, err := jsonWebhookRequest(body)
+	if err != nil {
+		return nil, err
+	}
+	r.URL = wh.URL
+	if !strings.HasSuffix(r.URL, "/message") {
+		r.URL += "/message"
+	}
+	r.Header.Set("X-Gotify-Key", wh.Token)
+	return r, nil
+}
+
+func jsonWebhookRequest(body interface{}) (*webhookHTTPRequest, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookHTTPRequest{ContentType: WebhookContentJSON, Body: b, Header: http.Header{}}, nil
+}
+
+func ntfyPriority(p string) int {
+	switch p {
+	case WebhookPriorityLow:
+		return 2
+	case WebhookPriorityHigh:
+		return 4
+	case WebhookPriorityUrgent:
+		return 5
+	}
+	return 3
+}
+
+func gotifyPriority(p string) int {
+	switch p {
+	case WebhookPriorityLow:
+		return 2
+	case WebhookPriorityHigh:
+		return 8
+	case WebhookPriorityUrgent:
+		return 10
+	}
+	return 5
+}
+
+func discordPriorityColor(p string) int {
+	switch p {
+	case WebhookPriorityLow:
+		return 0x95a5a6
+	case WebhookPriorityHigh:
+		return 0xe67e22
+	case WebhookPriorityUrgent:
+		return 0xe74c3c
+	}
+	return 0x3498db
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "~", `\~`, "|", `\|`, ">", `\>`, "#", `\#`, "[", `\[`, "]", `\]`,
+)
+
+// escapeMarkdown keeps SMS text from being rendered as Markdown.
+func escapeMarkdown(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func escapeSlackText(s string) string {
+	return slackEscaper.Replace(s)
+}
+
+func truncateRunes(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-1]) + "…"
+}
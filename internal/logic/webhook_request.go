@@ -0,0 +1,173 @@
+package logic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+const (
+	WebhookTimestampHeader = "X-Smsie-Timestamp"
+	WebhookSignatureHeader = "X-Smsie-Signature"
+
+	WebhookContentJSON  = "application/json"
+	WebhookContentForm  = "application/x-www-form-urlencoded"
+	WebhookContentPlain = "text/plain"
+
+	// WebhookHeaderMask replaces sensitive header values in API responses.
+	// Sending it back on update keeps the stored value.
+	WebhookHeaderMask = "********"
+)
+
+var webhookHeaderName = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// SignWebhookPayload returns the X-Smsie-Signature value: the hex HMAC-SHA256
+// of "<timestamp>.<body>" keyed with the webhook secret. Receivers should
+// recompute it and reject timestamps too far from their own clock.
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookHeaders decodes the static headers stored on the webhook.
+func WebhookHeaders(wh *model.Webhook) map[string]string {
+	headers := map[string]string{}
+	if strings.TrimSpace(wh.Headers) == "" {
+		return headers
+	}
+	if err := json.Unmarshal([]byte(wh.Headers), &headers); err != nil {
+		return map[string]string{}
+	}
+	return headers
+}
+
+// SetWebhookHeaders validates and stores static headers. Masked values are
+// taken from the headers already stored under the same name.
+func SetWebhookHeaders(wh *model.Webhook, headers map[string]string) error {
+	current := WebhookHeaders(wh)
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !webhookHeaderName.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		switch {
+		case name == "Content-Type", name == "Content-Length", name == "Host", strings.HasPrefix(name, "X-Smsie-"):
+			return fmt.Errorf("header %s cannot be overridden", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %s", name)
+		}
+		if value == WebhookHeaderMask {
+			prev, ok := current[name]
+			if !ok {
+				return fmt.Errorf("header %s has no stored value", name)
+			}
+			value = prev
+		}
+		out[name] = value
+	}
+
+	if len(out) == 0 {
+		wh.Headers = ""
+		return nil
+	}
+	b, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	wh.Headers = string(b)
+	return nil
+}
+
+// MaskWebhookHeaders hides values of headers that usually carry credentials.
+func MaskWebhookHeaders(headers map[string]string) map[string]string {
+	out := make(map[string]string, len(headers))
+	for name, value := range headers {
+		lower := strings.ToLower(name)
+		if lower == "authorization" || lower == "cookie" || strings.Contains(lower, "token") ||
+			strings.Contains(lower, "secret") || strings.Contains(lower, "key") {
+			value = WebhookHeaderMask
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// ValidateWebhookRequestOptions normalizes method and content type in place.
+func ValidateWebhookRequestOptions(wh *model.Webhook) error {
+	wh.Method = strings.ToUpper(strings.TrimSpace(wh.Method))
+	switch wh.Method {
+	case "":
+		wh.Method = http.MethodPost
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return errors.New("method must be POST, PUT or PATCH")
+	}
+
+	wh.ContentType = strings.ToLower(strings.TrimSpace(wh.ContentType))
+	switch wh.ContentType {
+	case "":
+		wh.ContentType = WebhookContentJSON
+	case WebhookContentJSON, WebhookContentForm, WebhookContentPlain:
+	default:
+		return errors.New("content_type must be application/json, application/x-www-form-urlencoded or text/plain")
+	}
+	return nil
+}
+
+// encodeGenericBody builds the generic platform body for the configured content type.
+func encodeGenericBody(contentType, text string, sms *model.SMS) ([]byte, error) {
+	switch contentType {
+	case WebhookContentPlain:
+		return []byte(text), nil
+	case WebhookContentForm:
+		form := url.Values{}
+		form.Set("text", text)
+		form.Set("id", strconv.FormatUint(uint64(sms.ID), 10))
+		form.Set("iccid", sms.ICCID)
+		form.Set("phone", sms.Phone)
+		form.Set("content", sms.Content)
+		form.Set("type", sms.Type)
+		form.Set("timestamp", sms.Timestamp.Format(time.RFC3339))
+		if sms.OTP != "" {
+			form.Set("otp", sms.OTP)
+			form.Set("otp_service", sms.OTPService)
+		}
+		return []byte(form.Encode()), nil
+	default:
+		return json.Marshal(map[string]interface{}{
+			"text": text,
+			"sms":  sms,
+		})
+	}
+}
+
+// applyWebhookHeaders sets static headers, then the content type and, when a
+// secret is configured, the timestamp and signature headers.
+func applyWebhookHeaders(req *http.Request, wh *model.Webhook, contentType string, body []byte, now time.Time) {
+	for name, value := range WebhookHeaders(wh) {
+		req.Header.Set(name, value)
+	}
+
+	req.Header.Set("Content-Type", contentType)
+	if wh.Secret != "" {
+		ts := now.Unix()
+		req.Header.Set(WebhookTimestampHeader, strconv.FormatInt(ts, 10))
+		req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(wh.Secret, ts, body))
+	}
+}
@@ -1,105 +1,336 @@
 package logic
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
-	"text/template"
+	"strconv"
 	"time"
 
+	"github.com/pccr10001/smsie/internal/config"
 	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/internal/repository"
 	"github.com/pccr10001/smsie/pkg/logger"
 )
 
+const (
+	webhookRetryInterval    = 10 * time.Second
+	webhookRetryBatch       = 50
+	webhookResponseBodySize = 512
+)
+
+var ErrDeliveryInFlight = errors.New("delivery not found or already being sent")
+
 type WebhookService struct {
-	repo *repository.WebhookRepository
+	repo       *repository.WebhookRepository
+	deliveries *repository.WebhookDeliveryRepository
+	smsRepo    *repository.SMSRepository
+	auth       SMSRuleAuthorizer
+}
+
+func NewWebhookService(repo *repository.WebhookRepository, deliveries *repository.WebhookDeliveryRepository, smsRepo *repository.SMSRepository) *WebhookService {
+	return &WebhookService{repo: repo, deliveries: deliveries, smsRepo: smsRepo}
+}
+
+// SetAuthorizer makes Dispatch skip, and retries dead-letter, webhooks whose
+// owner can no longer view SMS of the modem. Webhooks without an owner are not
+// checked.
+func (s *WebhookService) SetAuthorizer(auth SMSRuleAuthorizer) {
+	s.auth = auth
+}
+
+// WebhookTestResult is the receiver's answer to a test message.
+type WebhookTestResult struct {
+	OK         bool   `json:"ok"`
+	StatusCode int    `json:"status_code"`
+	Body       string `json:"body"`
+	Error      string `json:"error,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
 }
 
-func NewWebhookService(repo *repository.WebhookRepository) *WebhookService {
-	return &WebhookService{repo: repo}
+type webhookResult struct {
+	Code    int
+	Body    string
+	Err     error
+	Latency time.Duration
+}
+
+// ok reports a delivered webhook. Redirects are followed by the client, so a
+// 3xx here is one that could not be and is a failure.
+func (r webhookResult) ok() bool {
+	return r.Err == nil && r.Code >= 200 && r.Code < 300
+}
+
+// retryable reports whether a failed attempt may succeed later. Client errors
+// other than timeouts and rate limits are treated as permanent.
+func (r webhookResult) retryable() bool {
+	if r.Err != nil || r.Code >= 500 {
+		return true
+	}
+	return r.Code == http.StatusRequestTimeout || r.Code == http.StatusTooManyRequests
 }
 
 func (s *WebhookService) Dispatch(sms *model.SMS) {
-	webhooks, err := s.repo.FindByICCID(sms.ICCID)
+	candidates, err := s.repo.FindCandidates(sms.ICCID)
 	if err != nil {
 		logger.Log.Errorf("Failed to fetch webhooks for ICCID %s: %v", sms.ICCID, err)
 		return
 	}
 
-	for _, wh := range webhooks {
+	for _, wh := range MatchWebhooks(candidates, sms) {
+		if wh.UserID != 0 && s.auth != nil && !s.auth.CanViewSMS(wh.UserID, sms.ICCID) {
+			continue
+		}
+		s.enqueue(wh, sms)
+	}
+}
+
+// Test sends the SMS to the webhook synchronously, whether or not it is
+// enabled, without recording a delivery.
+func (s *WebhookService) Test(wh model.Webhook, sms *model.SMS) WebhookTestResult {
+	res := s.sendWebhook(wh, sms)
+	out := WebhookTestResult{
+		OK:         res.ok(),
+		StatusCode: res.Code,
+		Body:       res.Body,
+		LatencyMs:  res.Latency.Milliseconds(),
+	}
+	if res.Err != nil {
+		out.Error = res.Err.Error()
+	}
+	return out
+}
+
+// DispatchTo sends the SMS to a single enabled webhook regardless of its scope
+// and filters, as long as its owner may still view the SMS.
+func (s *WebhookService) DispatchTo(id uint, sms *model.SMS) error {
+	wh, err := s.repo.FindByID(id)
+	if err != nil {
+		return err
+	}
+	if !wh.Enabled {
+		return fmt.Errorf("webhook %d is disabled", id)
+	}
+	if wh.UserID != 0 && s.auth != nil && !s.auth.CanViewSMS(wh.UserID, sms.ICCID) {
+		return fmt.Errorf("owner of webhook %d cannot view SMS of %s", id, sms.ICCID)
+	}
+	s.enqueue(*wh, sms)
+	return nil
+}
+
+// enqueue records the delivery before the first attempt so that it is retried
+// even if the process stops while sending.
+func (s *WebhookService) enqueue(wh model.Webhook, sms *model.SMS) {
+	if s.deliveries == nil || sms.ID == 0 {
 		go s.sendWebhook(wh, sms)
+		return
+	}
+
+	d := &model.WebhookDelivery{
+		WebhookID: wh.ID,
+		SMSID:     sms.ID,
+		ICCID:     sms.ICCID,
+		Status:    repository.DeliverySending,
+	}
+	if err := s.deliveries.Create(d); err != nil {
+		logger.Log.Errorf("Failed to record webhook delivery for %s: %v", wh.URL, err)
+		go s.sendWebhook(wh, sms)
+		return
 	}
+
+	go func() {
+		s.recordAttempt(d, s.sendWebhook(wh, sms))
+	}()
 }
 
-func (s *WebhookService) sendWebhook(wh model.Webhook, sms *model.SMS) {
-	// 1. Render Template
-	content := sms.Content
-	if wh.Template != "" {
-		tmpl, err := template.New("msg").Parse(wh.Template)
-		if err == nil {
-			var buf bytes.Buffer
-			if err := tmpl.Execute(&buf, sms); err == nil {
-				content = buf.String()
-			}
-		}
+func (s *WebhookService) recordAttempt(d *model.WebhookDelivery, res webhookResult) {
+	now := time.Now()
+	d.Attempts++
+	d.LastAttemptAt = &now
+	d.ResponseCode = res.Code
+	d.ResponseBody = res.Body
+	d.LatencyMs = res.Latency.Milliseconds()
+	d.Error = ""
+	if res.Err != nil {
+		d.Error = res.Err.Error()
 	}
 
-	// 2. Format Payload based on Platform
-	var payload []byte
-	var err error
+	switch {
+	case res.ok():
+		d.Status = repository.DeliverySuccess
+		d.DeliveredAt = &now
+		d.NextAttemptAt = nil
+	case !res.retryable() || d.Attempts >= webhookMaxAttempts():
+		d.Status = repository.DeliveryDead
+		d.NextAttemptAt = nil
+		logger.Log.Warnf("Webhook delivery %d dead-lettered after %d attempts", d.ID, d.Attempts)
+	default:
+		next := now.Add(WebhookRetryDelay(d.Attempts))
+		d.Status = repository.DeliveryRetrying
+		d.NextAttemptAt = &next
+	}
 
-	switch wh.Platform {
-	case "telegram":
-		// Auto-encode for Telegram: assumes URL contains chat_id or is handled by receiver.
-		// We construct the body: {"text": content} as required by commonly used bots or webhook adapters.
-		// If URL is `https://api.telegram.org/bot<token>/sendMessage`, user should append `?chat_id=...` or strictly use JSON.
-		body := map[string]interface{}{
-			"text":       content,
-			"parse_mode": "Markdown",
-		}
-		if wh.ChannelID != "" {
-			body["chat_id"] = wh.ChannelID
-		}
-		if strings.Contains(wh.URL, "slack.com") {
-			body = map[string]interface{}{"text": content}
+	if err := s.deliveries.Save(d); err != nil {
+		logger.Log.Errorf("Failed to update webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+func webhookMaxAttempts() int {
+	if n := config.AppConfig.Webhook.MaxAttempts; n > 0 {
+		return n
+	}
+	return 8
+}
+
+// WebhookRetryDelay is the backoff after the given number of failed attempts:
+// retry_base_sec doubled per attempt, capped at retry_max_sec.
+func WebhookRetryDelay(attempts int) time.Duration {
+	base := time.Duration(config.AppConfig.Webhook.RetryBaseSec) * time.Second
+	max := time.Duration(config.AppConfig.Webhook.RetryMaxSec) * time.Second
+	if base <= 0 {
+		base = 30 * time.Second
+	}
+	if max < base {
+		max = base
+	}
+
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// RequeueInterrupted schedules deliveries left in "sending" by a previous
+// process. Call it once at startup, before any modem dispatches.
+func (s *WebhookService) RequeueInterrupted() {
+	if s.deliveries == nil {
+		return
+	}
+	if n, err := s.deliveries.RequeueInterrupted(time.Now()); err != nil {
+		logger.Log.Errorf("Failed to requeue interrupted webhook deliveries: %v", err)
+	} else if n > 0 {
+		logger.Log.Infof("Requeued %d interrupted webhook deliveries", n)
+	}
+}
+
+// RunRetryLoop resends due deliveries until stop is closed. Only one loop
+// should run per database.
+func (s *WebhookService) RunRetryLoop(stop <-chan struct{}) {
+	if s.deliveries == nil {
+		return
+	}
+
+	ticker := time.NewTicker(webhookRetryInterval)
+	defer ticker.Stop()
+	lastPurge := time.Time{}
+	for {
+		s.retryDue()
+
+		if time.Since(lastPurge) > time.Hour {
+			lastPurge = time.Now()
+			days := config.AppConfig.Webhook.DeliveryRetentionDays
+			if days <= 0 {
+				days = 30
+			}
+			if _, err := s.deliveries.PurgeDelivered(lastPurge.AddDate(0, 0, -days)); err != nil {
+				logger.Log.Warnf("Failed to purge webhook deliveries: %v", err)
+			}
 		}
-		payload, err = json.Marshal(body)
 
-	default:
-		// Generic JSON
-		body := map[string]interface{}{
-			"text": content,
-			"sms":  sms,
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
 		}
-		payload, err = json.Marshal(body)
 	}
+}
 
+func (s *WebhookService) retryDue() {
+	due, err := s.deliveries.FindDue(time.Now(), webhookRetryBatch)
 	if err != nil {
-		logger.Log.Errorf("Failed to marshal webhook payload: %v", err)
+		logger.Log.Errorf("Failed to load due webhook deliveries: %v", err)
 		return
 	}
 
-	// 3. Send Request
-	req, err := http.NewRequest("POST", wh.URL, bytes.NewBuffer(payload))
+	for i := range due {
+		d := due[i]
+		claimed, err := s.deliveries.Claim(d.ID, []string{repository.DeliveryRetrying})
+		if err != nil || !claimed {
+			continue
+		}
+		go s.resend(&d)
+	}
+}
+
+// Redeliver sends a finished or pending delivery again right away and returns
+// the updated record.
+func (s *WebhookService) Redeliver(id uint) (*model.WebhookDelivery, error) {
+	if s.deliveries == nil {
+		return nil, errors.New("delivery log unavailable")
+	}
+	claimed, err := s.deliveries.Claim(id, []string{repository.DeliveryRetrying, repository.DeliveryDead, repository.DeliverySuccess})
 	if err != nil {
-		logger.Log.Errorf("Failed to create request: %v", err)
-		return
+		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
+	if !claimed {
+		return nil, ErrDeliveryInFlight
+	}
+
+	d, err := s.deliveries.FindByID(id)
+	if err != nil {
+		return nil, err
+	}
+	// A manual redelivery gets a fresh retry budget.
+	d.Attempts = 0
+	s.resend(d)
+	return d, nil
+}
 
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
+func (s *WebhookService) resend(d *model.WebhookDelivery) {
+	wh, err := s.repo.FindByID(d.WebhookID)
 	if err != nil {
-		logger.Log.Errorf("Failed to send webhook to %s: %v", wh.URL, err)
+		s.deadLetter(d, "webhook no longer exists")
 		return
 	}
-	defer resp.Body.Close()
+	sms, err := s.smsRepo.FindByID(d.SMSID)
+	if err != nil {
+		s.deadLetter(d, "sms no longer exists")
+		return
+	}
+	// Access may have been revoked since the delivery was queued.
+	if wh.UserID != 0 && s.auth != nil && !s.auth.CanViewSMS(wh.UserID, sms.ICCID) {
+		s.deadLetter(d, "webhook owner can no longer view SMS of this modem")
+		return
+	}
+	s.recordAttempt(d, s.sendWebhook(*wh, sms))
+}
 
-	if resp.StatusCode >= 400 {
-		logger.Log.Errorf("Webhook %s returned status: %d", wh.URL, resp.StatusCode)
-	} else {
-		logger.Log.Infof("Webhook sent to %s", wh.URL)
+func (s *WebhookService) deadLetter(d *model.WebhookDelivery, reason string) {
+	d.Status = repository.DeliveryDead
+	d.Error = reason
+	d.NextAttemptAt = nil
+	if err := s.deliveries.Save(d); err != nil {
+		logger.Log.Errorf("Failed to update webhook delivery %d: %v", d.ID, err)
+	}
+}
+
+func (s *WebhookService) sendWebhook(wh model.Webhook, sms *model.SMS) webhookResult {
+	platform := lookupWebhookPlatform(wh.Platform)
+	if platform == nil {
+		err := fmt.Errorf("unknown webhook platform %q", wh.Platform)
+		logger.Log.Errorf("Webhook %d: %v", wh.ID, err)
+		return webhookResult{Err: err}
+	}
+	msg := renderWebhookMessage(&wh, sms)
+	msg.PublicOnly = wh.UserID != 0 && !s.repo.OwnerIsAdmin(wh.UserID)
+	if msg.PublicOnly && wh.Platform == "telegram" && wh.URL == "" {
+		if id := s.repo.OwnerTelegramID(wh.UserID); id != 0 {
+			msg.OwnerTelegramChat = strconv.FormatInt(id, 10)
+		}
 	}
+	return platform.Deliver(&wh, msg)
 }
@@ -0,0 +1,143 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
+)
+
+func TestWebhookRetryDelayBackoff(t *testing.T) {
+	prev := config.AppConfig.Webhook
+	defer func() { config.AppConfig.Webhook = prev }()
+	config.AppConfig.Webhook.RetryBaseSec = 30
+	config.AppConfig.Webhook.RetryMaxSec = 300
+
+	want := []time.Duration{30 * time.Second, 60 * time.Second, 120 * time.Second, 240 * time.Second, 300 * time.Second, 300 * time.Second}
+	for i, expected := range want {
+		if got := WebhookRetryDelay(i + 1); got != expected {
+			t.Fatalf("attempt %d: expected %v, got %v", i+1, expected, got)
+		}
+	}
+}
+
+func TestWebhookResultRetryable(t *testing.T) {
+	if !(webhookResult{Code: http.StatusBadGateway}).retryable() {
+		t.Fatal("expected 502 to be retried")
+	}
+	if !(webhookResult{Code: http.StatusTooManyRequests}).retryable() {
+		t.Fatal("expected 429 to be retried")
+	}
+	if (webhookResult{Code: http.StatusNotFound}).retryable() {
+		t.Fatal("expected 404 to be dead-lettered")
+	}
+	if (webhookResult{Code: http.StatusFound}).ok() || (webhookResult{Code: http.StatusNotModified}).ok() {
+		t.Fatal("expected an unfollowed redirect not to count as delivered")
+	}
+	if !(webhookResult{Code: http.StatusNoContent}).ok() {
+		t.Fatal("expected 204 to count as delivered")
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	// Reference value: printf '1700000000.{"text":"hi"}' | openssl dgst -sha256 -hmac s3cret
+	got := SignWebhookPayload("s3cret", 1700000000, []byte(`{"text":"hi"}`))
+	want := "sha256=a4abab2c9ec335a751cf8c3848e413a84a4e0eef17a9660d993911fafacadb66"
+	if got != want {
+		t.Fatalf("expected %s, got %s", want, got)
+	}
+}
+
+func TestWebhookServiceTestReportsResponse(t *testing.T) {
+	if logger.Log == nil {
+		logger.InitLogger("error")
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("nope"))
+	}))
+	defer srv.Close()
+
+	s := &WebhookService{}
+	res := s.Test(model.Webhook{URL: srv.URL, Enabled: false}, &model.SMS{ICCID: "1", Phone: "+1", Content: "hi"})
+	if res.OK || res.StatusCode != http.StatusTeapot || res.Body != "nope" || res.Error != "" {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	srv.Close()
+	res = s.Test(model.Webhook{URL: srv.URL}, &model.SMS{ICCID: "1", Phone: "+1", Content: "hi"})
+	if res.OK || res.Error == "" {
+		t.Fatalf("expected connection error, got %+v", res)
+	}
+}
+
+func TestWebhookPublicOnlyTargets(t *testing.T) {
+	if logger.Log == nil {
+		logger.InitLogger("error")
+	}
+	for raw, public := range map[string]bool{
+		"http://127.0.0.1:8080/x":       false,
+		"http://10.1.2.3/":              false,
+		"http://169.254.169.254/latest": false,
+		"http://[::1]/":                 false,
+		"http://[fd00::1]/":             false,
+		"http://100.64.0.1/":            false,
+		"https://8.8.8.8/hook":          true,
+	} {
+		err := CheckWebhookTarget(context.Background(), raw)
+		if (err == nil) != public {
+			t.Fatalf("%s: expected public=%v, got %v", raw, public, err)
+		}
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer srv.Close()
+	wh := &model.Webhook{URL: srv.URL}
+	if res := doWebhookHTTP(wh, &webhookHTTPRequest{}, true); !errors.Is(res.Err, ErrWebhookPrivateTarget) || res.Body != "" {
+		t.Fatalf("expected the loopback receiver to be refused, got %+v", res)
+	}
+	if res := doWebhookHTTP(wh, &webhookHTTPRequest{}, false); res.Err != nil || res.Body != "internal" {
+		t.Fatalf("expected admin webhooks to reach it, got %+v", res)
+	}
+}
+
+func TestWebhookRetryChecksOwner(t *testing.T) {
+	logger.InitLogger("error")
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.Webhook{}, &model.WebhookDelivery{}, &model.SMS{}); err != nil {
+		t.Fatal(err)
+	}
+	wh := model.Webhook{UserID: 5, URL: "https://example.com/hook", Platform: "generic", Enabled: true}
+	db.Create(&wh)
+	sms := model.SMS{ICCID: "8988", Phone: "+886900000001", Content: "hi"}
+	db.Create(&sms)
+	d := model.WebhookDelivery{WebhookID: wh.ID, SMSID: sms.ID, ICCID: sms.ICCID, Status: repository.DeliveryRetrying}
+	db.Create(&d)
+
+	deliveries := repository.NewWebhookDeliveryRepository(db)
+	s := NewWebhookService(repository.NewWebhookRepository(db), deliveries, repository.NewSMSRepository(db))
+	s.SetAuthorizer(denySMSRuleAuthorizer{})
+	s.resend(&d)
+
+	stored, err := deliveries.FindByID(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != repository.DeliveryDead || stored.Attempts != 0 {
+		t.Fatalf("expected the retry to be dead-lettered without sending, got %s after %d attempts", stored.Status, stored.Attempts)
+	}
+}
@@ -0,0 +1,104 @@
+package logic
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrWebhookPrivateTarget = errors.New("webhook target is a private, loopback or link-local address")
+
+// webhookReservedNets are non-public ranges the net.IP helpers do not cover.
+var webhookReservedNets = func() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// publicWebhookIP reports whether a webhook of a non-admin may connect to ip.
+func publicWebhookIP(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range webhookReservedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckWebhookTarget resolves the host of an http(s) URL and refuses it if
+// any of its addresses is not public.
+func CheckWebhookTarget(ctx context.Context, raw string) error {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("invalid URL")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if !publicWebhookIP(ip) {
+			return ErrWebhookPrivateTarget
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !publicWebhookIP(addr.IP) {
+			return ErrWebhookPrivateTarget
+		}
+	}
+	return nil
+}
+
+// publicDialControl is a net.Dialer Control hook that refuses connections to
+// addresses that are not public.
+func publicDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicWebhookIP(net.ParseIP(host)) {
+		return ErrWebhookPrivateTarget
+	}
+	return nil
+}
+
+// webhookPublicTransport checks the address of every connection it opens, so
+// redirects and DNS answers that change after CheckWebhookTarget cannot reach
+// internal services. It ignores proxy settings, whose address is usually
+// private itself.
+var webhookPublicTransport = &http.Transport{
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicDialControl,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: time.Second,
+}
+
+// PublicOnlyHTTPClient returns a client that, like webhooks of non-admins,
+// only connects to public addresses.
+func PublicOnlyHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{Timeout: timeout, Transport: webhookPublicTransport}
+}
@@ -0,0 +1,105 @@
+package logic
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pccr10001/smsie/internal/model"
+)
+
+const (
+	TwilioAPIVersion      = "2010-04-01"
+	TwilioSignatureHeader = "X-Twilio-Signature"
+	// twilioDefaultAccountSID is sent when a twilio webhook has no channel_id.
+	twilioDefaultAccountSID = "AC00000000000000000000000000000000"
+)
+
+var (
+	modemNumberMu     sync.RWMutex
+	modemNumberLookup func(iccid string) string
+)
+
+// SetModemNumberLookup installs the function that returns the phone number
+// configured for a modem, used as "To" of inbound Twilio webhooks.
+func SetModemNumberLookup(fn func(iccid string) string) {
+	modemNumberMu.Lock()
+	defer modemNumberMu.Unlock()
+	modemNumberLookup = fn
+}
+
+// ModemAddress is the modem's phone number, or its ICCID when none is set.
+func ModemAddress(iccid string) string {
+	modemNumberMu.RLock()
+	fn := modemNumberLookup
+	modemNumberMu.RUnlock()
+	if fn != nil {
+		if number := fn(iccid); number != "" {
+			return number
+		}
+	}
+	return iccid
+}
+
+// TwilioSMSSID is the Twilio message SID of a received SMS.
+func TwilioSMSSID(id uint) string {
+	return fmt.Sprintf("SM%032x", id)
+}
+
+// TwilioSignature computes X-Twilio-Signature: HMAC-SHA1 over the URL followed
+// by every form parameter name and value in name order.
+func TwilioSignature(authToken, fullURL string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(fullURL)
+	for _, k := range keys {
+		for _, v := range params[k] {
+			sb.WriteString(k)
+			sb.WriteString(v)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(sb.String()))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Twilio: form-encoded inbound message like Twilio's SMS webhook. token is
+// the auth token used for X-Twilio-Signature, channel_id the AccountSid.
+func buildTwilioWebhook(wh *model.Webhook, msg *WebhookMessage) (*webhookHTTPRequest, error) {
+	sms := msg.SMS
+	sid := TwilioSMSSID(sms.ID)
+	account := strings.TrimSpace(wh.ChannelID)
+	if account == "" {
+		account = twilioDefaultAccountSID
+	}
+	params := url.Values{
+		"MessageSid":    {sid},
+		"SmsSid":        {sid},
+		"SmsMessageSid": {sid},
+		"AccountSid":    {account},
+		"From":          {sms.Phone},
+		"To":            {ModemAddress(sms.ICCID)},
+		"Body":          {sms.Content},
+		"NumMedia":      {"0"},
+		"NumSegments":   {"1"},
+		"SmsStatus":     {"received"},
+		"ApiVersion":    {TwilioAPIVersion},
+	}
+
+	r := &webhookHTTPRequest{ContentType: WebhookContentForm, Body: []byte(params.Encode())}
+	if wh.Token != "" {
+		r.Header = http.Header{TwilioSignatureHeader: {TwilioSignature(wh.Token, wh.URL, params)}}
+	}
+	return r, nil
+}
@@ -3,6 +3,7 @@ package mccmnc
 import (
 	"encoding/json"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -47,3 +48,14 @@ func GetOperatorName(mcc, mnc string) string {
 	}
 	return ""
 }
+
+// CallingCode returns the international calling code (e.g. "886") of an ISO
+// country code such as "TW".
+func CallingCode(iso string) string {
+	for _, op := range operators {
+		if op.CountryCode != "" && strings.EqualFold(op.ISO, iso) {
+			return op.CountryCode
+		}
+	}
+	return ""
+}
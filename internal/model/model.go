@@ -7,14 +7,22 @@ import (
 )
 
 type User struct {
-	ID            uint           `gorm:"primaryKey" json:"id"`
-	Username      string         `gorm:"uniqueIndex;not null" json:"username"`
-	PasswordHash  string         `gorm:"not null" json:"-"`
-	Role          string         `gorm:"default:'user'" json:"role"` // admin, user
-	AllowedModems string         `json:"allowed_modems"`             // Comma separated ICCIDs, or "*"
-	CreatedAt     time.Time      `json:"created_at"`
-	UpdatedAt     time.Time      `json:"updated_at"`
-	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	Username        string         `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash    string         `gorm:"not null" json:"-"`
+	Role            string         `gorm:"default:'user'" json:"role"`         // admin, user
+	AllowedModems   string         `json:"allowed_modems"`                     // Comma separated ICCIDs, or "*"
+	TelegramID      int64          `gorm:"index" json:"telegram_id,omitempty"` // Telegram user ID for the bot bridge
+	OIDCSubject     string         `gorm:"column:oidc_subject;size:255;index" json:"oidc_subject,omitempty"`
+	TOTPEnabled     bool           `gorm:"column:totp_enabled;default:false" json:"totp_enabled"`
+	TOTPSecret      string         `gorm:"column:totp_secret;size:64" json:"-"`
+	TOTPPending     string         `gorm:"column:totp_pending;size:64" json:"-"` // secret being enrolled
+	TOTPLastStep    int64          `gorm:"column:totp_last_step" json:"-"`       // last accepted time step, against replays
+	TOTPFailures    int            `gorm:"column:totp_failures" json:"-"`        // wrong codes since the last success or lockout
+	TOTPLockedUntil *time.Time     `gorm:"column:totp_locked_until" json:"-"`    // no codes are accepted before this
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type UserModemPermission struct {
@@ -46,10 +54,90 @@ type APIKey struct {
 	UpdatedAt   time.Time  `json:"updated_at"`
 }
 
+// RecoveryCode is a one-time code that stands in for a TOTP code when the
+// authenticator is lost. Only its hash is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	UserID    uint       `gorm:"index;not null" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;index;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// AppSetting holds a setting admins change at runtime.
+type AppSetting struct {
+	Key       string    `gorm:"primaryKey;size:64" json:"key"`
+	Value     string    `gorm:"type:text" json:"value"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AuthSession is a dashboard login. Access tokens name it in their sid claim
+// and stop working once it is revoked or expired; its refresh token is
+// stored hashed and replaced on every refresh.
+type AuthSession struct {
+	ID              string     `gorm:"primaryKey;size:32" json:"id"`
+	UserID          uint       `gorm:"index;not null" json:"user_id"`
+	RefreshHash     string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	PrevRefreshHash string     `gorm:"size:64;index" json:"-"` // replaced token, to detect reuse
+	RotatedAt       time.Time  `json:"rotated_at"`
+	ExpiresAt       time.Time  `gorm:"index" json:"expires_at"`
+	RevokedAt       *time.Time `json:"revoked_at,omitempty"`
+	IP              string     `gorm:"column:ip;size:64" json:"ip"`
+	UserAgent       string     `gorm:"size:255" json:"user_agent"`
+	CreatedAt       time.Time  `json:"created_at"`
+	LastUsedAt      time.Time  `json:"last_used_at"`
+}
+
+// SMSQuota limits how many SMS a user or an API key may send per calendar
+// minute, hour, day and month. A key is also bound by its owner's quotas.
+type SMSQuota struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	APIKeyID  uint      `gorm:"column:api_key_id;index" json:"api_key_id"` // 0 = applies to the user
+	ICCID     string    `gorm:"column:iccid" json:"iccid"`                 // empty = all modems together
+	PerMinute int       `json:"per_minute"`                                // 0 = unlimited
+	PerHour   int       `json:"per_hour"`
+	PerDay    int       `json:"per_day"`
+	PerMonth  int       `json:"per_month"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SMSUsage counts the SMS sent by a user (or one of its API keys) through a
+// modem within one minute.
+type SMSUsage struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	UserID   uint      `gorm:"uniqueIndex:idx_sms_usage;not null" json:"user_id"`
+	APIKeyID uint      `gorm:"column:api_key_id;uniqueIndex:idx_sms_usage;index" json:"api_key_id"`
+	ICCID    string    `gorm:"column:iccid;uniqueIndex:idx_sms_usage" json:"iccid"`
+	Minute   time.Time `gorm:"uniqueIndex:idx_sms_usage;index" json:"minute"`
+	Count    int       `json:"count"`
+}
+
+// AuditLog records one security-relevant or modem-affecting action. Rows
+// are only inserted, and removed when they pass the retention period.
+type AuditLog struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	CreatedAt    time.Time `gorm:"index" json:"created_at"`
+	UserID       uint      `gorm:"index" json:"user_id"` // 0 = not authenticated
+	Username     string    `gorm:"size:64" json:"username"`
+	APIKeyID     uint      `gorm:"column:api_key_id;index" json:"api_key_id,omitempty"`
+	AuthType     string    `gorm:"size:16" json:"auth_type"` // jwt, api_key, mcp, oidc or empty
+	IP           string    `gorm:"column:ip;size:64" json:"ip"`
+	Action       string    `gorm:"size:64;index" json:"action"`
+	ICCID        string    `gorm:"column:iccid;index" json:"iccid,omitempty"`
+	TargetUserID uint      `gorm:"index" json:"target_user_id,omitempty"`
+	Params       string    `gorm:"type:text" json:"params"`     // JSON with secrets redacted
+	Result       string    `gorm:"size:16;index" json:"result"` // success or failure
+	Status       int       `json:"status"`
+	Error        string    `gorm:"type:text" json:"error,omitempty"`
+}
+
 type Modem struct {
 	ICCID             string    `gorm:"primaryKey;column:iccid" json:"iccid"`
 	Name              string    `gorm:"column:name" json:"name"` // User defined alias
 	IMEI              string    `gorm:"column:imei" json:"imei"`
+	PhoneNumber       string    `gorm:"column:phone_number;index" json:"phone_number"` // SIM's MSISDN, set by the user
 	SIPEnabled        bool      `gorm:"column:sip_enabled" json:"sip_enabled"`
 	SIPUsername       string    `gorm:"column:sip_username" json:"sip_username,omitempty"`
 	SIPPassword       string    `gorm:"column:sip_password" json:"-"`
@@ -72,24 +160,169 @@ type Modem struct {
 }
 
 type SMS struct {
-	ID        uint      `gorm:"primaryKey" json:"id"`
-	ICCID     string    `gorm:"index;not null;column:iccid" json:"iccid"`
-	Phone     string    `gorm:"index;not null" json:"phone"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `gorm:"index" json:"timestamp"`
-	Type      string    `gorm:"index" json:"type"` // sent, received
-	IsRead    bool      `gorm:"default:false" json:"is_read"`
-	RawPDU    string    `json:"raw_pdu,omitempty"` // For debugging
-	CreatedAt time.Time `json:"created_at"`
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	ICCID         string    `gorm:"index;not null;column:iccid" json:"iccid"`
+	Phone         string    `gorm:"index;not null" json:"phone"`
+	Content       string    `json:"content"`
+	Timestamp     time.Time `gorm:"index" json:"timestamp"`
+	Type          string    `gorm:"index" json:"type"` // sent, received
+	IsRead        bool      `gorm:"default:false" json:"is_read"`
+	IsSpam        bool      `gorm:"default:false;index" json:"is_spam"`
+	Tags          string    `json:"tags,omitempty"`                  // Comma separated, set by SMS rules
+	OTP           string    `gorm:"column:otp" json:"otp,omitempty"` // One-time code found in Content
+	OTPConfidence float64   `gorm:"column:otp_confidence" json:"otp_confidence,omitempty"`
+	OTPService    string    `gorm:"column:otp_service;index" json:"otp_service,omitempty"`
+	Pool          string    `gorm:"size:64;index" json:"pool,omitempty"` // Modem pool a sent SMS was routed through
+	RawPDU        string    `json:"raw_pdu,omitempty"`                   // For debugging
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// ModemPool groups modems so that senders can name the pool instead of a
+// modem and let the router pick one.
+type ModemPool struct {
+	ID        uint              `gorm:"primaryKey" json:"id"`
+	Name      string            `gorm:"size:64;uniqueIndex;not null" json:"name"`
+	Strategy  string            `gorm:"size:16" json:"strategy"` // round_robin, least_recent, priority
+	OnNet     string            `gorm:"type:text" json:"on_net"` // "prefix=operator" pairs, comma separated
+	MinSignal int               `json:"min_signal"`              // percent, 0 = any
+	Enabled   bool              `gorm:"index" json:"enabled"`
+	Members   []ModemPoolMember `gorm:"-" json:"members"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+type ModemPoolMember struct {
+	ID           uint   `gorm:"primaryKey" json:"id"`
+	PoolID       uint   `gorm:"index:idx_pool_iccid,unique;not null" json:"pool_id"`
+	ICCID        string `gorm:"column:iccid;index:idx_pool_iccid,unique;not null" json:"iccid"`
+	Priority     int    `json:"priority"`     // lower is tried first
+	Destinations string `json:"destinations"` // prefixes (+886) or ISO countries (TW), comma separated; empty = any
+	DailyLimit   int    `json:"daily_limit"`  // SMS per day sent through pools, 0 = unlimited
 }
 
 type Webhook struct {
+	ID            uint              `gorm:"primaryKey" json:"id"`
+	UserID        uint              `gorm:"index" json:"user_id"`                     // Owner, 0 = admin managed
+	ICCID         string            `gorm:"index;not null;column:iccid" json:"iccid"` // "*" = all modems
+	ICCIDs        string            `gorm:"column:iccids;type:text" json:"iccids"`    // Additional modems, comma separated
+	URL           string            `gorm:"not null" json:"url"`
+	Platform      string            `json:"platform"`               // generic, telegram, slack, discord, teams, matrix, ntfy, gotify, twilio, email
+	ChannelID     string            `json:"channel_id"`             // Telegram chat ID, Matrix room ID, Twilio AccountSid
+	Template      string            `json:"template"`               // "Msg from {{.Phone}}: {{.Content}}"
+	Title         string            `json:"title"`                  // Template for card/notification title and email subject
+	Priority      string            `gorm:"size:8" json:"priority"` // low, normal, high, urgent
+	Markdown      bool              `json:"markdown"`
+	Token         string            `json:"-"` // Matrix access token, ntfy/Gotify token, Twilio auth token
+	SMTPHost      string            `gorm:"column:smtp_host" json:"smtp_host,omitempty"`
+	SMTPPort      int               `gorm:"column:smtp_port" json:"smtp_port,omitempty"`
+	SMTPUsername  string            `gorm:"column:smtp_username" json:"smtp_username,omitempty"`
+	SMTPPassword  string            `gorm:"column:smtp_password" json:"-"`
+	SMTPSecurity  string            `gorm:"column:smtp_security;size:16" json:"smtp_security,omitempty"` // starttls, tls, none
+	EmailFrom     string            `json:"email_from,omitempty"`
+	EmailTo       string            `json:"email_to,omitempty"` // Comma separated
+	Enabled       bool              `gorm:"default:true" json:"enabled"`
+	SenderPattern string            `json:"sender_pattern"`              // Filter: regex on the normalized sender
+	ContentRegex  string            `json:"content_regex"`               // Filter
+	Keywords      string            `json:"keywords"`                    // Filter: comma separated, any matches (case-insensitive)
+	MessageTypes  string            `json:"message_types"`               // Filter: comma separated SMS types, empty = all
+	Method        string            `gorm:"size:8" json:"method"`        // POST (default), PUT, PATCH
+	ContentType   string            `gorm:"size:64" json:"content_type"` // generic only, default application/json
+	Headers       string            `gorm:"type:text" json:"-"`          // JSON object of static headers
+	Secret        string            `json:"-"`                           // HMAC-SHA256 signing key
+	HeaderMap     map[string]string `gorm:"-" json:"headers,omitempty"`  // runtime field, sensitive values masked
+	HasSecret     bool              `gorm:"-" json:"has_secret"`         // runtime field
+	HasToken      bool              `gorm:"-" json:"has_token"`          // runtime field
+	HasSMTPPass   bool              `gorm:"-" json:"has_smtp_password"`  // runtime field
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+type WebhookDelivery struct {
+	ID            uint       `gorm:"primaryKey" json:"id"`
+	WebhookID     uint       `gorm:"index;not null" json:"webhook_id"`
+	SMSID         uint       `gorm:"column:sms_id;index" json:"sms_id"`
+	ICCID         string     `gorm:"index;column:iccid" json:"iccid"`
+	Status        string     `gorm:"size:16;index" json:"status"` // sending, retrying, success, dead
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"response_code"`
+	ResponseBody  string     `json:"response_body"` // truncated
+	Error         string     `json:"error"`
+	LatencyMs     int64      `json:"latency_ms"`
+	NextAttemptAt *time.Time `gorm:"index" json:"next_attempt_at,omitempty"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time  `gorm:"index" json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+type CallerRule struct {
+	ID        uint       `gorm:"primaryKey" json:"id"`
+	ICCID     string     `gorm:"index;column:iccid" json:"iccid"`         // empty = all modems
+	MatchType string     `gorm:"size:16;not null" json:"match_type"`      // exact, prefix, regex, unknown, any
+	Pattern   string     `json:"pattern"`                                 // ignored for unknown/any
+	Action    string     `gorm:"size:16;not null" json:"action"`          // allow, block, spam
+	AppliesTo string     `gorm:"size:16;default:'all'" json:"applies_to"` // call, sms, all
+	Note      string     `json:"note"`
+	Enabled   bool       `gorm:"index" json:"enabled"`
+	CallHits  int64      `gorm:"default:0" json:"call_hits"`
+	SMSHits   int64      `gorm:"column:sms_hits;default:0" json:"sms_hits"`
+	LastHitAt *time.Time `json:"last_hit_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type SMSRule struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         uint       `gorm:"index;not null" json:"user_id"` // owner
+	Name           string     `gorm:"size:64" json:"name"`
+	Priority       int        `gorm:"default:0" json:"priority"` // lower runs first
+	Enabled        bool       `gorm:"index" json:"enabled"`
+	ICCID          string     `gorm:"index;column:iccid" json:"iccid"` // empty = any modem the owner can view
+	SenderPattern  string     `json:"sender_pattern"`                  // regex on the normalized sender
+	ContentRegex   string     `json:"content_regex"`
+	TimeStart      string     `gorm:"size:5" json:"time_start"` // HH:MM server local time
+	TimeEnd        string     `gorm:"size:5" json:"time_end"`
+	Action         string     `gorm:"size:16;not null" json:"action"` // auto_reply, forward, tag, mark_read, webhook
+	ReplyText      string     `json:"reply_text"`                     // template for auto_reply/forward
+	ForwardTo      string     `json:"forward_to"`
+	ForwardICCID   string     `gorm:"column:forward_iccid" json:"forward_iccid"` // empty = receiving modem
+	Tag            string     `gorm:"size:64" json:"tag"`
+	WebhookID      uint       `json:"webhook_id"`
+	StopProcessing bool       `json:"stop_processing"`
+	CooldownSec    int        `json:"cooldown_sec"` // per sender, 0 = default
+	HitCount       int64      `gorm:"default:0" json:"hit_count"`
+	LastHitAt      *time.Time `json:"last_hit_at,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// TelegramMessage links a bot message in a Telegram chat to the SMS
+// conversation it belongs to, so that replies can be sent back by SMS.
+type TelegramMessage struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
-	ICCID     string    `gorm:"index;not null;column:iccid" json:"iccid"`
-	URL       string    `gorm:"not null" json:"url"`
-	Platform  string    `json:"platform"`   // telegram, slack, generic
-	ChannelID string    `json:"channel_id"` // For Telegram
-	Template  string    `json:"template"`   // "Msg from {{.Phone}}: {{.Content}}"
-	Enabled   bool      `gorm:"default:true" json:"enabled"`
-	CreatedAt time.Time `json:"created_at"`
+	ChatID    int64     `gorm:"uniqueIndex:idx_tg_chat_message;not null" json:"chat_id"`
+	MessageID int64     `gorm:"uniqueIndex:idx_tg_chat_message;not null" json:"message_id"`
+	SMSID     uint      `gorm:"column:sms_id" json:"sms_id,omitempty"`
+	ICCID     string    `gorm:"index;column:iccid" json:"iccid"`
+	Phone     string    `json:"phone"`
+	CreatedAt time.Time `gorm:"index" json:"created_at"`
+}
+
+// TwilioMessage is an SMS sent through the Twilio-compatible Messages API.
+type TwilioMessage struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	SID            string     `gorm:"column:sid;uniqueIndex;size:34;not null" json:"sid"`
+	UserID         uint       `gorm:"index" json:"user_id"`
+	APIKeyID       uint       `gorm:"column:api_key_id;index" json:"api_key_id"`
+	ICCID          string     `gorm:"index;column:iccid" json:"iccid"`
+	From           string     `gorm:"column:from_number" json:"from"`
+	To             string     `gorm:"column:to_number;index" json:"to"`
+	Body           string     `json:"body"`
+	NumSegments    int        `json:"num_segments"`
+	Status         string     `gorm:"size:16;index" json:"status"` // queued, sending, sent, failed
+	ErrorCode      int        `json:"error_code,omitempty"`
+	ErrorMessage   string     `json:"error_message,omitempty"`
+	StatusCallback string     `json:"status_callback,omitempty"`
+	SentAt         *time.Time `json:"sent_at,omitempty"`
+	CreatedAt      time.Time  `gorm:"index" json:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
 }
@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type AuditLogRepository struct {
+	db *gorm.DB
+}
+
+func NewAuditLogRepository(db *gorm.DB) *AuditLogRepository {
+	return &AuditLogRepository{db: db}
+}
+
+type AuditLogFilter struct {
+	UserID       uint
+	APIKeyID     uint
+	TargetUserID uint
+	Action       string // exact, or a prefix ending in "." such as "modem."
+	ICCID        string
+	Result       string
+	IP           string
+	Since        time.Time
+	Until        time.Time
+	Limit        int
+	Offset       int
+}
+
+func (r *AuditLogRepository) Create(entry *model.AuditLog) error {
+	return r.db.Create(entry).Error
+}
+
+func (r *AuditLogRepository) query(f AuditLogFilter) *gorm.DB {
+	query := r.db.Model(&model.AuditLog{})
+	if f.UserID != 0 {
+		query = query.Where("user_id = ?", f.UserID)
+	}
+	if f.APIKeyID != 0 {
+		query = query.Where("api_key_id = ?", f.APIKeyID)
+	}
+	if f.TargetUserID != 0 {
+		query = query.Where("target_user_id = ?", f.TargetUserID)
+	}
+	if f.Action != "" {
+		if f.Action[len(f.Action)-1] == '.' {
+			query = query.Where("action LIKE ?", f.Action+"%")
+		} else {
+			query = query.Where("action = ?", f.Action)
+		}
+	}
+	if f.ICCID != "" {
+		query = query.Where("iccid = ?", f.ICCID)
+	}
+	if f.Result != "" {
+		query = query.Where("result = ?", f.Result)
+	}
+	if f.IP != "" {
+		query = query.Where("ip = ?", f.IP)
+	}
+	if !f.Since.IsZero() {
+		query = query.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		query = query.Where("created_at < ?", f.Until)
+	}
+	return query
+}
+
+// List returns matching entries, newest first, and their total count.
+func (r *AuditLogRepository) List(f AuditLogFilter) ([]model.AuditLog, int64, error) {
+	query := r.query(f)
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var list []model.AuditLog
+	err := query.Order("id desc").Limit(f.Limit).Offset(f.Offset).Find(&list).Error
+	return list, total, err
+}
+
+// Each calls fn for every matching entry, newest first, in batches, so an
+// export does not load the whole log at once.
+func (r *AuditLogRepository) Each(f AuditLogFilter, fn func(*model.AuditLog) error) error {
+	lastID := uint(0)
+	for {
+		var batch []model.AuditLog
+		query := r.query(f)
+		if lastID != 0 {
+			query = query.Where("id < ?", lastID)
+		}
+		if err := query.Order("id desc").Limit(500).Find(&batch).Error; err != nil {
+			return err
+		}
+		for i := range batch {
+			if err := fn(&batch[i]); err != nil {
+				return err
+			}
+		}
+		if len(batch) < 500 {
+			return nil
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+// PurgeBefore removes entries created before the cutoff.
+func (r *AuditLogRepository) PurgeBefore(before time.Time) (int64, error) {
+	res := r.db.Where("created_at < ?", before).Delete(&model.AuditLog{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,41 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type CallerRuleRepository struct {
+	db *gorm.DB
+}
+
+func NewCallerRuleRepository(db *gorm.DB) *CallerRuleRepository {
+	return &CallerRuleRepository{db: db}
+}
+
+// FindActive returns enabled rules for the modem and global rules, per-modem first.
+func (r *CallerRuleRepository) FindActive(iccid, channel string) ([]model.CallerRule, error) {
+	var list []model.CallerRule
+	err := r.db.
+		Where("enabled = ? AND (iccid = ? OR iccid = '')", true, iccid).
+		Where("applies_to IN ?", []string{"all", "", channel}).
+		Order("CASE WHEN iccid = '' THEN 1 ELSE 0 END").
+		Order("id asc").
+		Find(&list).Error
+	return list, err
+}
+
+// RecordHit counts a match of the rule, unless its action is no longer the one
+// that matched.
+func (r *CallerRuleRepository) RecordHit(id uint, channel, action string) error {
+	column := "sms_hits"
+	if channel == "call" {
+		column = "call_hits"
+	}
+	return r.db.Model(&model.CallerRule{}).Where("id = ? AND action = ?", id, action).Updates(map[string]interface{}{
+		column:        gorm.Expr(column+" + ?", 1),
+		"last_hit_at": time.Now(),
+	}).Error
+}
@@ -0,0 +1,107 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type ModemPoolRepository struct {
+	db *gorm.DB
+}
+
+func NewModemPoolRepository(db *gorm.DB) *ModemPoolRepository {
+	return &ModemPoolRepository{db: db}
+}
+
+func (r *ModemPoolRepository) List() ([]model.ModemPool, error) {
+	var pools []model.ModemPool
+	if err := r.db.Order("name asc").Find(&pools).Error; err != nil {
+		return nil, err
+	}
+	for i := range pools {
+		if err := r.loadMembers(&pools[i]); err != nil {
+			return nil, err
+		}
+	}
+	return pools, nil
+}
+
+// FindByName looks a pool up case-insensitively.
+func (r *ModemPoolRepository) FindByName(name string) (*model.ModemPool, error) {
+	var pool model.ModemPool
+	if err := r.db.Where("LOWER(name) = LOWER(?)", name).First(&pool).Error; err != nil {
+		return nil, err
+	}
+	return &pool, r.loadMembers(&pool)
+}
+
+func (r *ModemPoolRepository) loadMembers(pool *model.ModemPool) error {
+	pool.Members = []model.ModemPoolMember{}
+	return r.db.Where("pool_id = ?", pool.ID).Order("priority asc").Order("id asc").Find(&pool.Members).Error
+}
+
+// Save creates or updates the pool and replaces its members.
+func (r *ModemPoolRepository) Save(pool *model.ModemPool) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(pool).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("pool_id = ?", pool.ID).Delete(&model.ModemPoolMember{}).Error; err != nil {
+			return err
+		}
+		for i := range pool.Members {
+			pool.Members[i].ID = 0
+			pool.Members[i].PoolID = pool.ID
+		}
+		if len(pool.Members) == 0 {
+			return nil
+		}
+		return tx.Create(&pool.Members).Error
+	})
+}
+
+func (r *ModemPoolRepository) Delete(id uint) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("pool_id = ?", id).Delete(&model.ModemPoolMember{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&model.ModemPool{}, id).Error
+	})
+}
+
+// SentSince counts SMS sent by each modem since the given time.
+func (r *ModemPoolRepository) SentSince(iccids []string, since time.Time) (map[string]int, error) {
+	var rows []struct {
+		ICCID string `gorm:"column:iccid"`
+		Count int
+	}
+	err := r.db.Model(&model.SMS{}).
+		Select("iccid, COUNT(*) AS count").
+		Where("type = ? AND iccid IN ? AND timestamp >= ?", "sent", iccids, since).
+		Group("iccid").
+		Scan(&rows).Error
+	out := make(map[string]int, len(rows))
+	for _, row := range rows {
+		out[row.ICCID] = row.Count
+	}
+	return out, err
+}
+
+// LastSent returns when each modem last sent an SMS.
+func (r *ModemPoolRepository) LastSent(iccids []string) (map[string]time.Time, error) {
+	out := make(map[string]time.Time, len(iccids))
+	for _, iccid := range iccids {
+		var list []model.SMS
+		err := r.db.Select("timestamp").Where("type = ? AND iccid = ?", "sent", iccid).
+			Order("timestamp desc").Limit(1).Find(&list).Error
+		if err != nil {
+			return out, err
+		}
+		if len(list) > 0 {
+			out[iccid] = list[0].Timestamp
+		}
+	}
+	return out, nil
+}
@@ -17,7 +17,7 @@ func NewModemRepository(db *gorm.DB) *ModemRepository {
 func (r *ModemRepository) Upsert(modem *model.Modem) error {
 	return r.db.Clauses(clause.OnConflict{
 		Columns:   []clause.Column{{Name: "iccid"}},
-		DoUpdates: clause.AssignmentColumns([]string{"imei", "port_name"}),
+		DoUpdates: clause.AssignmentColumns([]string{"imei"}), // port_name is runtime only
 	}).Create(modem).Error
 }
 
@@ -30,3 +30,10 @@ func (r *ModemRepository) FindByICCID(iccid string) (*model.Modem, error) {
 func (r *ModemRepository) MarkAllOffline() {
 	// Runtime status is in-memory and should not be persisted.
 }
+
+// PhoneNumber returns the number configured for the modem, or "".
+func (r *ModemRepository) PhoneNumber(iccid string) string {
+	var number string
+	r.db.Model(&model.Modem{}).Where("iccid = ?", iccid).Limit(1).Pluck("phone_number", &number)
+	return number
+}
@@ -22,3 +22,18 @@ func (r *SMSRepository) FindByICCID(iccid string) ([]model.SMS, error) {
 	err := r.db.Where("iccid = ?", iccid).Order("timestamp desc").Find(&smsList).Error
 	return smsList, err
 }
+
+func (r *SMSRepository) UpdateFlags(id uint, tags string, isRead bool) error {
+	return r.db.Model(&model.SMS{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"tags":    tags,
+		"is_read": isRead,
+	}).Error
+}
+
+func (r *SMSRepository) FindByID(id uint) (*model.SMS, error) {
+	var sms model.SMS
+	if err := r.db.First(&sms, id).Error; err != nil {
+		return nil, err
+	}
+	return &sms, nil
+}
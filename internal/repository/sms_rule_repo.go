@@ -0,0 +1,34 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type SMSRuleRepository struct {
+	db *gorm.DB
+}
+
+func NewSMSRuleRepository(db *gorm.DB) *SMSRuleRepository {
+	return &SMSRuleRepository{db: db}
+}
+
+// FindActive returns enabled rules that may apply to the modem, in evaluation order.
+func (r *SMSRuleRepository) FindActive(iccid string) ([]model.SMSRule, error) {
+	var list []model.SMSRule
+	err := r.db.
+		Where("enabled = ? AND (iccid = ? OR iccid = '')", true, iccid).
+		Order("priority asc").
+		Order("id asc").
+		Find(&list).Error
+	return list, err
+}
+
+func (r *SMSRuleRepository) RecordHit(id uint) error {
+	return r.db.Model(&model.SMSRule{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"hit_count":   gorm.Expr("hit_count + ?", 1),
+		"last_hit_at": time.Now(),
+	}).Error
+}
@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type TelegramMessageRepository struct {
+	db *gorm.DB
+}
+
+func NewTelegramMessageRepository(db *gorm.DB) *TelegramMessageRepository {
+	return &TelegramMessageRepository{db: db}
+}
+
+// Create records a bot message; a message that is already recorded is kept.
+func (r *TelegramMessageRepository) Create(m *model.TelegramMessage) error {
+	return r.db.Clauses(clause.OnConflict{DoNothing: true}).Create(m).Error
+}
+
+func (r *TelegramMessageRepository) Find(chatID, messageID int64) (*model.TelegramMessage, error) {
+	var m model.TelegramMessage
+	if err := r.db.Where("chat_id = ? AND message_id = ?", chatID, messageID).First(&m).Error; err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (r *TelegramMessageRepository) PurgeBefore(before time.Time) (int64, error) {
+	res := r.db.Where("created_at < ?", before).Delete(&model.TelegramMessage{})
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+const (
+	DeliverySending  = "sending"
+	DeliveryRetrying = "retrying"
+	DeliverySuccess  = "success"
+	DeliveryDead     = "dead"
+)
+
+type WebhookDeliveryRepository struct {
+	db *gorm.DB
+}
+
+func NewWebhookDeliveryRepository(db *gorm.DB) *WebhookDeliveryRepository {
+	return &WebhookDeliveryRepository{db: db}
+}
+
+type WebhookDeliveryFilter struct {
+	WebhookID uint
+	ICCID     string
+	Status    string
+	Limit     int
+	Offset    int
+}
+
+type WebhookDeliveryStats struct {
+	WebhookID    uint    `json:"webhook_id"`
+	Total        int64   `json:"total"`
+	Success      int64   `json:"success"`
+	Dead         int64   `json:"dead"`
+	Pending      int64   `json:"pending"`
+	Attempts     int64   `json:"attempts"`
+	AvgLatencyMs float64 `json:"avg_latency_ms"`
+	SuccessRate  float64 `json:"success_rate"` // success / (success + dead)
+}
+
+func (r *WebhookDeliveryRepository) Create(d *model.WebhookDelivery) error {
+	return r.db.Create(d).Error
+}
+
+func (r *WebhookDeliveryRepository) Save(d *model.WebhookDelivery) error {
+	return r.db.Save(d).Error
+}
+
+func (r *WebhookDeliveryRepository) FindByID(id uint) (*model.WebhookDelivery, error) {
+	var d model.WebhookDelivery
+	if err := r.db.First(&d, id).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r *WebhookDeliveryRepository) List(f WebhookDeliveryFilter) ([]model.WebhookDelivery, int64, error) {
+	query := r.db.Model(&model.WebhookDelivery{})
+	if f.WebhookID != 0 {
+		query = query.Where("webhook_id = ?", f.WebhookID)
+	}
+	if f.ICCID != "" {
+		query = query.Where("iccid = ?", f.ICCID)
+	}
+	if f.Status != "" {
+		query = query.Where("status = ?", f.Status)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var list []model.WebhookDelivery
+	err := query.Order("id desc").Limit(f.Limit).Offset(f.Offset).Find(&list).Error
+	return list, total, err
+}
+
+// FindDue returns retrying deliveries whose next attempt is due.
+func (r *WebhookDeliveryRepository) FindDue(now time.Time, limit int) ([]model.WebhookDelivery, error) {
+	var list []model.WebhookDelivery
+	err := r.db.
+		Where("status = ? AND next_attempt_at <= ?", DeliveryRetrying, now).
+		Order("next_attempt_at asc").
+		Limit(limit).
+		Find(&list).Error
+	return list, err
+}
+
+// Claim moves a delivery to sending if it is still in one of the given states,
+// so concurrent retriers never send the same delivery twice.
+func (r *WebhookDeliveryRepository) Claim(id uint, from []string) (bool, error) {
+	res := r.db.Model(&model.WebhookDelivery{}).
+		Where("id = ? AND status IN ?", id, from).
+		Updates(map[string]interface{}{"status": DeliverySending, "updated_at": time.Now()})
+	return res.RowsAffected == 1, res.Error
+}
+
+// RequeueInterrupted schedules deliveries that were mid-send when the
+// previous process stopped.
+func (r *WebhookDeliveryRepository) RequeueInterrupted(before time.Time) (int64, error) {
+	res := r.db.Model(&model.WebhookDelivery{}).
+		Where("status = ? AND updated_at < ?", DeliverySending, before).
+		Updates(map[string]interface{}{"status": DeliveryRetrying, "next_attempt_at": time.Now()})
+	return res.RowsAffected, res.Error
+}
+
+// PurgeDelivered removes successful deliveries created before the cutoff.
+// Dead letters are kept until they are redelivered or their webhook is deleted.
+func (r *WebhookDeliveryRepository) PurgeDelivered(before time.Time) (int64, error) {
+	res := r.db.Where("status = ? AND created_at < ?", DeliverySuccess, before).Delete(&model.WebhookDelivery{})
+	return res.RowsAffected, res.Error
+}
+
+func (r *WebhookDeliveryRepository) Stats(iccid string, since time.Time) ([]WebhookDeliveryStats, error) {
+	query := r.db.Model(&model.WebhookDelivery{}).
+		Select(`webhook_id,
+			COUNT(*) AS total,
+			SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS success,
+			SUM(CASE WHEN status = ? THEN 1 ELSE 0 END) AS dead,
+			SUM(CASE WHEN status IN ? THEN 1 ELSE 0 END) AS pending,
+			SUM(attempts) AS attempts,
+			AVG(CASE WHEN status = ? THEN latency_ms END) AS avg_latency_ms`,
+			DeliverySuccess, DeliveryDead, []string{DeliverySending, DeliveryRetrying}, DeliverySuccess)
+	if iccid != "" {
+		query = query.Where("iccid = ?", iccid)
+	}
+	if !since.IsZero() {
+		query = query.Where("created_at >= ?", since)
+	}
+
+	var list []WebhookDeliveryStats
+	if err := query.Group("webhook_id").Order("webhook_id asc").Scan(&list).Error; err != nil {
+		return nil, err
+	}
+	for i := range list {
+		if finished := list[i].Success + list[i].Dead; finished > 0 {
+			list[i].SuccessRate = float64(list[i].Success) / float64(finished)
+		}
+	}
+	return list, nil
+}
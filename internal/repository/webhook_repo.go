@@ -17,12 +17,43 @@ func (r *WebhookRepository) Create(webhook *model.Webhook) error {
 	return r.db.Create(webhook).Error
 }
 
-func (r *WebhookRepository) FindByICCID(iccid string) ([]model.Webhook, error) {
+// FindCandidates returns enabled webhooks that may cover the modem: its own,
+// wildcard ones and those listing it in iccids. Callers still have to check
+// list membership and filters, see logic.WebhookMatches.
+func (r *WebhookRepository) FindCandidates(iccid string) ([]model.Webhook, error) {
 	var list []model.Webhook
-	err := r.db.Where("iccid = ? AND enabled = ?", iccid, true).Find(&list).Error
+	err := r.db.
+		Where("enabled = ?", true).
+		Where("iccid = ? OR iccid = '*' OR iccids LIKE ?", iccid, "%"+iccid+"%").
+		Find(&list).Error
 	return list, err
 }
 
 func (r *WebhookRepository) Delete(id uint) error {
 	return r.db.Delete(&model.Webhook{}, id).Error
 }
+
+// OwnerIsAdmin reports whether the webhook owner is an admin; unknown users
+// are not.
+func (r *WebhookRepository) OwnerIsAdmin(userID uint) bool {
+	var n int64
+	r.db.Model(&model.User{}).Where("id = ? AND role = ?", userID, "admin").Count(&n)
+	return n > 0
+}
+
+// OwnerTelegramID returns the Telegram user linked to the webhook owner, or 0.
+func (r *WebhookRepository) OwnerTelegramID(userID uint) int64 {
+	var user model.User
+	if err := r.db.Select("telegram_id").First(&user, userID).Error; err != nil {
+		return 0
+	}
+	return user.TelegramID
+}
+
+func (r *WebhookRepository) FindByID(id uint) (*model.Webhook, error) {
+	var wh model.Webhook
+	if err := r.db.First(&wh, id).Error; err != nil {
+		return nil, err
+	}
+	return &wh, nil
+}
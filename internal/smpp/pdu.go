@@ -0,0 +1,336 @@
+// Package smpp encodes and decodes the SMPP 3.4 PDUs used by the smsie SMSC
+// interface.
+package smpp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Command IDs
+const (
+	GenericNack         uint32 = 0x80000000
+	BindReceiver        uint32 = 0x00000001
+	BindReceiverResp    uint32 = 0x80000001
+	BindTransmitter     uint32 = 0x00000002
+	BindTransmitterResp uint32 = 0x80000002
+	QuerySM             uint32 = 0x00000003
+	SubmitSM            uint32 = 0x00000004
+	SubmitSMResp        uint32 = 0x80000004
+	DeliverSM           uint32 = 0x00000005
+	DeliverSMResp       uint32 = 0x80000005
+	Unbind              uint32 = 0x00000006
+	UnbindResp          uint32 = 0x80000006
+	BindTransceiver     uint32 = 0x00000009
+	BindTransceiverResp uint32 = 0x80000009
+	EnquireLink         uint32 = 0x00000015
+	EnquireLinkResp     uint32 = 0x80000015
+)
+
+// Command status codes
+const (
+	StatusOK           uint32 = 0x00000000
+	StatusInvMsgLen    uint32 = 0x00000001
+	StatusInvCmdLen    uint32 = 0x00000002
+	StatusInvCmdID     uint32 = 0x00000003
+	StatusInvBndSts    uint32 = 0x00000004
+	StatusAlyBnd       uint32 = 0x00000005
+	StatusSysErr       uint32 = 0x00000008
+	StatusInvSrcAdr    uint32 = 0x0000000A
+	StatusInvDstAdr    uint32 = 0x0000000B
+	StatusBindFail     uint32 = 0x0000000D
+	StatusInvPaswd     uint32 = 0x0000000E
+	StatusInvSysID     uint32 = 0x0000000F
+	StatusMsgQFul      uint32 = 0x00000014
+	StatusSubmitFail   uint32 = 0x00000045
+	StatusThrottled    uint32 = 0x00000058
+	StatusInvSched     uint32 = 0x00000061
+	StatusRxTAppn      uint32 = 0x00000064
+	StatusInvOptParVal uint32 = 0x000000C4
+	StatusUnknownErr   uint32 = 0x000000FF
+)
+
+// Optional parameter tags
+const (
+	TagReceiptedMessageID uint16 = 0x001E
+	TagSARMsgRefNum       uint16 = 0x020C
+	TagSARTotalSegments   uint16 = 0x020E
+	TagSARSegmentSeqnum   uint16 = 0x020F
+	TagSCInterfaceVersion uint16 = 0x0210
+	TagMessagePayload     uint16 = 0x0424
+	TagMessageState       uint16 = 0x0427
+)
+
+const (
+	InterfaceVersion34     byte = 0x34
+	ESMClassDeliveryReport byte = 0x04
+	ESMClassUDHI           byte = 0x40
+
+	headerLen          = 16
+	MaxPDULen          = 64 * 1024
+	MaxShortMessageLen = 254
+)
+
+// Message states used in delivery receipts
+const (
+	StateDelivered     byte = 2
+	StateUndeliverable byte = 5
+	StateAccepted      byte = 6
+	StateRejected      byte = 8
+)
+
+var ErrShortBody = errors.New("smpp: PDU body truncated")
+
+// PDU is one SMPP packet with an undecoded body.
+type PDU struct {
+	CommandID uint32
+	Status    uint32
+	Sequence  uint32
+	Body      []byte
+}
+
+// IsResponse reports whether the PDU answers a request.
+func (p *PDU) IsResponse() bool {
+	return p.CommandID&GenericNack != 0
+}
+
+// ReadPDU reads one PDU. Lengths outside 16 bytes to MaxPDULen are errors
+// because the stream can no longer be trusted.
+func ReadPDU(r io.Reader) (*PDU, error) {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if length < headerLen || length > MaxPDULen {
+		return nil, fmt.Errorf("smpp: invalid command_length %d", length)
+	}
+	p := &PDU{
+		CommandID: binary.BigEndian.Uint32(hdr[4:8]),
+		Status:    binary.BigEndian.Uint32(hdr[8:12]),
+		Sequence:  binary.BigEndian.Uint32(hdr[12:16]),
+		Body:      make([]byte, length-headerLen),
+	}
+	if _, err := io.ReadFull(r, p.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Bytes encodes the PDU including its header.
+func (p *PDU) Bytes() []byte {
+	out := make([]byte, headerLen, headerLen+len(p.Body))
+	binary.BigEndian.PutUint32(out[0:4], uint32(headerLen+len(p.Body)))
+	binary.BigEndian.PutUint32(out[4:8], p.CommandID)
+	binary.BigEndian.PutUint32(out[8:12], p.Status)
+	binary.BigEndian.PutUint32(out[12:16], p.Sequence)
+	return append(out, p.Body...)
+}
+
+// Bind is the body of bind_transmitter, bind_receiver and bind_transceiver.
+type Bind struct {
+	SystemID         string
+	Password         string
+	SystemType       string
+	InterfaceVersion byte
+	AddrTON          byte
+	AddrNPI          byte
+	AddressRange     string
+}
+
+// ParseBind decodes a bind body. Field lengths are not enforced so clients
+// can send API keys longer than the 8 characters SMPP allows for passwords.
+func ParseBind(body []byte) (Bind, error) {
+	r := bodyReader{b: body}
+	b := Bind{
+		SystemID:         r.cstring(),
+		Password:         r.cstring(),
+		SystemType:       r.cstring(),
+		InterfaceVersion: r.byte(),
+		AddrTON:          r.byte(),
+		AddrNPI:          r.byte(),
+		AddressRange:     r.cstring(),
+	}
+	return b, r.err
+}
+
+// BindRespBody is the body of a bind response.
+func BindRespBody(systemID string) []byte {
+	var buf bytes.Buffer
+	writeCString(&buf, systemID)
+	writeTLV(&buf, TagSCInterfaceVersion, []byte{InterfaceVersion34})
+	return buf.Bytes()
+}
+
+// ShortMessage is the body shared by submit_sm and deliver_sm.
+type ShortMessage struct {
+	ServiceType          string
+	SourceTON            byte
+	SourceNPI            byte
+	SourceAddr           string
+	DestTON              byte
+	DestNPI              byte
+	DestAddr             string
+	ESMClass             byte
+	ProtocolID           byte
+	PriorityFlag         byte
+	ScheduleDeliveryTime string
+	ValidityPeriod       string
+	RegisteredDelivery   byte
+	ReplaceIfPresent     byte
+	DataCoding           byte
+	SMDefaultMsgID       byte
+	Message              []byte
+	TLVs                 map[uint16][]byte
+}
+
+func ParseShortMessage(body []byte) (ShortMessage, error) {
+	r := bodyReader{b: body}
+	m := ShortMessage{
+		ServiceType:          r.cstring(),
+		SourceTON:            r.byte(),
+		SourceNPI:            r.byte(),
+		SourceAddr:           r.cstring(),
+		DestTON:              r.byte(),
+		DestNPI:              r.byte(),
+		DestAddr:             r.cstring(),
+		ESMClass:             r.byte(),
+		ProtocolID:           r.byte(),
+		PriorityFlag:         r.byte(),
+		ScheduleDeliveryTime: r.cstring(),
+		ValidityPeriod:       r.cstring(),
+		RegisteredDelivery:   r.byte(),
+		ReplaceIfPresent:     r.byte(),
+		DataCoding:           r.byte(),
+		SMDefaultMsgID:       r.byte(),
+	}
+	m.Message = r.bytes(int(r.byte()))
+	m.TLVs = r.tlvs()
+	return m, r.err
+}
+
+// Payload returns message_payload when present, otherwise short_message.
+func (m *ShortMessage) Payload() []byte {
+	if p, ok := m.TLVs[TagMessagePayload]; ok && len(m.Message) == 0 {
+		return p
+	}
+	return m.Message
+}
+
+// Body encodes the message. Messages longer than MaxShortMessageLen are sent
+// in message_payload.
+func (m *ShortMessage) Body() []byte {
+	var buf bytes.Buffer
+	writeCString(&buf, m.ServiceType)
+	buf.WriteByte(m.SourceTON)
+	buf.WriteByte(m.SourceNPI)
+	writeCString(&buf, m.SourceAddr)
+	buf.WriteByte(m.DestTON)
+	buf.WriteByte(m.DestNPI)
+	writeCString(&buf, m.DestAddr)
+	buf.WriteByte(m.ESMClass)
+	buf.WriteByte(m.ProtocolID)
+	buf.WriteByte(m.PriorityFlag)
+	writeCString(&buf, m.ScheduleDeliveryTime)
+	writeCString(&buf, m.ValidityPeriod)
+	buf.WriteByte(m.RegisteredDelivery)
+	buf.WriteByte(m.ReplaceIfPresent)
+	buf.WriteByte(m.DataCoding)
+	buf.WriteByte(m.SMDefaultMsgID)
+	if len(m.Message) > MaxShortMessageLen {
+		buf.WriteByte(0)
+		writeTLV(&buf, TagMessagePayload, m.Message)
+	} else {
+		buf.WriteByte(byte(len(m.Message)))
+		buf.Write(m.Message)
+	}
+	for tag, value := range m.TLVs {
+		if tag == TagMessagePayload {
+			continue
+		}
+		writeTLV(&buf, tag, value)
+	}
+	return buf.Bytes()
+}
+
+// MessageIDBody is the body of submit_sm_resp and deliver_sm_resp.
+func MessageIDBody(id string) []byte {
+	var buf bytes.Buffer
+	writeCString(&buf, id)
+	return buf.Bytes()
+}
+
+type bodyReader struct {
+	b   []byte
+	err error
+}
+
+func (r *bodyReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.b) == 0 {
+		r.err = ErrShortBody
+		return 0
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v
+}
+
+func (r *bodyReader) cstring() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.b, 0)
+	if i < 0 {
+		r.err = ErrShortBody
+		return ""
+	}
+	s := string(r.b[:i])
+	r.b = r.b[i+1:]
+	return s
+}
+
+func (r *bodyReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.b) < n {
+		r.err = ErrShortBody
+		return nil
+	}
+	v := append([]byte(nil), r.b[:n]...)
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *bodyReader) tlvs() map[uint16][]byte {
+	out := map[uint16][]byte{}
+	for r.err == nil && len(r.b) >= 4 {
+		tag := binary.BigEndian.Uint16(r.b[0:2])
+		n := int(binary.BigEndian.Uint16(r.b[2:4]))
+		r.b = r.b[4:]
+		out[tag] = r.bytes(n)
+	}
+	if r.err == nil && len(r.b) > 0 {
+		r.err = ErrShortBody
+	}
+	return out
+}
+
+func writeCString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0)
+}
+
+func writeTLV(buf *bytes.Buffer, tag uint16, value []byte) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[0:2], tag)
+	binary.BigEndian.PutUint16(hdr[2:4], uint16(len(value)))
+	buf.Write(hdr[:])
+	buf.Write(value)
+}
@@ -0,0 +1,113 @@
+package smpp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShortMessageRoundTrip(t *testing.T) {
+	coding, text := EncodeText("驗證碼 123456")
+	in := ShortMessage{
+		SourceTON:          1,
+		SourceNPI:          1,
+		SourceAddr:         "886912345678",
+		DestAddr:           "8988600000000000001",
+		RegisteredDelivery: 1,
+		DataCoding:         coding,
+		Message:            text,
+		TLVs:               map[uint16][]byte{TagMessageState: {StateAccepted}},
+	}
+	pdu := &PDU{CommandID: DeliverSM, Sequence: 7, Body: in.Body()}
+
+	read, err := ReadPDU(bytes.NewReader(pdu.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read.CommandID != DeliverSM || read.Sequence != 7 || read.IsResponse() {
+		t.Fatalf("unexpected header: %+v", read)
+	}
+	out, err := ParseShortMessage(read.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeText(out.DataCoding, out.Payload())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "驗證碼 123456" || out.SourceAddr != in.SourceAddr || out.DestAddr != in.DestAddr || out.RegisteredDelivery != 1 {
+		t.Fatalf("round trip mismatch: %+v %q", out, got)
+	}
+	if !bytes.Equal(out.TLVs[TagMessageState], []byte{StateAccepted}) {
+		t.Fatalf("TLV lost: %v", out.TLVs)
+	}
+}
+
+func TestLongMessageUsesPayload(t *testing.T) {
+	in := ShortMessage{DestAddr: "1", Message: []byte(strings.Repeat("a", 300))}
+	out, err := ParseShortMessage(in.Body())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Message) != 0 || len(out.Payload()) != 300 {
+		t.Fatalf("expected message_payload, got sm %d payload %d", len(out.Message), len(out.Payload()))
+	}
+}
+
+func TestParseBindAllowsLongPassword(t *testing.T) {
+	body := []byte("app\x00smsie_0123456789abcdef0123456789abcdef01234567\x00\x00\x34\x00\x00\x00")
+	b, err := ParseBind(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.SystemID != "app" || !strings.HasPrefix(b.Password, "smsie_") || b.InterfaceVersion != InterfaceVersion34 {
+		t.Fatalf("unexpected bind: %+v", b)
+	}
+	if _, err := ParseBind([]byte("app\x00pw")); err == nil {
+		t.Fatal("truncated bind accepted")
+	}
+}
+
+func TestSplitSegment(t *testing.T) {
+	m := ShortMessage{ESMClass: ESMClassUDHI, Message: append([]byte{0x05, 0x00, 0x03, 0x2A, 0x02, 0x01}, "Hello"...)}
+	seg, payload, ok, err := m.SplitSegment()
+	if err != nil || !ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if seg != (Segment{Ref: 0x2A, Total: 2, Seq: 1}) || string(payload) != "Hello" {
+		t.Fatalf("unexpected segment %+v %q", seg, payload)
+	}
+
+	sar := ShortMessage{Message: []byte("World"), TLVs: map[uint16][]byte{
+		TagSARMsgRefNum:     {0x01, 0x02},
+		TagSARTotalSegments: {2},
+		TagSARSegmentSeqnum: {2},
+	}}
+	seg, payload, ok, err = sar.SplitSegment()
+	if err != nil || !ok || seg != (Segment{Ref: 0x0102, Total: 2, Seq: 2}) || string(payload) != "World" {
+		t.Fatalf("sar segment: %+v %q ok=%v err=%v", seg, payload, ok, err)
+	}
+
+	bad := ShortMessage{ESMClass: ESMClassUDHI, Message: []byte{0x05, 0x00, 0x03, 0x2A, 0x02, 0x03}}
+	if _, _, _, err := bad.SplitSegment(); err == nil {
+		t.Fatal("segment 3 of 2 accepted")
+	}
+}
+
+func TestReceipt(t *testing.T) {
+	orig := ShortMessage{SourceTON: 5, SourceAddr: "APP", DestTON: 1, DestAddr: "886912345678"}
+	at := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	sm := Receipt{MessageID: "abc", Stat: "ACCEPTD", State: StateAccepted, Submitted: at, Done: at, Text: "Your code is 123456 thanks"}.ShortMessage(&orig)
+
+	want := "id:abc sub:001 dlvrd:000 submit date:2405011230 done date:2405011230 stat:ACCEPTD err:000 text:Your code is 123456 "
+	if string(sm.Message) != want {
+		t.Fatalf("receipt = %q", sm.Message)
+	}
+	if sm.DestAddr != "APP" || sm.SourceAddr != "886912345678" || sm.ESMClass != ESMClassDeliveryReport {
+		t.Fatalf("receipt not addressed back: %+v", sm)
+	}
+	if string(sm.TLVs[TagReceiptedMessageID]) != "abc\x00" {
+		t.Fatalf("receipted_message_id = %q", sm.TLVs[TagReceiptedMessageID])
+	}
+}
@@ -0,0 +1,158 @@
+package smpp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Data coding schemes
+const (
+	CodingDefault byte = 0x00
+	CodingIA5     byte = 0x01
+	CodingLatin1  byte = 0x03
+	CodingUCS2    byte = 0x08
+)
+
+// DecodeText converts a message body to a string. The SMSC default alphabet
+// is treated as ASCII, which is what most ESMEs send.
+func DecodeText(dataCoding byte, b []byte) (string, error) {
+	switch dataCoding {
+	case CodingDefault, CodingIA5, CodingLatin1:
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	case CodingUCS2:
+		if len(b)%2 != 0 {
+			return "", fmt.Errorf("smpp: odd UCS2 length %d", len(b))
+		}
+		units := make([]uint16, len(b)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(b[2*i:])
+		}
+		return string(utf16.Decode(units)), nil
+	default:
+		return "", fmt.Errorf("smpp: unsupported data_coding 0x%02X", dataCoding)
+	}
+}
+
+// EncodeText encodes s as ASCII when possible and UCS2 otherwise.
+func EncodeText(s string) (byte, []byte) {
+	ascii := true
+	for _, r := range s {
+		if r > 0x7F {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return CodingDefault, []byte(s)
+	}
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 2*len(units))
+	for i, u := range units {
+		binary.BigEndian.PutUint16(out[2*i:], u)
+	}
+	return CodingUCS2, out
+}
+
+// Segment identifies one part of a concatenated message.
+type Segment struct {
+	Ref   uint16
+	Total byte
+	Seq   byte
+}
+
+// SplitSegment strips the user data header from a UDHI message and returns
+// its concatenation info, or falls back to the sar_* parameters. ok is false
+// for a message that is not part of a concatenated one.
+func (m *ShortMessage) SplitSegment() (seg Segment, payload []byte, ok bool, err error) {
+	payload = m.Payload()
+	if m.ESMClass&ESMClassUDHI != 0 {
+		if len(payload) == 0 || int(payload[0])+1 > len(payload) {
+			return Segment{}, nil, false, fmt.Errorf("smpp: invalid user data header")
+		}
+		udh := payload[1 : 1+int(payload[0])]
+		payload = payload[1+int(payload[0]):]
+		for len(udh) >= 2 {
+			id, n := udh[0], int(udh[1])
+			if len(udh) < 2+n {
+				return Segment{}, nil, false, fmt.Errorf("smpp: invalid user data header")
+			}
+			ie := udh[2 : 2+n]
+			switch {
+			case id == 0x00 && n == 3:
+				seg, ok = Segment{Ref: uint16(ie[0]), Total: ie[1], Seq: ie[2]}, true
+			case id == 0x08 && n == 4:
+				seg, ok = Segment{Ref: binary.BigEndian.Uint16(ie[0:2]), Total: ie[2], Seq: ie[3]}, true
+			}
+			udh = udh[2+n:]
+		}
+	} else if ref, found := m.TLVs[TagSARMsgRefNum]; found && len(ref) == 2 {
+		total, seq := m.TLVs[TagSARTotalSegments], m.TLVs[TagSARSegmentSeqnum]
+		if len(total) == 1 && len(seq) == 1 {
+			seg, ok = Segment{Ref: binary.BigEndian.Uint16(ref), Total: total[0], Seq: seq[0]}, true
+		}
+	}
+	if ok && (seg.Total == 0 || seg.Seq == 0 || seg.Seq > seg.Total) {
+		return Segment{}, nil, false, fmt.Errorf("smpp: invalid segment %d/%d", seg.Seq, seg.Total)
+	}
+	if ok && seg.Total == 1 {
+		ok = false
+	}
+	return seg, payload, ok, nil
+}
+
+// Receipt is the delivery receipt sent back for a submitted message.
+type Receipt struct {
+	MessageID string
+	Stat      string // DELIVRD, ACCEPTD, UNDELIV, REJECTD, ...
+	State     byte
+	Err       int
+	Submitted time.Time
+	Done      time.Time
+	Text      string
+}
+
+// ShortMessage builds the deliver_sm for the receipt, addressed back to the
+// sender of the original message.
+func (r Receipt) ShortMessage(orig *ShortMessage) ShortMessage {
+	text := r.Text
+	if len([]rune(text)) > 20 {
+		text = string([]rune(text)[:20])
+	}
+	dlvrd := "000"
+	if r.Stat == "DELIVRD" {
+		dlvrd = "001"
+	}
+	body := fmt.Sprintf("id:%s sub:001 dlvrd:%s submit date:%s done date:%s stat:%s err:%03d text:%s",
+		r.MessageID, dlvrd, r.Submitted.Format("0601021504"), r.Done.Format("0601021504"), r.Stat, r.Err, asciiOnly(text))
+	return ShortMessage{
+		SourceTON:  orig.DestTON,
+		SourceNPI:  orig.DestNPI,
+		SourceAddr: orig.DestAddr,
+		DestTON:    orig.SourceTON,
+		DestNPI:    orig.SourceNPI,
+		DestAddr:   orig.SourceAddr,
+		ESMClass:   ESMClassDeliveryReport,
+		DataCoding: CodingDefault,
+		Message:    []byte(body),
+		TLVs: map[uint16][]byte{
+			TagReceiptedMessageID: append([]byte(r.MessageID), 0),
+			TagMessageState:       {r.State},
+		},
+	}
+}
+
+func asciiOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7E {
+			return '?'
+		}
+		return r
+	}, s)
+}
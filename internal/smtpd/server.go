@@ -0,0 +1,553 @@
+// Package smtpd is the small SMTP server (RFC 5321) behind the smsie
+// email-to-SMS gateway. It supports EHLO, STARTTLS, AUTH PLAIN and LOGIN,
+// SIZE and 8BITMIME; everything else is left to the Backend.
+package smtpd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxLineLen      = 4096
+	maxAuthFailures = 3
+	maxBadCommands  = 10
+)
+
+// Backend decides who may send and what happens to accepted mail. The
+// identity returned by Auth or Anonymous is passed to Rcpt and Data.
+type Backend interface {
+	// Auth checks SMTP AUTH credentials.
+	Auth(username, password string) (any, error)
+	// Anonymous is called for MAIL FROM without AUTH. An error makes the
+	// client authenticate first.
+	Anonymous(remote net.Addr, from string) (any, error)
+	Rcpt(identity any, to string) error
+	Data(identity any, env *Envelope) error
+}
+
+// Envelope is one accepted message.
+type Envelope struct {
+	Remote net.Addr
+	From   string
+	To     []string
+	Data   []byte
+}
+
+// Error is an SMTP reply a Backend can return instead of the default one
+// for the failing command.
+type Error struct {
+	Code     int
+	Enhanced string
+	Message  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d %s %s", e.Code, e.Enhanced, e.Message)
+}
+
+type Server struct {
+	Hostname          string
+	Backend           Backend
+	TLSConfig         *tls.Config // enables STARTTLS
+	AllowInsecureAuth bool        // offer AUTH without TLS; always offered to loopback clients
+	MaxMessageBytes   int
+	MaxRecipients     int
+	Timeout           time.Duration // per command
+
+	mu     sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+var (
+	ErrServerClosed = errors.New("smtpd: server closed")
+
+	errAuthRequired = &Error{Code: 530, Enhanced: "5.7.0", Message: "Authentication required"}
+	errLineTooLong  = errors.New("smtpd: line too long")
+)
+
+// Serve accepts connections until Close is called.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.ln = ln
+	if s.conns == nil {
+		s.conns = map[net.Conn]struct{}{}
+	}
+	s.mu.Unlock()
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed || errors.Is(err, net.ErrClosed) {
+				return ErrServerClosed
+			}
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go func() {
+			s.serveConn(c)
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops the listener and drops open connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.ln != nil {
+		_ = s.ln.Close()
+	}
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+type session struct {
+	srv    *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	tls    bool
+	helo   bool
+	authID any // identity from AUTH, kept across transactions
+
+	txID    any // identity of the current transaction
+	inTx    bool
+	from    string
+	rcpts   []string
+	authBad int
+}
+
+func (s *Server) serveConn(c net.Conn) {
+	defer c.Close()
+	sess := &session{srv: s, conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+	_, sess.tls = c.(*tls.Conn)
+	sess.reply(220, "", s.Hostname+" ESMTP smsie")
+
+	bad := 0
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				sess.reply(500, "5.5.2", "Line too long")
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			sess.hello(arg, false)
+		case "EHLO":
+			sess.hello(arg, true)
+		case "STARTTLS":
+			if !sess.startTLS() {
+				return
+			}
+		case "AUTH":
+			if !sess.auth(arg) {
+				return
+			}
+		case "MAIL":
+			sess.mail(arg)
+		case "RCPT":
+			sess.rcpt(arg)
+		case "DATA":
+			if !sess.data() {
+				return
+			}
+		case "RSET":
+			sess.reset()
+			sess.reply(250, "2.0.0", "OK")
+		case "NOOP":
+			sess.reply(250, "2.0.0", "OK")
+		case "VRFY":
+			sess.reply(252, "2.5.0", "Cannot VRFY user")
+		case "QUIT":
+			sess.reply(221, "2.0.0", "Bye")
+			return
+		default:
+			bad++
+			if bad >= maxBadCommands {
+				sess.reply(421, "4.7.0", "Too many errors")
+				return
+			}
+			sess.reply(502, "5.5.2", "Command not recognized")
+		}
+	}
+}
+
+func (s *session) readLine() (string, error) {
+	if s.srv.Timeout > 0 {
+		_ = s.conn.SetDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	var buf []byte
+	for {
+		chunk, isPrefix, err := s.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, chunk...)
+		if len(buf) > maxLineLen {
+			return "", errLineTooLong
+		}
+		if !isPrefix {
+			return string(buf), nil
+		}
+	}
+}
+
+func (s *session) reply(code int, enhanced, text string) {
+	if enhanced != "" {
+		text = enhanced + " " + text
+	}
+	fmt.Fprintf(s.w, "%d %s\r\n", code, text)
+	_ = s.w.Flush()
+}
+
+func (s *session) replyError(err error, code int, enhanced string) {
+	var e *Error
+	if errors.As(err, &e) {
+		s.reply(e.Code, e.Enhanced, e.Message)
+		return
+	}
+	s.reply(code, enhanced, err.Error())
+}
+
+func (s *session) reset() {
+	s.inTx, s.txID, s.from, s.rcpts = false, nil, "", nil
+}
+
+func (s *session) authAllowed() bool {
+	if s.tls || s.srv.AllowInsecureAuth {
+		return true
+	}
+	if addr, ok := s.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.IsLoopback()
+	}
+	return false
+}
+
+func (s *session) hello(arg string, extended bool) {
+	if strings.TrimSpace(arg) == "" {
+		s.reply(501, "5.5.4", "Domain required")
+		return
+	}
+	s.reset()
+	s.helo = true
+	if !extended {
+		s.reply(250, "", s.srv.Hostname)
+		return
+	}
+	lines := []string{s.srv.Hostname, "8BITMIME", "ENHANCEDSTATUSCODES"}
+	if s.srv.MaxMessageBytes > 0 {
+		lines = append(lines, "SIZE "+strconv.Itoa(s.srv.MaxMessageBytes))
+	}
+	if s.srv.TLSConfig != nil && !s.tls {
+		lines = append(lines, "STARTTLS")
+	}
+	if s.authID == nil && s.authAllowed() {
+		lines = append(lines, "AUTH PLAIN LOGIN")
+	}
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(s.w, "250%s%s\r\n", sep, l)
+	}
+	_ = s.w.Flush()
+}
+
+func (s *session) startTLS() bool {
+	if s.srv.TLSConfig == nil || s.tls {
+		s.reply(502, "5.5.1", "STARTTLS not available")
+		return true
+	}
+	s.reply(220, "2.0.0", "Ready to start TLS")
+	tc := tls.Server(s.conn, s.srv.TLSConfig)
+	if s.srv.Timeout > 0 {
+		_ = tc.SetDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	if err := tc.Handshake(); err != nil {
+		return false
+	}
+	// RFC 3207: forget everything learned before TLS.
+	s.conn, s.r, s.w, s.tls = tc, bufio.NewReader(tc), bufio.NewWriter(tc), true
+	s.helo, s.authID = false, nil
+	s.reset()
+	return true
+}
+
+// auth handles AUTH PLAIN and AUTH LOGIN. It returns false when the
+// connection should be closed.
+func (s *session) auth(arg string) bool {
+	switch {
+	case !s.helo:
+		s.reply(503, "5.5.1", "Send EHLO first")
+		return true
+	case s.authID != nil:
+		s.reply(503, "5.5.1", "Already authenticated")
+		return true
+	case s.inTx:
+		s.reply(503, "5.5.1", "AUTH not allowed during a mail transaction")
+		return true
+	case !s.authAllowed():
+		s.reply(538, "5.7.11", "Encryption required for requested authentication mechanism")
+		return true
+	}
+
+	mech, initial, _ := strings.Cut(arg, " ")
+	var username, password string
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		resp, ok := s.authResponse(initial, "")
+		if !ok {
+			return true
+		}
+		parts := bytes.Split(resp, []byte{0})
+		if len(parts) != 3 {
+			s.reply(501, "5.5.2", "Invalid PLAIN response")
+			return true
+		}
+		username, password = string(parts[1]), string(parts[2])
+	case "LOGIN":
+		user, ok := s.authResponse(initial, "VXNlcm5hbWU6")
+		if !ok {
+			return true
+		}
+		pass, ok := s.authResponse("", "UGFzc3dvcmQ6")
+		if !ok {
+			return true
+		}
+		username, password = string(user), string(pass)
+	default:
+		s.reply(504, "5.5.4", "Unrecognized authentication type")
+		return true
+	}
+
+	id, err := s.srv.Backend.Auth(username, password)
+	if err != nil || id == nil {
+		s.authBad++
+		if s.authBad >= maxAuthFailures {
+			s.reply(421, "4.7.0", "Too many authentication failures")
+			return false
+		}
+		s.reply(535, "5.7.8", "Authentication credentials invalid")
+		return true
+	}
+	s.authID = id
+	s.reply(235, "2.7.0", "Authentication successful")
+	return true
+}
+
+// authResponse decodes the initial response, or prompts for one with the
+// base64 challenge.
+func (s *session) authResponse(initial, challenge string) ([]byte, bool) {
+	if initial == "" {
+		s.reply(334, "", challenge)
+		line, err := s.readLine()
+		if err != nil {
+			return nil, false
+		}
+		initial = line
+	}
+	switch initial {
+	case "*":
+		s.reply(501, "5.0.0", "Authentication cancelled")
+		return nil, false
+	case "=":
+		return []byte{}, true
+	}
+	b, err := base64.StdEncoding.DecodeString(initial)
+	if err != nil {
+		s.reply(501, "5.5.2", "Invalid base64 response")
+		return nil, false
+	}
+	return b, true
+}
+
+// parsePath extracts the address from "FROM:<addr> params".
+func parsePath(arg, prefix string) (string, []string, bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	rest := strings.TrimSpace(arg[len(prefix):])
+	if !strings.HasPrefix(rest, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(rest, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	return rest[1:end], strings.Fields(rest[end+1:]), true
+}
+
+func (s *session) mail(arg string) {
+	if !s.helo {
+		s.reply(503, "5.5.1", "Send EHLO first")
+		return
+	}
+	if s.inTx {
+		s.reply(503, "5.5.1", "Nested MAIL command")
+		return
+	}
+	from, params, ok := parsePath(arg, "FROM:")
+	if !ok {
+		s.reply(501, "5.5.4", "Syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, p := range params {
+		key, value, _ := strings.Cut(p, "=")
+		if strings.EqualFold(key, "SIZE") && s.srv.MaxMessageBytes > 0 {
+			if n, err := strconv.Atoi(value); err == nil && n > s.srv.MaxMessageBytes {
+				s.reply(552, "5.3.4", "Message size exceeds fixed limit")
+				return
+			}
+		}
+	}
+
+	id := s.authID
+	if id == nil {
+		var err error
+		id, err = s.srv.Backend.Anonymous(s.conn.RemoteAddr(), from)
+		if err != nil || id == nil {
+			if err == nil {
+				err = errAuthRequired
+			}
+			s.replyError(err, 530, "5.7.0")
+			return
+		}
+	}
+	s.inTx, s.txID, s.from = true, id, from
+	s.reply(250, "2.1.0", "OK")
+}
+
+func (s *session) rcpt(arg string) {
+	if !s.inTx {
+		s.reply(503, "5.5.1", "Need MAIL before RCPT")
+		return
+	}
+	to, _, ok := parsePath(arg, "TO:")
+	if !ok || to == "" {
+		s.reply(501, "5.5.4", "Syntax: RCPT TO:<address>")
+		return
+	}
+	if s.srv.MaxRecipients > 0 && len(s.rcpts) >= s.srv.MaxRecipients {
+		s.reply(452, "4.5.3", "Too many recipients")
+		return
+	}
+	if err := s.srv.Backend.Rcpt(s.txID, to); err != nil {
+		s.replyError(err, 550, "5.1.1")
+		return
+	}
+	s.rcpts = append(s.rcpts, to)
+	s.reply(250, "2.1.5", "OK")
+}
+
+// data reads the message up to the terminating dot. It returns false when
+// the connection should be closed.
+func (s *session) data() bool {
+	if len(s.rcpts) == 0 {
+		s.reply(503, "5.5.1", "Need RCPT before DATA")
+		return true
+	}
+	s.reply(354, "", "Start mail input; end with <CRLF>.<CRLF>")
+
+	var buf bytes.Buffer
+	tooBig := false
+	for {
+		line, err := s.readDataLine()
+		if errors.Is(err, errLineTooLong) {
+			tooBig = true
+			continue
+		}
+		if err != nil {
+			return false
+		}
+		if string(line) == "." {
+			break
+		}
+		if tooBig {
+			continue
+		}
+		buf.Write(bytes.TrimPrefix(line, []byte(".")))
+		buf.WriteString("\r\n")
+		if s.srv.MaxMessageBytes > 0 && buf.Len() > s.srv.MaxMessageBytes {
+			tooBig = true
+			buf.Reset()
+		}
+	}
+
+	defer s.reset()
+	if tooBig {
+		s.reply(552, "5.3.4", "Message size exceeds fixed limit")
+		return true
+	}
+	env := &Envelope{Remote: s.conn.RemoteAddr(), From: s.from, To: s.rcpts, Data: buf.Bytes()}
+	if err := s.srv.Backend.Data(s.txID, env); err != nil {
+		s.replyError(err, 554, "5.0.0")
+		return true
+	}
+	s.reply(250, "2.0.0", "OK: queued")
+	return true
+}
+
+// readDataLine reads a message line without CRLF. Body lines may exceed the
+// command line limit; a line longer than the message limit is consumed and
+// reported as errLineTooLong.
+func (s *session) readDataLine() ([]byte, error) {
+	if s.srv.Timeout > 0 {
+		_ = s.conn.SetDeadline(time.Now().Add(s.srv.Timeout))
+	}
+	limit := s.srv.MaxMessageBytes
+	if limit <= 0 {
+		limit = maxLineLen
+	}
+	var line []byte
+	overflow := false
+	for {
+		chunk, err := s.r.ReadSlice('\n')
+		if !overflow {
+			line = append(line, chunk...)
+			if len(line) > limit+2 {
+				overflow, line = true, nil
+			}
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		break
+	}
+	if overflow {
+		return nil, errLineTooLong
+	}
+	return bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r")), nil
+}
@@ -0,0 +1,90 @@
+package smtpd
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testBackend struct {
+	envs chan *Envelope
+}
+
+func (b *testBackend) Auth(username, password string) (any, error) {
+	if password != "secret" {
+		return nil, errors.New("bad password")
+	}
+	return username, nil
+}
+
+func (b *testBackend) Anonymous(remote net.Addr, from string) (any, error) {
+	if strings.HasSuffix(from, "@trusted.example") {
+		return "anonymous", nil
+	}
+	return nil, nil
+}
+
+func (b *testBackend) Rcpt(identity any, to string) error {
+	if !strings.HasSuffix(to, "@sms.local") {
+		return &Error{Code: 550, Enhanced: "5.7.1", Message: "Relaying denied"}
+	}
+	return nil
+}
+
+func (b *testBackend) Data(identity any, env *Envelope) error {
+	b.envs <- env
+	return nil
+}
+
+func startTestServer(t *testing.T) (string, *testBackend) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{envs: make(chan *Envelope, 1)}
+	srv := &Server{Hostname: "sms.local", Backend: b, MaxMessageBytes: 1024, MaxRecipients: 2, Timeout: 5 * time.Second}
+	go srv.Serve(ln)
+	t.Cleanup(srv.Close)
+	return ln.Addr().String(), b
+}
+
+func TestSendWithAuth(t *testing.T) {
+	addr, b := startTestServer(t)
+	msg := "Subject: hi\r\n\r\nline one\r\n.leading dot\r\n"
+	err := smtp.SendMail(addr, smtp.PlainAuth("", "app", "secret", "127.0.0.1"), "me@example.com", []string{"+886912345678@sms.local"}, []byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := <-b.envs
+	if env.From != "me@example.com" || len(env.To) != 1 || env.To[0] != "+886912345678@sms.local" {
+		t.Fatalf("unexpected envelope %+v", env)
+	}
+	if string(env.Data) != msg {
+		t.Fatalf("data = %q", env.Data)
+	}
+}
+
+func TestRejections(t *testing.T) {
+	addr, _ := startTestServer(t)
+
+	if err := smtp.SendMail(addr, smtp.PlainAuth("", "app", "wrong", "127.0.0.1"), "me@example.com", []string{"1@sms.local"}, []byte("x")); err == nil || !strings.Contains(err.Error(), "535") {
+		t.Fatalf("expected 535, got %v", err)
+	}
+	if err := smtp.SendMail(addr, nil, "me@example.com", []string{"1@sms.local"}, []byte("x")); err == nil || !strings.Contains(err.Error(), "530") {
+		t.Fatalf("expected 530 without auth, got %v", err)
+	}
+	if err := smtp.SendMail(addr, nil, "alerts@trusted.example", []string{"me@example.com"}, []byte("x")); err == nil || !strings.Contains(err.Error(), "Relaying denied") {
+		t.Fatalf("expected relay denial, got %v", err)
+	}
+	if err := smtp.SendMail(addr, nil, "alerts@trusted.example", []string{"1@sms.local", "2@sms.local", "3@sms.local"}, []byte("x")); err == nil || !strings.Contains(err.Error(), "452") {
+		t.Fatalf("expected recipient limit, got %v", err)
+	}
+	big := strings.Repeat("a", 2000)
+	if err := smtp.SendMail(addr, nil, "alerts@trusted.example", []string{"1@sms.local"}, []byte(big)); err == nil || !strings.Contains(err.Error(), "552") {
+		t.Fatalf("expected size limit, got %v", err)
+	}
+}
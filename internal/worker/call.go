@@ -15,17 +15,34 @@ type CallState struct {
 	Incoming        bool      `json:"incoming"`
 	Voice           bool      `json:"voice"`
 	IncomingRinging bool      `json:"incoming_ringing"`
+	Waiting         bool      `json:"waiting"`
+	Calls           []CallLeg `json:"calls"`
 	UpdatedAt       time.Time `json:"updated_at"`
 	UACVID          string    `json:"uac_vid,omitempty"`
 	UACPID          string    `json:"uac_pid,omitempty"`
 }
 
 func (w *ModemWorker) CallState() CallState {
+	if w.remote != nil {
+		return w.remoteCallState()
+	}
 	return w.callStateFromSnapshot(w.GetCallState())
 }
 
 func (w *ModemWorker) callStateFromSnapshot(s callSnapshot) CallState {
 	vid, pid := w.UACIdentity()
+	calls := make([]CallLeg, 0, s.LegCount)
+	for _, leg := range s.callLegs() {
+		calls = append(calls, CallLeg{
+			Index:      leg.Index,
+			State:      callLegStateName(leg.Stat),
+			Direction:  leg.Direction,
+			Stat:       leg.Stat,
+			Mode:       leg.Mode,
+			Multiparty: leg.Multiparty,
+			Number:     leg.Number,
+		})
+	}
 	return CallState{
 		State:           s.State,
 		Reason:          s.Reason,
@@ -36,6 +53,8 @@ func (w *ModemWorker) callStateFromSnapshot(s callSnapshot) CallState {
 		Incoming:        s.Incoming,
 		Voice:           s.Voice,
 		IncomingRinging: s.IncomingRinging,
+		Waiting:         s.Waiting,
+		Calls:           calls,
 		UpdatedAt:       s.UpdatedAt,
 		UACVID:          vid,
 		UACPID:          pid,
@@ -49,3 +68,7 @@ func IsInvalidDialNumberError(err error) bool {
 func IsCallInProgressError(err error) bool {
 	return errors.Is(err, errCallInProgress)
 }
+
+func IsNoIncomingCallError(err error) bool {
+	return errors.Is(err, errNoIncomingCall)
+}
@@ -1,5 +1,7 @@
 package worker
 
+import "github.com/pccr10001/smsie/internal/logic"
+
 type CallStateListener func(w *ModemWorker, state CallState)
 
 func (m *Manager) AddCallStateListener(listener CallStateListener) func() {
@@ -35,4 +37,5 @@ func (m *Manager) notifyCallStateChanged(w *ModemWorker, state CallState) {
 	for _, listener := range listeners {
 		listener(w, state)
 	}
+	w.publishEvent(logic.EventCallState, state)
 }
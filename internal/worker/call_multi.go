@@ -0,0 +1,365 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+// 27.007 allows one active/held pair plus a waiting call, and a multiparty
+// call of up to five members; seven slots cover every combination. A fixed
+// array keeps callSnapshot comparable.
+const maxCallLegs = 7
+
+const (
+	CallControlHoldAccept    = "hold_accept"    // AT+CHLD=2 with a waiting call
+	CallControlSwap          = "swap"           // AT+CHLD=2 between active and held
+	CallControlReleaseAccept = "release_accept" // AT+CHLD=1
+	CallControlRelease       = "release"        // AT+CHLD=1<idx>
+	CallControlSplit         = "split"          // AT+CHLD=2<idx>
+	CallControlConference    = "conference"     // AT+CHLD=3
+	CallControlReleaseHeld   = "release_held"   // AT+CHLD=0
+)
+
+var (
+	errInvalidCallControl = errors.New("invalid call control")
+	errCallNotFound       = errors.New("call not found")
+)
+
+type callLeg struct {
+	Index      int
+	Direction  int
+	Stat       int
+	Mode       int
+	Multiparty bool
+	Number     string
+}
+
+type CallLeg struct {
+	Index      int    `json:"index"`
+	State      string `json:"state"`
+	Direction  int    `json:"direction"`
+	Stat       int    `json:"stat"`
+	Mode       int    `json:"mode"`
+	Multiparty bool   `json:"multiparty"`
+	Number     string `json:"number"`
+}
+
+func IsInvalidCallControlError(err error) bool {
+	return errors.Is(err, errInvalidCallControl)
+}
+
+func IsCallNotFoundError(err error) bool {
+	return errors.Is(err, errCallNotFound)
+}
+
+func callLegStateName(stat int) string {
+	switch stat {
+	case 0:
+		return "active"
+	case 1:
+		return "held"
+	case 2:
+		return "dialing"
+	case 3:
+		return "alerting"
+	case 4:
+		return "incoming"
+	case 5:
+		return "waiting"
+	default:
+		return "releasing"
+	}
+}
+
+// Quectel ccinfo reports -1 and unsolicited +CLCC reports 6 for a released call.
+func callLegReleased(stat int) bool {
+	return stat < 0 || stat == 6
+}
+
+func callLegFromCLCC(info clccDetails) callLeg {
+	return callLeg{
+		Index:      info.Index,
+		Direction:  info.Direction,
+		Stat:       info.Stat,
+		Mode:       info.Mode,
+		Multiparty: info.Multiparty,
+		Number:     info.Number,
+	}
+}
+
+func (s callSnapshot) callLegs() []callLeg {
+	legs := make([]callLeg, 0, s.LegCount)
+	for i := 0; i < s.LegCount && i < maxCallLegs; i++ {
+		legs = append(legs, s.Legs[i])
+	}
+	return legs
+}
+
+func (s *callSnapshot) setCallLegs(legs []callLeg) {
+	sort.Slice(legs, func(i, j int) bool { return legs[i].Index < legs[j].Index })
+	s.Legs = [maxCallLegs]callLeg{}
+	s.LegCount = 0
+	for _, leg := range legs {
+		if s.LegCount == maxCallLegs {
+			break
+		}
+		s.Legs[s.LegCount] = leg
+		s.LegCount++
+	}
+}
+
+func (s callSnapshot) findCallLeg(index int) (callLeg, bool) {
+	for _, leg := range s.callLegs() {
+		if leg.Index == index {
+			return leg, true
+		}
+	}
+	return callLeg{}, false
+}
+
+func (s callSnapshot) hasCallLegStat(stat int) bool {
+	for _, leg := range s.callLegs() {
+		if leg.Stat == stat {
+			return true
+		}
+	}
+	return false
+}
+
+func removeCallLeg(legs []callLeg, index int) []callLeg {
+	out := legs[:0]
+	for _, leg := range legs {
+		if leg.Index != index {
+			out = append(out, leg)
+		}
+	}
+	return out
+}
+
+// primaryCallLeg picks the leg the flat call state fields describe: the
+// active call first, then held, outgoing and finally incoming/waiting.
+func primaryCallLeg(legs []callLeg) callLeg {
+	rank := func(stat int) int {
+		switch stat {
+		case 0:
+			return 0
+		case 1:
+			return 1
+		case 2, 3:
+			return 2
+		case 4:
+			return 3
+		case 5:
+			return 4
+		default:
+			return 5
+		}
+	}
+	best := legs[0]
+	for _, leg := range legs[1:] {
+		if rank(leg.Stat) < rank(best.Stat) {
+			best = leg
+		}
+	}
+	return best
+}
+
+func (w *ModemWorker) applyCallLegs(legs []callLeg, source string) {
+	if len(legs) == 0 {
+		w.setCallStateWithMeta(callStateIdle, source, clearCallDetails)
+		return
+	}
+
+	primary := primaryCallLeg(legs)
+	established := false
+	waiting := false
+	for _, leg := range legs {
+		switch leg.Stat {
+		case 0, 1:
+			established = true
+		case 5:
+			waiting = true
+		}
+	}
+
+	state := callStateDialing
+	if established {
+		state = callStateInCall
+	}
+	incomingVoice := primary.Direction == 1 && primary.Mode == 0
+
+	w.setCallStateWithMeta(state, source+"_multi", func(snapshot *callSnapshot) {
+		snapshot.Number = primary.Number
+		snapshot.Direction = primary.Direction
+		snapshot.Stat = primary.Stat
+		snapshot.Mode = primary.Mode
+		snapshot.Incoming = incomingVoice
+		snapshot.Voice = primary.Mode == 0
+		snapshot.IncomingRinging = !established && incomingVoice && (primary.Stat == 4 || primary.Stat == 5)
+		snapshot.Waiting = established && waiting
+		snapshot.setCallLegs(legs)
+	})
+}
+
+// refreshCallList replaces the tracked legs with the modem's +CLCC list.
+// It issues AT commands, so it must not run on the read loop goroutine.
+func (w *ModemWorker) refreshCallList(source string) {
+	resp, err := w.ExecuteAT("AT+CLCC", 5*time.Second)
+	if err != nil {
+		logger.Log.Warnf("[%s] Failed to refresh call list: %v", w.PortName, err)
+		return
+	}
+	w.applyCallLegs(parseCLCCList(resp), source)
+}
+
+func parseCLCCList(resp string) []callLeg {
+	legs := []callLeg{}
+	for _, line := range strings.Split(resp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToUpper(line), "+CLCC:") {
+			continue
+		}
+		info, ok := parseCLCCState(line)
+		if !ok || info.Index <= 0 || callLegReleased(info.Stat) {
+			continue
+		}
+		legs = append(legs, callLegFromCLCC(info))
+	}
+	return legs
+}
+
+// isCCWAURC tells a waiting-call notification (+CCWA: "<number>",...) apart
+// from the +CCWA: <status>,<class> lines of a call waiting query.
+func isCCWAURC(line string) bool {
+	idx := strings.Index(line, ":")
+	return idx >= 0 && strings.HasPrefix(strings.TrimSpace(line[idx+1:]), "\"")
+}
+
+func parseCCWAURC(line string) (string, bool) {
+	if !isCCWAURC(line) {
+		return "", false
+	}
+	params := splitATParams(line[strings.Index(line, ":")+1:])
+	if len(params) < 3 {
+		return "", false
+	}
+	number := params[0]
+	if len(params) >= 5 {
+		if validity, err := strconv.Atoi(params[4]); err == nil && validity != 0 {
+			number = ""
+		}
+	}
+	return number, true
+}
+
+// CallControl runs an AT+CHLD operation on the tracked calls. index is only
+// used by release and split.
+func (w *ModemWorker) CallControl(action string, index int) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpCallControl, remoteCallControlArgs{Action: action, Index: index}, nil, remoteCallTimeout)
+	}
+	if !callingEnabled() {
+		return errors.New("calling disabled in this build")
+	}
+
+	w.callOpMu.Lock()
+	defer w.callOpMu.Unlock()
+
+	current := w.GetCallState()
+	if current.State == callStateIdle {
+		return errCallNotFound
+	}
+
+	cmd := ""
+	switch strings.ToLower(strings.TrimSpace(action)) {
+	case CallControlHoldAccept:
+		return w.holdAndAcceptLocked()
+	case CallControlReleaseHeld:
+		return w.releaseHeldOrWaitingLocked("release_held")
+	case CallControlSwap:
+		if !current.hasCallLegStat(1) {
+			return fmt.Errorf("%w: no held call to swap with", errInvalidCallControl)
+		}
+		cmd = "AT+CHLD=2"
+	case CallControlReleaseAccept:
+		cmd = "AT+CHLD=1"
+	case CallControlRelease:
+		if _, ok := current.findCallLeg(index); !ok {
+			return errCallNotFound
+		}
+		cmd = fmt.Sprintf("AT+CHLD=1%d", index)
+	case CallControlSplit:
+		leg, ok := current.findCallLeg(index)
+		if !ok {
+			return errCallNotFound
+		}
+		if !leg.Multiparty {
+			return fmt.Errorf("%w: call %d is not part of a conference", errInvalidCallControl, index)
+		}
+		cmd = fmt.Sprintf("AT+CHLD=2%d", index)
+	case CallControlConference:
+		if !current.hasCallLegStat(0) || !current.hasCallLegStat(1) {
+			return fmt.Errorf("%w: conference needs an active and a held call", errInvalidCallControl)
+		}
+		cmd = "AT+CHLD=3"
+	default:
+		return fmt.Errorf("%w: unknown action %q", errInvalidCallControl, action)
+	}
+
+	return w.runCallHoldLocked(cmd, "chld_"+strings.ToLower(strings.TrimSpace(action)))
+}
+
+func (w *ModemWorker) holdAndAcceptLocked() error {
+	current := w.GetCallState()
+	if !current.Waiting && !current.hasCallLegStat(5) {
+		return errNoIncomingCall
+	}
+	return w.runCallHoldLocked("AT+CHLD=2", "chld_hold_accept")
+}
+
+func (w *ModemWorker) releaseHeldOrWaitingLocked(source string) error {
+	current := w.GetCallState()
+	if !current.Waiting && !current.hasCallLegStat(1) && !current.hasCallLegStat(5) {
+		return errCallNotFound
+	}
+	return w.runCallHoldLocked("AT+CHLD=0", source)
+}
+
+// releaseWaitingLegLocked releases only the waiting call with AT+CHLD=1<idx>;
+// AT+CHLD=0 would release the held calls as well. The index is read from the
+// modem because a call screened on +CCWA is not tracked yet.
+func (w *ModemWorker) releaseWaitingLegLocked(source string) error {
+	w.SetBusy(true)
+	resp, err := w.ExecuteAT("AT+CLCC", 5*time.Second)
+	w.SetBusy(false)
+	if err != nil {
+		return err
+	}
+	for _, leg := range parseCLCCList(resp) {
+		if leg.Stat == 5 || (leg.Stat == 4 && leg.Direction == 1) {
+			return w.runCallHoldLocked(fmt.Sprintf("AT+CHLD=1%d", leg.Index), source)
+		}
+	}
+	return errCallNotFound
+}
+
+func (w *ModemWorker) runCallHoldLocked(cmd, source string) error {
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if _, err := w.ExecuteAT(cmd, 15*time.Second); err != nil {
+		return err
+	}
+
+	w.refreshCallList(source)
+	if w.GetCallState().State == callStateIdle {
+		_, _ = w.ExecuteATSilent(`AT+QPCMV=0`, 3*time.Second)
+	}
+	return nil
+}
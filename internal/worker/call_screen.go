@@ -0,0 +1,107 @@
+package worker
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+// A screening decision is reused while the same caller keeps ringing so
+// repeated RING/+CLIP URCs neither hit the database nor bump rule counters.
+const callScreenHold = 15 * time.Second
+
+type callScreen struct {
+	number  string
+	blocked bool
+	seenAt  time.Time
+}
+
+// parseCLIP extracts the caller number from a +CLIP URC. Withheld or
+// unavailable numbers (CLI validity 1/2) are reported as empty.
+func parseCLIP(line string) (string, bool) {
+	idx := strings.Index(line, ":")
+	if idx < 0 {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSpace(line[idx+1:]), ",")
+	if len(parts) < 2 {
+		return "", false
+	}
+
+	number := strings.Trim(strings.TrimSpace(parts[0]), "\"")
+	if len(parts) >= 6 {
+		if validity, err := strconv.Atoi(strings.TrimSpace(parts[5])); err == nil && validity != 0 {
+			number = ""
+		}
+	}
+	return number, true
+}
+
+// recentlyBlockedCaller reports whether a RING, which carries no number,
+// belongs to the caller that was just rejected.
+func (w *ModemWorker) recentlyBlockedCaller() bool {
+	w.screenMu.Lock()
+	defer w.screenMu.Unlock()
+	return w.screen.blocked && time.Since(w.screen.seenAt) < callScreenHold
+}
+
+// screenIncomingCall evaluates caller rules for a ringing call and rejects
+// it in the background when blocked. It must run before the ringing state
+// is published, otherwise the SIP gateway would already forward the call.
+func (w *ModemWorker) screenIncomingCall(number string) bool {
+	if w.callerFilter == nil {
+		return false
+	}
+
+	w.screenMu.Lock()
+	if w.screen.number == number && time.Since(w.screen.seenAt) < callScreenHold {
+		w.screen.seenAt = time.Now()
+		blocked := w.screen.blocked
+		w.screenMu.Unlock()
+		return blocked
+	}
+	w.screenMu.Unlock()
+
+	iccid := ""
+	if w.modem != nil {
+		iccid = w.modem.ICCID
+	}
+	decision := w.callerFilter.Evaluate(iccid, number, logic.CallerChannelCall)
+	blocked := decision.Screened()
+
+	w.screenMu.Lock()
+	w.screen = callScreen{number: number, blocked: blocked, seenAt: time.Now()}
+	w.screenMu.Unlock()
+
+	if blocked {
+		logger.Log.Infof("[%s] Rejecting call from %q by caller rule %d (%s)", w.PortName, number, decision.RuleID, decision.Action)
+		// URCs are handled on the read loop, so ATH must not be issued inline.
+		go w.rejectScreenedCall()
+	}
+	return blocked
+}
+
+func (w *ModemWorker) rejectScreenedCall() {
+	w.callOpMu.Lock()
+	defer w.callOpMu.Unlock()
+
+	// A blocked waiting call must not take the established or held calls
+	// down with it.
+	if current := w.GetCallState(); current.State == callStateInCall || current.LegCount > 1 {
+		if err := w.releaseWaitingLegLocked("blocked"); err != nil {
+			logger.Log.Warnf("[%s] Failed to reject blocked waiting call: %v", w.PortName, err)
+		}
+		return
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if _, err := w.ExecuteAT("ATH", 10*time.Second); err != nil {
+		logger.Log.Warnf("[%s] Failed to reject blocked call: %v", w.PortName, err)
+	}
+	w.setCallStateWithMeta(callStateIdle, "blocked", clearCallDetails)
+}
@@ -0,0 +1,56 @@
+package worker
+
+import "github.com/pccr10001/smsie/internal/logic"
+
+// Events is the hub that modem, SMS and call changes are published to.
+func (m *Manager) Events() *logic.EventHub {
+	if m == nil {
+		return nil
+	}
+	return m.events
+}
+
+func (m *Manager) publishEvent(eventType, iccid string, data interface{}) {
+	if m == nil {
+		return
+	}
+	m.events.Publish(eventType, iccid, data)
+}
+
+func (w *ModemWorker) publishEvent(eventType string, data interface{}) {
+	if w.modem == nil {
+		return
+	}
+	w.manager.publishEvent(eventType, w.modem.ICCID, data)
+}
+
+func (w *ModemWorker) publishModemOnline() {
+	w.publishEvent(logic.EventModemOnline, map[string]interface{}{
+		"port_name":       w.PortName,
+		"imei":            w.modem.IMEI,
+		"operator":        w.modem.Operator,
+		"signal_strength": w.modem.SignalStrength,
+		"registration":    w.modem.Registration,
+	})
+}
+
+// setSignal updates the runtime signal strength and publishes changes.
+func (w *ModemWorker) setSignal(signal int) {
+	prev := w.modem.SignalStrength
+	w.modem.SignalStrength = signal
+	if prev != signal {
+		w.publishEvent(logic.EventModemSignal, map[string]interface{}{"signal_strength": signal})
+	}
+}
+
+// publishRegistrationChange publishes the registration and operator if they
+// differ from the given previous values.
+func (w *ModemWorker) publishRegistrationChange(prevRegistration, prevOperator string) {
+	if w.modem.Registration == prevRegistration && w.modem.Operator == prevOperator {
+		return
+	}
+	w.publishEvent(logic.EventModemRegistration, map[string]interface{}{
+		"registration": w.modem.Registration,
+		"operator":     w.modem.Operator,
+	})
+}
@@ -1,10 +1,14 @@
 package worker
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"time"
 
 	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/pkg/logger"
 	"go.bug.st/serial"
 	"gorm.io/gorm"
@@ -12,23 +16,32 @@ import (
 
 type Manager struct {
 	workers                 map[string]*ModemWorker
-	activeICCIDs            map[string]string // iccid -> portName
-	probedPorts             map[string]bool   // portName -> probed once while present
+	remotes                 map[string]*ModemWorker // iccid -> modem attached to an agent
+	activeICCIDs            map[string]string       // iccid -> portName
+	probedPorts             map[string]bool         // portName -> probed once while present
 	callStateListeners      map[int]CallStateListener
 	nextCallStateListenerID int
 	mu                      sync.RWMutex
 	stop                    chan struct{}
 	db                      *gorm.DB
+	smsRules                *logic.SMSRuleEngine
+	webhookAuth             logic.SMSRuleAuthorizer
+	events                  *logic.EventHub
+	poolMu                  sync.Mutex
+	poolLast                map[uint]string // pool ID -> ICCID that sent last
 }
 
 func NewManager(db *gorm.DB) *Manager {
 	return &Manager{
 		workers:            make(map[string]*ModemWorker),
+		remotes:            make(map[string]*ModemWorker),
 		activeICCIDs:       make(map[string]string),
 		probedPorts:        make(map[string]bool),
 		callStateListeners: make(map[int]CallStateListener),
 		stop:               make(chan struct{}),
 		db:                 db,
+		events:             logic.NewEventHub(),
+		poolLast:           make(map[uint]string),
 	}
 }
 
@@ -65,6 +78,9 @@ func (m *Manager) Stop() {
 	for _, w := range m.workers {
 		w.Stop()
 	}
+	for _, w := range m.remotes {
+		w.Stop()
+	}
 }
 
 func (m *Manager) ScanAndManage() {
@@ -147,6 +163,11 @@ func (m *Manager) RemoveWorkerByICCID(iccid string) bool {
 		m.unregisterWorkerLocked(port, w)
 		return true
 	}
+	if w := m.remotes[iccid]; w != nil {
+		w.Stop()
+		delete(m.remotes, iccid)
+		return true
+	}
 
 	delete(m.activeICCIDs, iccid)
 	return false
@@ -173,9 +194,85 @@ func (m *Manager) GetWorkerByICCID(iccid string) *ModemWorker {
 			return w
 		}
 	}
+	if w := m.remotes[iccid]; w != nil && !w.IsStopped() {
+		return w
+	}
 	return nil
 }
 
+// SetSMSRuleEngine installs the rules applied to every received SMS. Call it
+// before Start.
+func (m *Manager) SetSMSRuleEngine(engine *logic.SMSRuleEngine) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.smsRules = engine
+}
+
+// SetWebhookAuthorizer re-checks webhook owners on dispatch. Call it before
+// Start.
+func (m *Manager) SetWebhookAuthorizer(auth logic.SMSRuleAuthorizer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhookAuth = auth
+}
+
+// webhookAuthorizer is read without the lock: it is set before Start, and
+// NewModemWorker calls it while ScanAndManage holds m.mu.
+func (m *Manager) webhookAuthorizer() logic.SMSRuleAuthorizer {
+	if m == nil {
+		return nil
+	}
+	return m.webhookAuth
+}
+
+func (m *Manager) smsRuleEngine() *logic.SMSRuleEngine {
+	if m == nil {
+		return nil
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.smsRules
+}
+
+// SendSMSFrom sends through the modem with the given ICCID, waiting for a
+// modem that is busy running a manual command.
+func (m *Manager) SendSMSFrom(iccid, phone, message string) error {
+	_, err := m.sendSMSFrom(iccid, phone, message, "")
+	return err
+}
+
+func (m *Manager) sendSMSFrom(iccid, phone, message, pool string) (*model.SMS, error) {
+	w := m.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, fmt.Errorf("modem %s is offline", iccid)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for w.IsBusy() {
+		if time.Now().After(deadline) {
+			return nil, errors.New("modem is busy")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return w.sendAndStoreSMS(phone, message, pool)
+}
+
+// SendUSSDFrom runs a USSD request on the modem with the given ICCID, waiting
+// for a busy modem like SendSMSFrom.
+func (m *Manager) SendUSSDFrom(iccid, code string) (*USSDResult, error) {
+	w := m.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, fmt.Errorf("modem %s is offline", iccid)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for w.IsBusy() {
+		if time.Now().After(deadline) {
+			return nil, errors.New("modem is busy")
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return w.SendUSSD(code, ussdDefaultTimeout)
+}
+
 func (m *Manager) RegisterICCID(port, iccid string) bool {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -0,0 +1,190 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+var (
+	ErrPoolNotFound = errors.New("modem pool not found")
+	ErrNoPoolModem  = errors.New("no modem in the pool can send to this number")
+)
+
+type poolCandidate struct {
+	member   model.ModemPoolMember
+	match    int  // length of the matching destination prefix
+	onNet    bool // on the operator serving the destination
+	busy     bool
+	lastSent time.Time
+}
+
+// SendSMSPool sends through a modem of the named pool and stores the SMS
+// with the modem that sent it. Modems are skipped when allowed rejects them,
+// when they are offline, unregistered, below the pool's signal minimum, do
+// not serve the destination or have reached their daily limit. The rest are
+// tried in routing order until one succeeds.
+func (m *Manager) SendSMSPool(name, phone, message string, allowed func(iccid string) bool) (*model.SMS, error) {
+	return m.SendSMSPoolReserving(name, phone, message, allowed, nil)
+}
+
+// SendSMSPoolReserving is SendSMSPool with a reserve hook that runs right
+// before each modem is tried. An error skips the modem, and the release func
+// it returns is called when sending through the modem fails.
+func (m *Manager) SendSMSPoolReserving(name, phone, message string, allowed func(iccid string) bool, reserve func(iccid string) (func(), error)) (*model.SMS, error) {
+	repo := repository.NewModemPoolRepository(m.db)
+	pool, err := repo.FindByName(name)
+	if err != nil || !pool.Enabled {
+		return nil, ErrPoolNotFound
+	}
+
+	candidates, err := m.poolCandidates(repo, pool, phone, allowed)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoPoolModem
+	}
+
+	var lastErr error
+	for _, cand := range candidates {
+		iccid := cand.member.ICCID
+		release := func() {}
+		if reserve != nil {
+			var err error
+			if release, err = reserve(iccid); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		sms, err := m.sendSMSFrom(iccid, phone, message, pool.Name)
+		if err != nil {
+			release()
+			logger.Log.Warnf("Pool %s: sending to %s via %s failed, trying the next modem: %v", pool.Name, phone, iccid, err)
+			lastErr = err
+			continue
+		}
+		m.poolMu.Lock()
+		m.poolLast[pool.ID] = iccid
+		m.poolMu.Unlock()
+		return sms, nil
+	}
+	return nil, fmt.Errorf("all %d modems of pool %s failed: %w", len(candidates), pool.Name, lastErr)
+}
+
+func (m *Manager) poolCandidates(repo *repository.ModemPoolRepository, pool *model.ModemPool, phone string, allowed func(string) bool) ([]poolCandidate, error) {
+	operator := strings.ToLower(logic.PoolOnNetOperator(pool.OnNet, phone))
+
+	var candidates []poolCandidate
+	var iccids, limited []string
+	for _, member := range pool.Members {
+		if allowed != nil && !allowed(member.ICCID) {
+			continue
+		}
+		w := m.GetWorkerByICCID(member.ICCID)
+		if w == nil {
+			continue
+		}
+		state, ok := w.RuntimeModemState()
+		if !ok || state.Status != "online" || !poolRegistrationHealthy(state.Registration) {
+			continue
+		}
+		if pool.MinSignal > 0 && state.SignalStrength < pool.MinSignal {
+			continue
+		}
+		match := logic.PoolDestinationMatch(member.Destinations, phone)
+		if match < 0 {
+			continue
+		}
+		candidates = append(candidates, poolCandidate{
+			member: member,
+			match:  match,
+			onNet:  operator != "" && strings.Contains(strings.ToLower(state.Operator), operator),
+			busy:   w.IsBusy(),
+		})
+		iccids = append(iccids, member.ICCID)
+		if member.DailyLimit > 0 {
+			limited = append(limited, member.ICCID)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	if len(limited) > 0 {
+		now := time.Now()
+		sent, err := repo.SentSince(limited, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+		if err != nil {
+			return nil, err
+		}
+		kept := candidates[:0]
+		for _, cand := range candidates {
+			if cand.member.DailyLimit == 0 || sent[cand.member.ICCID] < cand.member.DailyLimit {
+				kept = append(kept, cand)
+			}
+		}
+		candidates = kept
+	}
+
+	switch pool.Strategy {
+	case logic.PoolStrategyLeastRecent:
+		last, err := repo.LastSent(iccids)
+		if err != nil {
+			return nil, err
+		}
+		for i := range candidates {
+			candidates[i].lastSent = last[candidates[i].member.ICCID]
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].lastSent.Before(candidates[j].lastSent)
+		})
+	case logic.PoolStrategyRoundRobin:
+		// Continue after the member that sent last, in member order.
+		m.poolMu.Lock()
+		last := m.poolLast[pool.ID]
+		m.poolMu.Unlock()
+		position := make(map[string]int, len(pool.Members))
+		lastPos := -1
+		for i, member := range pool.Members {
+			position[member.ICCID] = i
+			if member.ICCID == last {
+				lastPos = i
+			}
+		}
+		n := len(pool.Members)
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return (position[candidates[i].member.ICCID]-lastPos-1+n)%n < (position[candidates[j].member.ICCID]-lastPos-1+n)%n
+		})
+	}
+
+	// The most specific destination wins, then on-net modems; idle modems
+	// go before busy ones so a failover does not wait for a busy modem.
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.match != b.match {
+			return a.match > b.match
+		}
+		if a.onNet != b.onNet {
+			return a.onNet
+		}
+		return !a.busy && b.busy
+	})
+	return candidates, nil
+}
+
+// poolRegistrationHealthy accepts home and roaming modems, and modems whose
+// registration has not been read yet.
+func poolRegistrationHealthy(registration string) bool {
+	switch registration {
+	case "", "Home Network", "Roaming":
+		return true
+	}
+	return false
+}
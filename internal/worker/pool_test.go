@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
+)
+
+func newPoolTestManager(t *testing.T, pool *model.ModemPool) *Manager {
+	t.Helper()
+	m := newRemoteTestManager(t)
+	if err := m.db.AutoMigrate(&model.ModemPool{}, &model.ModemPoolMember{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.NewModemPoolRepository(m.db).Save(pool); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSendSMSPoolRoutesAndFailsOver(t *testing.T) {
+	m := newPoolTestManager(t, &model.ModemPool{
+		Name:     "main",
+		Strategy: "priority",
+		Enabled:  true,
+		Members: []model.ModemPoolMember{
+			{ICCID: "any", Priority: 1},
+			{ICCID: "tw", Priority: 2, Destinations: "+886"},
+			{ICCID: "us", Priority: 0, Destinations: "+1"},
+			{ICCID: "denied", Priority: 0},
+			{ICCID: "offline", Priority: 0},
+		},
+	})
+	links := map[string]*fakeLink{}
+	for _, iccid := range []string{"any", "tw", "us", "denied"} {
+		links[iccid] = &fakeLink{}
+		reg := "Home Network"
+		if iccid == "denied" {
+			reg = "Denied"
+		}
+		m.AttachRemote(links[iccid], RemoteModemState{ICCID: iccid, PortName: iccid, Registration: reg})
+	}
+	links["tw"].errs = map[string]error{RemoteOpSendSMS: errors.New("CMS ERROR 500")}
+
+	sms, err := m.SendSMSPool("MAIN", "+886912345678", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links["tw"].calls) != 1 || len(links["any"].calls) != 1 || len(links["us"].calls)+len(links["denied"].calls) != 0 {
+		t.Fatalf("unexpected routing: tw=%v any=%v us=%v denied=%v", links["tw"].calls, links["any"].calls, links["us"].calls, links["denied"].calls)
+	}
+	var stored model.SMS
+	if err := m.db.First(&stored, sms.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if stored.ICCID != "any" || stored.Pool != "main" || stored.Type != "sent" {
+		t.Fatalf("unexpected stored SMS %+v", stored)
+	}
+
+	if _, err := m.SendSMSPool("main", "+886912345678", "hi", func(iccid string) bool { return iccid == "us" }); !errors.Is(err, ErrNoPoolModem) {
+		t.Fatalf("expected ErrNoPoolModem, got %v", err)
+	}
+	if _, err := m.SendSMSPool("other", "+886912345678", "hi", nil); !errors.Is(err, ErrPoolNotFound) {
+		t.Fatalf("expected ErrPoolNotFound, got %v", err)
+	}
+}
+
+func TestSendSMSPoolRotatesWithinLimits(t *testing.T) {
+	m := newPoolTestManager(t, &model.ModemPool{
+		Name:     "rr",
+		Strategy: "round_robin",
+		OnNet:    "+88693=Taiwan Mobile",
+		Enabled:  true,
+		Members: []model.ModemPoolMember{
+			{ICCID: "a", DailyLimit: 1},
+			{ICCID: "b"},
+			{ICCID: "c"},
+		},
+	})
+	m.AttachRemote(&fakeLink{}, RemoteModemState{ICCID: "a", PortName: "a", Operator: "Chunghwa Telecom"})
+	m.AttachRemote(&fakeLink{}, RemoteModemState{ICCID: "b", PortName: "b", Operator: "Chunghwa Telecom"})
+	m.AttachRemote(&fakeLink{}, RemoteModemState{ICCID: "c", PortName: "c", Operator: "Taiwan Mobile"})
+
+	var used []string
+	for i := 0; i < 3; i++ {
+		sms, err := m.SendSMSPool("rr", "+886912345678", "hi", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		used = append(used, sms.ICCID)
+	}
+	if used[0] != "a" || used[1] != "b" || used[2] != "c" {
+		t.Fatalf("unexpected rotation %v", used)
+	}
+	for i := 0; i < 2; i++ {
+		sms, err := m.SendSMSPool("rr", "+886912345678", "hi", nil)
+		if err != nil || sms.ICCID == "a" {
+			t.Fatalf("expected a to be over its daily limit, got %+v %v", sms, err)
+		}
+	}
+
+	sms, err := m.SendSMSPool("rr", "+886933123456", "hi", nil)
+	if err != nil || sms.ICCID != "c" {
+		t.Fatalf("expected on-net modem c, got %+v %v", sms, err)
+	}
+}
+
+func TestSendSMSPoolReservingReleasesFailedModems(t *testing.T) {
+	m := newPoolTestManager(t, &model.ModemPool{
+		Name:     "main",
+		Strategy: "priority",
+		Enabled:  true,
+		Members: []model.ModemPoolMember{
+			{ICCID: "full", Priority: 3},
+			{ICCID: "broken", Priority: 2},
+			{ICCID: "ok", Priority: 1},
+		},
+	})
+	links := map[string]*fakeLink{}
+	for _, iccid := range []string{"full", "broken", "ok"} {
+		links[iccid] = &fakeLink{}
+		m.AttachRemote(links[iccid], RemoteModemState{ICCID: iccid, PortName: iccid})
+	}
+	links["broken"].errs = map[string]error{RemoteOpSendSMS: errors.New("CMS ERROR 500")}
+
+	reserved := map[string]int{}
+	sms, err := m.SendSMSPoolReserving("main", "+886912345678", "hi", nil, func(iccid string) (func(), error) {
+		if iccid == "full" {
+			return nil, errors.New("quota exceeded")
+		}
+		reserved[iccid]++
+		return func() { reserved[iccid]-- }, nil
+	})
+	if err != nil || sms.ICCID != "ok" {
+		t.Fatalf("expected ok to send, got %+v %v", sms, err)
+	}
+	if len(links["full"].calls) != 0 || reserved["broken"] != 0 || reserved["ok"] != 1 {
+		t.Fatalf("unexpected reservations %v, full calls %v", reserved, links["full"].calls)
+	}
+}
+
+func TestSendSMSPoolCountsDirectSends(t *testing.T) {
+	m := newPoolTestManager(t, &model.ModemPool{
+		Name:     "main",
+		Strategy: "priority",
+		Enabled:  true,
+		Members: []model.ModemPoolMember{
+			{ICCID: "a", Priority: 1, DailyLimit: 1},
+			{ICCID: "b"},
+		},
+	})
+	m.AttachRemote(&fakeLink{}, RemoteModemState{ICCID: "a", PortName: "a"})
+	m.AttachRemote(&fakeLink{}, RemoteModemState{ICCID: "b", PortName: "b"})
+
+	// An SMS sent from modem a outside the pool uses up its daily limit.
+	if err := m.SendSMSFrom("a", "+886912345678", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	sms, err := m.SendSMSPool("main", "+886912345678", "hi", nil)
+	if err != nil || sms.ICCID != "b" {
+		t.Fatalf("expected a to be over its daily limit, got %+v %v", sms, err)
+	}
+}
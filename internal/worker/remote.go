@@ -0,0 +1,402 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+// A remote modem is attached to an agent (smsie agent) on another host. The
+// server keeps a ModemWorker for it whose operations are carried out by the
+// agent's own worker over a RemoteLink, and whose state follows the agent's
+// reports.
+
+const (
+	RemoteOpAT                 = "at"
+	RemoteOpSendSMS            = "send_sms"
+	RemoteOpUSSD               = "ussd"
+	RemoteOpDial               = "dial"
+	RemoteOpAnswer             = "answer"
+	RemoteOpReject             = "reject"
+	RemoteOpHangup             = "hangup"
+	RemoteOpCallControl        = "call_control"
+	RemoteOpScanNetworks       = "scan_networks"
+	RemoteOpSetOperator        = "set_operator"
+	RemoteOpReboot             = "reboot"
+	RemoteOpSupplementary      = "supplementary"
+	RemoteOpQuerySupplementary = "query_supplementary"
+	RemoteOpSetCallForwarding  = "set_call_forwarding"
+	RemoteOpSetCallWaiting     = "set_call_waiting"
+	RemoteOpSetCLIR            = "set_clir"
+
+	remoteCallTimeout = 30 * time.Second
+	remoteLongTimeout = 3 * time.Minute
+)
+
+// RemoteLink carries an operation to the agent that owns a modem and decodes
+// the reply into reply, which may be nil.
+type RemoteLink interface {
+	Name() string
+	Call(iccid, op string, args, reply interface{}, timeout time.Duration) error
+}
+
+// RemoteModemState is what an agent reports about one of its modems.
+type RemoteModemState struct {
+	ICCID          string    `json:"iccid"`
+	IMEI           string    `json:"imei"`
+	PortName       string    `json:"port_name"`
+	Operator       string    `json:"operator"`
+	SignalStrength int       `json:"signal_strength"`
+	Registration   string    `json:"registration"`
+	Call           CallState `json:"call"`
+}
+
+type remoteATArgs struct {
+	Cmd       string `json:"cmd"`
+	TimeoutMS int64  `json:"timeout_ms"`
+	Silent    bool   `json:"silent,omitempty"`
+}
+
+type remoteSMSArgs struct {
+	Phone   string `json:"phone"`
+	Message string `json:"message"`
+}
+
+type remoteDialArgs struct {
+	Number string `json:"number"`
+	CLIR   string `json:"clir,omitempty"`
+}
+
+type remoteCallControlArgs struct {
+	Action string `json:"action"`
+	Index  int    `json:"index"`
+}
+
+type remoteForwardingArgs struct {
+	Reason      string `json:"reason"`
+	Enable      bool   `json:"enable"`
+	Number      string `json:"number"`
+	NoReplyTime int    `json:"no_reply_time"`
+}
+
+type remoteValueArgs struct {
+	Value  string `json:"value,omitempty"`
+	Enable bool   `json:"enable,omitempty"`
+}
+
+type remoteSupplementaryReply struct {
+	Services SupplementaryServices `json:"services"`
+	OK       bool                  `json:"ok"`
+}
+
+// Worker errors that callers test with errors.Is keep their identity across
+// the link by name.
+var remoteErrors = map[string]error{
+	"invalid_dial_number":   errInvalidDialNumber,
+	"call_in_progress":      errCallInProgress,
+	"no_incoming_call":      errNoIncomingCall,
+	"invalid_call_control":  errInvalidCallControl,
+	"call_not_found":        errCallNotFound,
+	"invalid_supplementary": errInvalidSupplementaryRequest,
+}
+
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.err }
+
+// RemoteErrorCode names the worker error err wraps, or returns "".
+func RemoteErrorCode(err error) string {
+	for code, sentinel := range remoteErrors {
+		if errors.Is(err, sentinel) {
+			return code
+		}
+	}
+	return ""
+}
+
+// RemoteError rebuilds an error reported by an agent.
+func RemoteError(code, message string) error {
+	if sentinel, ok := remoteErrors[code]; ok {
+		return &remoteError{msg: message, err: sentinel}
+	}
+	return errors.New(message)
+}
+
+// IsRemote reports whether the modem is attached to an agent.
+func (w *ModemWorker) IsRemote() bool {
+	return w != nil && w.remote != nil
+}
+
+func (w *ModemWorker) remoteCall(op string, args, reply interface{}, timeout time.Duration) error {
+	if w.IsStopped() {
+		return fmt.Errorf("modem %s is offline", w.modem.ICCID)
+	}
+	return w.remote.Call(w.modem.ICCID, op, args, reply, timeout)
+}
+
+func (w *ModemWorker) remoteAT(cmd string, timeout time.Duration, silent bool) (string, error) {
+	var resp string
+	err := w.remoteCall(RemoteOpAT, remoteATArgs{Cmd: cmd, TimeoutMS: timeout.Milliseconds(), Silent: silent}, &resp, timeout+remoteCallTimeout)
+	return resp, err
+}
+
+func (w *ModemWorker) remoteCallState() CallState {
+	w.callMu.RLock()
+	defer w.callMu.RUnlock()
+	return w.remoteCallSt
+}
+
+func (w *ModemWorker) remoteSupplementary() (SupplementaryServices, bool) {
+	var reply remoteSupplementaryReply
+	if err := w.remoteCall(RemoteOpSupplementary, nil, &reply, remoteCallTimeout); err != nil {
+		return SupplementaryServices{}, false
+	}
+	return reply.Services, reply.OK
+}
+
+// AttachRemote adds or updates a modem reported by the agent behind link.
+func (m *Manager) AttachRemote(link RemoteLink, state RemoteModemState) {
+	if state.ICCID == "" {
+		return
+	}
+	m.mu.Lock()
+	w := m.remotes[state.ICCID]
+	attach := w == nil || w.remote != link || w.IsStopped()
+	if attach {
+		if w != nil {
+			w.Stop()
+		}
+		w = NewModemWorker(link.Name()+":"+state.PortName, m.db, m)
+		w.remote = link
+		w.modem = &model.Modem{ICCID: state.ICCID, Status: "online"}
+		m.remotes[state.ICCID] = w
+	}
+	m.mu.Unlock()
+
+	prevRegistration, prevOperator := w.modem.Registration, w.modem.Operator
+	w.modem.IMEI = state.IMEI
+	w.modem.PortName = w.PortName
+	w.modem.Operator = state.Operator
+	w.modem.Registration = state.Registration
+	w.modem.LastSeen = time.Now()
+
+	if attach {
+		w.modem.SignalStrength = state.SignalStrength
+		if err := w.repo.Upsert(&model.Modem{ICCID: state.ICCID, IMEI: state.IMEI, PortName: w.PortName}); err != nil {
+			logger.Log.Errorf("Failed to save remote modem %s: %v", state.ICCID, err)
+		}
+		logger.Log.Infof("Remote modem attached: %s (%s)", state.ICCID, w.PortName)
+		w.publishModemOnline()
+	} else {
+		w.setSignal(state.SignalStrength)
+		w.publishRegistrationChange(prevRegistration, prevOperator)
+	}
+
+	w.callMu.Lock()
+	prevCall := w.remoteCallSt
+	w.remoteCallSt = state.Call
+	w.callMu.Unlock()
+	if !prevCall.UpdatedAt.Equal(state.Call.UpdatedAt) && !state.Call.UpdatedAt.IsZero() {
+		m.notifyCallStateChanged(w, state.Call)
+	}
+}
+
+// DetachRemote stops the remote modem iccid of link, or all of its modems
+// when iccid is empty.
+func (m *Manager) DetachRemote(link RemoteLink, iccid string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, w := range m.remotes {
+		if w.remote != link || (iccid != "" && id != iccid) {
+			continue
+		}
+		w.Stop()
+		delete(m.remotes, id)
+		logger.Log.Infof("Remote modem detached: %s (%s)", id, w.PortName)
+	}
+}
+
+// ReceiveRemoteSMS runs an SMS received by an agent modem through the same
+// filters, rules and webhooks as a local one. Resent messages that are
+// already stored are ignored.
+func (m *Manager) ReceiveRemoteSMS(link RemoteLink, sms model.SMS) error {
+	var count int64
+	if err := m.db.Model(&model.SMS{}).
+		Where("iccid = ? AND phone = ? AND type = ? AND content = ? AND timestamp = ?", sms.ICCID, sms.Phone, "received", sms.Content, sms.Timestamp).
+		Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	m.mu.RLock()
+	w := m.remotes[sms.ICCID]
+	m.mu.RUnlock()
+	if w == nil || w.remote != link {
+		// The modem is gone but its buffered SMS still arrive.
+		w = NewModemWorker(link.Name(), m.db, m)
+		w.remote = link
+		w.modem = &model.Modem{ICCID: sms.ICCID}
+	}
+
+	sms.ID = 0
+	sms.Type = "received"
+	sms.IsRead = false
+	sms.IsSpam = false
+	sms.Tags = ""
+	sms.CreatedAt = time.Now()
+	w.receiveSMS(&sms)
+	return nil
+}
+
+// RemoteModemStates reports every active local modem, for an agent.
+func (m *Manager) RemoteModemStates() []RemoteModemState {
+	m.mu.RLock()
+	workers := make([]*ModemWorker, 0, len(m.workers))
+	for _, w := range m.workers {
+		workers = append(workers, w)
+	}
+	m.mu.RUnlock()
+
+	var states []RemoteModemState
+	for _, w := range workers {
+		if state, ok := w.remoteModemState(); ok {
+			states = append(states, state)
+		}
+	}
+	return states
+}
+
+// RemoteModemState reports one local modem, for an agent.
+func (m *Manager) RemoteModemState(iccid string) (RemoteModemState, bool) {
+	return m.GetWorkerByICCID(iccid).remoteModemState()
+}
+
+func (w *ModemWorker) remoteModemState() (RemoteModemState, bool) {
+	rt, ok := w.RuntimeModemState()
+	if !ok || rt.Status != "online" {
+		return RemoteModemState{}, false
+	}
+	return RemoteModemState{
+		ICCID:          rt.ICCID,
+		IMEI:           rt.IMEI,
+		PortName:       rt.PortName,
+		Operator:       rt.Operator,
+		SignalStrength: rt.SignalStrength,
+		Registration:   rt.Registration,
+		Call:           w.CallState(),
+	}, true
+}
+
+// HandleRemoteCall runs an operation sent by the server on a local modem, for
+// an agent.
+func (m *Manager) HandleRemoteCall(iccid, op string, args json.RawMessage) (interface{}, error) {
+	w := m.GetWorkerByICCID(iccid)
+	if w == nil {
+		return nil, fmt.Errorf("modem %s is offline", iccid)
+	}
+	decode := func(v interface{}) error {
+		if len(args) == 0 {
+			return nil
+		}
+		return json.Unmarshal(args, v)
+	}
+
+	switch op {
+	case RemoteOpAT:
+		var a remoteATArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		timeout := time.Duration(a.TimeoutMS) * time.Millisecond
+		if a.Silent {
+			return w.ExecuteATSilent(a.Cmd, timeout)
+		}
+		return w.ExecuteAT(a.Cmd, timeout)
+	case RemoteOpSendSMS:
+		var a remoteSMSArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, m.SendSMSFrom(iccid, a.Phone, a.Message)
+	case RemoteOpUSSD:
+		var a remoteValueArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return m.SendUSSDFrom(iccid, a.Value)
+	case RemoteOpDial:
+		var a remoteDialArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.Dial(a.Number, a.CLIR)
+	case RemoteOpAnswer:
+		return nil, w.Answer()
+	case RemoteOpReject:
+		return nil, w.Reject()
+	case RemoteOpHangup:
+		return nil, w.Hangup()
+	case RemoteOpCallControl:
+		var a remoteCallControlArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.CallControl(a.Action, a.Index)
+	case RemoteOpScanNetworks:
+		return w.ScanNetworks()
+	case RemoteOpSetOperator:
+		var a remoteValueArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.SetOperator(a.Value)
+	case RemoteOpReboot:
+		return nil, w.Reboot()
+	case RemoteOpSupplementary:
+		ss, ok := w.SupplementaryServices()
+		return remoteSupplementaryReply{Services: ss, OK: ok}, nil
+	case RemoteOpQuerySupplementary:
+		return w.QuerySupplementaryServices()
+	case RemoteOpSetCallForwarding:
+		var a remoteForwardingArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.SetCallForwarding(a.Reason, a.Enable, a.Number, a.NoReplyTime)
+	case RemoteOpSetCallWaiting:
+		var a remoteValueArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.SetCallWaiting(a.Enable)
+	case RemoteOpSetCLIR:
+		var a remoteValueArgs
+		if err := decode(&a); err != nil {
+			return nil, err
+		}
+		return nil, w.SetCLIR(a.Value)
+	}
+	return nil, fmt.Errorf("unknown remote operation %q", strings.TrimSpace(op))
+}
+
+// IsRemoteStateEvent reports whether an agent should send a fresh modem state
+// for the event.
+func IsRemoteStateEvent(eventType string) bool {
+	switch eventType {
+	case logic.EventModemOnline, logic.EventModemSignal, logic.EventModemRegistration, logic.EventCallState:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"gorm.io/gorm"
+)
+
+type fakeLink struct {
+	calls   []string
+	args    []string
+	replies map[string]interface{}
+	errs    map[string]error
+}
+
+func (l *fakeLink) Name() string { return "office" }
+
+func (l *fakeLink) Call(iccid, op string, args, reply interface{}, timeout time.Duration) error {
+	b, _ := json.Marshal(args)
+	l.calls = append(l.calls, op)
+	l.args = append(l.args, string(b))
+	if err := l.errs[op]; err != nil {
+		return err
+	}
+	if r, ok := l.replies[op]; ok && reply != nil {
+		b, _ := json.Marshal(r)
+		return json.Unmarshal(b, reply)
+	}
+	return nil
+}
+
+func newRemoteTestManager(t *testing.T) *Manager {
+	t.Helper()
+	initTestLogger()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.Modem{}, &model.SMS{}, &model.Webhook{}, &model.WebhookDelivery{}, &model.CallerRule{}); err != nil {
+		t.Fatal(err)
+	}
+	return NewManager(db)
+}
+
+func TestRemoteModemDelegatesToLink(t *testing.T) {
+	m := newRemoteTestManager(t)
+	link := &fakeLink{
+		replies: map[string]interface{}{RemoteOpAT: "+CSQ: 20,99\r\nOK"},
+		errs:    map[string]error{RemoteOpDial: RemoteError("invalid_dial_number", "invalid dial number")},
+	}
+	m.AttachRemote(link, RemoteModemState{ICCID: "8988", PortName: "/dev/ttyUSB2", Operator: "Test", SignalStrength: 60})
+
+	w := m.GetWorkerByICCID("8988")
+	if w == nil || !w.IsRemote() {
+		t.Fatal("expected a remote worker")
+	}
+	rt, ok := w.RuntimeModemState()
+	if !ok || rt.PortName != "office:/dev/ttyUSB2" || rt.Status != "online" || rt.SignalStrength != 60 {
+		t.Fatalf("unexpected runtime state %+v", rt)
+	}
+
+	if err := m.SendSMSFrom("8988", "+886912345678", "hi"); err != nil {
+		t.Fatal(err)
+	}
+	if link.calls[0] != RemoteOpSendSMS || link.args[0] != `{"phone":"+886912345678","message":"hi"}` {
+		t.Fatalf("unexpected call %s %s", link.calls[0], link.args[0])
+	}
+	resp, err := w.ExecuteAT("AT+CSQ", time.Second)
+	if err != nil || resp != "+CSQ: 20,99\r\nOK" {
+		t.Fatalf("ExecuteAT = %q, %v", resp, err)
+	}
+	if err := w.Dial("x", ""); !IsInvalidDialNumberError(err) {
+		t.Fatalf("expected invalid dial number error, got %v", err)
+	}
+
+	m.DetachRemote(link, "")
+	if m.GetWorkerByICCID("8988") != nil {
+		t.Fatal("expected modem to be detached")
+	}
+}
+
+func TestRemoteStateAndSMS(t *testing.T) {
+	m := newRemoteTestManager(t)
+	link := &fakeLink{}
+	var calls []CallState
+	m.AddCallStateListener(func(w *ModemWorker, state CallState) {
+		calls = append(calls, state)
+	})
+	m.AttachRemote(link, RemoteModemState{ICCID: "8988", PortName: "COM3"})
+
+	_, events, cancel := m.Events().Subscribe(0)
+	defer cancel()
+	now := time.Now()
+	m.AttachRemote(link, RemoteModemState{ICCID: "8988", PortName: "COM3", SignalStrength: 40, Call: CallState{State: "in_call", UpdatedAt: now}})
+	if len(calls) != 1 || calls[0].State != "in_call" || m.GetWorkerByICCID("8988").CallState().State != "in_call" {
+		t.Fatalf("call state not applied: %+v", calls)
+	}
+	if e := <-events; e.Type != logic.EventModemSignal {
+		t.Fatalf("expected signal event, got %s", e.Type)
+	}
+
+	sms := model.SMS{ID: 7, ICCID: "8988", Phone: "+886912345678", Content: "code 123456", Timestamp: now.Truncate(time.Second), Type: "received"}
+	for i := 0; i < 2; i++ {
+		if err := m.ReceiveRemoteSMS(link, sms); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var stored []model.SMS
+	m.db.Find(&stored)
+	if len(stored) != 1 || stored[0].OTP != "123456" {
+		t.Fatalf("expected one stored SMS with OTP, got %+v", stored)
+	}
+	for e := range events {
+		if e.Type == logic.EventSMSReceived {
+			break
+		}
+		if e.Type != logic.EventCallState {
+			t.Fatalf("unexpected event %s", e.Type)
+		}
+	}
+
+	if err := m.ReceiveRemoteSMS(&fakeLink{}, model.SMS{ICCID: "other", Phone: "+1", Content: "x", Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	if errors.Is(m.db.First(&model.SMS{}, "iccid = ?", "other").Error, gorm.ErrRecordNotFound) {
+		t.Fatal("expected SMS of a detached modem to be stored")
+	}
+}
@@ -0,0 +1,504 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+const (
+	CallForwardUnconditional  = "unconditional"
+	CallForwardBusy           = "busy"
+	CallForwardNoReply        = "no_reply"
+	CallForwardNotReachable   = "not_reachable"
+	CallForwardAll            = "all"
+	CallForwardAllConditional = "all_conditional"
+)
+
+const (
+	supplementaryQueryTimeout   = 20 * time.Second
+	supplementaryVoiceClass     = 1
+	supplementaryDefaultNoReply = 20
+	// supplementaryCacheTTL is how old the configuration in the modem detail
+	// may get before it is queried again in the background.
+	supplementaryCacheTTL = time.Hour
+)
+
+const (
+	CLIRDefault = "default"
+	CLIRHide    = "hide"
+	CLIRShow    = "show"
+)
+
+// 27.007 <reason> values. all/all_conditional can only be set, not queried.
+var callForwardReasonCodes = map[string]int{
+	CallForwardUnconditional:  0,
+	CallForwardBusy:           1,
+	CallForwardNoReply:        2,
+	CallForwardNotReachable:   3,
+	CallForwardAll:            4,
+	CallForwardAllConditional: 5,
+}
+
+var callForwardQueryOrder = []string{
+	CallForwardUnconditional,
+	CallForwardBusy,
+	CallForwardNoReply,
+	CallForwardNotReachable,
+}
+
+var clirModeCodes = map[string]int{
+	CLIRDefault: 0,
+	CLIRHide:    1,
+	CLIRShow:    2,
+}
+
+var clirProvisionNames = map[int]string{
+	0: "not_provisioned",
+	1: "permanent",
+	2: "unknown",
+	3: "temporary_restricted",
+	4: "temporary_allowed",
+}
+
+var errInvalidSupplementaryRequest = errors.New("invalid supplementary service request")
+
+type CallForwardEntry struct {
+	Reason      string `json:"reason"`
+	Active      bool   `json:"active"`
+	Class       int    `json:"class"`
+	Number      string `json:"number,omitempty"`
+	NumberType  int    `json:"number_type,omitempty"`
+	NoReplyTime int    `json:"no_reply_time,omitempty"`
+}
+
+type CallWaitingEntry struct {
+	Active bool `json:"active"`
+	Class  int  `json:"class"`
+}
+
+type CLIRStatus struct {
+	Mode      string `json:"mode"`
+	Provision string `json:"provision"`
+}
+
+type SupplementaryServices struct {
+	Forwarding         []CallForwardEntry `json:"forwarding"`
+	CallWaiting        []CallWaitingEntry `json:"call_waiting"`
+	CallWaitingEnabled bool               `json:"call_waiting_enabled"`
+	CLIR               *CLIRStatus        `json:"clir,omitempty"`
+	Errors             map[string]string  `json:"errors,omitempty"`
+	UpdatedAt          time.Time          `json:"updated_at"`
+}
+
+func IsInvalidSupplementaryRequestError(err error) bool {
+	return errors.Is(err, errInvalidSupplementaryRequest)
+}
+
+// NormalizeCLIR maps API values to CLIR modes. Empty means "no override".
+func NormalizeCLIR(v string) (string, bool) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "" {
+		return "", true
+	}
+	_, ok := clirModeCodes[v]
+	return v, ok
+}
+
+// SupplementaryServices returns the configuration seen by the last query or change.
+func (w *ModemWorker) SupplementaryServices() (SupplementaryServices, bool) {
+	if w.remote != nil {
+		return w.remoteSupplementary()
+	}
+	w.ssMu.RLock()
+	defer w.ssMu.RUnlock()
+	if w.ss == nil {
+		return SupplementaryServices{}, false
+	}
+	return cloneSupplementaryServices(*w.ss), true
+}
+
+// RefreshSupplementaryServices queries the configuration in the background
+// when none is known or it is older than supplementaryCacheTTL, so that the
+// modem detail fills in without an explicit query. It does nothing while the
+// modem is busy or another background query ran within the TTL.
+func (w *ModemWorker) RefreshSupplementaryServices() {
+	if ss, ok := w.SupplementaryServices(); ok && time.Since(ss.UpdatedAt) < supplementaryCacheTTL {
+		return
+	}
+	if w.IsBusy() {
+		return
+	}
+	w.ssMu.Lock()
+	if time.Since(w.ssTried) < supplementaryCacheTTL {
+		w.ssMu.Unlock()
+		return
+	}
+	w.ssTried = time.Now()
+	w.ssMu.Unlock()
+
+	go func() {
+		ss, err := w.QuerySupplementaryServices()
+		if err != nil {
+			logger.Log.Warnf("[%s] Supplementary service query failed: %v", w.PortName, err)
+		} else if len(ss.Errors) > 0 {
+			logger.Log.Debugf("[%s] Supplementary service query incomplete: %v", w.PortName, ss.Errors)
+		}
+	}()
+}
+
+// QuerySupplementaryServices interrogates forwarding, call waiting and CLIR
+// from the network. Individual failures are reported in Errors so one
+// unsupported service does not hide the others.
+func (w *ModemWorker) QuerySupplementaryServices() (SupplementaryServices, error) {
+	if w.remote != nil {
+		var ss SupplementaryServices
+		err := w.remoteCall(RemoteOpQuerySupplementary, nil, &ss, remoteLongTimeout)
+		return ss, err
+	}
+	if w.modem == nil {
+		return SupplementaryServices{}, errors.New("modem not initialized")
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	result := SupplementaryServices{
+		Forwarding:  []CallForwardEntry{},
+		CallWaiting: []CallWaitingEntry{},
+		Errors:      map[string]string{},
+	}
+
+	for _, reason := range callForwardQueryOrder {
+		entries, err := w.queryCallForwarding(reason)
+		if err != nil {
+			result.Errors["forwarding_"+reason] = err.Error()
+			continue
+		}
+		result.Forwarding = append(result.Forwarding, entries...)
+	}
+
+	if entries, err := w.queryCallWaiting(); err != nil {
+		result.Errors["call_waiting"] = err.Error()
+	} else {
+		result.CallWaiting = entries
+		result.CallWaitingEnabled = callWaitingVoiceActive(entries)
+	}
+
+	if clir, err := w.queryCLIR(); err != nil {
+		result.Errors["clir"] = err.Error()
+	} else {
+		result.CLIR = &clir
+	}
+
+	if len(result.Errors) == 0 {
+		result.Errors = nil
+	}
+	result.UpdatedAt = time.Now()
+
+	w.ssMu.Lock()
+	stored := cloneSupplementaryServices(result)
+	w.ss = &stored
+	w.ssMu.Unlock()
+
+	return result, nil
+}
+
+func (w *ModemWorker) SetCallForwarding(reason string, enable bool, number string, noReplyTime int) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpSetCallForwarding, remoteForwardingArgs{Reason: reason, Enable: enable, Number: number, NoReplyTime: noReplyTime}, nil, remoteLongTimeout)
+	}
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	code, ok := callForwardReasonCodes[reason]
+	if !ok {
+		return fmt.Errorf("%w: unknown forwarding reason %q", errInvalidSupplementaryRequest, reason)
+	}
+
+	number = strings.TrimSpace(number)
+	cmd := fmt.Sprintf("AT+CCFC=%d,0", code)
+	if enable {
+		if number == "" || !dialNumberPattern.MatchString(number) {
+			return fmt.Errorf("%w: forwarding number is required", errInvalidSupplementaryRequest)
+		}
+		numberType := 129
+		if strings.HasPrefix(number, "+") {
+			numberType = 145
+		}
+		// Mode 3 (registration) both stores the number and activates it.
+		cmd = fmt.Sprintf("AT+CCFC=%d,3,\"%s\",%d,%d", code, number, numberType, supplementaryVoiceClass)
+		if code == 2 || code == 4 || code == 5 {
+			if noReplyTime == 0 {
+				noReplyTime = supplementaryDefaultNoReply
+			}
+			if noReplyTime < 5 || noReplyTime > 30 || noReplyTime%5 != 0 {
+				return fmt.Errorf("%w: no_reply_time must be 5-30 in steps of 5", errInvalidSupplementaryRequest)
+			}
+			cmd += fmt.Sprintf(",,,%d", noReplyTime)
+		}
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if _, err := w.ExecuteAT(cmd, supplementaryQueryTimeout); err != nil {
+		return err
+	}
+
+	w.refreshCachedForwarding()
+	return nil
+}
+
+func (w *ModemWorker) SetCallWaiting(enable bool) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpSetCallWaiting, remoteValueArgs{Enable: enable}, nil, remoteLongTimeout)
+	}
+	mode := 0
+	if enable {
+		mode = 1
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	// n=1 keeps +CCWA URC presentation on so waiting calls are visible.
+	if _, err := w.ExecuteAT(fmt.Sprintf("AT+CCWA=1,%d,%d", mode, supplementaryVoiceClass), supplementaryQueryTimeout); err != nil {
+		return err
+	}
+
+	if entries, err := w.queryCallWaiting(); err == nil {
+		w.updateCachedSupplementary(func(ss *SupplementaryServices) {
+			ss.CallWaiting = entries
+			ss.CallWaitingEnabled = callWaitingVoiceActive(entries)
+		})
+	}
+	return nil
+}
+
+func (w *ModemWorker) SetCLIR(mode string) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpSetCLIR, remoteValueArgs{Value: mode}, nil, remoteLongTimeout)
+	}
+	mode, ok := NormalizeCLIR(mode)
+	if !ok || mode == "" {
+		return fmt.Errorf("%w: clir mode must be default, hide or show", errInvalidSupplementaryRequest)
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if _, err := w.ExecuteAT(fmt.Sprintf("AT+CLIR=%d", clirModeCodes[mode]), supplementaryQueryTimeout); err != nil {
+		return err
+	}
+
+	clir, err := w.queryCLIR()
+	if err != nil {
+		clir = CLIRStatus{Mode: mode, Provision: "unknown"}
+	}
+	w.updateCachedSupplementary(func(ss *SupplementaryServices) {
+		ss.CLIR = &clir
+	})
+	return nil
+}
+
+func (w *ModemWorker) refreshCachedForwarding() {
+	forwarding := []CallForwardEntry{}
+	for _, reason := range callForwardQueryOrder {
+		entries, err := w.queryCallForwarding(reason)
+		if err != nil {
+			logger.Log.Warnf("[%s] Failed to query call forwarding (%s): %v", w.PortName, reason, err)
+			return
+		}
+		forwarding = append(forwarding, entries...)
+	}
+	w.updateCachedSupplementary(func(ss *SupplementaryServices) {
+		ss.Forwarding = forwarding
+	})
+}
+
+func (w *ModemWorker) updateCachedSupplementary(update func(*SupplementaryServices)) {
+	w.ssMu.Lock()
+	defer w.ssMu.Unlock()
+	if w.ss == nil {
+		w.ss = &SupplementaryServices{
+			Forwarding:  []CallForwardEntry{},
+			CallWaiting: []CallWaitingEntry{},
+		}
+	}
+	update(w.ss)
+	w.ss.UpdatedAt = time.Now()
+}
+
+func (w *ModemWorker) queryCallForwarding(reason string) ([]CallForwardEntry, error) {
+	resp, err := w.ExecuteAT(fmt.Sprintf("AT+CCFC=%d,2", callForwardReasonCodes[reason]), supplementaryQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseCCFCResponse(resp, reason), nil
+}
+
+func (w *ModemWorker) queryCallWaiting() ([]CallWaitingEntry, error) {
+	resp, err := w.ExecuteAT("AT+CCWA=1,2", supplementaryQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseCCWAResponse(resp), nil
+}
+
+func (w *ModemWorker) queryCLIR() (CLIRStatus, error) {
+	resp, err := w.ExecuteAT("AT+CLIR?", supplementaryQueryTimeout)
+	if err != nil {
+		return CLIRStatus{}, err
+	}
+	clir, ok := parseCLIRResponse(resp)
+	if !ok {
+		return CLIRStatus{}, fmt.Errorf("unexpected CLIR response: %s", resp)
+	}
+	return clir, nil
+}
+
+// parseCCFCResponse parses +CCFC: <status>,<class>[,<number>,<type>[,<subaddr>,<satype>[,<time>]]]
+// lines. A network without any forwarding answers a single inactive line.
+func parseCCFCResponse(resp, reason string) []CallForwardEntry {
+	entries := []CallForwardEntry{}
+	for _, line := range strings.Split(resp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToUpper(line), "+CCFC:") {
+			continue
+		}
+		params := splitATParams(line[len("+CCFC:"):])
+		if len(params) < 2 {
+			continue
+		}
+		status, err := strconv.Atoi(params[0])
+		if err != nil {
+			continue
+		}
+		class, err := strconv.Atoi(params[1])
+		if err != nil {
+			continue
+		}
+
+		entry := CallForwardEntry{
+			Reason: reason,
+			Active: status == 1,
+			Class:  class,
+		}
+		if len(params) >= 3 {
+			entry.Number = params[2]
+		}
+		if len(params) >= 4 {
+			entry.NumberType, _ = strconv.Atoi(params[3])
+		}
+		if len(params) >= 7 {
+			entry.NoReplyTime, _ = strconv.Atoi(params[6])
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func parseCCWAResponse(resp string) []CallWaitingEntry {
+	entries := []CallWaitingEntry{}
+	for _, line := range strings.Split(resp, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(strings.ToUpper(line), "+CCWA:") {
+			continue
+		}
+		params := splitATParams(line[len("+CCWA:"):])
+		if len(params) != 2 {
+			// Longer lines are waiting-call URCs, not query results.
+			continue
+		}
+		status, err := strconv.Atoi(params[0])
+		if err != nil {
+			continue
+		}
+		class, err := strconv.Atoi(params[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, CallWaitingEntry{Active: status == 1, Class: class})
+	}
+	return entries
+}
+
+func parseCLIRResponse(resp string) (CLIRStatus, bool) {
+	params := splitATParams(parseID(resp, "+CLIR:"))
+	if len(params) < 2 {
+		return CLIRStatus{}, false
+	}
+	n, err := strconv.Atoi(params[0])
+	if err != nil {
+		return CLIRStatus{}, false
+	}
+	m, err := strconv.Atoi(params[1])
+	if err != nil {
+		return CLIRStatus{}, false
+	}
+
+	status := CLIRStatus{Mode: CLIRDefault, Provision: clirProvisionNames[m]}
+	for name, code := range clirModeCodes {
+		if code == n {
+			status.Mode = name
+		}
+	}
+	if status.Provision == "" {
+		status.Provision = "unknown"
+	}
+	return status, true
+}
+
+func callWaitingVoiceActive(entries []CallWaitingEntry) bool {
+	for _, entry := range entries {
+		if entry.Active && entry.Class&supplementaryVoiceClass != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// splitATParams splits a response parameter list on commas outside quotes
+// and strips the quotes from each value.
+func splitATParams(body string) []string {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return nil
+	}
+
+	var params []string
+	var current strings.Builder
+	quoted := false
+	for _, r := range body {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			params = append(params, strings.TrimSpace(current.String()))
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	return append(params, strings.TrimSpace(current.String()))
+}
+
+func cloneSupplementaryServices(ss SupplementaryServices) SupplementaryServices {
+	out := ss
+	out.Forwarding = append([]CallForwardEntry{}, ss.Forwarding...)
+	out.CallWaiting = append([]CallWaitingEntry{}, ss.CallWaiting...)
+	if ss.CLIR != nil {
+		clir := *ss.CLIR
+		out.CLIR = &clir
+	}
+	if ss.Errors != nil {
+		out.Errors = make(map[string]string, len(ss.Errors))
+		for k, v := range ss.Errors {
+			out.Errors[k] = v
+		}
+	}
+	return out
+}
@@ -0,0 +1,177 @@
+package worker
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/pccr10001/smsie/pkg/logger"
+)
+
+const (
+	USSDDone          = "done"
+	USSDFurtherAction = "further_action"
+	USSDTerminated    = "terminated"
+	USSDOtherClient   = "other_client"
+	USSDNotSupported  = "not_supported"
+	USSDTimeout       = "timeout"
+
+	ussdDefaultTimeout = 30 * time.Second
+)
+
+// 27.007 +CUSD <m> values.
+var ussdStates = map[int]string{
+	0: USSDDone,
+	1: USSDFurtherAction,
+	2: USSDTerminated,
+	3: USSDOtherClient,
+	4: USSDNotSupported,
+	5: USSDTimeout,
+}
+
+var (
+	ussdCodePattern    = regexp.MustCompile(`^[0-9*#+]{1,32}$`)
+	errInvalidUSSDCode = errors.New("invalid USSD code")
+)
+
+type USSDResult struct {
+	Status int    `json:"status"`
+	State  string `json:"state"`
+	Text   string `json:"text"`
+	DCS    int    `json:"dcs"`
+}
+
+// SendUSSD sends a USSD string such as *100# and waits for the network reply.
+// While a session needs further action, the reply to a menu is sent the same
+// way (e.g. "1").
+func (w *ModemWorker) SendUSSD(code string, timeout time.Duration) (*USSDResult, error) {
+	if w.remote != nil {
+		var result USSDResult
+		if err := w.remoteCall(RemoteOpUSSD, remoteValueArgs{Value: code}, &result, timeout+remoteCallTimeout); err != nil {
+			return nil, err
+		}
+		return &result, nil
+	}
+	code = strings.TrimSpace(code)
+	if !ussdCodePattern.MatchString(code) {
+		return nil, errInvalidUSSDCode
+	}
+	if timeout <= 0 {
+		timeout = ussdDefaultTimeout
+	}
+
+	w.ussdOpMu.Lock()
+	defer w.ussdOpMu.Unlock()
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if w.modem == nil {
+		return nil, errors.New("modem not initialized")
+	}
+
+	ch := make(chan USSDResult, 1)
+	w.ussdMu.Lock()
+	w.ussdWait = ch
+	w.ussdMu.Unlock()
+	defer func() {
+		w.ussdMu.Lock()
+		w.ussdWait = nil
+		w.ussdMu.Unlock()
+	}()
+
+	if _, err := w.ExecuteAT(fmt.Sprintf(`AT+CUSD=1,"%s",15`, code), 10*time.Second); err != nil {
+		return nil, fmt.Errorf("AT+CUSD failed: %w", err)
+	}
+
+	select {
+	case res := <-ch:
+		logger.Log.Infof("[%s] USSD %s: %s", w.PortName, code, res.State)
+		return &res, nil
+	case <-time.After(timeout):
+		_, _ = w.ExecuteATSilent("AT+CUSD=2", 3*time.Second)
+		return nil, errors.New("USSD response timeout")
+	}
+}
+
+// handleUSSDURC runs on the run loop and must not block.
+func (w *ModemWorker) handleUSSDURC(line string) {
+	res, ok := parseCUSD(line)
+	if !ok {
+		return
+	}
+	w.ussdMu.Lock()
+	ch := w.ussdWait
+	w.ussdMu.Unlock()
+	if ch == nil {
+		logger.Log.Debugf("[%s] Unsolicited USSD: %s", w.PortName, res.Text)
+		return
+	}
+	select {
+	case ch <- res:
+	default:
+	}
+}
+
+// parseCUSD parses +CUSD: <m>[,<str>[,<dcs>]].
+func parseCUSD(line string) (USSDResult, bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(strings.ToUpper(line), "+CUSD:") {
+		return USSDResult{}, false
+	}
+	rest := strings.TrimSpace(line[len("+CUSD:"):])
+
+	mPart := rest
+	if comma := strings.Index(rest, ","); comma >= 0 {
+		mPart, rest = rest[:comma], strings.TrimSpace(rest[comma+1:])
+	} else {
+		rest = ""
+	}
+	m, err := strconv.Atoi(strings.TrimSpace(mPart))
+	if err != nil {
+		return USSDResult{}, false
+	}
+	res := USSDResult{Status: m, State: ussdStates[m], DCS: 15}
+	if res.State == "" {
+		res.State = strconv.Itoa(m)
+	}
+
+	text := rest
+	if strings.HasPrefix(rest, `"`) {
+		if end := strings.LastIndex(rest, `"`); end > 0 {
+			text = rest[1:end]
+			after := strings.TrimSpace(rest[end+1:])
+			if strings.HasPrefix(after, ",") {
+				if dcs, err := strconv.Atoi(strings.TrimSpace(after[1:])); err == nil {
+					res.DCS = dcs
+				}
+			}
+		} else {
+			text = rest[1:]
+		}
+	}
+	res.Text = decodeUSSDText(text, res.DCS)
+	return res, true
+}
+
+// decodeUSSDText decodes UCS2 replies, which modems report as hex.
+func decodeUSSDText(text string, dcs int) string {
+	ucs2 := dcs&0xF0 == 0x40 && dcs&0x0C == 0x08 || dcs == 0x11 || dcs == 0x48
+	if !ucs2 || len(text)%4 != 0 {
+		return text
+	}
+	raw, err := hex.DecodeString(text)
+	if err != nil {
+		return text
+	}
+	units := make([]uint16, 0, len(raw)/2)
+	for i := 0; i+1 < len(raw); i += 2 {
+		units = append(units, uint16(raw[i])<<8|uint16(raw[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
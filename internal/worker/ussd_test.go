@@ -0,0 +1,31 @@
+package worker
+
+import "testing"
+
+func TestParseCUSD(t *testing.T) {
+	initTestLogger()
+	res, ok := parseCUSD(`+CUSD: 0,"Your balance is 12.50",15`)
+	if !ok {
+		t.Fatal("expected CUSD parse to succeed")
+	}
+	if res.State != USSDDone || res.Text != "Your balance is 12.50" || res.DCS != 15 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+
+	res, ok = parseCUSD(`+CUSD: 1,"004D0065006E0075003A00200031002E00208CBB",72`)
+	if !ok {
+		t.Fatal("expected UCS2 CUSD parse to succeed")
+	}
+	if res.State != USSDFurtherAction || res.Text != "Menu: 1. 費" {
+		t.Fatalf("unexpected UCS2 result: %+v", res)
+	}
+
+	res, ok = parseCUSD(`+CUSD: 4`)
+	if !ok || res.State != USSDNotSupported || res.Text != "" {
+		t.Fatalf("unexpected result without text: %+v", res)
+	}
+
+	if _, ok := parseCUSD(`+CUSD: x,"a"`); ok {
+		t.Fatal("expected malformed CUSD to fail")
+	}
+}
@@ -35,6 +35,9 @@ type ModemWorker struct {
 
 	busyMu sync.Mutex
 	busy   bool
+	// smsMu keeps sends out of a poll's CMGL/CMGD sequence; rule-generated
+	// replies wait for the poll that received their SMS to finish.
+	smsMu sync.Mutex
 
 	callOpMu sync.Mutex
 	callMu   sync.RWMutex
@@ -43,13 +46,24 @@ type ModemWorker struct {
 	uacReady bool
 	uacVID   string
 	uacPID   string
+	screenMu sync.Mutex
+	screen   callScreen
+	ssMu     sync.RWMutex
+	ss       *SupplementaryServices
+	ssTried  time.Time // last background query, see RefreshSupplementaryServices
+	ussdOpMu sync.Mutex
+	ussdMu   sync.Mutex
+	ussdWait chan USSDResult
 
 	// Data
 	repo           *repository.ModemRepository
 	smsRepo        *repository.SMSRepository
 	webhookService *logic.WebhookService
+	callerFilter   *logic.CallerFilter
 	modem          *model.Modem
 	manager        *Manager
+	remote         RemoteLink // set for modems attached to an agent
+	remoteCallSt   CallState
 
 	// Internal
 	rxChan      chan rxMsg
@@ -79,6 +93,9 @@ type callSnapshot struct {
 	Incoming        bool
 	Voice           bool
 	IncomingRinging bool
+	Waiting         bool
+	LegCount        int
+	Legs            [maxCallLegs]callLeg
 	UpdatedAt       time.Time
 }
 
@@ -91,18 +108,22 @@ const (
 var (
 	errInvalidDialNumber = errors.New("invalid dial number")
 	errCallInProgress    = errors.New("call already in progress")
+	errNoIncomingCall    = errors.New("no incoming call")
 )
 
 var dialNumberPattern = regexp.MustCompile(`^[0-9*#+]+$`)
 
 func NewModemWorker(portName string, db *gorm.DB, manager *Manager) *ModemWorker {
+	webhookService := logic.NewWebhookService(repository.NewWebhookRepository(db), repository.NewWebhookDeliveryRepository(db), repository.NewSMSRepository(db))
+	webhookService.SetAuthorizer(manager.webhookAuthorizer())
 	return &ModemWorker{
 		PortName:       portName,
 		stop:           make(chan struct{}),
 		cmdChan:        make(chan commandRequest, 10),
 		repo:           repository.NewModemRepository(db),
 		smsRepo:        repository.NewSMSRepository(db),
-		webhookService: logic.NewWebhookService(repository.NewWebhookRepository(db)),
+		webhookService: webhookService,
+		callerFilter:   logic.NewCallerFilter(repository.NewCallerRuleRepository(db)),
 		manager:        manager,
 		rxChan:         make(chan rxMsg, 100), // Buffer to prevent blocking reader
 		triggerChan:    make(chan struct{}, 1),
@@ -310,6 +331,7 @@ func (w *ModemWorker) readLoop() {
 func (w *ModemWorker) Stop() {
 	w.stopOnce.Do(func() {
 		close(w.stop)
+		w.publishEvent(logic.EventModemOffline, map[string]interface{}{"port_name": w.PortName})
 	})
 }
 
@@ -495,8 +517,8 @@ func (w *ModemWorker) initModem() {
 		} else {
 			w.modem = modem
 			logger.Log.Infof("Modem registered: %s (%s) Op: %s Sig: %d%%", iccid, w.PortName, operator, signal)
+			w.publishModemOnline()
 		}
-
 	}()
 }
 
@@ -512,6 +534,9 @@ func parseID(resp, prefix string) string {
 }
 
 func (w *ModemWorker) ExecuteAT(cmd string, timeout time.Duration) (string, error) {
+	if w.remote != nil {
+		return w.remoteAT(cmd, timeout, false)
+	}
 	respChan := make(chan string)
 	errChan := make(chan error)
 	w.cmdChan <- commandRequest{
@@ -532,6 +557,9 @@ func (w *ModemWorker) ExecuteAT(cmd string, timeout time.Duration) (string, erro
 }
 
 func (w *ModemWorker) ExecuteATSilent(cmd string, timeout time.Duration) (string, error) {
+	if w.remote != nil {
+		return w.remoteAT(cmd, timeout, true)
+	}
 	respChan := make(chan string)
 	errChan := make(chan error)
 	w.cmdChan <- commandRequest{
@@ -554,7 +582,7 @@ func (w *ModemWorker) ExecuteATSilent(cmd string, timeout time.Duration) (string
 
 func (w *ModemWorker) isURC(line string) bool {
 	// List of known URCs
-	if strings.HasPrefix(line, "+CMTI:") || strings.HasPrefix(line, "+CREG:") {
+	if strings.HasPrefix(line, "+CMTI:") || strings.HasPrefix(line, "+CREG:") || strings.HasPrefix(line, "+CUSD:") {
 		return true
 	}
 	if w.shouldHandleCallURC(line) {
@@ -576,16 +604,23 @@ func (w *ModemWorker) handleURC(line string) {
 		return
 	}
 
+	if strings.HasPrefix(line, "+CUSD:") {
+		w.handleUSSDURC(line)
+		return
+	}
+
 	if strings.HasPrefix(strings.ToUpper(strings.TrimSpace(line)), "+CREG:") {
 		if code, text, err := parseCREGStatus(line); err == nil {
 			if w.modem == nil {
 				logger.Log.Debugf("[%s] Ignore CREG URC before modem init: %s", w.PortName, line)
 			} else {
+				prevReg, prevOp := w.modem.Registration, w.modem.Operator
 				w.modem.Registration = text
 				if code != "1" && code != "5" {
 					w.modem.Operator = ""
 				}
 				w.modem.LastSeen = time.Now()
+				w.publishRegistrationChange(prevReg, prevOp)
 			}
 		}
 	}
@@ -609,7 +644,11 @@ func (w *ModemWorker) shouldHandleCallURC(line string) bool {
 		return true
 	}
 
-	if strings.HasPrefix(upper, "+CLCC:") {
+	if strings.HasPrefix(upper, "+CLCC:") || strings.HasPrefix(upper, "+CLIP:") {
+		return true
+	}
+
+	if strings.HasPrefix(upper, "+CCWA:") && isCCWAURC(line) {
 		return true
 	}
 
@@ -621,10 +660,15 @@ func (w *ModemWorker) handleCallURC(line string) {
 
 	switch {
 	case upper == "RING":
-		if w.GetCallState().State == callStateIdle {
+		if w.GetCallState().State == callStateIdle && !w.recentlyBlockedCaller() {
 			w.setCallStateWithMeta(callStateDialing, "ring", clearCallDetails)
 		}
 	case upper == "NO CARRIER":
+		if w.GetCallState().LegCount > 1 {
+			// Only one of several calls ended; re-read the list off the read loop.
+			go w.refreshCallList("no_carrier")
+			return
+		}
 		w.setCallStateWithMeta(callStateIdle, "no_carrier", clearCallDetails)
 	case upper == "BUSY":
 		w.setCallStateWithMeta(callStateIdle, "busy", clearCallDetails)
@@ -632,6 +676,26 @@ func (w *ModemWorker) handleCallURC(line string) {
 		w.setCallStateWithMeta(callStateIdle, "no_answer", clearCallDetails)
 	case upper == "NO DIALTONE":
 		w.setCallStateWithMeta(callStateIdle, "no_dialtone", clearCallDetails)
+	case strings.HasPrefix(upper, "+CCWA:"):
+		if number, ok := parseCCWAURC(line); ok {
+			if w.GetCallState().State == callStateIdle || w.screenIncomingCall(number) {
+				return
+			}
+			go w.refreshCallList("ccwa")
+		}
+	case strings.HasPrefix(upper, "+CLIP:"):
+		if number, ok := parseCLIP(line); ok {
+			// During a call +CLIP belongs to the waiting call, whose index
+			// only +CLCC knows; the single-call path would overwrite the
+			// established call.
+			if current := w.GetCallState(); current.State == callStateInCall || current.LegCount > 1 {
+				if !w.screenIncomingCall(number) {
+					go w.refreshCallList("clip")
+				}
+				return
+			}
+			w.applyCLCCState(clccDetails{Direction: 1, Stat: 4, Mode: 0, Number: number}, "clip")
+		}
 	case strings.HasPrefix(upper, "+CLCC:"):
 		if info, ok := parseCLCCState(line); ok {
 			w.applyCLCCState(info, "clcc")
@@ -644,10 +708,12 @@ func (w *ModemWorker) handleCallURC(line string) {
 }
 
 type clccDetails struct {
-	Direction int
-	Stat      int
-	Mode      int
-	Number    string
+	Index      int
+	Direction  int
+	Stat       int
+	Mode       int
+	Multiparty bool
+	Number     string
 }
 
 func isCCInfoQIND(line string) bool {
@@ -704,17 +770,37 @@ func parseCLCCLikeParts(parts []string) (clccDetails, bool) {
 		number = strings.Trim(strings.TrimSpace(parts[5]), "\"")
 	}
 
+	index, _ := strconv.Atoi(strings.TrimSpace(parts[0]))
 	return clccDetails{
-		Direction: direction,
-		Stat:      stat,
-		Mode:      mode,
-		Number:    number,
+		Index:      index,
+		Direction:  direction,
+		Stat:       stat,
+		Mode:       mode,
+		Multiparty: strings.TrimSpace(parts[4]) == "1",
+		Number:     number,
 	}, true
 }
 
 func (w *ModemWorker) applyCLCCState(info clccDetails, source string) {
 	incomingVoice := info.Direction == 1 && info.Mode == 0
 	incomingRinging := incomingVoice && (info.Stat == 4 || info.Stat == 5)
+	if incomingRinging && w.screenIncomingCall(info.Number) {
+		return
+	}
+
+	// With more than one call the snapshot is derived from all legs; the
+	// single-call path below keeps the original behaviour.
+	if info.Index > 0 {
+		others := w.GetCallState().callLegs()
+		others = removeCallLeg(others, info.Index)
+		if len(others) > 0 {
+			if !callLegReleased(info.Stat) {
+				others = append(others, callLegFromCLCC(info))
+			}
+			w.applyCallLegs(others, source)
+			return
+		}
+	}
 	state := ""
 	reason := ""
 
@@ -749,6 +835,10 @@ func (w *ModemWorker) applyCLCCState(info clccDetails, source string) {
 		snapshot.Incoming = incomingVoice
 		snapshot.Voice = info.Mode == 0
 		snapshot.IncomingRinging = incomingRinging
+		snapshot.Waiting = false
+		if info.Index > 0 {
+			snapshot.setCallLegs([]callLeg{callLegFromCLCC(info)})
+		}
 	})
 }
 
@@ -760,6 +850,8 @@ func clearCallDetails(snapshot *callSnapshot) {
 	snapshot.Incoming = false
 	snapshot.Voice = false
 	snapshot.IncomingRinging = false
+	snapshot.Waiting = false
+	snapshot.setCallLegs(nil)
 }
 
 func (w *ModemWorker) GetCallState() callSnapshot {
@@ -807,7 +899,12 @@ func (w *ModemWorker) setCallStateWithMeta(state, reason string, update func(*ca
 	}
 }
 
-func (w *ModemWorker) Dial(number string) error {
+// Dial places a voice call. clir overrides caller ID presentation for this
+// call only (hide/show); empty or "default" follows the AT+CLIR setting.
+func (w *ModemWorker) Dial(number, clir string) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpDial, remoteDialArgs{Number: number, CLIR: clir}, nil, remoteCallTimeout)
+	}
 	if !callingEnabled() {
 		return errors.New("calling disabled in this build")
 	}
@@ -817,6 +914,18 @@ func (w *ModemWorker) Dial(number string) error {
 		return errInvalidDialNumber
 	}
 
+	clir, ok := NormalizeCLIR(clir)
+	if !ok {
+		return fmt.Errorf("%w: clir must be default, hide or show", errInvalidSupplementaryRequest)
+	}
+	dialSuffix := ";"
+	switch clir {
+	case CLIRHide:
+		dialSuffix = "I;"
+	case CLIRShow:
+		dialSuffix = "i;"
+	}
+
 	w.callOpMu.Lock()
 	defer w.callOpMu.Unlock()
 
@@ -840,7 +949,7 @@ func (w *ModemWorker) Dial(number string) error {
 		snapshot.Mode = 0
 		snapshot.Voice = true
 	})
-	if _, err := w.ExecuteAT("ATD"+number+";", 15*time.Second); err != nil {
+	if _, err := w.ExecuteAT("ATD"+number+dialSuffix, 15*time.Second); err != nil {
 		_, _ = w.ExecuteATSilent(`AT+QPCMV=0`, 3*time.Second)
 		w.setCallStateWithMeta(callStateIdle, "dial_error", clearCallDetails)
 		return err
@@ -856,6 +965,9 @@ func (w *ModemWorker) Dial(number string) error {
 }
 
 func (w *ModemWorker) Answer() error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpAnswer, nil, nil, remoteCallTimeout)
+	}
 	if !callingEnabled() {
 		return errors.New("calling disabled in this build")
 	}
@@ -864,8 +976,11 @@ func (w *ModemWorker) Answer() error {
 	defer w.callOpMu.Unlock()
 
 	current := w.GetCallState()
+	if current.Waiting {
+		return w.holdAndAcceptLocked()
+	}
 	if current.State == callStateIdle || !current.Incoming {
-		return errors.New("no incoming call to answer")
+		return errNoIncomingCall
 	}
 
 	w.SetBusy(true)
@@ -889,7 +1004,43 @@ func (w *ModemWorker) Answer() error {
 	return nil
 }
 
+// Reject declines a ringing incoming call with ATH without answering it.
+// A waiting call is declined with AT+CHLD=1<idx> so the active and held calls
+// stay up.
+func (w *ModemWorker) Reject() error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpReject, nil, nil, remoteCallTimeout)
+	}
+	if !callingEnabled() {
+		return errors.New("calling disabled in this build")
+	}
+
+	w.callOpMu.Lock()
+	defer w.callOpMu.Unlock()
+
+	current := w.GetCallState()
+	if current.Waiting {
+		return w.releaseWaitingLegLocked("reject")
+	}
+	if current.State == callStateIdle || !current.IncomingRinging {
+		return errNoIncomingCall
+	}
+
+	w.SetBusy(true)
+	defer w.SetBusy(false)
+
+	if _, err := w.ExecuteAT("ATH", 10*time.Second); err != nil {
+		return err
+	}
+
+	w.setCallStateWithMeta(callStateIdle, "reject", clearCallDetails)
+	return nil
+}
+
 func (w *ModemWorker) Hangup() error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpHangup, nil, nil, remoteCallTimeout)
+	}
 	if !callingEnabled() {
 		return errors.New("calling disabled in this build")
 	}
@@ -1022,6 +1173,11 @@ func (w *ModemWorker) SetOccupied(occupied bool) {
 }
 
 func (w *ModemWorker) ScanNetworks() ([]string, error) {
+	if w.remote != nil {
+		var networks []string
+		err := w.remoteCall(RemoteOpScanNetworks, nil, &networks, remoteLongTimeout)
+		return networks, err
+	}
 	w.SetBusy(true)
 	defer w.SetBusy(false)
 
@@ -1110,6 +1266,9 @@ func (w *ModemWorker) ScanNetworks() ([]string, error) {
 }
 
 func (w *ModemWorker) SetOperator(oper string) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpSetOperator, remoteValueArgs{Value: oper}, nil, remoteLongTimeout)
+	}
 	w.SetBusy(true)
 	defer w.SetBusy(false)
 
@@ -1125,9 +1284,49 @@ func (w *ModemWorker) SetOperator(oper string) error {
 }
 
 // SendSMS sends an SMS message using PDU format
+// SendSMS sends an SMS and stores it as sent, so that the daily limits and
+// routing of modem pools see SMS from every send path.
 func (w *ModemWorker) SendSMS(phoneNumber, message string) error {
+	_, err := w.sendAndStoreSMS(phoneNumber, message, "")
+	return err
+}
+
+// sendAndStoreSMS sends an SMS and stores it as sent, through pool if set.
+func (w *ModemWorker) sendAndStoreSMS(phoneNumber, message, pool string) (*model.SMS, error) {
+	if err := w.sendSMS(phoneNumber, message); err != nil {
+		w.publishEvent(logic.EventSMSFailed, map[string]interface{}{"phone": phoneNumber, "content": message, "error": err.Error()})
+		return nil, err
+	}
+	w.publishEvent(logic.EventSMSSent, map[string]interface{}{"phone": phoneNumber, "content": message})
+
+	sms := &model.SMS{
+		Phone:     phoneNumber,
+		Content:   message,
+		Timestamp: time.Now(),
+		Type:      "sent",
+		IsRead:    true,
+		Pool:      pool,
+	}
+	if w.modem != nil {
+		sms.ICCID = w.modem.ICCID
+	}
+	if err := w.smsRepo.Create(sms); err != nil {
+		logger.Log.Errorf("[%s] Failed to store SMS sent to %s: %v", w.PortName, phoneNumber, err)
+		return sms, nil
+	}
+	// Webhooks with message_types "sent" get it.
+	w.webhookService.Dispatch(sms)
+	return sms, nil
+}
+
+func (w *ModemWorker) sendSMS(phoneNumber, message string) error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpSendSMS, remoteSMSArgs{Phone: phoneNumber, Message: message}, nil, remoteLongTimeout)
+	}
 	w.SetBusy(true)
 	defer w.SetBusy(false)
+	w.smsMu.Lock()
+	defer w.smsMu.Unlock()
 
 	if w.modem == nil {
 		return errors.New("modem not initialized")
@@ -1213,6 +1412,9 @@ func (w *ModemWorker) SendSMS(phoneNumber, message string) error {
 }
 
 func (w *ModemWorker) Reboot() error {
+	if w.remote != nil {
+		return w.remoteCall(RemoteOpReboot, nil, nil, remoteCallTimeout)
+	}
 	if !callingEnabled() {
 		return errors.New("calling disabled in this build")
 	}
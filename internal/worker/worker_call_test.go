@@ -4,7 +4,12 @@ import (
 	"testing"
 	"time"
 
+	"github.com/glebarez/sqlite"
+	"github.com/pccr10001/smsie/internal/logic"
+	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
 	"github.com/pccr10001/smsie/pkg/logger"
+	"gorm.io/gorm"
 )
 
 func initTestLogger() {
@@ -76,3 +81,164 @@ func TestHandleCallURCWaitsForNoCarrierOnRelease(t *testing.T) {
 		t.Fatalf("expected caller number to be cleared after NO CARRIER, got %q", state.Number)
 	}
 }
+
+func TestScreenIncomingCallKeysOnNumber(t *testing.T) {
+	initTestLogger()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.CallerRule{}); err != nil {
+		t.Fatal(err)
+	}
+	db.Create(&model.CallerRule{MatchType: logic.CallerMatchExact, Pattern: "0911000000", Action: logic.CallerActionBlock, AppliesTo: "all", Enabled: true})
+
+	w := &ModemWorker{
+		PortName:     "test",
+		callerFilter: logic.NewCallerFilter(repository.NewCallerRuleRepository(db)),
+		screen:       callScreen{number: "0911000000", blocked: true, seenAt: time.Now()},
+	}
+	if w.screenIncomingCall("0922000000") {
+		t.Fatal("expected another caller not to inherit the blocked decision")
+	}
+	if w.screen.number != "0922000000" || w.screen.blocked {
+		t.Fatalf("expected the new caller to be cached, got %+v", w.screen)
+	}
+}
+
+func TestParseCLIP(t *testing.T) {
+	initTestLogger()
+	number, ok := parseCLIP(`+CLIP: "0955452980",129,"",0,"",0`)
+	if !ok || number != "0955452980" {
+		t.Fatalf("expected number 0955452980, got %q (ok=%v)", number, ok)
+	}
+
+	number, ok = parseCLIP(`+CLIP: "",128,"",0,"",1`)
+	if !ok || number != "" {
+		t.Fatalf("expected withheld number to be empty, got %q (ok=%v)", number, ok)
+	}
+}
+
+func TestParseCCFCResponse(t *testing.T) {
+	initTestLogger()
+	resp := "+CCFC: 1,1,\"+886912345678\",145,,,20\n+CCFC: 0,2\nOK"
+	entries := parseCCFCResponse(resp, CallForwardNoReply)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if !entries[0].Active || entries[0].Class != 1 || entries[0].Number != "+886912345678" {
+		t.Fatalf("unexpected voice entry: %+v", entries[0])
+	}
+	if entries[0].NumberType != 145 || entries[0].NoReplyTime != 20 {
+		t.Fatalf("unexpected type/time: %+v", entries[0])
+	}
+	if entries[1].Active || entries[1].Class != 2 || entries[1].Number != "" {
+		t.Fatalf("unexpected data entry: %+v", entries[1])
+	}
+}
+
+func TestHandleCallURCTracksWaitingCall(t *testing.T) {
+	initTestLogger()
+	w := &ModemWorker{
+		PortName: "test",
+		call: callSnapshot{
+			State:     callStateIdle,
+			Reason:    "init",
+			UpdatedAt: time.Now(),
+		},
+	}
+
+	w.handleCallURC(`+QIND: "ccinfo",1,0,0,0,0,"0911111111",129`)
+	w.handleCallURC(`+QIND: "ccinfo",2,1,5,0,0,"0922222222",129`)
+
+	state := w.CallState()
+	if state.State != callStateInCall {
+		t.Fatalf("expected in_call with a waiting call, got %q", state.State)
+	}
+	if !state.Waiting || state.IncomingRinging {
+		t.Fatalf("expected waiting without incoming ringing, got waiting=%v ringing=%v", state.Waiting, state.IncomingRinging)
+	}
+	if state.Number != "0911111111" {
+		t.Fatalf("expected active call to stay primary, got %q", state.Number)
+	}
+	if len(state.Calls) != 2 || state.Calls[1].Index != 2 || state.Calls[1].State != "waiting" {
+		t.Fatalf("unexpected call legs: %+v", state.Calls)
+	}
+
+	w.handleCallURC(`+QIND: "ccinfo",2,1,-1,0,0,"0922222222",129`)
+	state = w.CallState()
+	if state.Waiting || len(state.Calls) != 1 || state.State != callStateInCall {
+		t.Fatalf("expected single active call after waiting call released, got %+v", state)
+	}
+}
+
+// fakeModemCommands answers AT+CLCC with clcc and OK to everything else, and
+// records the commands sent.
+func fakeModemCommands(w *ModemWorker, clcc string) *[]string {
+	sent := []string{}
+	w.cmdChan = make(chan commandRequest)
+	go func() {
+		for req := range w.cmdChan {
+			sent = append(sent, req.cmd)
+			if req.cmd == "AT+CLCC" {
+				req.respChan <- clcc
+				continue
+			}
+			req.respChan <- "OK"
+		}
+	}()
+	return &sent
+}
+
+func TestHandleCallURCRoutesCLIPToWaitingCall(t *testing.T) {
+	initTestLogger()
+	w := &ModemWorker{
+		PortName: "test",
+		call:     callSnapshot{State: callStateIdle, Reason: "init", UpdatedAt: time.Now()},
+	}
+	fakeModemCommands(w, "+CLCC: 1,0,0,0,0,\"0911111111\",129\r\n+CLCC: 2,1,5,0,0,\"0922222222\",129\r\nOK")
+
+	w.handleCallURC(`+QIND: "ccinfo",1,0,0,0,0,"0911111111",129`)
+	w.handleCallURC(`+CCWA: "0922222222",129,1`)
+	w.handleCallURC(`+CLIP: "0922222222",129,"",0,"",0`)
+
+	state := w.CallState()
+	if state.State != callStateInCall || state.Number != "0911111111" {
+		t.Fatalf("expected +CLIP not to replace the active call, got %q %q", state.State, state.Number)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !w.CallState().Waiting {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the call list refresh to report the waiting call")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	state = w.CallState()
+	if len(state.Calls) != 2 || state.Calls[0].State != "active" || state.Calls[1].State != "waiting" {
+		t.Fatalf("unexpected call legs: %+v", state.Calls)
+	}
+}
+
+func TestRejectScreenedCallKeepsHeldCall(t *testing.T) {
+	initTestLogger()
+	w := &ModemWorker{
+		PortName: "test",
+		call:     callSnapshot{State: callStateIdle, Reason: "init", UpdatedAt: time.Now()},
+	}
+	sent := fakeModemCommands(w, "+CLCC: 1,0,1,0,0,\"0911111111\",129\r\n+CLCC: 2,0,0,0,0,\"0933333333\",129\r\n+CLCC: 3,1,5,0,0,\"0922222222\",129\r\nOK")
+	w.handleCallURC(`+QIND: "ccinfo",1,0,1,0,0,"0911111111",129`)
+	w.handleCallURC(`+QIND: "ccinfo",2,0,0,0,0,"0933333333",129`)
+
+	w.rejectScreenedCall()
+	found := false
+	for _, cmd := range *sent {
+		if cmd == "AT+CHLD=0" {
+			t.Fatal("expected the held call not to be released")
+		}
+		found = found || cmd == "AT+CHLD=13"
+	}
+	if !found {
+		t.Fatalf("expected only the waiting call to be released, sent %v", *sent)
+	}
+}
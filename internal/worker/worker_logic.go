@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/model"
 	"github.com/pccr10001/smsie/pkg/logger"
 	"github.com/warthog618/sms"
@@ -84,12 +85,14 @@ func (w *ModemWorker) checkOperator() {
 
 func (w *ModemWorker) checkSignal() {
 	// Registration drives whether operator should be shown.
+	prevReg, prevOp := w.modem.Registration, w.modem.Operator
 	regCode := w.checkRegistration()
 	if regCode == "1" || regCode == "5" {
 		w.checkOperator()
 	} else if regCode != "" {
 		w.modem.Operator = ""
 	}
+	w.publishRegistrationChange(prevReg, prevOp)
 
 	resp, err := w.ExecuteAT("AT+CSQ", 2*time.Second)
 	if err != nil {
@@ -115,7 +118,7 @@ func (w *ModemWorker) checkSignal() {
 					signal = int(float64(rssi) / 31.0 * 100.0)
 				}
 
-				w.modem.SignalStrength = signal
+				w.setSignal(signal)
 				w.modem.LastSeen = time.Now()
 			}
 		}
@@ -177,6 +180,9 @@ func parseCREGStatus(resp string) (string, string, error) {
 }
 
 func (w *ModemWorker) checkSMS() {
+	w.smsMu.Lock()
+	defer w.smsMu.Unlock()
+
 	// PDU mode read all
 	resp, err := w.ExecuteAT("AT+CMGL=4", 10*time.Second)
 	if err != nil {
@@ -289,9 +295,34 @@ func (w *ModemWorker) processPDU(raw string) {
 	if sms.Timestamp.IsZero() {
 		sms.Timestamp = time.Now()
 	}
+	w.receiveSMS(sms)
+}
+
+// receiveSMS stores a received SMS and runs caller rules, SMS rules and
+// webhooks on it.
+func (w *ModemWorker) receiveSMS(sms *model.SMS) {
+	logic.ApplyOTP(sms)
+
+	decision := w.callerFilter.Evaluate(sms.ICCID, sms.Phone, logic.CallerChannelSMS)
+	switch decision.Action {
+	case logic.CallerActionBlock:
+		logger.Log.Infof("[%s] Dropped SMS from %s by caller rule %d", w.PortName, sms.Phone, decision.RuleID)
+		return
+	case logic.CallerActionSpam:
+		sms.IsSpam = true
+	}
 
 	w.smsRepo.Create(sms)
 
+	if sms.IsSpam {
+		logger.Log.Infof("[%s] Stored SMS from %s as spam by caller rule %d", w.PortName, sms.Phone, decision.RuleID)
+		return
+	}
+
+	// Rules run before webhooks so tags and read state are part of the payload
+	w.manager.smsRuleEngine().Apply(sms)
+	w.publishEvent(logic.EventSMSReceived, *sms)
+
 	// Trigger Webhook
 	w.webhookService.Dispatch(sms)
 }
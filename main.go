@@ -16,10 +16,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/glebarez/sqlite"
 	"github.com/pccr10001/smsie/internal/api"
+	"github.com/pccr10001/smsie/internal/auth"
 	"github.com/pccr10001/smsie/internal/calling"
 	"github.com/pccr10001/smsie/internal/config"
+	"github.com/pccr10001/smsie/internal/logic"
 	"github.com/pccr10001/smsie/internal/mccmnc"
 	"github.com/pccr10001/smsie/internal/model"
+	"github.com/pccr10001/smsie/internal/repository"
 	"github.com/pccr10001/smsie/internal/worker"
 	"github.com/pccr10001/smsie/pkg/logger"
 	"golang.org/x/crypto/bcrypt"
@@ -33,6 +36,25 @@ func main() {
 
 	// 2. Init Logger
 	logger.InitLogger(config.AppConfig.Log.Level)
+
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		runAgent()
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-jwt-key" {
+		if config.AppConfig.Auth.JWTSecret != "" {
+			logger.Log.Fatal("auth.jwt_secret is set; change it and list the old one in auth.jwt_previous_secrets instead")
+		}
+		kid, err := auth.RotateKeyFile(config.AppConfig.Auth.JWTKeyFile)
+		if err != nil {
+			logger.Log.Fatalf("Failed to add JWT signing key: %v", err)
+		}
+		logger.Log.Infof("Added JWT signing key %s to %s, restart smsie to sign with it", kid, config.AppConfig.Auth.JWTKeyFile)
+		return
+	}
+	if err := auth.Init(config.AppConfig.Auth); err != nil {
+		logger.Log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
 	logger.Log.Info("Starting SMS Dashboard...")
 
 	// Load MCCMNC
@@ -47,7 +69,8 @@ func main() {
 	if config.AppConfig.Server.Mode == "release" {
 		gin.SetMode(gin.ReleaseMode)
 	}
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(accessLogFormatter), gin.Recovery())
 
 	r.GET("/ping", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -57,6 +80,62 @@ func main() {
 
 	// 5. Start Worker Manager
 	wm := worker.NewManager(db)
+	wm.SetSMSRuleEngine(logic.NewSMSRuleEngine(db, wm.SendSMSFrom, api.NewSMSRuleAuthorizer(db)))
+	wm.SetWebhookAuthorizer(api.NewSMSRuleAuthorizer(db))
+
+	// Requeue before workers start so only deliveries of the previous run are picked up
+	webhookRetry := logic.NewWebhookService(
+		repository.NewWebhookRepository(db),
+		repository.NewWebhookDeliveryRepository(db),
+		repository.NewSMSRepository(db),
+	)
+	webhookRetry.SetAuthorizer(api.NewSMSRuleAuthorizer(db))
+	webhookRetry.RequeueInterrupted()
+	logic.SetModemNumberLookup(repository.NewModemRepository(db).PhoneNumber)
+	webhookStop := make(chan struct{})
+	defer close(webhookStop)
+	go webhookRetry.RunRetryLoop(webhookStop)
+
+	auditStop := make(chan struct{})
+	defer close(auditStop)
+	go logic.NewAuditLogger(db).RunRetention(auditStop)
+
+	var telegramBot *api.TelegramBot
+	if config.AppConfig.Telegram.Enabled {
+		bot, err := api.NewTelegramBot(db, wm, config.AppConfig.Telegram)
+		if err != nil {
+			logger.Log.Fatalf("Failed to init Telegram bot: %v", err)
+		}
+		telegramBot = bot
+		logic.SetTelegramBridge(telegramBot)
+		telegramStop := make(chan struct{})
+		defer close(telegramStop)
+		go telegramBot.Run(telegramStop)
+	}
+
+	if config.AppConfig.SMPP.Enabled {
+		smppServer := api.NewSMPPServer(db, wm, config.AppConfig.SMPP)
+		if err := smppServer.Listen(); err != nil {
+			logger.Log.Fatalf("Failed to start SMPP server: %v", err)
+		}
+		smppStop := make(chan struct{})
+		defer close(smppStop)
+		go smppServer.Run(smppStop)
+	}
+
+	if config.AppConfig.SMTP.Enabled {
+		smtpGateway, err := api.NewSMTPGateway(db, wm, config.AppConfig.SMTP)
+		if err != nil {
+			logger.Log.Fatalf("Invalid SMTP gateway config: %v", err)
+		}
+		if err := smtpGateway.Listen(); err != nil {
+			logger.Log.Fatalf("Failed to start SMTP gateway: %v", err)
+		}
+		smtpStop := make(chan struct{})
+		defer close(smtpStop)
+		go smtpGateway.Run(smtpStop)
+	}
+
 	wm.Start()
 	defer wm.Stop()
 
@@ -121,54 +200,149 @@ func main() {
 	wh := api.NewWebhookHandler(db)
 	uh := api.NewUserHandler(db)
 	akh := api.NewAPIKeyHandler(db)
-	mcpHTTP := api.NewMCPHTTPServer(db, wm)
+	crh := api.NewCallerRuleHandler(db)
+	srh := api.NewSMSRuleHandler(db)
+	eh := api.NewEventHandler(db, wm)
+	oh := api.NewOTPHandler(db, wm)
+	ph := api.NewModemPoolHandler(db, wm)
+	qh := api.NewSMSQuotaHandler(db)
+	ah := api.NewAuditHandler(db)
+	var oidch *api.OIDCHandler
+	if cfg := config.AppConfig.OIDC; cfg.Enabled {
+		if cfg.DiscoveryURL == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+			logger.Log.Fatal("oidc.discovery_url, oidc.client_id and oidc.redirect_url are required when OIDC is enabled")
+		}
+		if err := logic.ValidateOIDCMappings(cfg.GroupMappings); err != nil {
+			logger.Log.Fatalf("Invalid OIDC config: %v", err)
+		}
+		oidch = api.NewOIDCHandler(db, cfg, uh)
+	}
+	mcpHTTP := api.NewMCPHTTPServer(db, wm, callMgr)
+	mcpStop := make(chan struct{})
+	defer close(mcpStop)
+	go mcpHTTP.Run(mcpStop)
 	r.Any("/mcp", gin.WrapH(mcpHTTP.Handler()))
+	if config.AppConfig.Agents.Enabled {
+		r.GET("/agent/ws", api.NewAgentServer(db, wm).Handle)
+	}
+	if telegramBot != nil && config.AppConfig.Telegram.Mode == api.TelegramModeWebhook {
+		r.POST("/telegram/webhook", telegramBot.HandleWebhook)
+	}
+	if config.AppConfig.Twilio.Enabled {
+		th := api.NewTwilioHandler(db, wm)
+		twilioGroup := r.Group("/2010-04-01/Accounts/:sid")
+		twilioGroup.Use(api.TwilioAuth(db))
+		{
+			twilioGroup.POST("/Messages.json", th.CreateMessage)
+			twilioGroup.GET("/Messages.json", th.ListMessages)
+			twilioGroup.GET("/Messages/:message", th.GetMessage)
+		}
+	}
 
 	apiGroup := r.Group("/api/v1")
 	{
-		apiGroup.POST("/login", uh.Login)
+		apiGroup.POST("/login", ah.Record("auth.login"), uh.Login)
+		apiGroup.POST("/login/2fa", ah.Record("auth.login_2fa"), uh.LoginTwoFactor)
+		apiGroup.POST("/token/refresh", ah.Record("auth.refresh"), uh.RefreshToken)
+		apiGroup.GET("/oidc/config", oidch.Config)
+		if oidch != nil {
+			apiGroup.GET("/oidc/login", oidch.Login)
+			apiGroup.GET("/oidc/callback", oidch.Callback)
+			apiGroup.POST("/oidc/exchange", oidch.Exchange)
+		}
 
 		// Authenticated Routes
 		authGroup := apiGroup.Group("/")
 		authGroup.Use(api.AuthMiddleware(db))
 		authGroup.Use(api.APIKeyAllowedOnly())
 		{
-			authGroup.POST("/change_password", uh.ChangePassword)
+			authGroup.POST("/logout", ah.Record("auth.logout"), uh.Logout)
+			authGroup.POST("/change_password", ah.Record("user.change_password"), uh.ChangePassword)
+			authGroup.GET("/2fa", uh.TwoFactorStatus)
+			authGroup.POST("/2fa/setup", uh.SetupTwoFactor)
+			authGroup.POST("/2fa/enable", ah.Record("user.2fa_enable"), uh.EnableTwoFactor)
+			authGroup.POST("/2fa/disable", ah.Record("user.2fa_disable"), uh.DisableTwoFactor)
+			authGroup.POST("/2fa/recovery_codes", ah.Record("user.2fa_recovery_codes"), uh.RegenerateRecoveryCodes)
 			authGroup.GET("/apikeys", akh.ListMyAPIKeys)
-			authGroup.POST("/apikeys", akh.CreateMyAPIKey)
-			authGroup.POST("/apikeys/:id/rotate", akh.RotateMyAPIKey)
-			authGroup.DELETE("/apikeys/:id", akh.DeleteMyAPIKey)
+			authGroup.POST("/apikeys", ah.Record("apikey.create"), akh.CreateMyAPIKey)
+			authGroup.POST("/apikeys/:id/rotate", ah.Record("apikey.rotate"), akh.RotateMyAPIKey)
+			authGroup.DELETE("/apikeys/:id", ah.Record("apikey.delete"), akh.DeleteMyAPIKey)
+			authGroup.GET("/apikeys/:id/usage", qh.KeyUsage)
 
 			authGroup.GET("/modems", mh.ListModems)
 			authGroup.GET("/modems/:iccid", mh.GetModem)
-			authGroup.PUT("/modems/:iccid", mh.UpdateModem)
+			authGroup.PUT("/modems/:iccid", ah.Record("modem.update"), mh.UpdateModem)
 			authGroup.POST("/modems/:iccid/scan", mh.ScanNetworks)
-			authGroup.POST("/modems/:iccid/operator", mh.SetOperator)
-			authGroup.POST("/modems/:iccid/at", mh.ExecuteAT)
-			authGroup.POST("/modems/:iccid/input", mh.ExecuteInput)
+			authGroup.POST("/modems/:iccid/operator", ah.Record("modem.set_operator"), mh.SetOperator)
+			authGroup.POST("/modems/:iccid/at", ah.Record("modem.at"), mh.ExecuteAT)
+			authGroup.POST("/modems/:iccid/input", ah.Record("modem.input"), mh.ExecuteInput)
 			authGroup.GET("/modems/:iccid/call/state", mh.GetCallState)
 			authGroup.POST("/modems/:iccid/call/dial", mh.Dial)
 			authGroup.POST("/modems/:iccid/call/hangup", mh.Hangup)
+			authGroup.POST("/modems/:iccid/call/answer", mh.Answer)
+			authGroup.POST("/modems/:iccid/call/reject", mh.Reject)
+			authGroup.POST("/modems/:iccid/call/control", mh.CallControl)
 			authGroup.POST("/modems/:iccid/call/dtmf", mh.DTMF)
-			authGroup.POST("/modems/:iccid/reboot", mh.Reboot)
+			authGroup.GET("/modems/:iccid/services", mh.GetSupplementaryServices)
+			authGroup.PUT("/modems/:iccid/services/forwarding", ah.Record("modem.call_forwarding"), mh.SetCallForwarding)
+			authGroup.PUT("/modems/:iccid/services/call_waiting", ah.Record("modem.call_waiting"), mh.SetCallWaiting)
+			authGroup.PUT("/modems/:iccid/services/clir", ah.Record("modem.clir"), mh.SetCLIR)
+			authGroup.POST("/modems/:iccid/reboot", ah.Record("modem.reboot"), mh.Reboot)
 			authGroup.POST("/modems/:iccid/send", mh.SendSMS)
+			authGroup.POST("/pools/:name/send", ph.SendSMS)
 			authGroup.GET("/sms", sh.ListSMS)
+			authGroup.GET("/otp/wait", oh.WaitOTP)
+			authGroup.GET("/sms_rules", srh.ListSMSRules)
+			authGroup.POST("/sms_rules", ah.Record("sms_rule.create"), srh.CreateSMSRule)
+			authGroup.PUT("/sms_rules/:id", ah.Record("sms_rule.update"), srh.UpdateSMSRule)
+			authGroup.DELETE("/sms_rules/:id", ah.Record("sms_rule.delete"), srh.DeleteSMSRule)
 			authGroup.GET("/modems/:iccid/ws", mh.WS)
+			authGroup.GET("/events", eh.Stream)
+			authGroup.GET("/webhooks", wh.ListWebhooks)
+			authGroup.POST("/webhooks", ah.Record("webhook.create"), wh.CreateWebhook)
+			authGroup.PUT("/webhooks/:id", ah.Record("webhook.update"), wh.UpdateWebhook)
+			authGroup.DELETE("/webhooks/:id", ah.Record("webhook.delete"), wh.DeleteWebhook)
+			authGroup.POST("/webhooks/:id/test", wh.TestWebhook)
 
 			// Admin Only
 			adminGroup := authGroup.Group("/")
 			adminGroup.Use(api.AdminOnly())
 			{
-				adminGroup.GET("/webhooks", wh.ListWebhooks)
-				adminGroup.POST("/webhooks", wh.CreateWebhook)
-				adminGroup.DELETE("/webhooks/:id", wh.DeleteWebhook)
-				adminGroup.DELETE("/modems/:iccid", mh.DeleteModem)
+				adminGroup.GET("/webhooks/deliveries", wh.ListDeliveries)
+				adminGroup.GET("/webhooks/dead_letters", wh.ListDeadLetters)
+				adminGroup.POST("/webhooks/deliveries/:id/redeliver", wh.RedeliverDelivery)
+				adminGroup.GET("/webhooks/stats", wh.WebhookStats)
+				adminGroup.DELETE("/modems/:iccid", ah.Record("modem.delete"), mh.DeleteModem)
+
+				adminGroup.GET("/caller_rules", crh.ListCallerRules)
+				adminGroup.GET("/caller_rules/stats", crh.CallerRuleStats)
+				adminGroup.POST("/caller_rules", ah.Record("caller_rule.create"), crh.CreateCallerRule)
+				adminGroup.PUT("/caller_rules/:id", ah.Record("caller_rule.update"), crh.UpdateCallerRule)
+				adminGroup.POST("/caller_rules/:id/reset", ah.Record("caller_rule.reset"), crh.ResetCallerRuleStats)
+				adminGroup.DELETE("/caller_rules/:id", ah.Record("caller_rule.delete"), crh.DeleteCallerRule)
+
+				adminGroup.GET("/pools", ph.ListPools)
+				adminGroup.POST("/pools", ah.Record("pool.create"), ph.CreatePool)
+				adminGroup.PUT("/pools/:name", ah.Record("pool.update"), ph.UpdatePool)
+				adminGroup.DELETE("/pools/:name", ah.Record("pool.delete"), ph.DeletePool)
+
+				adminGroup.GET("/quotas", qh.ListQuotas)
+				adminGroup.POST("/quotas", ah.Record("quota.create"), qh.CreateQuota)
+				adminGroup.PUT("/quotas/:id", ah.Record("quota.update"), qh.UpdateQuota)
+				adminGroup.DELETE("/quotas/:id", ah.Record("quota.delete"), qh.DeleteQuota)
 
 				adminGroup.GET("/users", uh.ListUsers)
-				adminGroup.POST("/users", uh.CreateUser)
+				adminGroup.POST("/users", ah.Record("user.create"), uh.CreateUser)
 				adminGroup.GET("/users/:id/permissions", uh.ListUserPermissions)
-				adminGroup.PUT("/users/:id/permissions", uh.UpdateUserPermissions)
-				adminGroup.DELETE("/users/:id", uh.DeleteUser)
+				adminGroup.PUT("/users/:id/permissions", ah.Record("user.permissions"), uh.UpdateUserPermissions)
+				adminGroup.PUT("/users/:id/telegram", ah.Record("user.telegram"), uh.UpdateUserTelegram)
+				adminGroup.DELETE("/users/:id", ah.Record("user.delete"), uh.DeleteUser)
+				adminGroup.DELETE("/users/:id/2fa", ah.Record("user.reset_2fa"), uh.ResetUserTwoFactor)
+				adminGroup.GET("/security/settings", uh.GetSecuritySettings)
+				adminGroup.PUT("/security/settings", ah.Record("security.settings"), uh.UpdateSecuritySettings)
+
+				adminGroup.GET("/audit", ah.ListAuditLogs)
+				adminGroup.GET("/audit/export", ah.ExportAuditLogs)
 			}
 		}
 	}
@@ -180,6 +354,23 @@ func main() {
 	}
 }
 
+// accessLogFormatter is gin's default access log line with the token query
+// parameter of the streaming endpoints redacted.
+func accessLogFormatter(param gin.LogFormatterParams) string {
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		param.StatusCode,
+		param.Latency,
+		param.ClientIP,
+		param.Method,
+		logic.RedactQueryToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
 func initDB() *gorm.DB {
 	var db *gorm.DB
 	var err error
@@ -249,7 +440,25 @@ func autoMigrateSchema(db *gorm.DB) error {
 	if err := migrateLegacyUserModemPermissionColumns(db); err != nil {
 		return err
 	}
-	return db.AutoMigrate(&model.User{}, &model.Modem{}, &model.SMS{}, &model.Webhook{}, &model.UserModemPermission{}, &model.APIKey{})
+	if err := db.AutoMigrate(&model.User{}, &model.Modem{}, &model.SMS{}, &model.Webhook{}, &model.UserModemPermission{}, &model.APIKey{}, &model.CallerRule{}, &model.SMSRule{}, &model.WebhookDelivery{}, &model.TelegramMessage{}, &model.TwilioMessage{}, &model.ModemPool{}, &model.ModemPoolMember{}, &model.SMSQuota{}, &model.SMSUsage{}, &model.AuditLog{}, &model.AuthSession{}, &model.RecoveryCode{}, &model.AppSetting{}); err != nil {
+		return err
+	}
+	return migrateTelegramSlackWebhooks(db)
+}
+
+// migrateTelegramSlackWebhooks moves webhooks that were saved as Telegram but
+// post to Slack, which older versions detected by URL, to the slack platform.
+func migrateTelegramSlackWebhooks(db *gorm.DB) error {
+	res := db.Model(&model.Webhook{}).
+		Where("platform = ? AND url LIKE ?", "telegram", "%slack.com%").
+		Update("platform", "slack")
+	if res.Error != nil {
+		return fmt.Errorf("move Slack webhooks off the telegram platform: %w", res.Error)
+	}
+	if res.RowsAffected > 0 {
+		logger.Log.Infof("Moved %d Slack webhook(s) from the telegram to the slack platform", res.RowsAffected)
+	}
+	return nil
 }
 
 func migrateLegacyModemSIPColumns(db *gorm.DB) error {
@@ -337,6 +546,8 @@ func registerSIPModemCallStateListener(wm *worker.Manager, callMgr *calling.Mana
 			Incoming:        state.Incoming,
 			Voice:           state.Voice,
 			IncomingRinging: state.IncomingRinging,
+			Waiting:         state.Waiting,
+			Calls:           len(state.Calls),
 			UpdatedAt:       state.UpdatedAt,
 		}
 		if !w.IsUACReady() {
@@ -419,7 +630,7 @@ func syncSIPInboundLines(db *gorm.DB, wm *worker.Manager, callMgr *calling.Manag
 				if w == nil {
 					return fmt.Errorf("modem %s not active", usedICCID)
 				}
-				return w.Dial(number)
+				return w.Dial(number, "")
 			},
 			AnswerModem: func(usedICCID string) error {
 				w := wm.GetWorkerByICCID(usedICCID)
@@ -12,6 +12,8 @@ if (currentLang === 'zh') currentLang = 'zh-tw';
 let auth = {
     username: localStorage.getItem('sms_username'),
     token: localStorage.getItem('sms_token'),
+    refreshToken: localStorage.getItem('sms_refresh_token'),
+    expiresAt: Number(localStorage.getItem('sms_token_expires')) || 0,
     role: localStorage.getItem('sms_role'), // 'admin' or 'user'
 };
 
@@ -24,6 +26,7 @@ let callPC = null;
 let callLocalStream = null;
 let callWSState = 'idle';
 let callStatePollTimer = null;
+let callWaitingActive = false;
 let modemSettingsRefreshTimer = null;
 
 function closeCallSignaling() {
@@ -66,8 +69,22 @@ function refreshCallStateUI(iccid) {
         const uacReady = normalizeFlag(state && state.uac_ready);
         const callState = state && state.state ? String(state.state) : 'idle';
         const callActive = callState === 'dialing' || callState === 'in_call';
+        const incomingRinging = normalizeFlag(state && state.incoming_ringing) && state.call_mode !== 'sip';
+        const calls = state && Array.isArray(state.calls) ? state.calls : [];
+        const waitingLeg = calls.find(function (leg) { return leg.state === 'waiting'; });
+        callWaitingActive = normalizeFlag(state && state.waiting) && state.call_mode !== 'sip';
+
+        let incomingNumber = state && state.number ? state.number : '';
+        if (callWaitingActive && waitingLeg) {
+            incomingNumber = waitingLeg.number || '';
+        }
 
         $('#call-status').text(`Call state: ${callState}${state && state.reason ? ` (${state.reason})` : ''}`);
+        $('#call-incoming-label').text(callWaitingActive ? 'Call waiting' : 'Incoming call');
+        $('#btn-call-answer').text(callWaitingActive ? 'Hold & Answer' : 'Answer');
+        $('#call-incoming-number').text(incomingNumber || 'Unknown');
+        $('#call-incoming').toggleClass('d-none', !(incomingRinging || callWaitingActive) || (hasUACFlag && !uacReady));
+        renderCallLegs(calls);
 
         if (hasUACFlag && !uacReady) {
             $('#call-panel').addClass('d-none');
@@ -94,6 +111,62 @@ function refreshCallStateUI(iccid) {
     });
 }
 
+function renderCallLegs(calls) {
+    const list = $('#call-legs-list');
+    list.empty();
+    if (calls.length < 2) {
+        $('#call-legs').addClass('d-none');
+        return;
+    }
+
+    calls.forEach(function (leg) {
+        const label = `${escapeHTML(leg.number || 'Unknown')} <span class="text-secondary">${escapeHTML(leg.state)}${leg.multiparty ? ', conference' : ''}</span>`;
+        list.append(`<li class="list-group-item d-flex align-items-center justify-content-between px-0">
+            <span class="mono">#${Number(leg.index)} ${label}</span>
+            <button class="btn btn-sm btn-outline-danger btn-call-release" type="button" data-index="${Number(leg.index)}">Release</button>
+        </li>`);
+    });
+
+    const hasActive = calls.some(function (leg) { return leg.state === 'active'; });
+    const hasHeld = calls.some(function (leg) { return leg.state === 'held'; });
+    $('#btn-call-swap').prop('disabled', !hasHeld);
+    $('#btn-call-conference').prop('disabled', !(hasActive && hasHeld));
+    $('#call-legs').removeClass('d-none');
+}
+
+function sendCallControl(iccid, action, index) {
+    const statusDiv = $('#call-status');
+    $.ajax({
+        url: `/api/v1/modems/${iccid}/call/control`,
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ action: action, index: index || 0 }),
+        success: function (resp) {
+            if (resp && resp.call_state && resp.call_state.state === 'idle') {
+                closeCallSignaling();
+            }
+            refreshCallStateUI(iccid);
+        },
+        error: function (xhr) {
+            const msg = xhr.responseJSON && xhr.responseJSON.error ? xhr.responseJSON.error : 'Call control failed';
+            statusDiv.html(`<span class="text-danger">${escapeHTML(msg)}</span>`);
+            refreshCallStateUI(iccid);
+        }
+    });
+}
+
+$(document).on('click', '#btn-call-swap', function () {
+    sendCallControl($('#call-iccid').val(), 'swap');
+});
+
+$(document).on('click', '#btn-call-conference', function () {
+    sendCallControl($('#call-iccid').val(), 'conference');
+});
+
+$(document).on('click', '.btn-call-release', function () {
+    sendCallControl($('#call-iccid').val(), 'release', Number($(this).data('index')));
+});
+
 async function ensureCallSignaling(iccid) {
     if (callPC && callWS && callWS.readyState === WebSocket.OPEN && callPC.connectionState === 'connected') {
         return;
@@ -192,6 +265,8 @@ async function ensureCallSignaling(iccid) {
                     await callPC.setRemoteDescription(msg.answer);
                 } else if (msg.type === 'candidate' && msg.candidate) {
                     await callPC.addIceCandidate(msg.candidate);
+                } else if (msg.type === 'incoming' || msg.type === 'call_state') {
+                    refreshCallStateUI(iccid);
                 } else if (msg.type === 'error') {
                     reject(new Error(msg.text || 'Signal error'));
                 }
@@ -212,16 +287,93 @@ $.ajaxSetup({
     },
     error: function (xhr) {
         if (xhr.status === 401) {
-            // Token expired or invalid
-            localStorage.removeItem('sms_username');
-            localStorage.removeItem('sms_token');
-            localStorage.removeItem('sms_role');
-            auth = {};
-            checkAuth();
+            // Access token expired or session revoked
+            refreshSession().fail(clearAuth);
+        } else if (xhr.status === 403 && xhr.responseJSON && xhr.responseJSON.code === 'totp_enrollment_required') {
+            twoFactorEnrollmentPending = true;
+            stopEventStream();
+            showTwoFactor();
         }
     }
 });
 
+function saveSession(resp) {
+    auth.username = resp.user.username;
+    auth.role = resp.user.role;
+    auth.token = resp.token;
+    auth.refreshToken = resp.refresh_token;
+    auth.expiresAt = Date.now() + resp.expires_in * 1000;
+
+    localStorage.setItem('sms_username', auth.username);
+    localStorage.setItem('sms_role', auth.role);
+    localStorage.setItem('sms_token', auth.token);
+    localStorage.setItem('sms_refresh_token', auth.refreshToken);
+    localStorage.setItem('sms_token_expires', String(auth.expiresAt));
+    scheduleTokenRefresh();
+}
+
+function clearAuth() {
+    clearTimeout(tokenRefreshTimer);
+    ['sms_username', 'sms_token', 'sms_refresh_token', 'sms_token_expires', 'sms_role'].forEach(k => localStorage.removeItem(k));
+    auth = {};
+    twoFactorEnrollmentPending = false;
+    checkAuth();
+}
+
+// Access tokens are short-lived; renew them a minute before they expire.
+let tokenRefreshTimer = null;
+let refreshRequest = null;
+
+function scheduleTokenRefresh() {
+    clearTimeout(tokenRefreshTimer);
+    if (!auth.refreshToken) return;
+    const delay = Math.max((auth.expiresAt || 0) - Date.now() - 60000, 5000);
+    tokenRefreshTimer = setTimeout(() => refreshSession().fail(clearAuth), delay);
+}
+
+function refreshSession() {
+    if (refreshRequest) return refreshRequest;
+    // Another tab may have refreshed already.
+    const stored = localStorage.getItem('sms_refresh_token');
+    if (stored && stored !== auth.refreshToken && localStorage.getItem('sms_token')) {
+        auth.refreshToken = stored;
+        auth.token = localStorage.getItem('sms_token');
+        auth.expiresAt = Number(localStorage.getItem('sms_token_expires')) || 0;
+        if (auth.expiresAt - Date.now() > 60000) {
+            scheduleTokenRefresh();
+            return $.Deferred().resolve().promise();
+        }
+    }
+    if (!auth.refreshToken) return $.Deferred().reject().promise();
+
+    refreshRequest = $.ajax({
+        url: '/api/v1/token/refresh',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ refresh_token: auth.refreshToken }),
+        global: false,
+        error: null,
+    }).done(function (resp) {
+        saveSession(resp);
+        // The event stream reconnects with the token in its URL.
+        if (eventSource && eventSource.readyState !== EventSource.OPEN) {
+            stopEventStream();
+            startEventStream();
+        }
+    }).always(function () {
+        refreshRequest = null;
+    });
+    return refreshRequest;
+}
+
+function doLogout() {
+    $.ajax({
+        url: '/api/v1/logout',
+        method: 'POST',
+        error: null,
+    }).always(clearAuth);
+}
+
 // Country Code Mapping
 const countryCodeMap = {
     '1': 'US', '7': 'RU', '20': 'EG', '27': 'ZA', '30': 'GR', '31': 'NL',
@@ -296,11 +448,18 @@ $(document).ready(function () {
 
     // Init Logic with async I18n load
     loadI18n(currentLang).then(() => {
-        checkAuth();
+        if (!finishOIDCLogin()) checkAuth();
     });
+    loadOIDCConfig();
 
     // Event Listeners
     $('#btn-login').click(doLogin);
+    $('#btn-logout').click(doLogout);
+    $('#btn-tfa-setup').click(setupTwoFactor);
+    $('#btn-tfa-enable').click(enableTwoFactor);
+    $('#btn-tfa-disable').click(disableTwoFactor);
+    $('#btn-tfa-regenerate').click(regenerateRecoveryCodes);
+    $('#require-admin-2fa').change(saveSecuritySettings);
     $('#lang-select').change(function () {
         currentLang = $(this).val();
         localStorage.setItem('sms_lang', currentLang);
@@ -332,8 +491,11 @@ $(document).ready(function () {
     // User Mgmt
     $('#btn-save-user').click(saveUser);
 
-    // Auto Refresh SMS
+    // Auto Refresh SMS, unless the event stream is delivering updates
     setInterval(() => {
+        if (eventSource && eventSource.readyState === EventSource.OPEN) {
+            return;
+        }
         if (!$('#view-sms').hasClass('d-none') && auth.username) {
             // Only refresh if on first page to allow reading logs without jumps?
             // User requested pagination. Usually auto-refresh interrupts pagination.
@@ -400,11 +562,18 @@ function applyI18n(data) {
 
 function checkAuth() {
     if (!auth.username) {
+        stopEventStream();
         $('#login-app').removeClass('d-none');
         $('#dashboard-app').addClass('d-none');
         return;
     }
 
+    // Renew a token that expired while the page was closed before using it.
+    if (auth.refreshToken && (auth.expiresAt || 0) <= Date.now() && !refreshRequest) {
+        refreshSession().done(checkAuth).fail(clearAuth);
+        return;
+    }
+
     // Show Dashboard
     $('#login-app').addClass('d-none');
     $('#dashboard-app').removeClass('d-none');
@@ -422,9 +591,104 @@ function checkAuth() {
     renderMCPExamples();
     loadModems(); // Preload for filter
     loadSMS();
+    scheduleTokenRefresh();
+    startEventStream();
+}
+
+// Live updates from /api/v1/events; EventSource resumes with Last-Event-ID.
+let eventSource = null;
+let modemRefreshTimer = null;
+
+function startEventStream() {
+    if (eventSource || !window.EventSource || !auth.token || twoFactorEnrollmentPending) return;
+    eventSource = new EventSource('/api/v1/events?types=sms,modem&token=' + encodeURIComponent(auth.token));
+    eventSource.addEventListener('sms.received', refreshSMSFromEvent);
+    ['modem.online', 'modem.offline', 'modem.signal', 'modem.registration'].forEach(type => {
+        eventSource.addEventListener(type, scheduleModemRefresh);
+    });
+    eventSource.addEventListener('stream.reset', function () {
+        scheduleModemRefresh();
+        refreshSMSFromEvent();
+    });
+    // A rejected reconnect (expired token) closes the stream for good.
+    eventSource.onerror = function () {
+        if (eventSource && eventSource.readyState === EventSource.CLOSED) {
+            stopEventStream();
+            refreshSession().done(startEventStream);
+        }
+    };
+}
+
+function stopEventStream() {
+    if (eventSource) {
+        eventSource.close();
+        eventSource = null;
+    }
+}
+
+function refreshSMSFromEvent() {
+    if (!$('#view-sms').hasClass('d-none') && currentSMSPage === 1) {
+        loadSMS(1);
+    }
+}
+
+function scheduleModemRefresh() {
+    clearTimeout(modemRefreshTimer);
+    modemRefreshTimer = setTimeout(loadModems, 1000);
 }
 
+// Single sign-on returns to /?oidc_code=... (or oidc_error) from the callback.
+function finishOIDCLogin() {
+    const params = new URLSearchParams(location.search);
+    const code = params.get('oidc_code');
+    const error = params.get('oidc_error');
+    if (!code && !error) return false;
+    history.replaceState(null, '', location.pathname);
+
+    if (error) {
+        alert(error);
+        checkAuth();
+        return true;
+    }
+    $.ajax({
+        url: '/api/v1/oidc/exchange',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ code: code }),
+        success: function (resp) {
+            if (resp.mfa_required) {
+                checkAuth();
+                mfaToken = resp.mfa_token;
+                $('#login-2fa').removeClass('d-none');
+                $('#login-code').val('').focus();
+                return;
+            }
+            saveSession(resp);
+            checkAuth();
+        },
+        error: function () {
+            alert("Login Failed");
+            checkAuth();
+        }
+    });
+    return true;
+}
+
+function loadOIDCConfig() {
+    $.get('/api/v1/oidc/config', function (resp) {
+        if (resp && resp.enabled) {
+            $('#btn-oidc-login span').text(resp.button_text);
+            $('#btn-oidc-login').removeClass('d-none');
+        }
+    });
+}
+
+// Set while the login waits for the two-factor code.
+let mfaToken = null;
+
 function doLogin() {
+    if (mfaToken) return doLoginTwoFactor();
+
     const u = $('#username').val();
     const p = $('#password').val();
     if (!u || !p) return;
@@ -437,15 +701,14 @@ function doLogin() {
         contentType: 'application/json',
         data: JSON.stringify({ username: u, password: p }),
         success: function (resp) {
-            auth.username = resp.user.username;
-            auth.role = resp.user.role;
-            auth.token = resp.token;
-
-            localStorage.setItem('sms_username', auth.username);
-            localStorage.setItem('sms_role', auth.role);
-            localStorage.setItem('sms_token', auth.token); // Not used by backend yet but good practice
-
-            checkAuth();
+            $('#btn-login').prop('disabled', false).text("Login");
+            if (resp.mfa_required) {
+                mfaToken = resp.mfa_token;
+                $('#login-2fa').removeClass('d-none');
+                $('#login-code').val('').focus();
+                return;
+            }
+            finishLogin(resp);
         },
         error: function () {
             alert("Login Failed");
@@ -454,6 +717,51 @@ function doLogin() {
     });
 }
 
+function doLoginTwoFactor() {
+    const code = $('#login-code').val().trim();
+    if (!code) return;
+
+    $('#btn-login').prop('disabled', true).text(window.t('validating') || 'Validating...');
+
+    $.ajax({
+        url: '/api/v1/login/2fa',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ mfa_token: mfaToken, code: code }),
+        global: false,
+        error: null,
+        success: function (resp) {
+            $('#btn-login').prop('disabled', false).text("Login");
+            if (resp.recovery_codes_left !== undefined) {
+                alert("Recovery code used, " + resp.recovery_codes_left + " left.");
+            }
+            finishLogin(resp);
+        }
+    }).fail(function (xhr) {
+        $('#btn-login').prop('disabled', false).text("Login");
+        const msg = (xhr.responseJSON && xhr.responseJSON.error) || "Login Failed";
+        alert(msg);
+        // The login expired or ran out of attempts; start over.
+        if (msg !== "Invalid two-factor code") resetLoginForm();
+        $('#login-code').val('');
+    });
+}
+
+function resetLoginForm() {
+    mfaToken = null;
+    $('#login-2fa').addClass('d-none');
+    $('#login-code').val('');
+}
+
+function finishLogin(resp) {
+    resetLoginForm();
+    $('#password').val('');
+    twoFactorEnrollmentPending = !!resp.totp_enrollment_required;
+    saveSession(resp);
+    checkAuth();
+    if (twoFactorEnrollmentPending) showTwoFactor();
+}
+
 const SMS_LIMIT = 20;
 
 function loadSMS(page = 1) {
@@ -484,6 +792,14 @@ function loadSMS(page = 1) {
                 const contentDiv = $('<div>').addClass('mb-1').text(sms.content); // Safer .text()
 
                 const footer = $('<small>').addClass('text-secondary').html(`<i class="bi bi-sim"></i> ${getFlagFromICCID(sms.iccid)} ${sms.iccid}`);
+                if (sms.otp) {
+                    const label = sms.otp_service ? `${sms.otp_service} ${sms.otp}` : sms.otp;
+                    const badge = $('<span>').addClass('badge bg-success ms-2').css('cursor', 'pointer')
+                        .attr('title', `One-time code, confidence ${sms.otp_confidence}. Click to copy.`)
+                        .text(label)
+                        .click(() => navigator.clipboard && navigator.clipboard.writeText(sms.otp));
+                    footer.append(badge);
+                }
 
                 div.append(header).append(contentDiv).append(footer);
                 list.append(div);
@@ -562,12 +878,8 @@ function loadModems() {
                     <button class="btn btn-sm btn-outline-secondary" onclick="showSMSModal('${m.iccid}')">SMS</button>
                     ${callSupported ? `<button class="btn btn-sm btn-outline-secondary" onclick="showCallModal('${m.iccid}')">Call</button>` : ''}
                     <button class="btn btn-sm btn-outline-secondary" onclick="showModemSettings('${m.iccid}')">${window.t('settings') || 'Settings'}</button>
+                    <button class="btn btn-sm btn-outline-secondary" onclick="manageWebhooks('${m.iccid}')">${window.t('webhooks') || 'Webhooks'}</button>
                 `;
-                const adminButtons = auth.role === 'admin'
-                    ? `
-                        <button class="btn btn-sm btn-outline-secondary" onclick="manageWebhooks('${m.iccid}')">${window.t('webhooks') || 'Webhooks'}</button>
-                      `
-                    : '';
 
                 list.append(`
                     <article class="modem-card">
@@ -584,7 +896,6 @@ function loadModems() {
                         ${sipListenerLine}
                         <div class="d-flex flex-wrap gap-2">
                             ${commonButtons}
-                            ${adminButtons}
                         </div>
                     </article>
                 `);
@@ -629,13 +940,53 @@ function loadUsers() {
                     <td>${u.username}</td>
                     <td>${u.role}</td>
                     <td>${u.allowed_modems || '*'}</td>
+                    <td>${u.telegram_id || '-'}</td>
+                    <td>${u.totp_enabled ? '<i class="bi bi-shield-check text-success" title="Enabled"></i>' : '-'}</td>
                     <td>
+                        <button class="btn btn-sm btn-outline-secondary" onclick="linkUserTelegram(${u.id}, ${u.telegram_id || 0})" title="Link Telegram"><i class="bi bi-telegram"></i></button>
+                        ${u.totp_enabled ? `<button class="btn btn-sm btn-outline-secondary" onclick="resetUserTwoFactor(${u.id})" title="Reset 2FA"><i class="bi bi-shield-x"></i></button>` : ''}
                         <button class="btn btn-sm btn-danger" onclick="deleteUser(${u.id})">Del</button>
                     </td>
                 </tr>
             `);
         });
     });
+    $.get('/api/v1/security/settings', function (resp) {
+        $('#require-admin-2fa').prop('checked', !!resp.require_admin_2fa);
+    });
+}
+
+function saveSecuritySettings() {
+    const enabled = $(this).is(':checked');
+    if (enabled && !confirm("Admins without two-factor authentication will have to set it up before they can continue. Continue?")) {
+        $(this).prop('checked', false);
+        return;
+    }
+    $.ajax({
+        url: '/api/v1/security/settings',
+        method: 'PUT',
+        contentType: 'application/json',
+        data: JSON.stringify({ require_admin_2fa: enabled }),
+        success: function (resp) {
+            $('#require-admin-2fa').prop('checked', !!resp.require_admin_2fa);
+        },
+        error: function (err) {
+            alert("Error: " + err.responseText);
+            loadUsers();
+        }
+    });
+}
+
+window.resetUserTwoFactor = function (id) {
+    if (!confirm("Reset two-factor authentication? The user can log in with the password alone until they set it up again.")) return;
+    $.ajax({
+        url: '/api/v1/users/' + id + '/2fa',
+        method: 'DELETE',
+        success: loadUsers,
+        error: function (err) {
+            alert("Error: " + err.responseText);
+        }
+    });
 }
 
 window.showAddUser = function () {
@@ -665,6 +1016,26 @@ function saveUser() {
     });
 }
 
+window.linkUserTelegram = function (id, current) {
+    const value = prompt("Telegram user ID (the bot's /start reply shows it; 0 to unlink):", current || '');
+    if (value === null) return;
+    const telegramID = parseInt(value.trim() || '0', 10);
+    if (isNaN(telegramID) || telegramID < 0) {
+        alert("Invalid Telegram user ID");
+        return;
+    }
+    $.ajax({
+        url: '/api/v1/users/' + id + '/telegram',
+        method: 'PUT',
+        contentType: 'application/json',
+        data: JSON.stringify({ telegram_id: telegramID }),
+        success: loadUsers,
+        error: function (err) {
+            alert("Error: " + err.responseText);
+        }
+    });
+}
+
 window.deleteUser = function (id) {
     if (confirm("Delete user?")) {
         $.ajax({
@@ -928,19 +1299,100 @@ window.manageWebhooks = function (iccid) {
     $('#webhookListModal').modal('show');
 }
 
+let webhooksByID = {};
+
 function loadWebhooks(iccid) {
-    $.get('/api/v1/webhooks?iccid=' + iccid, function (data) { // Ensure using admin route
-        const body = $('#wh-list-body');
+    const statsURL = auth.role === 'admin' ? '/api/v1/webhooks/stats?iccid=' + iccid : null;
+    const stats = statsURL ? $.get(statsURL) : $.Deferred().resolve([]);
+    stats.always(function (stats) {
+        const byWebhook = {};
+        (Array.isArray(stats) ? stats : []).forEach(st => { byWebhook[st.webhook_id] = st; });
+
+        $.get('/api/v1/webhooks?iccid=' + iccid, function (data) {
+            const body = $('#wh-list-body');
+            body.empty();
+            webhooksByID = {};
+            data.forEach(w => {
+                webhooksByID[w.id] = w;
+                const st = byWebhook[w.id];
+                const target = w.platform === 'email' ? w.email_to : w.url;
+                const delivery = st
+                    ? `${Math.round(st.success_rate * 100)}% <small class="text-muted">(${st.success}/${st.success + st.dead}${st.pending ? `, ${st.pending} pending` : ''})</small>`
+                    : '-';
+                body.append(`
+                    <tr>
+                        <td>${w.platform}${w.iccid === '*' ? ' <span class="badge text-bg-secondary">all modems</span>' : (w.iccids ? ' <span class="badge text-bg-secondary">group</span>' : '')}</td>
+                        <td><div class="text-truncate" style="max-width: 150px;" title="${target}">${target}</div></td>
+                        <td>${w.channel_id ? w.channel_id : '-'}</td>
+                        <td>${w.template || 'Default'}</td>
+                        <td>${w.method || 'POST'}${w.has_secret ? ' <i class="bi bi-shield-lock" title="Signed"></i>' : ''}</td>
+                        <td>${delivery}</td>
+                        <td>
+                            <div class="form-check form-switch mb-0">
+                                <input class="form-check-input" type="checkbox" ${w.enabled ? 'checked' : ''} onchange="toggleWebhook(${w.id}, this.checked)">
+                            </div>
+                        </td>
+                        <td class="text-nowrap">
+                            <button class="btn btn-sm btn-outline-secondary" title="Send test" onclick="testWebhook(${w.id})"><i class="bi bi-send"></i></button>
+                            <button class="btn btn-sm btn-outline-secondary" title="Edit" onclick="editWebhook(${w.id})"><i class="bi bi-pencil"></i></button>
+                            <button class="btn btn-sm btn-danger" onclick="deleteWebhook(${w.id})"><i class="bi bi-trash"></i></button>
+                        </td>
+                    </tr>
+                `);
+            });
+        });
+    });
+    if (auth.role === 'admin') {
+        loadDeadLetters(iccid);
+    } else {
+        $('#wh-dead-section').addClass('d-none');
+    }
+}
+
+window.toggleWebhook = function (id, enabled) {
+    $.ajax({
+        url: '/api/v1/webhooks/' + id,
+        method: 'PUT',
+        contentType: 'application/json',
+        data: JSON.stringify({ enabled: enabled }),
+        error: function (err) {
+            alert("Error: " + err.responseText);
+            loadWebhooks(currentICCIDForWebhook);
+        }
+    });
+}
+
+window.testWebhook = function (id) {
+    $.ajax({
+        url: '/api/v1/webhooks/' + id + '/test',
+        method: 'POST',
+        success: function (r) {
+            const status = r.error ? r.error : ('HTTP ' + r.status_code);
+            alert(`${r.ok ? 'Test delivered' : 'Test failed'}: ${status} (${r.latency_ms} ms)${r.body ? '\n\n' + r.body : ''}`);
+        },
+        error: function (err) {
+            alert("Error: " + err.responseText);
+        }
+    });
+}
+
+function loadDeadLetters(iccid) {
+    $.get('/api/v1/webhooks/dead_letters?limit=20&iccid=' + iccid, function (data) {
+        const list = data.deliveries || [];
+        const body = $('#wh-dead-body');
         body.empty();
-        data.forEach(w => {
+        $('#wh-dead-section').toggleClass('d-none', list.length === 0);
+        list.forEach(d => {
+            const reason = d.error || (d.response_code ? `HTTP ${d.response_code}` : '-');
             body.append(`
                 <tr>
-                    <td>${w.platform}</td>
-                    <td><div class="text-truncate" style="max-width: 150px;" title="${w.url}">${w.url}</div></td>
-                    <td>${w.channel_id ? w.channel_id : '-'}</td>
-                    <td>${w.template || 'Default'}</td>
+                    <td>${d.webhook_id}</td>
+                    <td>${d.sms_id}</td>
+                    <td>${d.attempts}</td>
+                    <td><div class="text-truncate" style="max-width: 220px;" title="${$('<div>').text(reason).html()}">${$('<div>').text(reason).html()}</div></td>
+                    <td>${d.last_attempt_at ? new Date(d.last_attempt_at).toLocaleString() : '-'}</td>
                     <td>
-                        <button class="btn btn-sm btn-danger" onclick="deleteWebhook(${w.id})"><i class="bi bi-trash"></i></button>
+                        <button class="btn btn-sm btn-outline-secondary" onclick="redeliverWebhook(${d.id})"><i class="bi bi-arrow-repeat"></i></button>
                     </td>
                 </tr>
             `);
@@ -948,24 +1400,143 @@ function loadWebhooks(iccid) {
     });
 }
 
+window.redeliverWebhook = function (id) {
+    $.ajax({
+        url: '/api/v1/webhooks/deliveries/' + id + '/redeliver',
+        method: 'POST',
+        success: function (d) {
+            if (d.status !== 'success') {
+                alert("Redelivery failed: " + (d.error || ('HTTP ' + d.response_code)));
+            }
+            loadWebhooks(currentICCIDForWebhook);
+        },
+        error: function (err) {
+            alert("Error: " + err.responseText);
+        }
+    });
+}
+
 window.showAddWebhook = function () {
     $('#webhookModal').modal('show');
+    $('#wh-modal-title').text('Add Webhook');
+    $('#btn-test-webhook').addClass('d-none');
+    $('#wh-id').val("");
+    $('#wh-enabled').prop('checked', true);
+    $('#wh-secret').attr('placeholder', 'empty = unsigned');
     $('#wh-iccid').val(currentICCIDForWebhook);
     $('#wh-platform').val("generic");
     $('#wh-url').val("");
     $('#wh-channel-id').val("");
     $('#wh-template').val("");
-    $('#wh-channel-group').addClass('d-none');
+    $('#wh-all-modems').prop('checked', false);
+    $('#wh-iccids').val("");
+    $('#wh-sender-pattern').val("");
+    $('#wh-content-regex').val("");
+    $('#wh-keywords').val("");
+    $('#wh-message-types').val("");
+    $('#wh-method').val("POST");
+    $('#wh-content-type').val("application/json");
+    $('#wh-headers').val("");
+    $('#wh-secret').val("");
+    $('#wh-title').val("");
+    $('#wh-priority').val("normal");
+    $('#wh-markdown').prop('checked', false);
+    $('#wh-token').val("");
+    $('#wh-smtp-host').val("");
+    $('#wh-smtp-port').val("");
+    $('#wh-smtp-security').val("starttls");
+    $('#wh-smtp-username').val("");
+    $('#wh-smtp-password').val("");
+    $('#wh-email-from').val("");
+    $('#wh-email-to').val("");
+    updateWebhookPlatformFields();
 }
 
-$('#wh-platform').change(function () {
-    if ($(this).val() === 'telegram') {
-        $('#wh-channel-group').removeClass('d-none');
-    } else {
-        $('#wh-channel-group').addClass('d-none');
-    }
+window.editWebhook = function (id) {
+    const w = webhooksByID[id];
+    if (!w) return;
+    showAddWebhook();
+    $('#wh-modal-title').text('Edit Webhook');
+    $('#btn-test-webhook').removeClass('d-none');
+    $('#wh-id').val(w.id);
+    $('#wh-enabled').prop('checked', !!w.enabled);
+    $('#wh-iccid').val(w.iccid === '*' ? currentICCIDForWebhook : w.iccid);
+    $('#wh-all-modems').prop('checked', w.iccid === '*');
+    $('#wh-iccids').val(w.iccids || "");
+    $('#wh-platform').val(w.platform || "generic");
+    $('#wh-url').val(w.url || "");
+    $('#wh-channel-id').val(w.channel_id || "");
+    $('#wh-template').val(w.template || "");
+    $('#wh-sender-pattern').val(w.sender_pattern || "");
+    $('#wh-content-regex').val(w.content_regex || "");
+    $('#wh-keywords').val(w.keywords || "");
+    $('#wh-message-types').val(w.message_types || "");
+    $('#wh-method').val(w.method || "POST");
+    $('#wh-content-type').val(w.content_type || "application/json");
+    $('#wh-headers').val(Object.entries(w.headers || {}).map(([k, v]) => `${k}: ${v}`).join('\n'));
+    $('#wh-secret').attr('placeholder', w.has_secret ? 'unchanged' : 'empty = unsigned');
+    $('#wh-title').val(w.title || "");
+    $('#wh-priority').val(w.priority || "normal");
+    $('#wh-markdown').prop('checked', !!w.markdown);
+    $('#wh-token').val(w.has_token ? '********' : "");
+    $('#wh-smtp-host').val(w.smtp_host || "");
+    $('#wh-smtp-port').val(w.smtp_port || "");
+    $('#wh-smtp-security').val(w.smtp_security || "starttls");
+    $('#wh-smtp-username').val(w.smtp_username || "");
+    $('#wh-smtp-password').val(w.has_smtp_password ? '********' : "");
+    $('#wh-email-from').val(w.email_from || "");
+    $('#wh-email-to').val(w.email_to || "");
+    updateWebhookPlatformFields();
+}
+
+$('#btn-test-webhook').click(function () {
+    testWebhook($('#wh-id').val());
 });
 
+$('#btn-wh-generate-secret').click(function () {
+    const buf = new Uint8Array(32);
+    crypto.getRandomValues(buf);
+    $('#wh-secret').val('whsec_' + Array.from(buf, b => b.toString(16).padStart(2, '0')).join(''));
+});
+
+function parseWebhookHeaders(text) {
+    const headers = {};
+    for (const line of text.split('\n')) {
+        if (!line.trim()) continue;
+        const idx = line.indexOf(':');
+        if (idx <= 0) {
+            throw new Error(`Invalid header line: ${line}`);
+        }
+        headers[line.slice(0, idx).trim()] = line.slice(idx + 1).trim();
+    }
+    return headers;
+}
+
+const webhookURLLabels = {
+    matrix: 'Homeserver URL',
+    ntfy: 'Topic URL',
+    gotify: 'Server URL',
+    twilio: 'SMS URL'
+};
+
+const webhookChannelLabels = {
+    matrix: 'Room ID',
+    twilio: 'Account SID'
+};
+
+function updateWebhookPlatformFields() {
+    const platform = $('#wh-platform').val();
+    $('#wh-channel-group').toggleClass('d-none', !['telegram', 'matrix', 'twilio'].includes(platform));
+    $('#wh-channel-label').text(webhookChannelLabels[platform] || 'Channel ID');
+    $('#wh-url-group').toggleClass('d-none', platform === 'email');
+    $('#wh-url-label').text(webhookURLLabels[platform] || 'URL');
+    $('#wh-token-group').toggleClass('d-none', !['matrix', 'ntfy', 'gotify', 'twilio'].includes(platform));
+    $('#wh-token-label').text(platform === 'twilio' ? 'Auth Token (signs X-Twilio-Signature)' : 'Token');
+    $('#wh-email-group').toggleClass('d-none', platform !== 'email');
+}
+
+$('#wh-platform').change(updateWebhookPlatformFields);
+
 $('#btn-save-webhook').click(function () {
     const iccid = $('#wh-iccid').val();
     const platform = $('#wh-platform').val();
@@ -973,22 +1544,55 @@ $('#btn-save-webhook').click(function () {
     const channelId = $('#wh-channel-id').val();
     const template = $('#wh-template').val();
 
-    if (!url) {
+    if (!url && platform !== 'email' && platform !== 'telegram') {
         alert("URL is required");
         return;
     }
 
+    let headers;
+    try {
+        headers = parseWebhookHeaders($('#wh-headers').val());
+    } catch (e) {
+        alert(e.message);
+        return;
+    }
+
     const data = {
-        iccid: iccid,
+        iccid: $('#wh-all-modems').is(':checked') ? '*' : iccid,
+        iccids: $('#wh-all-modems').is(':checked') ? '' : $('#wh-iccids').val(),
+        sender_pattern: $('#wh-sender-pattern').val(),
+        content_regex: $('#wh-content-regex').val(),
+        keywords: $('#wh-keywords').val(),
+        message_types: $('#wh-message-types').val(),
         platform: platform,
         url: url,
         channel_id: channelId,
-        template: template
+        template: template,
+        title: $('#wh-title').val(),
+        priority: $('#wh-priority').val(),
+        markdown: $('#wh-markdown').is(':checked'),
+        token: $('#wh-token').val(),
+        smtp_host: $('#wh-smtp-host').val(),
+        smtp_port: parseInt($('#wh-smtp-port').val(), 10) || 0,
+        smtp_security: $('#wh-smtp-security').val(),
+        smtp_username: $('#wh-smtp-username').val(),
+        smtp_password: $('#wh-smtp-password').val(),
+        email_from: $('#wh-email-from').val(),
+        email_to: $('#wh-email-to').val(),
+        method: $('#wh-method').val(),
+        content_type: $('#wh-content-type').val(),
+        headers: headers,
+        enabled: $('#wh-enabled').is(':checked')
     };
+    const id = $('#wh-id').val();
+    // When editing, an empty secret keeps the stored one.
+    if (!id || $('#wh-secret').val()) {
+        data.secret = $('#wh-secret').val();
+    }
 
     $.ajax({
-        url: '/api/v1/webhooks',
-        method: 'POST',
+        url: id ? '/api/v1/webhooks/' + id : '/api/v1/webhooks',
+        method: id ? 'PUT' : 'POST',
         contentType: 'application/json',
         data: JSON.stringify(data),
         success: function () {
@@ -1115,6 +1719,7 @@ function populateModemSettingsForm(modem) {
     const current = modem || {};
     $('#modemModal').data('modem', current);
     $('#m-name').val(current.name || '');
+    $('#m-phone-number').val(current.phone_number || '');
     $('#m-operator').val(current.operator || '');
     $('#m-sip-enabled').prop('checked', normalizeFlag(current.sip_enabled));
     $('#m-sip-username').val(current.sip_username || '');
@@ -1146,6 +1751,7 @@ window.showModemSettings = function (iccid) {
     $('#m-iccid-title').text(iccid);
     $('#m-iccid').val(iccid);
     $('#m-name').val('');
+    $('#m-phone-number').val('');
     $('#m-operator').val('');
     $('#m-sip-enabled').prop('checked', false);
     $('#m-sip-username').val('');
@@ -1328,6 +1934,90 @@ $(document).on('click', '#btn-call-hangup', function () {
     });
 });
 
+$(document).on('click', '#btn-call-answer', function () {
+    const iccid = $('#call-iccid').val();
+    const statusDiv = $('#call-status');
+    const answerBtn = $(this);
+    const rejectBtn = $('#btn-call-reject');
+    const answeringWaiting = callWaitingActive;
+
+    answerBtn.prop('disabled', true);
+    rejectBtn.prop('disabled', true);
+    statusDiv.html('<span class="text-muted">Initializing microphone/WebRTC...</span>');
+
+    (async () => {
+        try {
+            await ensureCallSignaling(iccid);
+        } catch (error) {
+            statusDiv.html(`<span class="text-danger">${error.message || 'WebRTC init failed'}</span>`);
+            answerBtn.prop('disabled', false);
+            rejectBtn.prop('disabled', false);
+            return;
+        }
+
+        statusDiv.html('<span class="text-muted">Answering...</span>');
+
+        $.ajax({
+            url: `/api/v1/modems/${iccid}/call/answer`,
+            method: 'POST',
+            contentType: 'application/json',
+            data: '{}',
+            success: function (resp) {
+                const state = resp && resp.call_state ? resp.call_state.state : 'in_call';
+                const reason = resp && resp.call_state ? resp.call_state.reason : '';
+                statusDiv.html(`<span class="text-success">Call state: ${state}${reason ? ` (${reason})` : ''}</span>`);
+                refreshCallStateUI(iccid);
+            },
+            error: function (xhr) {
+                let msg = 'Answer failed';
+                if (xhr.responseJSON && xhr.responseJSON.error) {
+                    msg = xhr.responseJSON.error;
+                } else if (xhr.responseText) {
+                    msg = xhr.responseText;
+                }
+                if (!answeringWaiting) {
+                    closeCallSignaling();
+                }
+                statusDiv.html(`<span class="text-danger">${msg}</span>`);
+                refreshCallStateUI(iccid);
+            },
+            complete: function () {
+                answerBtn.prop('disabled', false);
+                rejectBtn.prop('disabled', false);
+            }
+        });
+    })();
+});
+
+$(document).on('click', '#btn-call-reject', function () {
+    const iccid = $('#call-iccid').val();
+    const statusDiv = $('#call-status');
+
+    $.ajax({
+        url: `/api/v1/modems/${iccid}/call/reject`,
+        method: 'POST',
+        contentType: 'application/json',
+        data: '{}',
+        success: function (resp) {
+            statusDiv.html('<span class="text-success">Call rejected</span>');
+            if (!resp || !resp.call_state || resp.call_state.state === 'idle') {
+                closeCallSignaling();
+            }
+            refreshCallStateUI(iccid);
+        },
+        error: function (xhr) {
+            let msg = 'Reject failed';
+            if (xhr.responseJSON && xhr.responseJSON.error) {
+                msg = xhr.responseJSON.error;
+            } else if (xhr.responseText) {
+                msg = xhr.responseText;
+            }
+            statusDiv.html(`<span class="text-danger">${msg}</span>`);
+            refreshCallStateUI(iccid);
+        }
+    });
+});
+
 $(document).on('click', '.btn-dtmf', function () {
     const iccid = $('#call-iccid').val();
     const tone = String($(this).data('tone') || '').trim();
@@ -1448,6 +2138,7 @@ $('#btn-save-modem').click(function () {
     const sipListenPort = parseInt($('#m-sip-port').val(), 10) || 0;
     const payload = {
         name: $('#m-name').val(),
+        phone_number: $('#m-phone-number').val().trim(),
         sip_enabled: $('#m-sip-enabled').is(':checked'),
         sip_username: $('#m-sip-username').val().trim(),
         sip_password: $('#m-sip-password').val(),
@@ -1592,6 +2283,128 @@ $('#btn-save-password').click(function () {
         }
     });
 });
+
+// Two-factor authentication. Set while the server refuses everything else
+// until the admin enrolls.
+let twoFactorEnrollmentPending = false;
+
+window.showTwoFactor = function () {
+    if ($('#twoFactorModal').hasClass('show')) return;
+    $('#tfa-setup, #tfa-recovery, #tfa-password-row').addClass('d-none');
+    $('#tfa-qr').empty();
+    $('#tfa-code, #tfa-password').val('');
+    $.ajax({ url: '/api/v1/2fa', method: 'GET', global: false, error: null }).done(renderTwoFactor);
+    $('#twoFactorModal').modal('show');
+}
+
+function renderTwoFactor(status) {
+    $('#btn-tfa-setup, #btn-tfa-enable, #btn-tfa-disable, #btn-tfa-regenerate').addClass('d-none');
+    if (!status.available) {
+        $('#tfa-status').text("Two-factor authentication is managed by your identity provider.");
+        $('#tfa-code-row').addClass('d-none');
+        return;
+    }
+    $('#tfa-code-row').removeClass('d-none');
+    if (status.enabled) {
+        $('#tfa-status').html('<i class="bi bi-shield-check text-success"></i> Enabled. ' +
+            escapeHTML(status.recovery_codes_left) + ' recovery codes left.');
+        $('#btn-tfa-regenerate').removeClass('d-none');
+        if (!status.required) {
+            $('#btn-tfa-disable').removeClass('d-none');
+            $('#tfa-password-row').removeClass('d-none');
+        }
+        return;
+    }
+    $('#tfa-status').text(status.required
+        ? "Your administrator requires two-factor authentication. Set it up to continue."
+        : "Two-factor authentication is off.");
+    $('#btn-tfa-setup').removeClass('d-none');
+}
+
+function setupTwoFactor() {
+    $.ajax({
+        url: '/api/v1/2fa/setup',
+        method: 'POST',
+        global: false,
+        error: null,
+    }).done(function (resp) {
+        $('#tfa-qr').empty();
+        if (window.QRCode) {
+            new QRCode(document.getElementById('tfa-qr'), { text: resp.uri, width: 180, height: 180 });
+        }
+        $('#tfa-secret').text(resp.secret);
+        $('#tfa-setup').removeClass('d-none');
+        $('#btn-tfa-setup').addClass('d-none');
+        $('#btn-tfa-enable').removeClass('d-none');
+        $('#tfa-code').val('').focus();
+    }).fail(showTwoFactorError);
+}
+
+function enableTwoFactor() {
+    $.ajax({
+        url: '/api/v1/2fa/enable',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ code: $('#tfa-code').val().trim() }),
+        global: false,
+        error: null,
+    }).done(function (resp) {
+        $('#tfa-setup').addClass('d-none');
+        $('#tfa-qr').empty();
+        showRecoveryCodes(resp.recovery_codes);
+        $.get('/api/v1/2fa', renderTwoFactor);
+        // Reload what the enrollment requirement blocked.
+        if (twoFactorEnrollmentPending) {
+            twoFactorEnrollmentPending = false;
+            loadModems();
+            loadSMS();
+            startEventStream();
+        }
+    }).fail(showTwoFactorError);
+}
+
+function disableTwoFactor() {
+    $.ajax({
+        url: '/api/v1/2fa/disable',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ password: $('#tfa-password').val(), code: $('#tfa-code').val().trim() }),
+        global: false,
+        error: null,
+    }).done(function () {
+        alert("Two-factor authentication disabled");
+        showTwoFactor();
+    }).fail(showTwoFactorError);
+}
+
+function regenerateRecoveryCodes() {
+    $.ajax({
+        url: '/api/v1/2fa/recovery_codes',
+        method: 'POST',
+        contentType: 'application/json',
+        data: JSON.stringify({ code: $('#tfa-code').val().trim() }),
+        global: false,
+        error: null,
+    }).done(function (resp) {
+        showRecoveryCodes(resp.recovery_codes);
+        $.get('/api/v1/2fa', renderTwoFactor);
+    }).fail(showTwoFactorError);
+}
+
+function showRecoveryCodes(codes) {
+    $('#tfa-code').val('');
+    $('#tfa-recovery-codes').text((codes || []).join('\n'));
+    $('#tfa-recovery').removeClass('d-none');
+}
+
+function showTwoFactorError(xhr) {
+    if (xhr.status === 401) {
+        refreshSession().fail(clearAuth);
+        return;
+    }
+    alert("Error: " + ((xhr.responseJSON && xhr.responseJSON.error) || xhr.responseText));
+}
+
 // AT Terminal Logic
 
 function sendATCommand(isRaw) {